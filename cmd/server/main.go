@@ -154,14 +154,19 @@ func main() {
 	features.AddRoutes(cfg.Logger, adminServer, accountsCallsDisabled, customersCallsDisabled)
 
 	// Start our periodic file operations
-	fileTransferRepo := filetransfer.NewRepository(configFilepath, db, os.Getenv("DATABASE_TYPE"))
+	fileTransferRepo := filetransfer.NewRepository(configFilepath, db, os.Getenv("DATABASE_TYPE"), stringKeeper)
 	defer fileTransferRepo.Close()
 	if err := filetransfer.ValidateTemplates(fileTransferRepo); err != nil {
 		panic(fmt.Sprintf("ERROR: problem validating outbound filename templates: %v", err))
 	}
+	if err := filetransfer.EncryptStoredSecrets(cfg.Logger, fileTransferRepo); err != nil {
+		panic(fmt.Sprintf("ERROR: problem encrypting file transfer secrets: %v", err))
+	}
+
+	odfiAccount := setupODFIAccount(accountsClient, stringKeeper)
 
 	achStorageDir := setupACHStorageDir(cfg.Logger)
-	fileTransferController, err := filetransfer.NewController(cfg, achStorageDir, fileTransferRepo, achClient, accountsClient)
+	fileTransferController, err := filetransfer.NewController(cfg, achStorageDir, fileTransferRepo, db, achClient, accountsClient, odfiAccount, eventRepo, stringKeeper)
 	if err != nil {
 		panic(fmt.Sprintf("ERROR: creating ACH file transfer controller: %v", err))
 	}
@@ -180,7 +185,6 @@ func main() {
 	route.AddPingRoute(cfg.Logger, handler)
 
 	// Depository HTTP routes
-	odfiAccount := setupODFIAccount(accountsClient, stringKeeper)
 	depositoryRouter := depository.NewRouter(cfg.Logger, odfiAccount, accountsClient, achClient, fedClient, depositoryRepo, eventRepo, stringKeeper)
 	depositoryRouter.RegisterRoutes(handler)
 
@@ -193,9 +197,16 @@ func main() {
 		return achclient.New(cfg.Logger, os.Getenv("ACH_ENDPOINT"), userId, httpClient)
 	}
 
+	returnRateThresholds, err := transfers.ParseReturnRateThresholds(transfers.UnauthorizedReturnRateLimit(), transfers.AdministrativeReturnRateLimit(), transfers.OverallReturnRateLimit(), transfers.ReturnRateMinimumDebits())
+	if err != nil {
+		panic(fmt.Sprintf("ERROR parsing return rate thresholds: %v", err))
+	}
+
 	transferLimitChecker := transfers.NewLimitChecker(cfg.Logger, db, limits)
-	xferRouter := transfers.NewTransferRouter(cfg.Logger, depositoryRepo, eventRepo, receiverRepo, originatorsRepo, transferRepo, transferLimitChecker, achClientFactory, accountsClient, customersClient)
+	returnRateChecker := transfers.NewReturnRateChecker(cfg.Logger, db, returnRateThresholds, transfers.EnforceReturnRates())
+	xferRouter := transfers.NewTransferRouter(cfg.Logger, depositoryRepo, eventRepo, receiverRepo, originatorsRepo, transferRepo, transferLimitChecker, returnRateChecker, achClientFactory, accountsClient, customersClient)
 	xferRouter.RegisterRoutes(handler)
+	transfers.RegisterAdminRoutes(cfg.Logger, adminServer, transferRepo, accountsClient, eventRepo)
 
 	// Check to see if our -http.addr flag has been overridden
 	if v := os.Getenv("HTTP_BIND_ADDRESS"); v != "" {
@@ -336,6 +347,11 @@ func setupFileTransferController(logger log.Logger, controller *filetransfer.Con
 
 	filetransfer.AddFileTransferConfigRoutes(logger, svc, fileTransferRepo)
 	filetransfer.AddFileTransferSyncRoute(logger, svc, flushIncoming, flushOutgoing)
+	filetransfer.AddDeadLetterRoutes(logger, svc, controller, transferRepo)
+	filetransfer.AddUploadedFileRoutes(logger, svc, controller)
+	filetransfer.AddExceptionRoutes(logger, svc, controller, depRepo, transferRepo)
+	filetransfer.AddMergedFileRoutes(logger, svc, controller, depRepo, transferRepo)
+	filetransfer.AddCorrectionRoutes(logger, svc, controller)
 
 	return cancelFileSync
 }
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	accounts "github.com/moov-io/accounts/client"
@@ -21,6 +22,10 @@ import (
 	"github.com/go-kit/kit/log"
 )
 
+// ErrInsufficientFunds is returned from PostTransaction when Accounts refuses a transaction
+// because an account's balance can't cover it.
+var ErrInsufficientFunds = errors.New("accounts: insufficient funds")
+
 type Client interface {
 	Ping() error
 
@@ -76,6 +81,9 @@ func (c *moovClient) PostTransaction(requestID string, userID id.User, lines []T
 		resp.Body.Close()
 	}
 	if err != nil {
+		if insufficientFunds(err) {
+			return nil, ErrInsufficientFunds
+		}
 		return &Transaction{
 			ID: tx.ID,
 		}, fmt.Errorf("accounts: PostTransaction: %v", err)
@@ -85,6 +93,19 @@ func (c *moovClient) PostTransaction(requestID string, userID id.User, lines []T
 	}, nil
 }
 
+// insufficientFunds returns true if err is Accounts rejecting a transaction because of an account's balance.
+func insufficientFunds(err error) bool {
+	apiErr, ok := err.(accounts.GenericOpenAPIError)
+	if !ok {
+		return false
+	}
+	msg := string(apiErr.Body())
+	if model, ok := apiErr.Model().(accounts.Error); ok {
+		msg = model.Error
+	}
+	return strings.Contains(strings.ToLower(msg), "insufficient funds")
+}
+
 func (c *moovClient) SearchAccounts(requestID string, userID id.User, dep *model.Depository) (*Account, error) {
 	ctx, cancelFn := context.WithTimeout(context.TODO(), 10*time.Second)
 	defer cancelFn()
@@ -7,6 +7,8 @@ package accounts
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	accounts "github.com/moov-io/accounts/client"
@@ -201,3 +203,28 @@ func TestAccounts__ReverseTransaction(t *testing.T) {
 
 	deployment.close(t) // close only if successful
 }
+
+func TestAccounts__PostTransactionInsufficientFunds(t *testing.T) {
+	status, body := http.StatusBadRequest, `{"error": "acocunt=\"from\" has insufficient funds: rollback=<nil>"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	client := NewClient(log.NewNopLogger(), server.URL, server.Client())
+	lines := []TransactionLine{
+		{AccountID: "to", Purpose: "achcredit", Amount: 10000},
+		{AccountID: "from", Purpose: "achdebit", Amount: 10000},
+	}
+	if _, err := client.PostTransaction(base.ID(), id.User(base.ID()), lines); err != ErrInsufficientFunds {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// other failures aren't insufficient funds
+	status, body = http.StatusInternalServerError, `{"error": "database is locked"}`
+	if _, err := client.PostTransaction(base.ID(), id.User(base.ID()), lines); err == nil || err == ErrInsufficientFunds {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -157,6 +157,158 @@ var (
 			// Max length for IPv6 addresses -- https://stackoverflow.com/a/7477384
 			"alter table transfers add column remote_address varchar(45) default '';",
 		),
+		execsql(
+			"create_file_transfer_leases",
+			"create table file_transfer_leases(name varchar(50) primary key, owner varchar(100), expires_at datetime);",
+		),
+		execsql(
+			"add_claimed_by_to_transfers",
+			"alter table transfers add column claimed_by varchar(100);",
+		),
+		execsql(
+			"add_claimed_at_to_transfers",
+			"alter table transfers add column claimed_at datetime;",
+		),
+		execsql(
+			"create_ach_file_upload_attempts",
+			"create table ach_file_upload_attempts(filename varchar(100) primary key, routing_number varchar(10), attempts integer, last_error varchar(1000), last_attempt_at datetime, next_attempt_at datetime, dead_lettered_at datetime);",
+		),
+		execsql(
+			"create_incoming_transfers",
+			"create table incoming_transfers(transfer_id varchar(40) primary key, user_id varchar(40), depository_id varchar(40), type varchar(10), amount varchar(20), standard_entry_class_code varchar(4), transaction_code integer, trace_number varchar(20), company_name varchar(16), company_identification varchar(10), company_entry_description varchar(10), individual_name varchar(22), effective_entry_date datetime, origin varchar(10), destination varchar(10), filename varchar(100), status varchar(10), return_code varchar(3), transaction_id varchar(40), created_at datetime, last_updated_at datetime);",
+		),
+		execsql(
+			"add_identification_number_to_incoming_transfers",
+			"alter table incoming_transfers add column identification_number varchar(15) default '';",
+		),
+		execsql(
+			"add_discretionary_data_to_incoming_transfers",
+			"alter table incoming_transfers add column discretionary_data varchar(2) default '';",
+		),
+		execsql(
+			"add_service_class_code_to_incoming_transfers",
+			"alter table incoming_transfers add column service_class_code integer default 200;",
+		),
+		execsql(
+			"create_incoming_transfer_returns",
+			"create table incoming_transfer_returns(transfer_id varchar(40) primary key, user_id varchar(40), return_code varchar(3), date_of_death datetime, addenda_information varchar(44), deadline datetime, merged_filename varchar(100), created_at datetime, merged_at datetime);",
+		),
+		execsql(
+			"create_transfer_returns",
+			"create table transfer_returns(transfer_id varchar(40) primary key, user_id varchar(40), receiver_depository varchar(40), return_code varchar(3), trace_number varchar(15), original_trace varchar(15), settlement_date varchar(3), origin varchar(10), destination varchar(10), standard_entry_class_code varchar(3), service_class_code integer, company_name varchar(16), company_identification varchar(10), company_entry_description varchar(10), transaction_code integer, amount varchar(30), individual_name varchar(22), identification_number varchar(15), dishonored_return_code varchar(3), dishonored_addenda_information varchar(21), dishonored_transaction_id varchar(40), dishonored_at datetime, merged_filename varchar(100), merged_at datetime, contested_return_code varchar(3), contested_at datetime, created_at datetime);",
+		),
+		execsql(
+			"add_dishonored_return_code_to_incoming_transfer_returns",
+			"alter table incoming_transfer_returns add column dishonored_return_code varchar(3);",
+		),
+		execsql(
+			"add_dishonored_at_to_incoming_transfer_returns",
+			"alter table incoming_transfer_returns add column dishonored_at datetime;",
+		),
+		execsql(
+			"create_noc_corrections",
+			"create table noc_corrections(correction_id varchar(40) primary key, user_id varchar(40), change_code varchar(3), original_trace varchar(15), transfer_id varchar(40), object_type varchar(20), object_id varchar(40), field_name varchar(40), previous_value varchar(100), corrected_value varchar(100), created_at datetime);",
+		),
+		execsql(
+			"create_file_sequences",
+			"create table file_sequences(destination varchar(10), day varchar(8), sequence integer, primary key (destination, day));",
+		),
+		execsql(
+			"add_tls_mode_to_ftp_configs",
+			"alter table ftp_configs add column tls_mode varchar(10);",
+		),
+		execsql(
+			"add_ca_certificates_to_ftp_configs",
+			"alter table ftp_configs add column ca_certificates text;",
+		),
+		execsql(
+			"add_client_certificate_to_ftp_configs",
+			"alter table ftp_configs add column client_certificate text;",
+		),
+		execsql(
+			"add_client_private_key_to_ftp_configs",
+			"alter table ftp_configs add column client_private_key text;",
+		),
+		execsql(
+			"add_disable_epsv_to_ftp_configs",
+			"alter table ftp_configs add column disable_epsv boolean;",
+		),
+		execsql(
+			"add_password_encrypted_to_ftp_configs",
+			"alter table ftp_configs add column password_encrypted varchar(512) default '';",
+		),
+		execsql(
+			"add_password_encrypted_to_sftp_configs",
+			"alter table sftp_configs add column password_encrypted varchar(512) default '';",
+		),
+		execsql(
+			"add_client_private_key_encrypted_to_sftp_configs",
+			"alter table sftp_configs add column client_private_key_encrypted text;",
+		),
+		execsql(
+			"add_mode_to_file_transfer_configs",
+			"alter table file_transfer_configs add column mode varchar(10) default '';",
+		),
+		execsql(
+			"add_balance_entries_to_file_transfer_configs",
+			"alter table file_transfer_configs add column balance_entries boolean;",
+		),
+		execsql(
+			"add_offset_routing_number_to_file_transfer_configs",
+			"alter table file_transfer_configs add column offset_routing_number varchar(10) default '';",
+		),
+		execsql(
+			"add_offset_account_number_encrypted_to_file_transfer_configs",
+			"alter table file_transfer_configs add column offset_account_number_encrypted varchar(255) default '';",
+		),
+		execsql(
+			"add_offset_account_type_to_file_transfer_configs",
+			"alter table file_transfer_configs add column offset_account_type varchar(10) default '';",
+		),
+		execsql(
+			"add_confirmation_format_to_file_transfer_configs",
+			"alter table file_transfer_configs add column confirmation_format varchar(20) default '';",
+		),
+		execsql(
+			"create_ach_file_uploads",
+			"create table ach_file_uploads(filename varchar(100) primary key, uploaded_filename varchar(255), destination varchar(10), origin varchar(10), file_creation_date varchar(6), file_id_modifier varchar(1), entry_count integer, total_debit bigint, total_credit bigint, uploaded_at datetime, confirmed_at datetime, sla_missed_at datetime);",
+		),
+		execsql(
+			"create_ach_entry_exceptions",
+			"create table ach_entry_exceptions(exception_id varchar(40) primary key, type varchar(10), filename varchar(255), origin varchar(10), destination varchar(10), trace_number varchar(15), reason text, record text, created_at datetime, transfer_id varchar(40), depository_id varchar(40), resolved_at datetime);",
+		),
+		execsql(
+			"create_transfer_trace_numbers",
+			"create table transfer_trace_numbers(trace_number varchar(15), transfer_id varchar(40), merged_filename varchar(100), created_at datetime);",
+		),
+		execsql(
+			"create_micro_deposit_trace_numbers",
+			"create table micro_deposit_trace_numbers(trace_number varchar(15), depository_id varchar(40), amount varchar(10), file_id varchar(40), merged_filename varchar(100), created_at datetime);",
+		),
+		execsql(
+			"add_effective_entry_date_to_transfers",
+			"alter table transfers add column effective_entry_date datetime;",
+		),
+		execsql(
+			"create_unique_ach_entry_exceptions_index",
+			"create unique index ach_entry_exceptions_idx on ach_entry_exceptions(filename, trace_number);",
+		),
+		execsql(
+			"add_identification_number_to_receivers",
+			"alter table receivers add column identification_number varchar(15);",
+		),
+		execsql(
+			"add_trace_number_to_micro_deposits",
+			"alter table micro_deposits add column trace_number varchar(15);",
+		),
+		execsql(
+			"add_requeued_at_to_transfers",
+			"alter table transfers add column requeued_at datetime;",
+		),
+		execsql(
+			"add_requeued_at_to_micro_deposits",
+			"alter table micro_deposits add column requeued_at datetime;",
+		),
 	)
 )
 
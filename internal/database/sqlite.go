@@ -140,6 +140,158 @@ var (
 			"add_remote_addr_to_transfers",
 			"alter table transfers add column remote_address default '';",
 		),
+		execsql(
+			"create_file_transfer_leases",
+			"create table file_transfer_leases(name primary key, owner, expires_at datetime);",
+		),
+		execsql(
+			"add_claimed_by_to_transfers",
+			"alter table transfers add column claimed_by;",
+		),
+		execsql(
+			"add_claimed_at_to_transfers",
+			"alter table transfers add column claimed_at datetime;",
+		),
+		execsql(
+			"create_ach_file_upload_attempts",
+			"create table ach_file_upload_attempts(filename primary key, routing_number, attempts integer, last_error, last_attempt_at datetime, next_attempt_at datetime, dead_lettered_at datetime);",
+		),
+		execsql(
+			"create_incoming_transfers",
+			"create table incoming_transfers(transfer_id primary key, user_id, depository_id, type, amount, standard_entry_class_code, transaction_code integer, trace_number, company_name, company_identification, company_entry_description, individual_name, effective_entry_date datetime, origin, destination, filename, status, return_code, transaction_id, created_at datetime, last_updated_at datetime);",
+		),
+		execsql(
+			"add_identification_number_to_incoming_transfers",
+			"alter table incoming_transfers add column identification_number default '';",
+		),
+		execsql(
+			"add_discretionary_data_to_incoming_transfers",
+			"alter table incoming_transfers add column discretionary_data default '';",
+		),
+		execsql(
+			"add_service_class_code_to_incoming_transfers",
+			"alter table incoming_transfers add column service_class_code integer default 200;",
+		),
+		execsql(
+			"create_incoming_transfer_returns",
+			"create table incoming_transfer_returns(transfer_id primary key, user_id, return_code, date_of_death datetime, addenda_information, deadline datetime, merged_filename, created_at datetime, merged_at datetime);",
+		),
+		execsql(
+			"create_transfer_returns",
+			"create table transfer_returns(transfer_id primary key, user_id, receiver_depository, return_code, trace_number, original_trace, settlement_date, origin, destination, standard_entry_class_code, service_class_code integer, company_name, company_identification, company_entry_description, transaction_code integer, amount, individual_name, identification_number, dishonored_return_code, dishonored_addenda_information, dishonored_transaction_id, dishonored_at datetime, merged_filename, merged_at datetime, contested_return_code, contested_at datetime, created_at datetime);",
+		),
+		execsql(
+			"add_dishonored_return_code_to_incoming_transfer_returns",
+			"alter table incoming_transfer_returns add column dishonored_return_code;",
+		),
+		execsql(
+			"add_dishonored_at_to_incoming_transfer_returns",
+			"alter table incoming_transfer_returns add column dishonored_at datetime;",
+		),
+		execsql(
+			"create_noc_corrections",
+			"create table noc_corrections(correction_id primary key, user_id, change_code, original_trace, transfer_id, object_type, object_id, field_name, previous_value, corrected_value, created_at datetime);",
+		),
+		execsql(
+			"create_file_sequences",
+			"create table file_sequences(destination, day, sequence integer, primary key (destination, day));",
+		),
+		execsql(
+			"add_tls_mode_to_ftp_configs",
+			"alter table ftp_configs add column tls_mode;",
+		),
+		execsql(
+			"add_ca_certificates_to_ftp_configs",
+			"alter table ftp_configs add column ca_certificates;",
+		),
+		execsql(
+			"add_client_certificate_to_ftp_configs",
+			"alter table ftp_configs add column client_certificate;",
+		),
+		execsql(
+			"add_client_private_key_to_ftp_configs",
+			"alter table ftp_configs add column client_private_key;",
+		),
+		execsql(
+			"add_disable_epsv_to_ftp_configs",
+			"alter table ftp_configs add column disable_epsv boolean;",
+		),
+		execsql(
+			"add_password_encrypted_to_ftp_configs",
+			"alter table ftp_configs add column password_encrypted default '';",
+		),
+		execsql(
+			"add_password_encrypted_to_sftp_configs",
+			"alter table sftp_configs add column password_encrypted default '';",
+		),
+		execsql(
+			"add_client_private_key_encrypted_to_sftp_configs",
+			"alter table sftp_configs add column client_private_key_encrypted default '';",
+		),
+		execsql(
+			"add_mode_to_file_transfer_configs",
+			"alter table file_transfer_configs add column mode default '';",
+		),
+		execsql(
+			"add_balance_entries_to_file_transfer_configs",
+			"alter table file_transfer_configs add column balance_entries boolean;",
+		),
+		execsql(
+			"add_offset_routing_number_to_file_transfer_configs",
+			"alter table file_transfer_configs add column offset_routing_number default '';",
+		),
+		execsql(
+			"add_offset_account_number_encrypted_to_file_transfer_configs",
+			"alter table file_transfer_configs add column offset_account_number_encrypted default '';",
+		),
+		execsql(
+			"add_offset_account_type_to_file_transfer_configs",
+			"alter table file_transfer_configs add column offset_account_type default '';",
+		),
+		execsql(
+			"add_confirmation_format_to_file_transfer_configs",
+			"alter table file_transfer_configs add column confirmation_format default '';",
+		),
+		execsql(
+			"create_ach_file_uploads",
+			"create table ach_file_uploads(filename primary key, uploaded_filename, destination, origin, file_creation_date, file_id_modifier, entry_count integer, total_debit integer, total_credit integer, uploaded_at datetime, confirmed_at datetime, sla_missed_at datetime);",
+		),
+		execsql(
+			"create_ach_entry_exceptions",
+			"create table ach_entry_exceptions(exception_id primary key, type, filename, origin, destination, trace_number, reason, record, created_at datetime, transfer_id, depository_id, resolved_at datetime);",
+		),
+		execsql(
+			"create_transfer_trace_numbers",
+			"create table transfer_trace_numbers(trace_number, transfer_id, merged_filename, created_at datetime);",
+		),
+		execsql(
+			"create_micro_deposit_trace_numbers",
+			"create table micro_deposit_trace_numbers(trace_number, depository_id, amount, file_id, merged_filename, created_at datetime);",
+		),
+		execsql(
+			"add_effective_entry_date_to_transfers",
+			"alter table transfers add column effective_entry_date datetime;",
+		),
+		execsql(
+			"create_unique_ach_entry_exceptions_index",
+			"create unique index ach_entry_exceptions_idx on ach_entry_exceptions(filename, trace_number);",
+		),
+		execsql(
+			"add_identification_number_to_receivers",
+			"alter table receivers add column identification_number;",
+		),
+		execsql(
+			"add_trace_number_to_micro_deposits",
+			"alter table micro_deposits add column trace_number;",
+		),
+		execsql(
+			"add_requeued_at_to_transfers",
+			"alter table transfers add column requeued_at datetime;",
+		),
+		execsql(
+			"add_requeued_at_to_micro_deposits",
+			"alter table micro_deposits add column requeued_at datetime;",
+		),
 	)
 )
 
@@ -22,6 +22,10 @@ type MicroDepositCursor struct {
 	// The value starts at today's first instant and progresses towards time.Now() with each
 	// batch by being set to the batch's newest time.
 	newerThan time.Time
+
+	// requeuedAfter is the newest requeued_at value read. Micro-deposits requeued after it move newerThan back
+	// so they're returned again.
+	requeuedAfter time.Time
 }
 
 type UploadableMicroDeposit struct {
@@ -35,6 +39,10 @@ type UploadableMicroDeposit struct {
 // Next returns a slice of micro-deposit objects from the current day. Next should be called to process
 // all objects for a given day in batches.
 func (cur *MicroDepositCursor) Next() ([]UploadableMicroDeposit, error) {
+	if err := cur.rewindToRequeued(); err != nil {
+		return nil, err
+	}
+
 	query := `select depository_id, user_id, amount, file_id, created_at from micro_deposits where deleted_at is null and merged_filename is null and created_at > ? order by created_at asc limit ?`
 	stmt, err := cur.DepRepo.db.Prepare(query)
 	if err != nil {
@@ -70,6 +78,44 @@ func (cur *MicroDepositCursor) Next() ([]UploadableMicroDeposit, error) {
 	return microDeposits, rows.Err()
 }
 
+// rewindToRequeued moves the cursor back to the oldest micro-deposit requeued since our last read. Micro-deposits are
+// requeued when any paygate instance abandons a merged file, which can happen after our cursor has passed them.
+func (cur *MicroDepositCursor) rewindToRequeued() error {
+	query := `select created_at, requeued_at from micro_deposits where requeued_at > ? and merged_filename is null and deleted_at is null`
+	stmt, err := cur.DepRepo.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("microDepositCursor.Next: prepare requeued: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(cur.requeuedAfter)
+	if err != nil {
+		return fmt.Errorf("microDepositCursor.Next: query requeued: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var createdAt, requeuedAt time.Time
+		if err := rows.Scan(&createdAt, &requeuedAt); err != nil {
+			return fmt.Errorf("microDepositCursor.Next: scan requeued: %v", err)
+		}
+		if !createdAt.After(cur.newerThan) {
+			cur.newerThan = createdAt.Add(-1 * time.Second)
+		}
+		if requeuedAt.After(cur.requeuedAfter) {
+			cur.requeuedAfter = requeuedAt
+		}
+	}
+	return rows.Err()
+}
+
+// Rewind moves the cursor back to the start of the current day so micro-deposits skipped over
+// (i.e. while another paygate instance held their merge lease) are returned again by Next.
+func (cur *MicroDepositCursor) Rewind() {
+	now := time.Now()
+	cur.newerThan = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
 // GetMicroDepositCursor returns a microDepositCursor for iterating through micro-deposits in ascending order (by CreatedAt)
 // beginning at the start of the current day.
 func (r *SQLRepo) GetMicroDepositCursor(batchSize int) *MicroDepositCursor {
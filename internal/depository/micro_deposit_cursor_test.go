@@ -67,4 +67,22 @@ func TestMicroDepositCursor__next(t *testing.T) {
 	if filename != "filename" {
 		t.Errorf("mc=%#v", mc)
 	}
+
+	// read micro-deposits merged into the file
+	merged, err := depRepo.GetMergedMicroDeposits("filename")
+	if err != nil || len(merged) != 1 {
+		t.Fatalf("merged=%#v error=%v", merged, err)
+	}
+	if merged[0].DepositoryID != "id" || merged[0].Amount.String() != "USD 0.11" {
+		t.Errorf("merged[0]=%#v", merged[0])
+	}
+
+	// abandon the merged file and expect the micro-deposit to be returned again
+	if err := depRepo.UnmergeMicroDeposits("filename"); err != nil {
+		t.Fatal(err)
+	}
+	microDeposits, err = depRepo.GetMicroDepositCursor(2).Next()
+	if len(microDeposits) != 1 || err != nil {
+		t.Fatalf("microDeposits=%#v error=%v", microDeposits, err)
+	}
 }
@@ -71,7 +71,8 @@ func NewODFIAccount(accountsClient accounts.Client, accountNumber string, routin
 	}
 }
 
-func (a *ODFIAccount) getID(requestID string, userID id.User) (string, error) {
+// AccountID returns the Accounts ID of our ODFI account, which is the other side of micro-deposits and incoming transfers.
+func (a *ODFIAccount) AccountID(requestID string, userID id.User) (string, error) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
@@ -130,6 +131,9 @@ type MicroDeposit struct {
 	Amount        model.Amount
 	FileID        string
 	TransactionID string
+
+	// TraceNumber is assigned when the micro-deposit is merged for upload
+	TraceNumber string
 }
 
 func (m MicroDeposit) MarshalJSON() ([]byte, error) {
@@ -147,6 +151,9 @@ func microDepositAmounts() []model.Amount {
 	}
 	// generate two amounts and a third that's the sum
 	n1, n2 := rand(), rand()
+	for n1 == n2 {
+		n2 = rand() // each micro-deposit needs a distinct amount so its trace number can be recorded on it
+	}
 	a1, _ := model.NewAmount("USD", fmt.Sprintf("0.%02d", n1)) // pad 1 to '01'
 	a2, _ := model.NewAmount("USD", fmt.Sprintf("0.%02d", n2))
 	return []model.Amount{*a1, *a2}
@@ -251,7 +258,7 @@ func updateMicroDepositsWithTransactionIDs(logger log.Logger, ODFIAccount *ODFIA
 	if err != nil || acct == nil {
 		return nil, fmt.Errorf("error reading account user=%s depository=%s: %v", userID, dep.ID, err)
 	}
-	ODFIAccountID, err := ODFIAccount.getID(requestID, userID)
+	ODFIAccountID, err := ODFIAccount.AccountID(requestID, userID)
 	if err != nil {
 		return nil, fmt.Errorf("posting micro-deposits: %v", err)
 	}
@@ -686,21 +693,125 @@ func (r *SQLRepo) confirmMicroDeposits(id id.Depository, userID id.User, guessAm
 
 // MarkMicroDepositAsMerged will set the merged_filename on micro-deposits so they aren't merged into multiple files
 // and the file uploaded to the Federal Reserve can be tracked.
+//
+// Every micro-deposit in the ACH file of mc is marked as they're merged together.
 func (r *SQLRepo) MarkMicroDepositAsMerged(filename string, mc UploadableMicroDeposit) error {
 	query := `update micro_deposits set merged_filename = ?
-where depository_id = ? and file_id = ? and amount = ? and (merged_filename is null or merged_filename = '') and deleted_at is null`
+where depository_id = ? and file_id = ? and (merged_filename is null or merged_filename = '') and deleted_at is null`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("MarkMicroDepositAsMerged: filename=%s: %v", filename, err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(filename, mc.DepositoryID, mc.FileID, mc.Amount.String())
+	_, err = stmt.Exec(filename, mc.DepositoryID, mc.FileID)
 	return err
 }
 
+// RecordMicroDepositTraceNumbers saves the trace number each of microDeposits was assigned in the merged file
+// of mc, which returns are matched against. Each micro-deposit row also keeps its trace number so a return
+// updates only the micro-deposit it was for.
+func (r *SQLRepo) RecordMicroDepositTraceNumbers(filename string, mc UploadableMicroDeposit, microDeposits []*MicroDeposit) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("RecordMicroDepositTraceNumbers: filename=%s: %v", filename, err)
+	}
+
+	query := `insert into micro_deposit_trace_numbers (trace_number, depository_id, amount, file_id, merged_filename, created_at) values (?, ?, ?, ?, ?, ?)`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("RecordMicroDepositTraceNumbers: prepare: %v rollback=%v", err, tx.Rollback())
+	}
+	defer stmt.Close()
+
+	query = `update micro_deposits set trace_number = ?
+where depository_id = ? and file_id = ? and amount = ? and (trace_number is null or trace_number = '') and deleted_at is null`
+	mdStmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("RecordMicroDepositTraceNumbers: prepare: %v rollback=%v", err, tx.Rollback())
+	}
+	defer mdStmt.Close()
+
+	now := time.Now()
+	for i := range microDeposits {
+		_, err := stmt.Exec(microDeposits[i].TraceNumber, mc.DepositoryID, microDeposits[i].Amount.String(), mc.FileID, filename, now)
+		if err != nil {
+			return fmt.Errorf("RecordMicroDepositTraceNumbers: traceNumber=%s: %v rollback=%v", microDeposits[i].TraceNumber, err, tx.Rollback())
+		}
+		_, err = mdStmt.Exec(microDeposits[i].TraceNumber, mc.DepositoryID, mc.FileID, microDeposits[i].Amount.String())
+		if err != nil {
+			return fmt.Errorf("RecordMicroDepositTraceNumbers: traceNumber=%s: %v rollback=%v", microDeposits[i].TraceNumber, err, tx.Rollback())
+		}
+	}
+	return tx.Commit()
+}
+
+// GetMergedMicroDeposits returns the micro-deposits which have been merged into filename.
+func (r *SQLRepo) GetMergedMicroDeposits(filename string) ([]UploadableMicroDeposit, error) {
+	query := `select depository_id, user_id, amount, file_id, created_at from micro_deposits where merged_filename = ? and deleted_at is null order by created_at asc`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetMergedMicroDeposits: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(filename)
+	if err != nil {
+		return nil, fmt.Errorf("GetMergedMicroDeposits: query: %v", err)
+	}
+	defer rows.Close()
+
+	var microDeposits []UploadableMicroDeposit
+	for rows.Next() {
+		var m UploadableMicroDeposit
+		var amt string
+		if err := rows.Scan(&m.DepositoryID, &m.UserID, &amt, &m.FileID, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("GetMergedMicroDeposits: scan: %v", err)
+		}
+		var amount model.Amount
+		if err := amount.FromString(amt); err != nil {
+			return nil, fmt.Errorf("GetMergedMicroDeposits: %s Amount from string: %v", amt, err)
+		}
+		m.Amount = &amount
+		microDeposits = append(microDeposits, m)
+	}
+	return microDeposits, rows.Err()
+}
+
+// UnmergeMicroDeposits resets merged_filename on every micro-deposit merged into filename so they're merged into
+// another file. This is used when a merged file is abandoned before upload.
+func (r *SQLRepo) UnmergeMicroDeposits(filename string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("UnmergeMicroDeposits: filename=%s: %v", filename, err)
+	}
+
+	query := `update micro_deposits set merged_filename = null, trace_number = null, requeued_at = ? where merged_filename = ? and deleted_at is null`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("UnmergeMicroDeposits: filename=%s: %v rollback=%v", filename, err, tx.Rollback())
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(time.Now(), filename); err != nil {
+		return fmt.Errorf("UnmergeMicroDeposits: filename=%s: %v rollback=%v", filename, err, tx.Rollback())
+	}
+
+	query = `delete from micro_deposit_trace_numbers where merged_filename = ?`
+	traceStmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("UnmergeMicroDeposits: filename=%s trace numbers: %v rollback=%v", filename, err, tx.Rollback())
+	}
+	defer traceStmt.Close()
+
+	if _, err := traceStmt.Exec(filename); err != nil {
+		return fmt.Errorf("UnmergeMicroDeposits: filename=%s trace numbers: %v rollback=%v", filename, err, tx.Rollback())
+	}
+	return tx.Commit()
+}
+
 func (r *SQLRepo) LookupMicroDepositFromReturn(id id.Depository, amount *model.Amount) (*MicroDeposit, error) {
-	query := `select file_id from micro_deposits where depository_id = ? and amount = ? and deleted_at is null order by created_at desc limit 1;`
+	query := `select file_id, trace_number from micro_deposits where depository_id = ? and amount = ? and deleted_at is null order by created_at desc limit 1;`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return nil, fmt.Errorf("LookupMicroDepositFromReturn prepare: %v", err)
@@ -708,28 +819,97 @@ func (r *SQLRepo) LookupMicroDepositFromReturn(id id.Depository, amount *model.A
 	defer stmt.Close()
 
 	var fileID string
-	if err := stmt.QueryRow(id, amount.String()).Scan(&fileID); err != nil {
+	var traceNumber *string
+	if err := stmt.QueryRow(id, amount.String()).Scan(&fileID, &traceNumber); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("LookupMicroDepositFromReturn scan: %v", err)
 	}
 	if string(fileID) != "" {
-		return &MicroDeposit{Amount: *amount, FileID: fileID}, nil
+		md := &MicroDeposit{Amount: *amount, FileID: fileID}
+		if traceNumber != nil {
+			md.TraceNumber = *traceNumber
+		}
+		return md, nil
 	}
 	return nil, nil
 }
 
-// SetReturnCode will write the given returnCode (e.g. "R14") onto the row for one of a Depository's micro-deposit
-func (r *SQLRepo) SetReturnCode(id id.Depository, amount model.Amount, returnCode string) error {
-	query := `update micro_deposits set return_code = ? where depository_id = ? and amount = ? and return_code = '' and deleted_at is null;`
+// LookupMicroDepositFromTrace returns the most recently merged micro-deposit with traceNumber and amount along with
+// its Depository. Trace numbers are only unique within a merged file, so the amount is also compared.
+func (r *SQLRepo) LookupMicroDepositFromTrace(traceNumber string, amount *model.Amount) (*model.Depository, *MicroDeposit, error) {
+	query := `select tn.depository_id, m.file_id, m.transaction_id from micro_deposit_trace_numbers tn
+inner join micro_deposits m on tn.depository_id = m.depository_id and tn.file_id = m.file_id and tn.amount = m.amount
+where tn.trace_number = ? and tn.amount = ? and m.deleted_at is null
+order by tn.created_at desc limit 1;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("LookupMicroDepositFromTrace prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	var depID, fileID string
+	var transactionID *string
+	if err := stmt.QueryRow(traceNumber, amount.String()).Scan(&depID, &fileID, &transactionID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("LookupMicroDepositFromTrace scan: %v", err)
+	}
+	dep, err := r.GetDepository(id.Depository(depID))
+	if dep == nil || err != nil {
+		return nil, nil, err
+	}
+	md := &MicroDeposit{Amount: *amount, FileID: fileID, TraceNumber: traceNumber}
+	if transactionID != nil {
+		md.TransactionID = *transactionID
+	}
+	return dep, md, nil
+}
+
+// LookupMicroDepositFromNOC returns the Depository of the most recently merged micro-deposit with traceNumber. NOCs
+// copy the trace number of the original entry but not its amount. A nil Depository is returned if none is found.
+func (r *SQLRepo) LookupMicroDepositFromNOC(traceNumber string) (*model.Depository, error) {
+	query := `select tn.depository_id from micro_deposit_trace_numbers tn
+inner join micro_deposits m on tn.depository_id = m.depository_id and tn.file_id = m.file_id and tn.amount = m.amount
+where tn.trace_number = ? and m.deleted_at is null
+order by tn.created_at desc limit 1;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("LookupMicroDepositFromNOC prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	var depID string
+	if err := stmt.QueryRow(traceNumber).Scan(&depID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("LookupMicroDepositFromNOC scan: %v", err)
+	}
+	return r.GetDepository(id.Depository(depID))
+}
+
+// SetReturnCode will write the given returnCode (e.g. "R14") onto the row for one of a Depository's micro-deposit.
+//
+// The micro-deposit is found by its trace number. Micro-deposits merged before trace numbers were recorded on them
+// are found by their amount instead.
+func (r *SQLRepo) SetReturnCode(id id.Depository, md *MicroDeposit, returnCode string) error {
+	query := `update micro_deposits set return_code = ? where depository_id = ? and trace_number = ? and return_code = '' and deleted_at is null;`
+	arg := md.TraceNumber
+	if md.TraceNumber == "" {
+		query = `update micro_deposits set return_code = ?
+where depository_id = ? and amount = ? and (trace_number is null or trace_number = '') and return_code = '' and deleted_at is null;`
+		arg = md.Amount.String()
+	}
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(returnCode, id, amount.String())
+	_, err = stmt.Exec(returnCode, id, arg)
 	return err
 }
 
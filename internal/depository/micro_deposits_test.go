@@ -63,7 +63,7 @@ func TestODFIAccount(t *testing.T) {
 		t.Errorf("depository: %#v", dep)
 	}
 
-	if accountID, err := odfi.getID("", "userID"); accountID != "accountID" || err != nil {
+	if accountID, err := odfi.AccountID("", "userID"); accountID != "accountID" || err != nil {
 		t.Errorf("accountID=%s error=%v", accountID, err)
 	}
 	odfi.accountID = "" // unset so we make the AccountsClient call
@@ -72,7 +72,7 @@ func TestODFIAccount(t *testing.T) {
 			ID: "accountID2",
 		},
 	}
-	if accountID, err := odfi.getID("", "userID"); accountID != "accountID2" || err != nil {
+	if accountID, err := odfi.AccountID("", "userID"); accountID != "accountID2" || err != nil {
 		t.Errorf("accountID=%s error=%v", accountID, err)
 	}
 	if odfi.accountID != "accountID2" {
@@ -82,13 +82,13 @@ func TestODFIAccount(t *testing.T) {
 	// error on AccountsClient call
 	odfi.accountID = ""
 	accountsClient.Err = errors.New("bad")
-	if accountID, err := odfi.getID("", "userID"); accountID != "" || err == nil {
+	if accountID, err := odfi.AccountID("", "userID"); accountID != "" || err == nil {
 		t.Errorf("expected error accountID=%s", accountID)
 	}
 
 	// on nil AccountsClient expect an error
 	odfi.client = nil
-	if accountID, err := odfi.getID("", "userID"); accountID != "" || err == nil {
+	if accountID, err := odfi.AccountID("", "userID"); accountID != "" || err == nil {
 		t.Errorf("expcted error accountID=%s", accountID)
 	}
 }
@@ -796,6 +796,88 @@ func TestMicroDeposits__submitNoAttemptsLeft(t *testing.T) {
 	}
 }
 
+func TestMicroDeposits__LookupMicroDepositFromTrace(t *testing.T) {
+	t.Parallel()
+
+	check := func(t *testing.T, repo *SQLRepo) {
+		userID := id.User(base.ID())
+		dep := &model.Depository{
+			ID:                     id.Depository(base.ID()),
+			BankName:               "bank name",
+			Holder:                 "holder",
+			HolderType:             model.Individual,
+			Type:                   model.Checking,
+			RoutingNumber:          "123",
+			EncryptedAccountNumber: "151",
+			Status:                 model.DepositoryUnverified,
+			Created:                base.NewTime(time.Now()),
+		}
+		if err := repo.UpsertUserDepository(userID, dep); err != nil {
+			t.Fatal(err)
+		}
+
+		// both micro-deposits are the same amount
+		amt, _ := model.NewAmount("USD", "0.11")
+		microDeposits := []*MicroDeposit{
+			{Amount: *amt, FileID: "fileID", TransactionID: "transactionID"},
+			{Amount: *amt, FileID: "fileID", TransactionID: "transactionID"},
+		}
+		if err := repo.InitiateMicroDeposits(dep.ID, userID, microDeposits); err != nil {
+			t.Fatal(err)
+		}
+		mc := UploadableMicroDeposit{DepositoryID: dep.ID.String(), UserID: userID.String(), Amount: amt, FileID: "fileID"}
+		if err := repo.MarkMicroDepositAsMerged("merged.ach", mc); err != nil {
+			t.Fatal(err)
+		}
+		traces := []*MicroDeposit{
+			{Amount: *amt, TraceNumber: "076401250000001"},
+			{Amount: *amt, TraceNumber: "076401250000002"},
+		}
+		if err := repo.RecordMicroDepositTraceNumbers("merged.ach", mc, traces); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range traces {
+			d, md, err := repo.LookupMicroDepositFromTrace(traces[i].TraceNumber, amt)
+			if err != nil || d == nil || md == nil {
+				t.Fatalf("depository=%#v micro-deposit=%#v error=%v", d, md, err)
+			}
+			if d.ID != dep.ID || md.TraceNumber != traces[i].TraceNumber || md.FileID != "fileID" || md.TransactionID != "transactionID" {
+				t.Errorf("depository=%#v micro-deposit=%#v", d, md)
+			}
+
+			// NOCs match the trace number without an amount
+			if d, err := repo.LookupMicroDepositFromNOC(traces[i].TraceNumber); err != nil || d == nil || d.ID != dep.ID {
+				t.Errorf("depository=%#v error=%v", d, err)
+			}
+		}
+
+		// other trace numbers and amounts don't match
+		other, _ := model.NewAmount("USD", "0.12")
+		if d, md, err := repo.LookupMicroDepositFromTrace("076401250000001", other); d != nil || md != nil || err != nil {
+			t.Errorf("depository=%#v micro-deposit=%#v error=%v", d, md, err)
+		}
+		if d, md, err := repo.LookupMicroDepositFromTrace("076401250000003", amt); d != nil || md != nil || err != nil {
+			t.Errorf("depository=%#v micro-deposit=%#v error=%v", d, md, err)
+		}
+		if d, err := repo.LookupMicroDepositFromNOC("076401250000003"); d != nil || err != nil {
+			t.Errorf("depository=%#v error=%v", d, err)
+		}
+	}
+
+	keeper := secrets.TestStringKeeper(t)
+
+	// SQLite tests
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+	check(t, NewDepositoryRepo(log.NewNopLogger(), sqliteDB.DB, keeper))
+
+	// MySQL tests
+	mysqlDB := database.CreateTestMySQLDB(t)
+	defer mysqlDB.Close()
+	check(t, NewDepositoryRepo(log.NewNopLogger(), mysqlDB.DB, keeper))
+}
+
 func TestMicroDeposits__LookupMicroDepositFromReturn(t *testing.T) {
 	t.Parallel()
 
@@ -899,21 +981,37 @@ func TestMicroDeposits__SetReturnCode(t *testing.T) {
 			t.Fatalf("code=%s", code)
 		}
 
-		// write a micro-deposit and set the return code
+		// write micro-deposits, merge them and set the return code on one
+		other, _ := model.NewAmount("USD", "0.12")
 		microDeposits := []*MicroDeposit{
 			{Amount: *amt, FileID: "fileID", TransactionID: "transactionID"},
+			{Amount: *other, FileID: "fileID", TransactionID: "transactionID"},
 		}
 		if err := repo.InitiateMicroDeposits(depID, userID, microDeposits); err != nil {
 			t.Fatal(err)
 		}
-		if err := repo.SetReturnCode(depID, *amt, "R14"); err != nil {
+		mc := UploadableMicroDeposit{DepositoryID: depID.String(), UserID: userID.String(), FileID: "fileID"}
+		traces := []*MicroDeposit{
+			{Amount: *amt, TraceNumber: "076401250000001"},
+			{Amount: *other, TraceNumber: "076401250000002"},
+		}
+		if err := repo.RecordMicroDepositTraceNumbers("merged.ach", mc, traces); err != nil {
+			t.Fatal(err)
+		}
+		if md, err := repo.LookupMicroDepositFromReturn(depID, amt); err != nil || md == nil || md.TraceNumber != "076401250000001" {
+			t.Fatalf("micro-deposit=%#v error=%v", md, err)
+		}
+		if err := repo.SetReturnCode(depID, &MicroDeposit{Amount: *amt, TraceNumber: "076401250000001"}, "R14"); err != nil {
 			t.Fatal(err)
 		}
 
-		// lookup again and expect the return_code
+		// lookup again and expect the return_code only on the returned micro-deposit
 		if code := getReturnCode(t, repo.db, depID, amt); code != "R14" {
 			t.Errorf("code=%s", code)
 		}
+		if code := getReturnCode(t, repo.db, depID, other); code != "" {
+			t.Errorf("code=%s", code)
+		}
 
 		xs, err := repo.getMicroDepositsForUser(depID, userID)
 		if err != nil {
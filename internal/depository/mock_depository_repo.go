@@ -18,6 +18,8 @@ type MockRepository struct {
 
 	Cur *MicroDepositCursor
 
+	MergedMicroDeposits []UploadableMicroDeposit
+
 	// Updated fields
 	Status     model.DepositoryStatus
 	ReturnCode string
@@ -97,7 +99,26 @@ func (r *MockRepository) LookupMicroDepositFromReturn(id id.Depository, amount *
 	return nil, nil
 }
 
-func (r *MockRepository) SetReturnCode(id id.Depository, amount model.Amount, returnCode string) error {
+func (r *MockRepository) LookupMicroDepositFromNOC(traceNumber string) (*model.Depository, error) {
+	dep, _, err := r.LookupMicroDepositFromTrace(traceNumber, nil)
+	return dep, err
+}
+
+func (r *MockRepository) LookupMicroDepositFromTrace(traceNumber string, amount *model.Amount) (*model.Depository, *MicroDeposit, error) {
+	if r.Err != nil {
+		return nil, nil, r.Err
+	}
+	if len(r.Depositories) > 0 {
+		for i := range r.MicroDeposits {
+			if r.MicroDeposits[i].TraceNumber == traceNumber {
+				return r.Depositories[0], r.MicroDeposits[i], nil
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+func (r *MockRepository) SetReturnCode(id id.Depository, md *MicroDeposit, returnCode string) error {
 	r.ReturnCode = returnCode
 	return r.Err
 }
@@ -113,3 +134,10 @@ func (r *MockRepository) confirmMicroDeposits(id id.Depository, userID id.User,
 func (r *MockRepository) GetMicroDepositCursor(batchSize int) *MicroDepositCursor {
 	return r.Cur
 }
+
+func (r *MockRepository) GetMergedMicroDeposits(filename string) ([]UploadableMicroDeposit, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.MergedMicroDeposits, nil
+}
@@ -32,11 +32,15 @@ type Repository interface {
 
 	LookupDepositoryFromReturn(routingNumber string, accountNumber string) (*model.Depository, error)
 	LookupMicroDepositFromReturn(id id.Depository, amount *model.Amount) (*MicroDeposit, error)
-	SetReturnCode(id id.Depository, amount model.Amount, returnCode string) error
+	LookupMicroDepositFromTrace(traceNumber string, amount *model.Amount) (*model.Depository, *MicroDeposit, error)
+	// LookupMicroDepositFromNOC returns the Depository of the micro-deposit merged with traceNumber.
+	LookupMicroDepositFromNOC(traceNumber string) (*model.Depository, error)
+	SetReturnCode(id id.Depository, md *MicroDeposit, returnCode string) error
 
 	InitiateMicroDeposits(id id.Depository, userID id.User, microDeposit []*MicroDeposit) error
 	confirmMicroDeposits(id id.Depository, userID id.User, amounts []model.Amount) error
 	GetMicroDepositCursor(batchSize int) *MicroDepositCursor
+	GetMergedMicroDeposits(filename string) ([]UploadableMicroDeposit, error)
 }
 
 func NewDepositoryRepo(logger log.Logger, db *sql.DB, keeper *secrets.StringKeeper) *SQLRepo {
@@ -23,4 +23,10 @@ const (
 	// DepositoryEvent EventType = "Depository"
 	// OriginatorEvent EventType = "Originator"
 	TransferEvent EventType = "Transfer"
+
+	// IncomingTransferEvent is written for entries other financial institutions send to our Depositories
+	IncomingTransferEvent EventType = "IncomingTransfer"
+
+	// NotificationOfChangeEvent is written for each NOC (COR entry) received with the corrected data
+	NotificationOfChangeEvent EventType = "NotificationOfChange"
 )
@@ -5,15 +5,21 @@
 package filetransfer
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/moov-io/base/admin"
 	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/transfers"
 	"github.com/moov-io/paygate/internal/util"
+	"github.com/moov-io/paygate/pkg/id"
 
 	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
 )
 
 func AddFileTransferSyncRoute(logger log.Logger, svc *admin.Server, flushIncoming FlushChan, flushOutgoing FlushChan) {
@@ -102,3 +108,177 @@ func maybeWait(w http.ResponseWriter, req *periodicFileOperationsRequest) error
 	}
 	return nil
 }
+
+// AddDeadLetterRoutes registers admin routes to inspect and re-queue files which failed to upload before their cutoff.
+func AddDeadLetterRoutes(logger log.Logger, svc *admin.Server, controller *Controller, transferRepo transfers.Repository) {
+	svc.AddHandler("/files/deadletter", getDeadLetterFiles(logger, controller))
+	svc.AddHandler("/files/deadletter/{filename}/requeue", requeueDeadLetterFile(logger, controller, transferRepo))
+}
+
+func getDeadLetterFiles(logger log.Logger, controller *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		files, err := controller.getDeadLetterFiles()
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(files)
+	}
+}
+
+func requeueDeadLetterFile(logger log.Logger, controller *Controller, transferRepo transfers.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		filename := mux.Vars(r)["filename"]
+		if err := controller.requeueDeadLetterFile(filename, transferRepo); err != nil {
+			if err == errDeadLetterFileNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			moovhttp.Problem(w, err)
+			return
+		}
+		logger.Log("files", fmt.Sprintf("re-queued dead-letter file %s for upload", filename), "requestID", moovhttp.GetRequestID(r))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// AddUploadedFileRoutes registers an admin route to list uploaded files and whether their ODFI has confirmed them.
+func AddUploadedFileRoutes(logger log.Logger, svc *admin.Server, controller *Controller) {
+	svc.AddHandler("/files/uploaded", getUploadedFiles(logger, controller))
+}
+
+func getUploadedFiles(logger log.Logger, controller *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		files := make([]*outboundFile, 0)
+		if controller.outboundFiles != nil {
+			limit := 100
+			if n, _ := strconv.Atoi(r.URL.Query().Get("limit")); n > 0 {
+				limit = n
+			}
+			fs, err := controller.outboundFiles.getOutboundFiles(limit)
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			files = append(files, fs...)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(files)
+	}
+}
+
+// AddExceptionRoutes registers admin routes to list inbound entries which didn't match a Transfer or Depository
+// and to link them to one.
+func AddExceptionRoutes(logger log.Logger, svc *admin.Server, controller *Controller, depRepo depository.Repository, transferRepo transfers.Repository) {
+	svc.AddHandler("/files/exceptions", getExceptions(logger, controller))
+	svc.AddHandler("/files/exceptions/{exceptionId}/link", linkException(logger, controller, depRepo, transferRepo))
+}
+
+func getExceptions(logger log.Logger, controller *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		exceptions := make([]*exception, 0)
+		if controller.exceptions != nil {
+			limit := 100
+			if n, _ := strconv.Atoi(r.URL.Query().Get("limit")); n > 0 {
+				limit = n
+			}
+			resolved, _ := strconv.ParseBool(r.URL.Query().Get("resolved"))
+			exs, err := controller.exceptions.getExceptions(resolved, limit)
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			exceptions = append(exceptions, exs...)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(exceptions)
+	}
+}
+
+type linkExceptionRequest struct {
+	TransferID   id.Transfer   `json:"transferID,omitempty"`
+	DepositoryID id.Depository `json:"depositoryID,omitempty"`
+}
+
+func linkException(logger log.Logger, controller *Controller, depRepo depository.Repository, transferRepo transfers.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		var req linkExceptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		exceptionID := mux.Vars(r)["exceptionId"]
+		if err := controller.linkException(exceptionID, req.TransferID, req.DepositoryID, depRepo, transferRepo); err != nil {
+			if err == errExceptionNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			logger.Log("files", fmt.Sprintf("problem linking exception=%s", exceptionID), "error", err, "requestID", moovhttp.GetRequestID(r))
+			moovhttp.Problem(w, err)
+			return
+		}
+		logger.Log("files", fmt.Sprintf("linked exception=%s to transfer=%s depository=%s", exceptionID, req.TransferID, req.DepositoryID), "requestID", moovhttp.GetRequestID(r))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// AddCorrectionRoutes registers an admin route to list the changes NOCs made to a Receiver.
+func AddCorrectionRoutes(logger log.Logger, svc *admin.Server, controller *Controller) {
+	svc.AddHandler("/receivers/{receiverId}/corrections", getReceiverCorrections(logger, controller))
+}
+
+func getReceiverCorrections(logger log.Logger, controller *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		corrections := make([]*nocCorrection, 0)
+		if controller.corrections != nil {
+			cors, err := controller.corrections.getCorrections("receiver", mux.Vars(r)["receiverId"])
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			corrections = append(corrections, cors...)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(corrections)
+	}
+}
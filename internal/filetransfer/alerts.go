@@ -0,0 +1,99 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	AlertCutoffApproaching  = "cutoff-approaching"
+	AlertCutoffMissed       = "cutoff-missed"
+	AlertConfirmationMissed = "confirmation-missed"
+)
+
+// Alert is raised when an ACH file needs an operator's attention, such as a merged file which missed its
+// cutoff time or an uploaded file its ODFI hasn't confirmed.
+type Alert struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+
+	Filename    string `json:"filename"`
+	Destination string `json:"destination"`
+	Origin      string `json:"origin"`
+
+	// Deadline is the cutoff time or confirmation SLA which was (or is about to be) missed
+	Deadline time.Time `json:"deadline"`
+}
+
+// Alerter delivers Alerts to operators, such as over a webhook or email.
+type Alerter interface {
+	Alert(alert *Alert) error
+}
+
+// AddAlerter registers an Alerter which is sent every Alert the Controller raises.
+func (c *Controller) AddAlerter(alerter Alerter) {
+	c.alertersMu.Lock()
+	defer c.alertersMu.Unlock()
+
+	c.alerters = append(c.alerters, alerter)
+}
+
+// raiseAlert logs alert and sends it to each Alerter. Failed deliveries are logged, but don't stop other Alerters.
+func (c *Controller) raiseAlert(alert *Alert) {
+	c.logger.Log("alerts", fmt.Sprintf("ALERT: %s", alert.Message), "kind", alert.Kind, "filename", alert.Filename)
+
+	c.alertersMu.RLock()
+	defer c.alertersMu.RUnlock()
+
+	for i := range c.alerters {
+		if err := c.alerters[i].Alert(alert); err != nil {
+			c.logger.Log("alerts", fmt.Sprintf("problem sending %s alert with %T", alert.Kind, c.alerters[i]), "error", err)
+		}
+	}
+}
+
+// webhookAlerter POSTs each Alert as JSON to an HTTP endpoint.
+type webhookAlerter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newWebhookAlerter(endpoint string) (*webhookAlerter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alert webhook: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid alert webhook scheme %q", u.Scheme)
+	}
+	return &webhookAlerter{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (a *webhookAlerter) Alert(alert *Alert) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(alert); err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.endpoint, "application/json", &buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned HTTP status %d", resp.StatusCode)
+	}
+	return nil
+}
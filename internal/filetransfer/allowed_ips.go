@@ -0,0 +1,105 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	connectionsRejected = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_file_transfer_connections_rejected",
+		Help: "Counter of FTP and SFTP connections refused because the remote address isn't in AllowedIPs",
+	}, []string{"routing_number", "hostname"})
+
+	// lookupIP resolves hostnames of FTP and SFTP servers, which is overridden in tests
+	lookupIP = net.LookupIP
+)
+
+// parseAllowedIPs reads a comma separated list of IP addresses and CIDR ranges.
+func parseAllowedIPs(raw string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+	for _, v := range strings.Split(raw, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") {
+			_, ipnet, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, ipnet)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no allowed IP addresses")
+	}
+	return out, nil
+}
+
+// allowedRemoteIP resolves hostname and returns the first of its addresses inside cfg.AllowedIPs.
+// Resolving our ODFI's hostname to an address outside of AllowedIPs could mean its DNS has been hijacked.
+func allowedRemoteIP(cfg *Config, hostname string) (net.IP, error) {
+	allowed, err := parseAllowedIPs(cfg.AllowedIPs)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := lookupIP(hostname)
+	if len(addrs) == 0 || err != nil {
+		return nil, fmt.Errorf("unable to resolve (found %d) %s: %v", len(addrs), hostname, err)
+	}
+	for i := range addrs {
+		for j := range allowed {
+			if allowed[j].Contains(addrs[i]) {
+				return addrs[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s resolved to %s which is not allowed", hostname, addrs[0].String())
+}
+
+// allowedDialer returns a dial function which only connects to addresses inside cfg.AllowedIPs. The hostname
+// is resolved once and the connection is made to the allowed address which was found. Rejected connections
+// are logged and counted.
+//
+// Every address is allowed when cfg has no AllowedIPs.
+func allowedDialer(logger log.Logger, cfg *Config, dialer *net.Dialer) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		if cfg == nil || cfg.AllowedIPs == "" {
+			return dialer.Dial(network, address)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		ip, err := allowedRemoteIP(cfg, host)
+		if err != nil {
+			if logger != nil {
+				logger.Log("filetransfer", fmt.Sprintf("refusing connection to %s for routingNumber=%s", address, cfg.RoutingNumber), "error", err)
+			}
+			connectionsRejected.With("routing_number", cfg.RoutingNumber, "hostname", host).Add(1)
+			return nil, fmt.Errorf("refusing connection to %s: %v", address, err)
+		}
+		return dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestAllowedIPs__parseAllowedIPs(t *testing.T) {
+	allowed, err := parseAllowedIPs("10.2.0.0/24, 192.168.1.12,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 3 {
+		t.Fatalf("got %d allowed", len(allowed))
+	}
+	if !allowed[0].Contains(net.ParseIP("10.2.0.15")) || !allowed[1].Contains(net.ParseIP("192.168.1.12")) || allowed[1].Contains(net.ParseIP("192.168.1.13")) {
+		t.Errorf("unexpected allowed IPs: %v", allowed)
+	}
+	if !allowed[2].Contains(net.ParseIP("::1")) {
+		t.Errorf("unexpected allowed IPs: %v", allowed)
+	}
+
+	if _, err := parseAllowedIPs("afkjsafkjahfa"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := parseAllowedIPs("10.0.0.0/33"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := parseAllowedIPs(" , "); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAllowedIPs__allowedRemoteIP(t *testing.T) {
+	defer func(f func(string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "ftp.bank.com" {
+			return []net.IP{net.ParseIP("8.8.4.4"), net.ParseIP("10.2.0.12")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	cfg := &Config{AllowedIPs: "10.2.0.12"}
+
+	// exact IP match, on the second address
+	if ip, err := allowedRemoteIP(cfg, "ftp.bank.com"); err != nil || ip.String() != "10.2.0.12" {
+		t.Errorf("ip=%v error=%v", ip, err)
+	}
+
+	// multiple allowed, match range
+	cfg.AllowedIPs = "127.0.0.1/24,10.2.0.0/24"
+	if ip, err := allowedRemoteIP(cfg, "ftp.bank.com"); err != nil || ip.String() != "10.2.0.12" {
+		t.Errorf("ip=%v error=%v", ip, err)
+	}
+
+	// no match
+	cfg.AllowedIPs = "8.8.8.0/24"
+	if _, err := allowedRemoteIP(cfg, "ftp.bank.com"); err == nil {
+		t.Error("expected error")
+	}
+
+	// error cases
+	cfg.AllowedIPs = "afkjsafkjahfa"
+	if _, err := allowedRemoteIP(cfg, "ftp.bank.com"); err == nil {
+		t.Error("expected error")
+	}
+	cfg.AllowedIPs = "10.0.0.0/8"
+	if _, err := allowedRemoteIP(cfg, "lsjafkshfaksjfhas"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAllowedIPs__allowedDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	address := net.JoinHostPort("localhost", port)
+
+	// empty AllowedIPs, allow all
+	cfg := &Config{RoutingNumber: "987654320"}
+	dial := allowedDialer(log.NewNopLogger(), cfg, &net.Dialer{})
+	if conn, err := dial("tcp", address); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+
+	// localhost is allowed
+	cfg.AllowedIPs = "127.0.0.0/8"
+	conn, err := dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("connected to %s", conn.RemoteAddr())
+	}
+	conn.Close()
+
+	// localhost isn't allowed
+	cfg.AllowedIPs = "10.0.0.0/8"
+	if _, err := dial("tcp", address); err == nil {
+		t.Error("expected error")
+	}
+}
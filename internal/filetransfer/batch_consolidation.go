@@ -0,0 +1,154 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/moov-io/ach"
+)
+
+// batchKey identifies the forward batches of a merged file whose entries are consolidated into one batch.
+//
+// The ODFI and entry description are part of the key as well because they're on the batch header and the
+// receiver's statement shows the entry description of their entry's batch.
+type batchKey struct {
+	companyIdentification   string
+	standardEntryClassCode  string
+	effectiveEntryDate      string
+	serviceClassCode        int
+	sameDay                 bool
+	odfiIdentification      string
+	companyEntryDescription string
+}
+
+func makeBatchKey(bh *ach.BatchHeader, fileCreationDate string) batchKey {
+	return batchKey{
+		companyIdentification:   strings.TrimSpace(bh.CompanyIdentification),
+		standardEntryClassCode:  bh.StandardEntryClassCode,
+		effectiveEntryDate:      bh.EffectiveEntryDate,
+		serviceClassCode:        bh.ServiceClassCode,
+		sameDay:                 bh.EffectiveEntryDate == fileCreationDate,
+		odfiIdentification:      bh.ODFIIdentification,
+		companyEntryDescription: strings.TrimSpace(bh.CompanyEntryDescription),
+	}
+}
+
+// consolidateBatch adds the entries of batch into the forward batch of merged with the same batchKey, or
+// adds batch to merged with the next batch number when there's no such batch. Returns and NOCs are added as-is.
+//
+// Forward entries are added as copies given trace numbers after the highest in merged, so they're unique within
+// the file and ascending within their batch. Merged files start with their entries renumbered from one (see
+// renumberTraceNumbers) so the sequence numbers never run out. The copies are returned in the order of batch's
+// entries and batch itself is left unchanged, so callers can restore the prior merged.Batches if the file grows
+// too large.
+func consolidateBatch(merged *ach.File, batch ach.Batcher) ([]*ach.EntryDetail, error) {
+	batches := make([]ach.Batcher, len(merged.Batches), len(merged.Batches)+1)
+	copy(batches, merged.Batches)
+
+	if batch.Category() != ach.CategoryForward {
+		merged.Batches = append(batches, batch)
+		return nil, nil
+	}
+
+	seq := maxTraceSequence(merged) + 1
+	key := makeBatchKey(batch.GetHeader(), merged.Header.FileCreationDate)
+	for i := range batches {
+		if batches[i].Category() != ach.CategoryForward || makeBatchKey(batches[i].GetHeader(), merged.Header.FileCreationDate) != key {
+			continue
+		}
+		header := *batches[i].GetHeader()
+		out, err := ach.NewBatch(&header)
+		if err != nil {
+			return nil, err
+		}
+		for _, ed := range batches[i].GetEntries() {
+			out.AddEntry(ed)
+		}
+		added := copyEntries(batch.GetEntries(), header.ODFIIdentification, seq)
+		for _, ed := range added {
+			out.AddEntry(ed)
+		}
+		if err := out.Create(); err != nil {
+			return nil, err
+		}
+		batches[i] = out
+		merged.Batches = batches
+		return added, nil
+	}
+
+	header := *batch.GetHeader()
+	header.BatchNumber = maxBatchNumber(merged) + 1
+	out, err := ach.NewBatch(&header)
+	if err != nil {
+		return nil, err
+	}
+	added := copyEntries(batch.GetEntries(), header.ODFIIdentification, seq)
+	for _, ed := range added {
+		out.AddEntry(ed)
+	}
+	if err := out.Create(); err != nil {
+		return nil, err
+	}
+	merged.Batches = append(batches, out)
+	return added, nil
+}
+
+// copyEntries returns copies of entries with trace numbers from odfi starting at seq.
+func copyEntries(entries []*ach.EntryDetail, odfi string, seq int) []*ach.EntryDetail {
+	out := make([]*ach.EntryDetail, len(entries))
+	for i := range entries {
+		ed := *entries[i]
+		ed.SetTraceNumber(odfi, seq+i)
+		out[i] = &ed
+	}
+	return out
+}
+
+// renumberTraceNumbers gives the forward entries of file sequence numbers in order from one. It's called on
+// a Transfer's file when a merged file is started from it, as the trace numbers of created files have random
+// sequence numbers.
+func renumberTraceNumbers(file *ach.File) {
+	seq := 1
+	for i := range file.Batches {
+		if file.Batches[i].Category() != ach.CategoryForward {
+			continue
+		}
+		odfi := file.Batches[i].GetHeader().ODFIIdentification
+		for _, ed := range file.Batches[i].GetEntries() {
+			ed.SetTraceNumber(odfi, seq)
+			seq++
+		}
+	}
+}
+
+// maxTraceSequence returns the highest sequence number (the last seven digits of a trace number) of the
+// forward entries in file.
+func maxTraceSequence(file *ach.File) int {
+	max := 0
+	for i := range file.Batches {
+		if file.Batches[i].Category() != ach.CategoryForward {
+			continue
+		}
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			if n, _ := strconv.Atoi(entries[j].TraceNumberField()[8:]); n > max {
+				max = n
+			}
+		}
+	}
+	return max
+}
+
+func maxBatchNumber(file *ach.File) int {
+	max := 0
+	for i := range file.Batches {
+		if n := file.Batches[i].GetHeader().BatchNumber; n > max {
+			max = n
+		}
+	}
+	return max
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moov-io/ach"
+
+	"github.com/go-kit/kit/log"
+)
+
+func readPPDDebitFile(t *testing.T) *ach.File {
+	t.Helper()
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestBatchConsolidation(t *testing.T) {
+	merged := readPPDDebitFile(t)
+
+	// a second transfer from the same originator is consolidated
+	incoming := readPPDDebitFile(t).Batches[0]
+	added, err := consolidateBatch(merged, incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].TraceNumber != "076401255655292" {
+		t.Errorf("added: %#v", added)
+	}
+	if n := len(merged.Batches); n != 1 {
+		t.Fatalf("got %d batches", n)
+	}
+	entries := merged.Batches[0].GetEntries()
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	if entries[0].TraceNumber != "076401255655291" || entries[1].TraceNumber != "076401255655292" {
+		t.Errorf("trace numbers: %s and %s", entries[0].TraceNumber, entries[1].TraceNumber)
+	}
+	if ctrl := merged.Batches[0].GetControl(); ctrl.TotalDebitEntryDollarAmount != 21000 || ctrl.EntryAddendaCount != 2 {
+		t.Errorf("unexpected batch control: %#v", ctrl)
+	}
+	// the incoming batch is left unchanged
+	if trace := incoming.GetEntries()[0].TraceNumber; trace != "076401255655291" {
+		t.Errorf("incoming trace number changed to %s", trace)
+	}
+
+	// a different originator is added as another batch
+	other := readPPDDebitFile(t)
+	other.Batches[0].GetHeader().CompanyIdentification = "other"
+	if _, err := consolidateBatch(merged, other.Batches[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(merged.Batches); n != 2 {
+		t.Fatalf("got %d batches", n)
+	}
+	if n := merged.Batches[1].GetHeader().BatchNumber; n != 2 {
+		t.Errorf("batch number %d", n)
+	}
+	if trace := merged.Batches[1].GetEntries()[0].TraceNumber; trace != "076401255655293" {
+		t.Errorf("trace number %s", trace)
+	}
+	if n := other.Batches[0].GetHeader().BatchNumber; n != 1 {
+		t.Errorf("incoming batch number changed to %d", n)
+	}
+	if err := merged.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBatchConsolidation__renumberTraceNumbers(t *testing.T) {
+	// merged files start with their entries numbered from one, so consolidated entries continue from there
+	merged := readPPDDebitFile(t)
+	renumberTraceNumbers(merged)
+	if trace := merged.Batches[0].GetEntries()[0].TraceNumber; trace != "076401250000001" {
+		t.Errorf("trace number %s", trace)
+	}
+
+	incoming := readPPDDebitFile(t)
+	incoming.Batches[0].GetEntries()[0].SetTraceNumber("07640125", 9999999)
+	added, err := consolidateBatch(merged, incoming.Batches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].TraceNumber != "076401250000002" {
+		t.Errorf("added: %#v", added)
+	}
+}
+
+func TestBatchConsolidation__returns(t *testing.T) {
+	merged := readPPDDebitFile(t)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace := file.Batches[0].GetEntries()[0].TraceNumber
+	if _, err := consolidateBatch(merged, file.Batches[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(merged.Batches); n != 2 {
+		t.Fatalf("got %d batches", n)
+	}
+	if v := merged.Batches[1].GetEntries()[0].TraceNumber; v != trace {
+		t.Errorf("return trace number changed to %s", v)
+	}
+}
+
+func TestController__mergeTransferConsolidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mergeTransfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mergableFile := &achFile{
+		File:     readPPDDebitFile(t),
+		filepath: filepath.Join(dir, "20200101-076401251-1.ach"),
+	}
+	controller := &Controller{repo: &mockRepository{}, logger: log.NewNopLogger()}
+
+	for i := 0; i < 3; i++ {
+		file := readPPDDebitFile(t)
+		file.Batches[0].GetEntries()[0].Amount += i + 1 // identical batches aren't merged twice
+		if out, err := controller.mergeTransfer(file, mergableFile); out != nil || err != nil {
+			t.Fatalf("out=%v error=%v", out, err)
+		}
+		// the transfer's entry was given its trace number in the merged file
+		if trace := file.Batches[0].GetEntries()[0].TraceNumber; trace == "076401255655291" {
+			t.Errorf("transfer %d kept trace number %s", i, trace)
+		}
+	}
+
+	file, err := parseACHFilepath(mergableFile.filepath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Batches) != 1 || len(file.Batches[0].GetEntries()) != 4 {
+		t.Errorf("unexpected batches: %#v", file.Batches)
+	}
+}
@@ -14,11 +14,13 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
 	"github.com/moov-io/base/admin"
 	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/paygate/internal/secrets"
 	"github.com/moov-io/paygate/internal/util"
 
 	"github.com/go-kit/kit/log"
@@ -40,7 +42,7 @@ type Repository interface {
 	deleteCutoffTime(routingNumber string) error
 
 	GetFTPConfigs() ([]*FTPConfig, error)
-	upsertFTPConfigs(routingNumber, host, user, pass string) error
+	upsertFTPConfigs(cfg *FTPConfig) error
 	deleteFTPConfig(routingNumber string) error
 
 	GetSFTPConfigs() ([]*SFTPConfig, error)
@@ -50,7 +52,9 @@ type Repository interface {
 	Close() error
 }
 
-func NewRepository(filepath string, db *sql.DB, dbType string) Repository {
+// NewRepository returns a Repository of file transfer configs. Configs are read from the YAML file at filepath
+// when it's non-empty, otherwise from db. Client certificates are encrypted in db with keeper.
+func NewRepository(filepath string, db *sql.DB, dbType string, keeper *secrets.StringKeeper) Repository {
 	if db == nil {
 		repo := &staticRepository{}
 		repo.populate()
@@ -59,11 +63,14 @@ func NewRepository(filepath string, db *sql.DB, dbType string) Repository {
 
 	// If we've got a config from a file on the filesystem let's use that
 	if filepath != "" {
-		repo, _ := readConfigFile(filepath)
+		repo, err := readConfigFile(filepath)
+		if err != nil {
+			return nil
+		}
 		return repo
 	}
 
-	sqliteRepo := &sqlRepository{db}
+	sqliteRepo := &sqlRepository{db: db, keeper: keeper}
 
 	if strings.EqualFold(dbType, "sqlite") || strings.EqualFold(dbType, "mysql") {
 		// On 'mysql' database setups return that over the local (hardcoded) values.
@@ -81,7 +88,8 @@ func NewRepository(filepath string, db *sql.DB, dbType string) Repository {
 }
 
 type sqlRepository struct {
-	db *sql.DB
+	db     *sql.DB
+	keeper *secrets.StringKeeper
 }
 
 func (r *sqlRepository) Close() error {
@@ -109,7 +117,9 @@ func (r *sqlRepository) GetCounts() (int, int, int) {
 }
 
 func (r *sqlRepository) GetConfigs() ([]*Config, error) {
-	query := `select routing_number, inbound_path, outbound_path, return_path, outbound_filename_template, allowed_ips from file_transfer_configs;`
+	query := `select routing_number, inbound_path, outbound_path, return_path, outbound_filename_template, allowed_ips, coalesce(mode, ''),
+coalesce(balance_entries, 0), coalesce(offset_routing_number, ''), coalesce(offset_account_number_encrypted, ''), coalesce(offset_account_type, ''),
+coalesce(confirmation_format, '') from file_transfer_configs;`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return nil, err
@@ -124,9 +134,14 @@ func (r *sqlRepository) GetConfigs() ([]*Config, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var cfg Config
-		if err := rows.Scan(&cfg.RoutingNumber, &cfg.InboundPath, &cfg.OutboundPath, &cfg.ReturnPath, &cfg.OutboundFilenameTemplate, &cfg.AllowedIPs); err != nil {
+		var offsetAccountNumber string
+		if err := rows.Scan(&cfg.RoutingNumber, &cfg.InboundPath, &cfg.OutboundPath, &cfg.ReturnPath, &cfg.OutboundFilenameTemplate, &cfg.AllowedIPs, &cfg.Mode,
+			&cfg.BalanceEntries, &cfg.OffsetRoutingNumber, &offsetAccountNumber, &cfg.OffsetAccountType, &cfg.ConfirmationFormat); err != nil {
 			return nil, fmt.Errorf("GetConfigs: scan: %v", err)
 		}
+		if cfg.OffsetAccountNumber, err = r.decrypt(offsetAccountNumber); err != nil {
+			return nil, fmt.Errorf("GetConfigs: offset account number for %s: %v", cfg.RoutingNumber, err)
+		}
 		configs = append(configs, &cfg)
 	}
 	return configs, rows.Err()
@@ -199,8 +214,14 @@ func (r *sqlRepository) getOutboundFilenameTemplates() ([]string, error) {
 }
 
 func (r *sqlRepository) upsertConfig(cfg *Config) error {
-	query := `replace into file_transfer_configs (routing_number, inbound_path, outbound_path, return_path, outbound_filename_template, allowed_ips) values (?, ?, ?, ?, ?, ?);`
-	return exec(r.db, query, cfg.RoutingNumber, cfg.InboundPath, cfg.OutboundPath, cfg.ReturnPath, cfg.OutboundFilenameTemplate, cfg.AllowedIPs)
+	offsetAccountNumber, err := r.encrypt(cfg.OffsetAccountNumber)
+	if err != nil {
+		return fmt.Errorf("error encrypting offset account number: %v", err)
+	}
+	query := `replace into file_transfer_configs (routing_number, inbound_path, outbound_path, return_path, outbound_filename_template, allowed_ips, mode,
+balance_entries, offset_routing_number, offset_account_number_encrypted, offset_account_type, confirmation_format) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	return exec(r.db, query, cfg.RoutingNumber, cfg.InboundPath, cfg.OutboundPath, cfg.ReturnPath, cfg.OutboundFilenameTemplate, cfg.AllowedIPs, cfg.Mode,
+		cfg.BalanceEntries, cfg.OffsetRoutingNumber, offsetAccountNumber, cfg.OffsetAccountType, cfg.ConfirmationFormat)
 }
 
 func (r *sqlRepository) deleteConfig(routingNumber string) error {
@@ -219,7 +240,8 @@ func (r *sqlRepository) deleteCutoffTime(routingNumber string) error {
 }
 
 func (r *sqlRepository) GetFTPConfigs() ([]*FTPConfig, error) {
-	query := `select routing_number, hostname, username, password from ftp_configs;`
+	query := `select routing_number, hostname, username, password, coalesce(password_encrypted, ''), coalesce(tls_mode, ''), coalesce(ca_certificates, ''),
+coalesce(client_certificate, ''), coalesce(client_private_key, ''), coalesce(disable_epsv, 0) from ftp_configs;`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return nil, err
@@ -234,55 +256,184 @@ func (r *sqlRepository) GetFTPConfigs() ([]*FTPConfig, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var cfg FTPConfig
-		if err := rows.Scan(&cfg.RoutingNumber, &cfg.Hostname, &cfg.Username, &cfg.Password); err != nil {
+		var pass, encryptedPass, clientCert, clientKey string
+		if err := rows.Scan(&cfg.RoutingNumber, &cfg.Hostname, &cfg.Username, &pass, &encryptedPass, &cfg.TLSMode, &cfg.CACertificates, &clientCert, &clientKey, &cfg.DisableEPSV); err != nil {
 			return nil, fmt.Errorf("GetFTPConfigs: scan: %v", err)
 		}
+		if cfg.Password, err = r.readSecret(encryptedPass, pass); err != nil {
+			return nil, fmt.Errorf("GetFTPConfigs: password for %s: %v", cfg.RoutingNumber, err)
+		}
+		if cfg.ClientCertificate, err = r.decrypt(clientCert); err != nil {
+			return nil, fmt.Errorf("GetFTPConfigs: client certificate for %s: %v", cfg.RoutingNumber, err)
+		}
+		if cfg.ClientPrivateKey, err = r.decrypt(clientKey); err != nil {
+			return nil, fmt.Errorf("GetFTPConfigs: client private key for %s: %v", cfg.RoutingNumber, err)
+		}
 		configs = append(configs, &cfg)
 	}
 	return configs, rows.Err()
 }
 
-func (r *sqlRepository) upsertFTPConfigs(routingNumber, host, user, pass string) error {
+// upsertFTPConfigs writes cfg, keeping the existing password and client certificate when they're empty.
+func (r *sqlRepository) upsertFTPConfigs(cfg *FTPConfig) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
 
-	stmt, err := tx.Prepare(`select password from ftp_configs where routing_number = ? limit 1;`)
+	stmt, err := tx.Prepare(`select password, coalesce(password_encrypted, ''), coalesce(client_certificate, ''), coalesce(client_private_key, '') from ftp_configs where routing_number = ? limit 1;`)
 	if err != nil {
 		return fmt.Errorf("error reading existing password: error=%v rollback=%v", err, tx.Rollback())
 	}
 	defer stmt.Close()
 
-	row := stmt.QueryRow(routingNumber)
-	var existingPass string
-	if err := row.Scan(&existingPass); err != nil {
+	row := stmt.QueryRow(cfg.RoutingNumber)
+	var existingPass, existingEncryptedPass, existingCert, existingKey string
+	if err := row.Scan(&existingPass, &existingEncryptedPass, &existingCert, &existingKey); err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("error scanning existing password: error=%v rollback=%v", err, tx.Rollback())
 	}
-	if pass == "" {
-		pass = existingPass
+	pass, err := r.keepSecret(cfg.Password, existingEncryptedPass, existingPass)
+	if err != nil {
+		return fmt.Errorf("error encrypting password: error=%v rollback=%v", err, tx.Rollback())
+	}
+	clientCert, clientKey := existingCert, existingKey
+	if cfg.ClientCertificate != "" || cfg.ClientPrivateKey != "" {
+		if clientCert, err = r.encrypt(cfg.ClientCertificate); err != nil {
+			return fmt.Errorf("error encrypting client certificate: error=%v rollback=%v", err, tx.Rollback())
+		}
+		if clientKey, err = r.encrypt(cfg.ClientPrivateKey); err != nil {
+			return fmt.Errorf("error encrypting client private key: error=%v rollback=%v", err, tx.Rollback())
+		}
 	}
 
-	query := `replace into ftp_configs (routing_number, hostname, username, password) values (?, ?, ?, ?);`
+	query := `replace into ftp_configs (routing_number, hostname, username, password, password_encrypted, tls_mode, ca_certificates, client_certificate, client_private_key, disable_epsv)
+values (?, ?, ?, '', ?, ?, ?, ?, ?, ?);`
 	stmt, err = tx.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("error preparing replace: error=%v rollback=%v", err, tx.Rollback())
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(routingNumber, host, user, pass); err != nil {
+	if _, err := stmt.Exec(cfg.RoutingNumber, cfg.Hostname, cfg.Username, pass, cfg.TLSMode, cfg.CACertificates, clientCert, clientKey, cfg.DisableEPSV); err != nil {
 		return fmt.Errorf("error replacing ftp config error=%v rollback=%v", err, tx.Rollback())
 	}
 
 	return tx.Commit()
 }
 
+// keepSecret returns the encrypted form of value, or the existing secret when value is empty. Secrets from
+// before we encrypted them are encrypted.
+func (r *sqlRepository) keepSecret(value, existingEncrypted, existingPlaintext string) (string, error) {
+	switch {
+	case value != "":
+		return r.encrypt(value)
+	case existingEncrypted != "":
+		return existingEncrypted, nil
+	}
+	return r.encrypt(existingPlaintext)
+}
+
+// readSecret decrypts a secret, or returns plaintext for rows written before secrets were encrypted.
+func (r *sqlRepository) readSecret(encrypted, plaintext string) (string, error) {
+	if encrypted == "" {
+		return plaintext, nil
+	}
+	return r.decrypt(encrypted)
+}
+
+// encrypt protects secrets (i.e. passwords and private keys) stored in our database.
+func (r *sqlRepository) encrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if r.keeper == nil {
+		return "", errors.New("nil secrets keeper")
+	}
+	return r.keeper.EncryptString(value)
+}
+
+func (r *sqlRepository) decrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if r.keeper == nil {
+		return "", errors.New("nil secrets keeper")
+	}
+	return r.keeper.DecryptString(value)
+}
+
+// EncryptStoredSecrets encrypts FTP and SFTP passwords and private keys which older versions of paygate
+// stored in plaintext. It only changes rows which still have a plaintext secret, so it's safe to call on startup.
+func EncryptStoredSecrets(logger log.Logger, repo Repository) error {
+	r, ok := repo.(*sqlRepository)
+	if !ok {
+		return nil // secrets from a config file or hardcoded defaults aren't stored by us
+	}
+	columns := []struct {
+		table, plaintext, encrypted string
+	}{
+		{"ftp_configs", "password", "password_encrypted"},
+		{"sftp_configs", "password", "password_encrypted"},
+		{"sftp_configs", "client_private_key", "client_private_key_encrypted"},
+	}
+	for i := range columns {
+		n, err := r.encryptColumn(columns[i].table, columns[i].plaintext, columns[i].encrypted)
+		if err != nil {
+			return fmt.Errorf("EncryptStoredSecrets: %s.%s: %v", columns[i].table, columns[i].plaintext, err)
+		}
+		if n > 0 && logger != nil {
+			logger.Log("file-transfer-configs", fmt.Sprintf("encrypted %d %s.%s values", n, columns[i].table, columns[i].plaintext))
+		}
+	}
+	return nil
+}
+
+// encryptColumn moves each non-empty plaintext value of a table into its encrypted column and returns how many rows changed.
+func (r *sqlRepository) encryptColumn(table, plaintext, encrypted string) (int, error) {
+	query := fmt.Sprintf(`select routing_number, %s from %s where %s <> '';`, plaintext, table, plaintext)
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return 0, err
+	}
+	values := make(map[string]string)
+	for rows.Next() {
+		var routingNumber, value string
+		if err := rows.Scan(&routingNumber, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		values[routingNumber] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	query = fmt.Sprintf(`update %s set %s = '', %s = ? where routing_number = ?;`, table, plaintext, encrypted)
+	for routingNumber, value := range values {
+		enc, err := r.encrypt(value)
+		if err != nil {
+			return 0, fmt.Errorf("routingNumber=%s: %v", routingNumber, err)
+		}
+		if err := exec(r.db, query, enc, routingNumber); err != nil {
+			return 0, fmt.Errorf("routingNumber=%s: %v", routingNumber, err)
+		}
+	}
+	return len(values), nil
+}
+
 func (r *sqlRepository) deleteFTPConfig(routingNumber string) error {
 	query := `delete from ftp_configs where routing_number = ?;`
 	return exec(r.db, query, routingNumber)
 }
 
 func (r *sqlRepository) GetSFTPConfigs() ([]*SFTPConfig, error) {
-	query := `select routing_number, hostname, username, password, client_private_key, host_public_key from sftp_configs;`
+	query := `select routing_number, hostname, username, password, coalesce(password_encrypted, ''), client_private_key, coalesce(client_private_key_encrypted, ''), host_public_key from sftp_configs;`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return nil, err
@@ -297,9 +448,16 @@ func (r *sqlRepository) GetSFTPConfigs() ([]*SFTPConfig, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var cfg SFTPConfig
-		if err := rows.Scan(&cfg.RoutingNumber, &cfg.Hostname, &cfg.Username, &cfg.Password, &cfg.ClientPrivateKey, &cfg.HostPublicKey); err != nil {
+		var pass, encryptedPass, privateKey, encryptedPrivateKey string
+		if err := rows.Scan(&cfg.RoutingNumber, &cfg.Hostname, &cfg.Username, &pass, &encryptedPass, &privateKey, &encryptedPrivateKey, &cfg.HostPublicKey); err != nil {
 			return nil, fmt.Errorf("GetSFTPConfigs: scan: %v", err)
 		}
+		if cfg.Password, err = r.readSecret(encryptedPass, pass); err != nil {
+			return nil, fmt.Errorf("GetSFTPConfigs: password for %s: %v", cfg.RoutingNumber, err)
+		}
+		if cfg.ClientPrivateKey, err = r.readSecret(encryptedPrivateKey, privateKey); err != nil {
+			return nil, fmt.Errorf("GetSFTPConfigs: client private key for %s: %v", cfg.RoutingNumber, err)
+		}
 		configs = append(configs, &cfg)
 	}
 	return configs, rows.Err()
@@ -311,7 +469,8 @@ func (r *sqlRepository) upsertSFTPConfigs(routingNumber, host, user, pass, priva
 		return err
 	}
 
-	query := `select password, client_private_key, host_public_key from sftp_configs where routing_number = ? limit 1;`
+	query := `select password, coalesce(password_encrypted, ''), client_private_key, coalesce(client_private_key_encrypted, ''), host_public_key
+from sftp_configs where routing_number = ? limit 1;`
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("error preparing read: error=%v rollback=%v", err, tx.Rollback())
@@ -319,23 +478,24 @@ func (r *sqlRepository) upsertSFTPConfigs(routingNumber, host, user, pass, priva
 	defer stmt.Close()
 
 	// read existing values
-	ePass, ePriv, ePub := "", "", ""
-	if err := stmt.QueryRow(routingNumber).Scan(&ePass, &ePriv, &ePub); err != nil {
+	ePass, eEncPass, ePriv, eEncPriv, ePub := "", "", "", "", ""
+	if err := stmt.QueryRow(routingNumber).Scan(&ePass, &eEncPass, &ePriv, &eEncPriv, &ePub); err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("error reading existing: error=%v rollback=%v", err, tx.Rollback())
 	}
 
-	if pass == "" {
-		pass = ePass
+	if pass, err = r.keepSecret(pass, eEncPass, ePass); err != nil {
+		return fmt.Errorf("error encrypting password: error=%v rollback=%v", err, tx.Rollback())
 	}
-	if privateKey == "" {
-		privateKey = ePriv
+	if privateKey, err = r.keepSecret(privateKey, eEncPriv, ePriv); err != nil {
+		return fmt.Errorf("error encrypting client private key: error=%v rollback=%v", err, tx.Rollback())
 	}
 	if publicKey == "" {
 		publicKey = ePub
 	}
 
 	// update/insert entire row
-	query = `replace into sftp_configs (routing_number, hostname, username, password, client_private_key, host_public_key) values (?, ?, ?, ?, ?, ?);`
+	query = `replace into sftp_configs (routing_number, hostname, username, password, password_encrypted, client_private_key, client_private_key_encrypted, host_public_key)
+values (?, ?, ?, '', ?, '', ?, ?);`
 	stmt, err = tx.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("error preparing replace: error=%v rollback=%v", err, tx.Rollback())
@@ -354,7 +514,7 @@ func (r *sqlRepository) deleteSFTPConfig(routingNumber string) error {
 	return exec(r.db, query, routingNumber)
 }
 
-func readConfigFile(path string) (Repository, error) {
+func readConfigFile(path string) (*staticRepository, error) {
 	bs, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -373,16 +533,23 @@ func readConfigFile(path string) (Repository, error) {
 	if err := yaml.NewDecoder(bytes.NewReader(bs)).Decode(&conf); err != nil {
 		return nil, err
 	}
+	for i := range conf.FileTransfer.Configs {
+		if err := validateConfig(conf.FileTransfer.Configs[i]); err != nil {
+			return nil, fmt.Errorf("routingNumber=%s: %v", conf.FileTransfer.Configs[i].RoutingNumber, err)
+		}
+	}
 	return &staticRepository{
 		configs:     conf.FileTransfer.Configs,
 		cutoffTimes: conf.FileTransfer.CutoffTimes,
 		ftpConfigs:  conf.FileTransfer.FTPConfigs,
 		sftpConfigs: conf.FileTransfer.SFTPConfigs,
 		protocol:    devFileTransferType,
+		path:        path,
 	}, nil
 }
 
 type staticRepository struct {
+	mu          sync.RWMutex
 	configs     []*Config
 	cutoffTimes []*CutoffTime
 	ftpConfigs  []*FTPConfig
@@ -391,6 +558,33 @@ type staticRepository struct {
 	// protocol represents values like ftp or sftp to return back relevant configs
 	// to the moov/fsftp or SFTP docker image
 	protocol string
+
+	// path is the YAML file these configs were read from, which is empty for the hardcoded configs
+	path string
+}
+
+// reload re-reads the YAML file of r and swaps in its configs once their templates are valid.
+// The existing configs are kept when an error is returned.
+func (r *staticRepository) reload() error {
+	if r.path == "" {
+		return errors.New("file transfer configs weren't read from a file")
+	}
+	next, err := readConfigFile(r.path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", r.path, err)
+	}
+	if err := ValidateTemplates(next); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.configs = next.configs
+	r.cutoffTimes = next.cutoffTimes
+	r.ftpConfigs = next.ftpConfigs
+	r.sftpConfigs = next.sftpConfigs
+	return nil
 }
 
 func (r *staticRepository) populate() {
@@ -453,18 +647,26 @@ func (r *staticRepository) populateSFTPConfigs() {
 }
 
 func (r *staticRepository) GetConfigs() ([]*Config, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.configs, nil
 }
 
 func (r *staticRepository) GetCutoffTimes() ([]*CutoffTime, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.cutoffTimes, nil
 }
 
 func (r *staticRepository) GetFTPConfigs() ([]*FTPConfig, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.ftpConfigs, nil
 }
 
 func (r *staticRepository) GetSFTPConfigs() ([]*SFTPConfig, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.sftpConfigs, nil
 }
 
@@ -488,7 +690,7 @@ func (r *staticRepository) deleteCutoffTime(routingNumber string) error {
 	return nil
 }
 
-func (r *staticRepository) upsertFTPConfigs(routingNumber, host, user, pass string) error {
+func (r *staticRepository) upsertFTPConfigs(cfg *FTPConfig) error {
 	return nil
 }
 
@@ -520,10 +722,13 @@ func readFileTransferConfig(repo Repository, routingNumber string) *Config {
 // AddFileTransferConfigRoutes registers the admin HTTP routes for modifying file-transfer (uploading) configs.
 func AddFileTransferConfigRoutes(logger log.Logger, svc *admin.Server, repo Repository) {
 	svc.AddHandler("/configs/filetransfers", GetConfigs(logger, repo))
+	svc.AddHandler("/configs/filetransfers/reload", reloadConfigs(logger, repo)) // before /{routingNumber}
 	svc.AddHandler("/configs/filetransfers/{routingNumber}", manageFileTransferConfig(logger, repo))
 	svc.AddHandler("/configs/filetransfers/cutoff-times/{routingNumber}", manageCutoffTimeConfig(logger, repo))
 	svc.AddHandler("/configs/filetransfers/ftp/{routingNumber}", manageFTPConfig(logger, repo))
 	svc.AddHandler("/configs/filetransfers/sftp/{routingNumber}", manageSFTPConfig(logger, repo))
+	svc.AddHandler("/configs/filetransfers/sftp/{routingNumber}/fingerprint", getSFTPHostKey(logger, repo))
+	svc.AddHandler("/configs/filetransfers/filename-templates/preview", previewFilenameTemplate(logger))
 }
 
 func getRoutingNumber(r *http.Request) string {
@@ -541,7 +746,7 @@ type adminConfigResponse struct {
 	SFTPConfigs         []*SFTPConfig `json:"SFTPConfigs"`
 }
 
-// GetConfigs returns all configurations (i.e. FTP, cutoff times, file-transfer configs with passwords masked. (e.g. 'p******d')
+// GetConfigs returns all configurations (i.e. FTP, cutoff times, file-transfer configs with passwords and private keys redacted.
 func GetConfigs(logger log.Logger, repo Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -560,7 +765,7 @@ func GetConfigs(logger log.Logger, repo Repository) http.HandlerFunc {
 			moovhttp.Problem(w, err)
 			return
 		} else {
-			resp.FileTransferConfigs = v
+			resp.FileTransferConfigs = maskConfigs(v)
 		}
 		if v, err := repo.GetFTPConfigs(); err != nil {
 			moovhttp.Problem(w, err)
@@ -581,6 +786,31 @@ func GetConfigs(logger log.Logger, repo Repository) http.HandlerFunc {
 	}
 }
 
+// reloadConfigs re-reads the YAML config file paygate was started with. Configs from the database are always
+// current so they can't be reloaded.
+func reloadConfigs(logger log.Logger, repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		static, ok := repo.(*staticRepository)
+		if !ok {
+			moovhttp.Problem(w, errors.New("file transfer configs weren't read from a file"))
+			return
+		}
+		if err := static.reload(); err != nil {
+			logger.Log("file-transfer-configs", "problem reloading configs, keeping existing configs", "error", err, "requestID", moovhttp.GetRequestID(r))
+			moovhttp.Problem(w, err)
+			return
+		}
+		logger.Log("file-transfer-configs", fmt.Sprintf("reloaded configs from %s", static.path), "requestID", moovhttp.GetRequestID(r))
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func maskPassword(s string) string {
 	if utf8.RuneCountInString(s) < 3 {
 		return "**" // too short, we can't mask anything
@@ -591,18 +821,48 @@ func maskPassword(s string) string {
 	}
 }
 
+// redactSecret hides every character of a secret (and its length) from admin responses. Empty secrets stay
+// empty so callers can tell whether one is set.
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "********"
+}
+
+// maskConfigs returns copies of cfgs with their offset account number redacted.
+func maskConfigs(cfgs []*Config) []*Config {
+	out := make([]*Config, len(cfgs))
+	for i := range cfgs {
+		cfg := *cfgs[i]
+		cfg.OffsetAccountNumber = redactSecret(cfg.OffsetAccountNumber)
+		out[i] = &cfg
+	}
+	return out
+}
+
+// maskFTPPasswords returns copies of cfgs with their secrets redacted, so configs held by a Repository aren't modified.
 func maskFTPPasswords(cfgs []*FTPConfig) []*FTPConfig {
+	out := make([]*FTPConfig, len(cfgs))
 	for i := range cfgs {
-		cfgs[i].Password = maskPassword(cfgs[i].Password)
+		cfg := *cfgs[i]
+		cfg.Password = redactSecret(cfg.Password)
+		cfg.ClientPrivateKey = redactSecret(cfg.ClientPrivateKey)
+		out[i] = &cfg
 	}
-	return cfgs
+	return out
 }
 
+// maskSFTPPasswords returns copies of cfgs with their password and client private key redacted.
 func maskSFTPPasswords(cfgs []*SFTPConfig) []*SFTPConfig {
+	out := make([]*SFTPConfig, len(cfgs))
 	for i := range cfgs {
-		cfgs[i].Password = maskPassword(cfgs[i].Password)
+		cfg := *cfgs[i]
+		cfg.Password = redactSecret(cfg.Password)
+		cfg.ClientPrivateKey = redactSecret(cfg.ClientPrivateKey)
+		out[i] = &cfg
 	}
-	return cfgs
+	return out
 }
 
 func manageFileTransferConfig(logger log.Logger, repo Repository) http.HandlerFunc {
@@ -620,6 +880,12 @@ func manageFileTransferConfig(logger log.Logger, repo Repository) http.HandlerFu
 				ReturnPath               string `json:"returnPath,omitempty"`
 				OutboundFilenameTemplate string `json:"outboundFilenameTemplate,omitempty"`
 				AllowedIPs               string `json:"allowedIPs,omitempty"`
+				Mode                     string `json:"mode,omitempty"`
+				BalanceEntries           *bool  `json:"balanceEntries,omitempty"`
+				OffsetRoutingNumber      string `json:"offsetRoutingNumber,omitempty"`
+				OffsetAccountNumber      string `json:"offsetAccountNumber,omitempty"`
+				OffsetAccountType        string `json:"offsetAccountType,omitempty"`
+				ConfirmationFormat       string `json:"confirmationFormat,omitempty"`
 			}
 			var req request
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -633,16 +899,35 @@ func manageFileTransferConfig(logger log.Logger, repo Repository) http.HandlerFu
 					return
 				}
 			}
+			if req.AllowedIPs != "" {
+				if _, err := parseAllowedIPs(req.AllowedIPs); err != nil {
+					moovhttp.Problem(w, err)
+					return
+				}
+			}
 			existing := readFileTransferConfig(repo, routingNumber)
-			err := repo.upsertConfig(&Config{
+			cfg := &Config{
 				RoutingNumber:            routingNumber,
 				InboundPath:              util.Or(req.InboundPath, existing.InboundPath),
 				OutboundPath:             util.Or(req.OutboundPath, existing.OutboundPath),
 				ReturnPath:               util.Or(req.ReturnPath, existing.ReturnPath),
 				OutboundFilenameTemplate: util.Or(req.OutboundFilenameTemplate, existing.OutboundFilenameTemplate),
 				AllowedIPs:               util.Or(req.AllowedIPs, existing.AllowedIPs),
-			})
-			if err != nil {
+				Mode:                     strings.ToLower(util.Or(req.Mode, existing.Mode)),
+				BalanceEntries:           existing.BalanceEntries,
+				OffsetRoutingNumber:      util.Or(req.OffsetRoutingNumber, existing.OffsetRoutingNumber),
+				OffsetAccountNumber:      util.Or(req.OffsetAccountNumber, existing.OffsetAccountNumber),
+				OffsetAccountType:        strings.ToLower(util.Or(req.OffsetAccountType, existing.OffsetAccountType)),
+				ConfirmationFormat:       strings.ToLower(util.Or(req.ConfirmationFormat, existing.ConfirmationFormat)),
+			}
+			if req.BalanceEntries != nil {
+				cfg.BalanceEntries = *req.BalanceEntries
+			}
+			if err := validateConfig(cfg); err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			if err := repo.upsertConfig(cfg); err != nil {
 				moovhttp.Problem(w, err)
 				return
 			}
@@ -720,11 +1005,33 @@ func manageFTPConfig(logger log.Logger, repo Repository) http.HandlerFunc {
 			return
 		}
 		switch r.Method {
+		case "GET":
+			configs, err := repo.GetFTPConfigs()
+			if err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			for _, cfg := range maskFTPPasswords(configs) {
+				if cfg.RoutingNumber == routingNumber {
+					w.Header().Set("Content-Type", "application/json; charset=utf-8")
+					w.WriteHeader(http.StatusOK)
+					json.NewEncoder(w).Encode(cfg)
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+
 		case "PUT":
 			type request struct {
-				Hostname string `json:"hostname"`
-				Username string `json:"username"`
-				Password string `json:"password,omitempty"`
+				Hostname          string `json:"hostname"`
+				Username          string `json:"username"`
+				Password          string `json:"password,omitempty"`
+				TLSMode           string `json:"tlsMode,omitempty"`
+				CACertificates    string `json:"caCertificates,omitempty"`
+				ClientCertificate string `json:"clientCertificate,omitempty"`
+				ClientPrivateKey  string `json:"clientPrivateKey,omitempty"`
+				DisableEPSV       bool   `json:"disableEPSV,omitempty"`
 			}
 			var req request
 			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -735,7 +1042,23 @@ func manageFTPConfig(logger log.Logger, repo Repository) http.HandlerFunc {
 				moovhttp.Problem(w, errors.New("missing hostname, or username"))
 				return
 			}
-			if err := repo.upsertFTPConfigs(routingNumber, req.Hostname, req.Username, req.Password); err != nil {
+			cfg := &FTPConfig{
+				RoutingNumber:     routingNumber,
+				Hostname:          req.Hostname,
+				Username:          req.Username,
+				Password:          req.Password,
+				TLSMode:           strings.ToLower(req.TLSMode),
+				CACertificates:    req.CACertificates,
+				ClientCertificate: req.ClientCertificate,
+				ClientPrivateKey:  req.ClientPrivateKey,
+				DisableEPSV:       req.DisableEPSV,
+			}
+			// Ensure the TLS settings and certificates can be used before saving them
+			if err := cfg.validate(); err != nil {
+				moovhttp.Problem(w, err)
+				return
+			}
+			if err := repo.upsertFTPConfigs(cfg); err != nil {
 				moovhttp.Problem(w, err)
 				return
 			}
@@ -781,6 +1104,12 @@ func manageSFTPConfig(logger log.Logger, repo Repository) http.HandlerFunc {
 				moovhttp.Problem(w, errors.New("missing hostname, or username"))
 				return
 			}
+			if req.HostPublicKey != "" {
+				if _, err := sftpHostKeyCallback(logger, &SFTPConfig{HostPublicKey: req.HostPublicKey}); err != nil {
+					moovhttp.Problem(w, err)
+					return
+				}
+			}
 			if err := repo.upsertSFTPConfigs(routingNumber, req.Hostname, req.Username, req.Password, req.ClientPrivateKey, req.HostPublicKey); err != nil {
 				moovhttp.Problem(w, err)
 				return
@@ -801,3 +1130,45 @@ func manageSFTPConfig(logger log.Logger, repo Repository) http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// getSFTPHostKey connects to the SFTP server of a routing number and displays its current host key
+// so it can be verified and added to the config (trust on first use).
+func getSFTPHostKey(logger log.Logger, repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+		routingNumber := getRoutingNumber(r)
+		if routingNumber == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		configs, err := repo.GetSFTPConfigs()
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		var sftpConf *SFTPConfig
+		for i := range configs {
+			if configs[i].RoutingNumber == routingNumber {
+				sftpConf = configs[i]
+			}
+		}
+		if sftpConf == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		hostKey, err := fetchSFTPHostKey(logger, readFileTransferConfig(repo, routingNumber), sftpConf)
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		logger.Log("file-transfer-configs", fmt.Sprintf("read SFTP host key %s for routingNumber=%s (trusted=%v)", hostKey.FingerprintSHA256, routingNumber, hostKey.Trusted), "requestID", moovhttp.GetRequestID(r))
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(hostKey)
+	}
+}
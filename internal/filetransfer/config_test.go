@@ -10,6 +10,8 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -18,6 +20,8 @@ import (
 	moovadmin "github.com/moov-io/base/admin"
 	"github.com/moov-io/paygate/admin"
 	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/secrets"
 
 	"github.com/go-kit/kit/log"
 )
@@ -87,7 +91,7 @@ func (r *mockRepository) GetFTPConfigs() ([]*FTPConfig, error) {
 	return r.ftpConfigs, nil
 }
 
-func (r *mockRepository) upsertFTPConfigs(routingNumber, host, user, pass string) error {
+func (r *mockRepository) upsertFTPConfigs(cfg *FTPConfig) error {
 	return r.err
 }
 
@@ -134,7 +138,7 @@ func TestSQLiteRepository__getCounts(t *testing.T) {
 
 	// If we read at least one row from each config table we need to make sure NewRepository
 	// returns sqlRepository
-	r := NewRepository("", repo.db, "")
+	r := NewRepository("", repo.db, "", nil)
 	if _, ok := r.(*sqlRepository); !ok {
 		t.Errorf("got %T", r)
 	}
@@ -268,7 +272,7 @@ func TestSQLiteRepository__GetConfigs(t *testing.T) {
 func TestMySQLConfigRepository(t *testing.T) {
 	testdb := database.CreateTestMySQLDB(t)
 
-	repo := NewRepository("", testdb.DB, "mysql")
+	repo := NewRepository("", testdb.DB, "mysql", nil)
 	if _, ok := repo.(*sqlRepository); !ok {
 		t.Fatalf("got %T", repo)
 	}
@@ -314,20 +318,23 @@ func TestFileTransferConfigs__maskPassword(t *testing.T) {
 		t.Errorf("got %q", v)
 	}
 
-	out := maskFTPPasswords([]*FTPConfig{{Password: "password"}})
+	out := maskFTPPasswords([]*FTPConfig{{Password: "password", ClientPrivateKey: "key"}})
 	if len(out) != 1 {
 		t.Errorf("got %d ftpConfigs: %v", len(out), out)
 	}
-	if out[0].Password != "p******d" {
-		t.Errorf("got %q", out[0].Password)
+	if out[0].Password != "********" || out[0].ClientPrivateKey != "********" {
+		t.Errorf("got %#v", out[0])
 	}
 
-	out2 := maskSFTPPasswords([]*SFTPConfig{{Password: "drowssap"}})
+	out2 := maskSFTPPasswords([]*SFTPConfig{{Password: "drowssap", ClientPrivateKey: "==secret=="}})
 	if len(out2) != 1 {
 		t.Errorf("got %d sftpConfigs: %v", len(out2), out2)
 	}
-	if out2[0].Password != "d******p" {
-		t.Errorf("got %q", out2[0].Password)
+	if out2[0].Password != "********" || out2[0].ClientPrivateKey != "********" {
+		t.Errorf("got %#v", out2[0])
+	}
+	if out3 := maskSFTPPasswords([]*SFTPConfig{{}}); out3[0].Password != "" {
+		t.Errorf("got %q", out3[0].Password)
 	}
 }
 
@@ -336,7 +343,7 @@ func TestFileTransferConfigsHTTP__GetConfigs(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
@@ -367,7 +374,7 @@ func TestFileTransferConfigsHTTP__GetConfigs(t *testing.T) {
 }
 
 func TestStaticRepository(t *testing.T) {
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	ftpConfigs, err := repo.GetFTPConfigs()
 	if err != nil {
 		t.Fatal(err)
@@ -413,7 +420,7 @@ func TestStaticRepository(t *testing.T) {
 	if err := repo.deleteCutoffTime(""); err != nil {
 		t.Error(err)
 	}
-	if err := repo.upsertFTPConfigs("", "", "", ""); err != nil {
+	if err := repo.upsertFTPConfigs(&FTPConfig{}); err != nil {
 		t.Error(err)
 	}
 	if err := repo.deleteFTPConfig(""); err != nil {
@@ -459,12 +466,12 @@ func TestConfigs__GetSFTPConfigs(t *testing.T) {
 	// SQLite tests
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
-	check(t, &testSQLRepository{&sqlRepository{sqliteDB.DB}, sqliteDB})
+	check(t, &testSQLRepository{&sqlRepository{db: sqliteDB.DB}, sqliteDB})
 
 	// MySQL tests
 	mysqlDB := database.CreateTestMySQLDB(t)
 	defer mysqlDB.Close()
-	check(t, &testSQLRepository{sqlRepository: &sqlRepository{mysqlDB.DB}})
+	check(t, &testSQLRepository{sqlRepository: &sqlRepository{db: mysqlDB.DB}})
 }
 
 func testifySqlRepo(repo *sqlRepository) *testSQLRepository {
@@ -523,12 +530,12 @@ func TestConfigs__UpsertDeleteCutoffTime(t *testing.T) {
 	// SQLite tests
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
-	check(t, &sqlRepository{sqliteDB.DB})
+	check(t, &sqlRepository{db: sqliteDB.DB})
 
 	// MySQL tests
 	mysqlDB := database.CreateTestMySQLDB(t)
 	defer mysqlDB.Close()
-	check(t, &sqlRepository{mysqlDB.DB})
+	check(t, &sqlRepository{db: mysqlDB.DB})
 }
 
 func TestConfigs__UpsertDeleteFTPConfigs(t *testing.T) {
@@ -544,7 +551,7 @@ func TestConfigs__UpsertDeleteFTPConfigs(t *testing.T) {
 
 		// upsert (update or insert)
 		f1 := ftpConfigs[0]
-		if err := repo.upsertFTPConfigs(f1.RoutingNumber, "ftp-sbx.bank.com", f1.Username, ""); err != nil {
+		if err := repo.upsertFTPConfigs(&FTPConfig{RoutingNumber: f1.RoutingNumber, Hostname: "ftp-sbx.bank.com", Username: f1.Username}); err != nil {
 			t.Fatal(err)
 		}
 		ftpConfigs, err = repo.GetFTPConfigs()
@@ -561,7 +568,7 @@ func TestConfigs__UpsertDeleteFTPConfigs(t *testing.T) {
 		}
 
 		// upsert password
-		if err := repo.upsertFTPConfigs(f1.RoutingNumber, f2.Hostname, f1.Username, "updated-password"); err != nil {
+		if err := repo.upsertFTPConfigs(&FTPConfig{RoutingNumber: f1.RoutingNumber, Hostname: f2.Hostname, Username: f1.Username, Password: "updated-password"}); err != nil {
 			t.Fatal(err)
 		}
 		ftpConfigs, err = repo.GetFTPConfigs()
@@ -573,6 +580,33 @@ func TestConfigs__UpsertDeleteFTPConfigs(t *testing.T) {
 			t.Errorf("f2.Password=%s f3.Password=%s", f2.Password, f3.Password)
 		}
 
+		// upsert TLS settings with a client certificate
+		f3.TLSMode = ftpTLSExplicit
+		f3.CACertificates = "ca-bundle"
+		f3.ClientCertificate = "client-cert"
+		f3.ClientPrivateKey = "client-key"
+		f3.DisableEPSV = true
+		if err := repo.upsertFTPConfigs(f3); err != nil {
+			t.Fatal(err)
+		}
+		var clientKey string
+		if err := repo.db.QueryRow(`select client_private_key from ftp_configs where routing_number = ?`, f1.RoutingNumber).Scan(&clientKey); err != nil || clientKey == "client-key" {
+			t.Errorf("client private key isn't encrypted: %q error=%v", clientKey, err)
+		}
+		f3.ClientCertificate, f3.ClientPrivateKey = "", "" // keep the existing certificate
+		if err := repo.upsertFTPConfigs(f3); err != nil {
+			t.Fatal(err)
+		}
+		ftpConfigs, err = repo.GetFTPConfigs()
+		if err != nil || len(ftpConfigs) != 1 {
+			t.Fatalf("got ftp configs: %v error=%v", ftpConfigs, err)
+		}
+		if f4 := ftpConfigs[0]; f4.TLSMode != ftpTLSExplicit || f4.CACertificates != "ca-bundle" || !f4.DisableEPSV {
+			t.Errorf("unexpected TLS settings: %#v", f4)
+		} else if f4.ClientCertificate != "client-cert" || f4.ClientPrivateKey != "client-key" {
+			t.Errorf("unexpected client certificate: %#v", f4)
+		}
+
 		// delete
 		if err := repo.deleteFTPConfig(f1.RoutingNumber); err != nil {
 			t.Fatal(err)
@@ -586,12 +620,12 @@ func TestConfigs__UpsertDeleteFTPConfigs(t *testing.T) {
 	// SQLite tests
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
-	check(t, &sqlRepository{sqliteDB.DB})
+	check(t, &sqlRepository{db: sqliteDB.DB, keeper: secrets.TestStringKeeper(t)})
 
 	// MySQL tests
 	mysqlDB := database.CreateTestMySQLDB(t)
 	defer mysqlDB.Close()
-	check(t, &sqlRepository{mysqlDB.DB})
+	check(t, &sqlRepository{db: mysqlDB.DB, keeper: secrets.TestStringKeeper(t)})
 }
 
 func TestConfigs__UpsertDeleteSFTPConfigs(t *testing.T) {
@@ -653,12 +687,106 @@ func TestConfigs__UpsertDeleteSFTPConfigs(t *testing.T) {
 	// SQLite tests
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
-	check(t, &sqlRepository{sqliteDB.DB})
+	check(t, &sqlRepository{db: sqliteDB.DB, keeper: secrets.TestStringKeeper(t)})
 
 	// MySQL tests
 	mysqlDB := database.CreateTestMySQLDB(t)
 	defer mysqlDB.Close()
-	check(t, &sqlRepository{mysqlDB.DB})
+	check(t, &sqlRepository{db: mysqlDB.DB, keeper: secrets.TestStringKeeper(t)})
+}
+
+func TestConfigs__EncryptStoredSecrets(t *testing.T) {
+	check := func(t *testing.T, repo *testSQLRepository) {
+		writeFTPConfig(t, repo)
+		writeSFTPConfig(t, repo)
+
+		if err := EncryptStoredSecrets(log.NewNopLogger(), repo.sqlRepository); err != nil {
+			t.Fatal(err)
+		}
+
+		// plaintext secrets are removed
+		var ftpPass, sftpPass, sftpKey string
+		if err := repo.db.QueryRow(`select password from ftp_configs where routing_number = '123456789';`).Scan(&ftpPass); err != nil || ftpPass != "" {
+			t.Errorf("ftp password=%q error=%v", ftpPass, err)
+		}
+		if err := repo.db.QueryRow(`select password, client_private_key from sftp_configs where routing_number = '123456789';`).Scan(&sftpPass, &sftpKey); err != nil || sftpKey != "" {
+			t.Errorf("sftp password=%q client_private_key=%q error=%v", sftpPass, sftpKey, err)
+		}
+
+		// a second run has nothing to encrypt
+		if err := EncryptStoredSecrets(log.NewNopLogger(), repo.sqlRepository); err != nil {
+			t.Fatal(err)
+		}
+
+		ftpConfigs, err := repo.GetFTPConfigs()
+		if err != nil || len(ftpConfigs) != 1 || ftpConfigs[0].Password != "secret" {
+			t.Errorf("ftp configs: %#v error=%v", ftpConfigs, err)
+		}
+		sftpConfigs, err := repo.GetSFTPConfigs()
+		if err != nil || len(sftpConfigs) != 1 || sftpConfigs[0].ClientPrivateKey != "==secret==" {
+			t.Errorf("sftp configs: %#v error=%v", sftpConfigs, err)
+		}
+	}
+
+	// SQLite tests
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+	check(t, &testSQLRepository{&sqlRepository{db: sqliteDB.DB, keeper: secrets.TestStringKeeper(t)}, sqliteDB})
+
+	// MySQL tests
+	mysqlDB := database.CreateTestMySQLDB(t)
+	defer mysqlDB.Close()
+	check(t, &testSQLRepository{sqlRepository: &sqlRepository{db: mysqlDB.DB, keeper: secrets.TestStringKeeper(t)}})
+
+	// configs from a file aren't changed
+	if err := EncryptStoredSecrets(log.NewNopLogger(), NewRepository("", nil, "", nil)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigs__OffsetAccount(t *testing.T) {
+	check := func(t *testing.T, repo *testSQLRepository) {
+		err := repo.upsertConfig(&Config{
+			RoutingNumber:       "123456789",
+			BalanceEntries:      true,
+			OffsetRoutingNumber: "121042882",
+			OffsetAccountNumber: "987654",
+			OffsetAccountType:   "checking",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the account number is encrypted
+		var encrypted string
+		if err := repo.db.QueryRow(`select offset_account_number_encrypted from file_transfer_configs where routing_number = '123456789';`).Scan(&encrypted); err != nil {
+			t.Fatal(err)
+		}
+		if encrypted == "" || encrypted == "987654" {
+			t.Errorf("offset_account_number_encrypted=%q", encrypted)
+		}
+
+		configs, err := repo.GetConfigs()
+		if err != nil || len(configs) != 1 {
+			t.Fatalf("configs=%#v error=%v", configs, err)
+		}
+		if acct := configs[0].offsetAccount(); acct == nil || acct.accountNumber != "987654" || acct.routingNumber != "121042882" || acct.accountType != model.Checking {
+			t.Errorf("unexpected offset account: %#v", acct)
+		}
+		if masked := maskConfigs(configs); masked[0].OffsetAccountNumber != "********" || configs[0].OffsetAccountNumber != "987654" {
+			t.Errorf("masked=%q", masked[0].OffsetAccountNumber)
+		}
+	}
+
+	// SQLite tests
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+	check(t, &testSQLRepository{&sqlRepository{db: sqliteDB.DB, keeper: secrets.TestStringKeeper(t)}, sqliteDB})
+
+	// MySQL tests
+	mysqlDB := database.CreateTestMySQLDB(t)
+	defer mysqlDB.Close()
+	check(t, &testSQLRepository{sqlRepository: &sqlRepository{db: mysqlDB.DB, keeper: secrets.TestStringKeeper(t)}})
 }
 
 func TestConfigsHTTP_UpsertCutoff(t *testing.T) {
@@ -666,7 +794,7 @@ func TestConfigsHTTP_UpsertCutoff(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	body := strings.NewReader(`{"cutoff": 1700, "location": "America/New_York"}`)
@@ -720,7 +848,7 @@ func TestConfigsHTTP_DeleteCutoff(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	body := strings.NewReader(`{"cutoff": 1700, "location": "America/New_York"}`)
@@ -756,7 +884,7 @@ func TestConfigsHTTP__CutoffErrors(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	req, _ := http.NewRequest("POST", "http://"+svc.BindAddr()+"/configs/filetransfers/cutoff-times/987654320", nil)
@@ -862,6 +990,82 @@ func TestConfigsHTTP_UpsertOutboundFilenameTemplate(t *testing.T) {
 	t.Error("never found *Config")
 }
 
+func TestConfigsHTTP_UpsertInvalidAllowedIPs(t *testing.T) {
+	svc := moovadmin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+
+	repo := createTestSQLiteRepository(t)
+	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
+
+	body := strings.NewReader(`{"inboundPath": "in/", "allowedIPs": "10.0.0.0/8,not-an-ip"}`)
+	req, err := http.NewRequest("PUT", "http://"+svc.BindAddr()+"/configs/filetransfers/987654320", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		t.Errorf("bogus HTTP status: %d: %s", resp.StatusCode, string(bs))
+	}
+}
+
+func TestConfigsHTTP_UpsertMode(t *testing.T) {
+	svc := moovadmin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+
+	repo := createTestSQLiteRepository(t)
+	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
+
+	put := func(body string) int {
+		req, err := http.NewRequest("PUT", "http://"+svc.BindAddr()+"/configs/filetransfers/987654320", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := put(`{"inboundPath": "in/", "mode": "shadow"}`); code != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", code)
+	}
+	if code := put(`{"inboundPath": "in/", "mode": "Dry-Run"}`); code != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", code)
+	}
+	configs, err := repo.GetConfigs()
+	if err != nil || len(configs) != 1 {
+		t.Fatalf("configs=%#v error=%v", configs, err)
+	}
+	if configs[0].Mode != ModeDryRun || !configs[0].dryRun() {
+		t.Errorf("mode=%q", configs[0].Mode)
+	}
+
+	// other updates keep the mode
+	if code := put(`{"outboundPath": "out/"}`); code != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", code)
+	}
+	if configs, _ := repo.GetConfigs(); configs[0].Mode != ModeDryRun {
+		t.Errorf("mode=%q", configs[0].Mode)
+	}
+	if code := put(`{"mode": "live"}`); code != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", code)
+	}
+	if configs, _ := repo.GetConfigs(); configs[0].dryRun() {
+		t.Errorf("mode=%q", configs[0].Mode)
+	}
+}
+
 func TestConfigsHTTP__FileTransferConfigError(t *testing.T) {
 	svc := moovadmin.NewServer(":0")
 	go svc.Listen()
@@ -948,7 +1152,7 @@ func TestConfigsHTTP_UpsertFTP(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	// Update the hostname and username
@@ -999,12 +1203,86 @@ func TestConfigsHTTP_UpsertFTP(t *testing.T) {
 	}
 }
 
+func TestConfigsHTTP_FTPTLS(t *testing.T) {
+	svc := moovadmin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	repo := &sqlRepository{db: db.DB, keeper: secrets.TestStringKeeper(t)}
+	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
+
+	// unknown tlsMode
+	body := strings.NewReader(`{"hostname": "ftp-sbx.bank.com", "username": "moovtest", "tlsMode": "other"}`)
+	req, _ := http.NewRequest("PUT", "http://"+svc.BindAddr()+"/configs/filetransfers/ftp/987654320", body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	// client certificate without a private key
+	body = strings.NewReader(`{"hostname": "ftp-sbx.bank.com", "username": "moovtest", "tlsMode": "explicit", "clientCertificate": "cert"}`)
+	req, _ = http.NewRequest("PUT", "http://"+svc.BindAddr()+"/configs/filetransfers/ftp/987654320", body)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	// config not found
+	resp, err = http.Get("http://" + svc.BindAddr() + "/configs/filetransfers/ftp/987654320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	body = strings.NewReader(`{"hostname": "ftp-sbx.bank.com", "username": "moovtest", "password": "secret", "tlsMode": "explicit", "disableEPSV": true}`)
+	req, _ = http.NewRequest("PUT", "http://"+svc.BindAddr()+"/configs/filetransfers/ftp/987654320", body)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("bogus HTTP status: %d: %s", resp.StatusCode, string(bs))
+	}
+
+	resp, err = http.Get("http://" + svc.BindAddr() + "/configs/filetransfers/ftp/987654320")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var cfg FTPConfig
+	if err := json.NewDecoder(resp.Body).Decode(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Password != "********" {
+		t.Errorf("password wasn't redacted: %q", cfg.Password)
+	}
+	if cfg.TLSMode != ftpTLSExplicit || !cfg.DisableEPSV {
+		t.Errorf("unexpected config: %#v", cfg)
+	}
+}
+
 func TestConfigsHTTP_DeleteFTP(t *testing.T) {
 	svc := moovadmin.NewServer(":0")
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	// write
@@ -1044,7 +1322,7 @@ func TestConfigsHTTP__FTPError(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	req, _ := http.NewRequest("POST", "http://"+svc.BindAddr()+"/configs/filetransfers/ftp/987654320", nil)
@@ -1067,7 +1345,7 @@ func TestConfigsHTTP_UpsertSFTP(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	// Update the hostname and username
@@ -1129,7 +1407,7 @@ func TestConfigsHTTP_DeleteSFTP(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	// write record
@@ -1172,7 +1450,7 @@ func TestConfigsHTTP_SFTPError(t *testing.T) {
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	// write record
@@ -1214,12 +1492,74 @@ func TestConfig__readConfigFile(t *testing.T) {
 	}
 }
 
+func TestConfigHTTP__reload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reload-configs")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	bs, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", "configs", "routing-good.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := moovadmin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
+
+	reload := func(t *testing.T, contents string) int {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post("http://"+svc.BindAddr()+"/configs/filetransfers/reload", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// an invalid template keeps the existing configs
+	invalid := strings.Replace(string(bs), `returnPath: "ach/returnPath/"`, `returnPath: "ach/returnPath/"
+      outboundFilenameTemplate: "{{ .Missing }}"`, 1)
+	if code := reload(t, invalid); code != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", code)
+	}
+	if cfgs, _ := repo.GetConfigs(); len(cfgs) != 1 || cfgs[0].OutboundFilenameTemplate != "" {
+		t.Errorf("unexpected configs: %#v", cfgs)
+	}
+
+	updated := strings.Replace(string(bs), `hostname: "ftp.bank.com"`, `hostname: "ftp2.bank.com"`, 1)
+	if code := reload(t, updated); code != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", code)
+	}
+	if cfgs, _ := repo.GetFTPConfigs(); len(cfgs) != 1 || cfgs[0].Hostname != "ftp2.bank.com" {
+		t.Errorf("unexpected FTP configs: %#v", cfgs)
+	}
+
+	// configs from a database can't be reloaded
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/configs/filetransfers/reload", nil)
+	reloadConfigs(log.NewNopLogger(), &mockRepository{})(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", w.Code)
+	}
+}
+
 func TestConfigHTTP__adminRead(t *testing.T) {
 	svc := moovadmin.NewServer(":0")
 	go svc.Listen()
 	defer svc.Shutdown()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
 
 	conf := admin.NewConfiguration()
@@ -1249,11 +1589,11 @@ func TestConfigHTTP_adminUpdateFileTransferConfig(t *testing.T) {
 	if testing.Short() {
 		db := database.CreateTestSqliteDB(t)
 		defer db.Close()
-		repo = NewRepository("", db.DB, "sqlite")
+		repo = NewRepository("", db.DB, "sqlite", nil)
 	} else {
 		db := database.CreateTestMySQLDB(t)
 		defer db.Close()
-		repo = NewRepository("", db.DB, "mysql")
+		repo = NewRepository("", db.DB, "mysql", nil)
 	}
 
 	if err := repo.upsertConfig(&Config{
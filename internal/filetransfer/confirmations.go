@@ -0,0 +1,325 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moov-io/ach"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// confirmationSLA is how long after uploading a file we expect its ODFI to confirm it. Only routing numbers
+	// with a ConfirmationFormat are expected to send confirmations.
+	confirmationSLA = func() time.Duration {
+		if v := os.Getenv("ACH_FILE_CONFIRMATION_SLA"); v != "" {
+			if dur, _ := time.ParseDuration(v); dur > 0 {
+				return dur
+			}
+		}
+		return 4 * time.Hour
+	}()
+
+	filesConfirmed = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_files_confirmed",
+		Help: "Counter of uploaded ACH files confirmed by their ODFI",
+	}, []string{"destination", "origin"})
+
+	unmatchedConfirmations = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_file_confirmations_unmatched",
+		Help: "Counter of ODFI confirmations which didn't match an uploaded ACH file",
+	}, []string{"routing_number"})
+
+	missedConfirmations = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_file_confirmations_missed",
+		Help: "Counter of uploaded ACH files not confirmed by their ODFI within ACH_FILE_CONFIRMATION_SLA",
+	}, []string{"destination", "origin"})
+)
+
+// Confirmation is an ODFI's acknowledgement that it received one of our outbound files. ODFIs identify files
+// differently, so only the non-empty fields are compared against what we've uploaded.
+type Confirmation struct {
+	// Filename is the name the file was uploaded as
+	Filename string
+
+	// FileCreationDate (YYMMDD) and FileIDModifier are from the file's header
+	FileCreationDate string
+	FileIDModifier   string
+
+	// EntryCount is the number of entries (not including addenda) in the file. The totals, in cents,
+	// are only compared when EntryCount is set.
+	EntryCount  int
+	TotalDebit  int
+	TotalCredit int
+
+	// TraceNumbers are entries of the file which were acknowledged, such as from ACK and ATX entries.
+	TraceNumbers []string
+}
+
+// ConfirmationParser reads the confirmation files of an ODFI. Parse should return no Confirmations, and no error,
+// for files which aren't confirmations as every inbound file is offered to the parser.
+type ConfirmationParser interface {
+	Parse(contents []byte) ([]*Confirmation, error)
+}
+
+// ConfirmationFormatNACHA reads ACK and ATX entries in inbound files as confirmations of the entries they acknowledge.
+const ConfirmationFormatNACHA = "nacha"
+
+var (
+	confirmationParsers   = make(map[string]ConfirmationParser)
+	confirmationParsersMu sync.RWMutex
+)
+
+func init() {
+	RegisterConfirmationParser(ConfirmationFormatNACHA, &nachaConfirmationParser{})
+}
+
+// RegisterConfirmationParser makes parser available as the ConfirmationFormat of a file transfer config.
+// Bank-specific formats are registered under their own names, which are case-insensitive.
+func RegisterConfirmationParser(format string, parser ConfirmationParser) {
+	confirmationParsersMu.Lock()
+	defer confirmationParsersMu.Unlock()
+
+	confirmationParsers[strings.ToLower(format)] = parser
+}
+
+func getConfirmationParser(format string) ConfirmationParser {
+	confirmationParsersMu.RLock()
+	defer confirmationParsersMu.RUnlock()
+
+	return confirmationParsers[strings.ToLower(format)]
+}
+
+// validateConfirmationFormat returns an error if format isn't registered. An empty format means we don't
+// expect confirmations.
+func validateConfirmationFormat(format string) error {
+	if format == "" || getConfirmationParser(format) != nil {
+		return nil
+	}
+	return fmt.Errorf("unknown confirmation format %q", format)
+}
+
+// isAcknowledgement returns true for batches of ACK and ATX entries
+func isAcknowledgement(bh *ach.BatchHeader) bool {
+	return bh.StandardEntryClassCode == ach.ACK || bh.StandardEntryClassCode == ach.ATX
+}
+
+type nachaConfirmationParser struct{}
+
+// Parse returns a Confirmation for each ACK or ATX batch in contents. The original entry's trace number
+// is in the IdentificationNumber of an acknowledgement.
+func (p *nachaConfirmationParser) Parse(contents []byte) ([]*Confirmation, error) {
+	file, err := parseACHFile(bytes.NewReader(contents))
+	if err != nil {
+		return nil, nil // not an ACH file
+	}
+	var out []*Confirmation
+	for i := range file.Batches {
+		if !isAcknowledgement(file.Batches[i].GetHeader()) {
+			continue
+		}
+		conf := &Confirmation{}
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			if trace := strings.TrimSpace(entries[j].IdentificationNumber); trace != "" {
+				conf.TraceNumbers = append(conf.TraceNumbers, trace)
+			}
+		}
+		if len(conf.TraceNumbers) > 0 {
+			out = append(out, conf)
+		}
+	}
+	return out, nil
+}
+
+// processConfirmationFiles reads each inbound file in dir with the ConfirmationParser of cfg and marks the
+// outbound files they confirm. Confirmation reports which aren't ACH files are removed so they're not
+// processed as inbound files.
+func (c *Controller) processConfirmationFiles(cfg *Config, dir string) error {
+	if c.outboundFiles == nil || cfg == nil || cfg.ConfirmationFormat == "" {
+		return nil
+	}
+	parser := getConfirmationParser(cfg.ConfirmationFormat)
+	if parser == nil {
+		return fmt.Errorf("unknown confirmation format %q for %s", cfg.ConfirmationFormat, cfg.RoutingNumber)
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if (err != nil && err != filepath.SkipDir) || info.IsDir() {
+			return nil // Ignore SkipDir and directories
+		}
+		contents, err := readFile(path, c.keeper)
+		if err != nil {
+			c.logger.Log("confirmations", fmt.Sprintf("problem reading inbound file %s", path), "error", err)
+			return nil
+		}
+		confirmations, err := parser.Parse(contents)
+		if err != nil {
+			c.logger.Log("confirmations", fmt.Sprintf("problem parsing %s confirmation %s", cfg.ConfirmationFormat, info.Name()), "error", err)
+			return nil
+		}
+		for i := range confirmations {
+			if err := c.confirmOutboundFile(cfg.RoutingNumber, confirmations[i]); err != nil {
+				c.logger.Log("confirmations", fmt.Sprintf("problem with confirmation in %s", info.Name()), "error", err)
+			}
+		}
+		if len(confirmations) > 0 {
+			if _, err := parseACHFile(bytes.NewReader(contents)); err != nil {
+				return os.Remove(path)
+			}
+		}
+		return nil
+	})
+}
+
+// confirmOutboundFile marks the oldest unconfirmed outbound file matching conf as confirmed. Only files sent
+// to or from routingNumber, the ODFI which sent conf, are considered.
+func (c *Controller) confirmOutboundFile(routingNumber string, conf *Confirmation) error {
+	files, err := c.outboundFiles.getUnconfirmedFiles()
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		if files[i].Destination != routingNumber && files[i].Origin != routingNumber {
+			continue
+		}
+		if !c.confirmationMatches(conf, files[i]) {
+			continue
+		}
+		if err := c.outboundFiles.markConfirmed(files[i].Filename); err != nil {
+			return err
+		}
+		c.logger.Log("confirmations", fmt.Sprintf("%s confirmed upload of %s", routingNumber, files[i].UploadedFilename))
+		filesConfirmed.With("destination", files[i].Destination, "origin", files[i].Origin).Add(1)
+		return nil
+	}
+	c.logger.Log("confirmations", fmt.Sprintf("WARNING: confirmation from %s didn't match any uploaded file", routingNumber),
+		"filename", conf.Filename, "entryCount", conf.EntryCount, "traceNumbers", len(conf.TraceNumbers))
+	unmatchedConfirmations.With("routing_number", routingNumber).Add(1)
+	return nil
+}
+
+// confirmationMatches returns true if every field set on conf matches file. Confirmations with trace numbers
+// match when any of them is an entry in the uploaded file.
+func (c *Controller) confirmationMatches(conf *Confirmation, file *outboundFile) bool {
+	matched := false
+	if conf.Filename != "" {
+		if !strings.EqualFold(filepath.Base(conf.Filename), file.UploadedFilename) {
+			return false
+		}
+		matched = true
+	}
+	if conf.FileCreationDate != "" {
+		if conf.FileCreationDate != file.FileCreationDate {
+			return false
+		}
+		matched = true
+	}
+	if conf.FileIDModifier != "" {
+		if !strings.EqualFold(conf.FileIDModifier, file.FileIDModifier) {
+			return false
+		}
+		matched = true
+	}
+	if conf.EntryCount > 0 {
+		if conf.EntryCount != file.EntryCount || conf.TotalDebit != file.TotalDebit || conf.TotalCredit != file.TotalCredit {
+			return false
+		}
+		matched = true
+	}
+	if len(conf.TraceNumbers) > 0 {
+		if !c.uploadedFileHasTraceNumber(file, conf.TraceNumbers) {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// uploadedFileHasTraceNumber reads our copy of an uploaded file for any entry with one of traceNumbers.
+func (c *Controller) uploadedFileHasTraceNumber(file *outboundFile, traceNumbers []string) bool {
+	f, err := parseACHFilepath(filepath.Join(c.rootDir, "merged", file.Filename+".uploaded"), c.keeper)
+	if err != nil {
+		return false
+	}
+	for i := range f.Batches {
+		entries := f.Batches[i].GetEntries()
+		for j := range entries {
+			for k := range traceNumbers {
+				if entries[j].TraceNumberField() == traceNumbers[k] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// recordOutboundFile saves an uploaded file so its confirmation can be matched.
+func (c *Controller) recordOutboundFile(f *achFile, uploadedFilename string) {
+	if c.outboundFiles == nil {
+		return
+	}
+	file := &outboundFile{
+		Filename:         filepath.Base(f.filepath),
+		UploadedFilename: uploadedFilename,
+		Destination:      f.Header.ImmediateDestination,
+		Origin:           f.Header.ImmediateOrigin,
+		FileCreationDate: f.Header.FileCreationDate,
+		FileIDModifier:   f.Header.FileIDModifier,
+		TotalDebit:       f.Control.TotalDebitEntryDollarAmountInFile,
+		TotalCredit:      f.Control.TotalCreditEntryDollarAmountInFile,
+		UploadedAt:       time.Now(),
+	}
+	for i := range f.Batches {
+		file.EntryCount += len(f.Batches[i].GetEntries())
+	}
+	if err := c.outboundFiles.recordUpload(file); err != nil {
+		c.logger.Log("confirmations", fmt.Sprintf("problem recording upload of %s", file.Filename), "error", err)
+	}
+}
+
+// alertUnconfirmedFiles raises an alert for each uploaded file its ODFI hasn't confirmed within confirmationSLA.
+// Files are only alerted on once.
+func (c *Controller) alertUnconfirmedFiles() error {
+	if c.outboundFiles == nil {
+		return nil
+	}
+	files, err := c.outboundFiles.getUnconfirmedFiles()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-1 * confirmationSLA)
+	for i := range files {
+		if files[i].SLAMissedAt != nil || files[i].UploadedAt.After(cutoff) {
+			continue
+		}
+		if cfg := c.findFileTransferConfig(files[i].Origin); cfg == nil || cfg.ConfirmationFormat == "" {
+			continue // this ODFI doesn't send confirmations
+		}
+		if err := c.outboundFiles.markSLAMissed(files[i].Filename); err != nil {
+			return err
+		}
+		missedConfirmations.With("destination", files[i].Destination, "origin", files[i].Origin).Add(1)
+		c.raiseAlert(&Alert{
+			Kind: AlertConfirmationMissed,
+			Message: fmt.Sprintf("%s uploaded as %s at %v hasn't been confirmed within %v",
+				files[i].Filename, files[i].UploadedFilename, files[i].UploadedAt.Format(time.RFC3339), confirmationSLA),
+			Filename:    files[i].Filename,
+			Destination: files[i].Destination,
+			Origin:      files[i].Origin,
+			Deadline:    files[i].UploadedAt.Add(confirmationSLA),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/database"
+
+	"github.com/go-kit/kit/log"
+)
+
+// ackFile returns the contents of an ACH file acknowledging the entry with traceNumber
+func ackFile(t *testing.T, traceNumber string) []byte {
+	t.Helper()
+
+	bh := ach.NewBatchHeader()
+	bh.ServiceClassCode = ach.CreditsOnly
+	bh.CompanyName = "Receiver Bank"
+	bh.CompanyIdentification = "231380104"
+	bh.StandardEntryClassCode = ach.ACK
+	bh.CompanyEntryDescription = "ACK"
+	bh.EffectiveEntryDate = time.Now().Format("060102")
+	bh.ODFIIdentification = "23138010"
+
+	ed := ach.NewEntryDetail()
+	ed.TransactionCode = ach.CheckingZeroDollarRemittanceCredit
+	ed.SetRDFI("076401251")
+	ed.DFIAccountNumber = "12345"
+	ed.IdentificationNumber = traceNumber
+	ed.IndividualName = "Our Company"
+	ed.SetTraceNumber(bh.ODFIIdentification, 1)
+
+	batch, err := ach.NewBatch(bh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.AddEntry(ed)
+	if err := batch.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	file := ach.NewFile()
+	file.Header = ach.NewFileHeader()
+	file.Header.ImmediateDestination = "076401251"
+	file.Header.ImmediateOrigin = "231380104"
+	file.Header.FileCreationDate = time.Now().Format("060102")
+	file.Header.ImmediateDestinationName = "Our Bank"
+	file.Header.ImmediateOriginName = "Receiver Bank"
+	file.AddBatch(batch)
+	if err := file.Create(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ach.NewWriter(&buf).Write(file); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type testConfirmationParser struct{}
+
+// Parse reads reports like "RECEIVED FILE <filename> ENTRIES <count>"
+func (p *testConfirmationParser) Parse(contents []byte) ([]*Confirmation, error) {
+	fields := strings.Fields(string(contents))
+	if len(fields) != 5 || fields[0] != "RECEIVED" {
+		return nil, nil
+	}
+	return []*Confirmation{{Filename: fields[2]}}, nil
+}
+
+func setupConfirmationController(t *testing.T) (*Controller, *achFile, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "confirmations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := database.CreateTestSqliteDB(t)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := &Controller{
+		rootDir: dir,
+		repo: &mockRepository{
+			configs: []*Config{
+				{RoutingNumber: file.Header.ImmediateOrigin, ConfirmationFormat: ConfirmationFormatNACHA},
+			},
+		},
+		outboundFiles: &sqlOutboundFileRepository{db: db.DB},
+		logger:        log.NewNopLogger(),
+	}
+
+	// upload a file
+	if err := os.MkdirAll(filepath.Join(dir, "merged"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	uploaded := &achFile{File: file, filepath: filepath.Join(dir, "merged", "20200101-076401251-1.ach")}
+	if err := uploaded.write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(uploaded.filepath, uploaded.filepath+".uploaded"); err != nil {
+		t.Fatal(err)
+	}
+	controller.recordOutboundFile(uploaded, "PAYGATE-1.ACH")
+
+	return controller, uploaded, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConfirmations__nachaParser(t *testing.T) {
+	confirmations, err := (&nachaConfirmationParser{}).Parse(ackFile(t, "076401255655291"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmations) != 1 || len(confirmations[0].TraceNumbers) != 1 || confirmations[0].TraceNumbers[0] != "076401255655291" {
+		t.Errorf("unexpected confirmations: %#v", confirmations)
+	}
+
+	// other inbound files aren't confirmations
+	bs, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmations, err := (&nachaConfirmationParser{}).Parse(bs); len(confirmations) != 0 || err != nil {
+		t.Errorf("confirmations=%#v error=%v", confirmations, err)
+	}
+	if confirmations, err := (&nachaConfirmationParser{}).Parse([]byte("file received")); len(confirmations) != 0 || err != nil {
+		t.Errorf("confirmations=%#v error=%v", confirmations, err)
+	}
+}
+
+func TestConfirmations__register(t *testing.T) {
+	if err := validateConfirmationFormat(""); err != nil {
+		t.Error(err)
+	}
+	if err := validateConfirmationFormat("NACHA"); err != nil {
+		t.Error(err)
+	}
+	if err := validateConfirmationFormat("other-report"); err == nil {
+		t.Error("expected error")
+	}
+	RegisterConfirmationParser("Test-Report", &testConfirmationParser{})
+	if err := validateConfirmationFormat("test-report"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfirmations__repository(t *testing.T) {
+	controller, _, cleanup := setupConfirmationController(t)
+	defer cleanup()
+
+	files, err := controller.outboundFiles.getUnconfirmedFiles()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files=%#v error=%v", files, err)
+	}
+	if f := files[0]; f.Filename != "20200101-076401251-1.ach" || f.UploadedFilename != "PAYGATE-1.ACH" || f.EntryCount != 1 || f.TotalDebit != 10500 {
+		t.Errorf("unexpected file: %#v", f)
+	}
+
+	if err := controller.outboundFiles.markConfirmed("20200101-076401251-1.ach"); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := controller.outboundFiles.getUnconfirmedFiles(); len(files) != 0 || err != nil {
+		t.Errorf("files=%#v error=%v", files, err)
+	}
+	files, err = controller.outboundFiles.getOutboundFiles(10)
+	if err != nil || len(files) != 1 || files[0].ConfirmedAt == nil {
+		t.Errorf("files=%#v error=%v", files, err)
+	}
+}
+
+func TestConfirmations__processACK(t *testing.T) {
+	controller, uploaded, cleanup := setupConfirmationController(t)
+	defer cleanup()
+
+	inbound := filepath.Join(controller.rootDir, "inbound")
+	os.MkdirAll(inbound, 0777)
+
+	// an acknowledgement of some other entry isn't matched
+	if err := ioutil.WriteFile(filepath.Join(inbound, "ack-1.ach"), ackFile(t, "076401250000009"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := controller.findFileTransferConfig(uploaded.Header.ImmediateOrigin)
+	if err := controller.processConfirmationFiles(cfg, inbound); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := controller.outboundFiles.getUnconfirmedFiles(); len(files) != 1 {
+		t.Fatalf("got %d unconfirmed files", len(files))
+	}
+
+	trace := uploaded.Batches[0].GetEntries()[0].TraceNumberField()
+	if err := ioutil.WriteFile(filepath.Join(inbound, "ack-1.ach"), ackFile(t, trace), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.processConfirmationFiles(cfg, inbound); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := controller.outboundFiles.getUnconfirmedFiles(); len(files) != 0 {
+		t.Errorf("got %d unconfirmed files", len(files))
+	}
+
+	// ACK files are still processed as inbound files
+	if _, err := os.Stat(filepath.Join(inbound, "ack-1.ach")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfirmations__processReport(t *testing.T) {
+	controller, uploaded, cleanup := setupConfirmationController(t)
+	defer cleanup()
+
+	RegisterConfirmationParser("test-report", &testConfirmationParser{})
+	cfg := &Config{RoutingNumber: uploaded.Header.ImmediateOrigin, ConfirmationFormat: "test-report"}
+
+	inbound := filepath.Join(controller.rootDir, "inbound")
+	os.MkdirAll(inbound, 0777)
+	path := filepath.Join(inbound, "report.txt")
+	if err := ioutil.WriteFile(path, []byte("RECEIVED FILE paygate-1.ach ENTRIES 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.processConfirmationFiles(cfg, inbound); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := controller.outboundFiles.getUnconfirmedFiles(); len(files) != 0 {
+		t.Errorf("got %d unconfirmed files", len(files))
+	}
+
+	// reports are removed so they aren't read as inbound ACH files
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed: %v", path, err)
+	}
+}
+
+func TestConfirmations__processReportOtherODFI(t *testing.T) {
+	controller, uploaded, cleanup := setupConfirmationController(t)
+	defer cleanup()
+
+	// another ODFI was sent a file uploaded with the same name
+	other := &achFile{File: readPPDDebitFile(t), filepath: filepath.Join(controller.rootDir, "merged", "20200101-231380104-1.ach")}
+	other.Header.ImmediateDestination = "231380104"
+	other.Header.ImmediateOrigin = "231380104"
+	controller.recordOutboundFile(other, "PAYGATE-1.ACH")
+
+	RegisterConfirmationParser("test-report", &testConfirmationParser{})
+	inbound := filepath.Join(controller.rootDir, "inbound")
+	os.MkdirAll(inbound, 0777)
+	path := filepath.Join(inbound, "report.txt")
+	if err := ioutil.WriteFile(path, []byte("RECEIVED FILE paygate-1.ach ENTRIES 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other ODFI's report only confirms its own file
+	cfg := &Config{RoutingNumber: "231380104", ConfirmationFormat: "test-report"}
+	if err := controller.processConfirmationFiles(cfg, inbound); err != nil {
+		t.Fatal(err)
+	}
+	files, err := controller.outboundFiles.getUnconfirmedFiles()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d unconfirmed files: %v", len(files), err)
+	}
+	if files[0].Filename != filepath.Base(uploaded.filepath) {
+		t.Errorf("unexpected unconfirmed file %s", files[0].Filename)
+	}
+}
+
+func TestConfirmations__alertUnconfirmedFiles(t *testing.T) {
+	controller, uploaded, cleanup := setupConfirmationController(t)
+	defer cleanup()
+
+	// within the SLA
+	if err := controller.alertUnconfirmedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := controller.outboundFiles.getUnconfirmedFiles()
+	if len(files) != 1 || files[0].SLAMissedAt != nil {
+		t.Fatalf("unexpected files: %#v", files)
+	}
+
+	// uploaded before the SLA
+	files[0].UploadedAt = time.Now().Add(-2 * confirmationSLA)
+	if err := controller.outboundFiles.recordUpload(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.alertUnconfirmedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ = controller.outboundFiles.getUnconfirmedFiles()
+	if len(files) != 1 || files[0].SLAMissedAt == nil {
+		t.Fatalf("unexpected files: %#v", files)
+	}
+
+	// routing numbers without confirmations aren't alerted on
+	controller.repo = &mockRepository{configs: []*Config{{RoutingNumber: uploaded.Header.ImmediateOrigin}}}
+	files[0].SLAMissedAt = nil
+	if err := controller.outboundFiles.recordUpload(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.alertUnconfirmedFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := controller.outboundFiles.getUnconfirmedFiles(); files[0].SLAMissedAt != nil {
+		t.Errorf("unexpected SLA alert: %#v", files[0])
+	}
+}
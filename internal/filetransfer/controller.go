@@ -8,8 +8,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"database/sql"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -21,8 +23,11 @@ import (
 	"github.com/moov-io/paygate/internal/accounts"
 	"github.com/moov-io/paygate/internal/config"
 	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/events"
+	"github.com/moov-io/paygate/internal/receivers"
 	"github.com/moov-io/paygate/internal/secrets"
 	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/internal/util"
 	"github.com/moov-io/paygate/pkg/achclient"
 
 	"github.com/go-kit/kit/log"
@@ -76,11 +81,65 @@ type Controller struct {
 
 	ach            *achclient.ACH
 	accountsClient accounts.Client
+	odfiAccount    *depository.ODFIAccount
+
+	eventRepo events.Repository
 
 	updateDepositoriesFromNOCs bool
 
+	// dishonorLateReturns automatically dishonors returns received after their NACHA deadline
+	dishonorLateReturns bool
+
+	// receiverRepo is updated from NOCs (C04, C09) with each change recorded in corrections
+	receiverRepo receivers.Repository
+	corrections  correctionRepository
+
+	// keeper encrypts ACH files at rest in rootDir (merged and downloaded files) along with NOC corrections
 	keeper *secrets.StringKeeper
 
+	// leases are shared locks so only one paygate instance merges and uploads
+	// files for a routing number at a time. instanceID identifies this Controller
+	// as the owner of leases and transfer claims.
+	leases        leaseRepository
+	leaseDuration time.Duration
+	instanceID    string
+	heldLeases    map[string]bool
+	heldLeasesMu  sync.Mutex
+
+	// lostLeases are routing numbers whose lease was taken over by another instance while we held it.
+	// Our merged files for them are abandoned on the next renewal. Guarded by heldLeasesMu.
+	lostLeases map[string]bool
+
+	// takenOverLeases are routing numbers whose lease we took over from another instance (keyed to that instance)
+	// after it expired or was released. Their un-uploaded merged files are requeued before we merge. Guarded by heldLeasesMu.
+	takenOverLeases map[string]string
+
+	// uploadAttempts tracks failed uploads of merged files so they're retried with backoff
+	uploadAttempts uploadAttemptRepository
+
+	// outboundFiles records uploaded files so ODFI confirmations can be matched against them
+	outboundFiles outboundFileRepository
+
+	// exceptions records inbound entries which didn't match a Transfer or Depository
+	exceptions exceptionRepository
+
+	// fileSequences hands out the per-day sequence number and FileIDModifier of each file we create
+	fileSequences     fileSequenceRepository
+	fileSequencesOnce sync.Once
+
+	// mergedFilesMu guards files in our merged directory between periodic operations and admin routes
+	mergedFilesMu sync.Mutex
+
+	// alerters are sent Alerts about files which missed their cutoff time or confirmation SLA
+	alerters   []Alerter
+	alertersMu sync.RWMutex
+
+	// cutoffAlerts remembers which pending files have been alerted on and pendingDestinations which
+	// destinations had pending files the last time cutoffs were checked
+	cutoffAlerts        map[cutoffAlertKey]bool
+	pendingDestinations map[string]bool
+	cutoffAlertsMu      sync.Mutex
+
 	logger log.Logger
 }
 
@@ -88,7 +147,14 @@ type Controller struct {
 // to their SFTP host for processing.
 //
 // To change the refresh duration set ACH_FILE_TRANSFER_INTERVAL with a Go time.Duration value. (i.e. 10m for 10 minutes)
-func NewController(cfg *config.Config, dir string, repo Repository, achClient *achclient.ACH, accountsClient accounts.Client) (*Controller, error) {
+//
+// When db is non-nil merging and uploading is coordinated across paygate instances with leases
+// held per routing number.
+//
+// Incoming entries for our Depositories are posted to Accounts against odfiAccount and written to eventRepo.
+//
+// ACH files written under dir are encrypted with keeper and only decrypted in memory.
+func NewController(cfg *config.Config, dir string, repo Repository, db *sql.DB, achClient *achclient.ACH, accountsClient accounts.Client, odfiAccount *depository.ODFIAccount, eventRepo events.Repository, keeper *secrets.StringKeeper) (*Controller, error) {
 	if _, err := os.Stat(dir); dir == "" || err != nil {
 		return nil, fmt.Errorf("file-transfer-controller: problem with storage directory %q: %v", dir, err)
 	}
@@ -129,7 +195,30 @@ func NewController(cfg *config.Config, dir string, repo Repository, achClient *a
 		ach:                        achClient,
 		logger:                     cfg.Logger,
 		accountsClient:             accountsClient,
+		odfiAccount:                odfiAccount,
+		eventRepo:                  eventRepo,
+		keeper:                     keeper,
 		updateDepositoriesFromNOCs: updateDepsFromNOCs(os.Getenv("UPDATE_DEPOSITORIES_FROM_CHANGE_CODE")),
+		dishonorLateReturns:        util.Yes(os.Getenv("ACH_DISHONOR_LATE_RETURNS")),
+		leaseDuration:              leaseDuration(interval),
+		instanceID:                 instanceID(),
+		heldLeases:                 make(map[string]bool),
+	}
+	if db != nil {
+		controller.leases = &sqlLeaseRepository{db: db}
+		controller.uploadAttempts = &sqlUploadAttemptRepository{db: db}
+		controller.outboundFiles = &sqlOutboundFileRepository{db: db}
+		controller.exceptions = &sqlExceptionRepository{db: db}
+		controller.receiverRepo = receivers.NewReceiverRepo(cfg.Logger, db)
+		controller.corrections = &sqlCorrectionRepository{db: db}
+		controller.fileSequences = &sqlFileSequenceRepository{db: db}
+	}
+	if v := os.Getenv("ACH_FILE_ALERT_WEBHOOK_URL"); v != "" {
+		alerter, err := newWebhookAlerter(v)
+		if err != nil {
+			return nil, fmt.Errorf("file-transfer-controller: %v", err)
+		}
+		controller.AddAlerter(alerter)
 	}
 
 	return controller, nil
@@ -207,6 +296,13 @@ func (c *Controller) StartPeriodicFileOperations(ctx context.Context, flushIncom
 	tick := time.NewTicker(c.interval)
 	defer tick.Stop()
 
+	// Failed uploads are retried more often than our interval so they can make their cutoff time
+	retryTick := time.NewTicker(uploadRetryBackoff)
+	defer retryTick.Stop()
+
+	// Pending files are checked against their cutoff time independently of merging and uploading
+	go c.startCutoffMonitor(ctx)
+
 	// Grab shared transfer cursor for new transfers to merge into local files
 	transferCursor := transferRepo.GetCursor(c.batchSize, depRepo)
 	microDepositCursor := depRepo.GetMicroDepositCursor(c.batchSize)
@@ -255,6 +351,8 @@ func (c *Controller) StartPeriodicFileOperations(ctx context.Context, flushIncom
 		case <-tick.C:
 			// This is triggered by the time.Ticker (which accounts for delays) so let's download and upload files.
 			c.logger.Log("StartPeriodicFileOperations", "Starting periodic file operations")
+			// Renew our leases every tick (not only while merging) so they don't expire while idle.
+			c.renewLeases(transferRepo, microDepositCursor.DepRepo)
 			req := &periodicFileOperationsRequest{}
 			wg.Add(1)
 			go func() {
@@ -273,42 +371,38 @@ func (c *Controller) StartPeriodicFileOperations(ctx context.Context, flushIncom
 			}()
 			finish(nil, &wg, errs)
 
+		case <-retryTick.C:
+			if err := c.retryFailedUploads(); err != nil {
+				c.logger.Log("StartPeriodicFileOperations", "ERROR: retrying failed uploads", "error", err)
+			}
+
 		case <-ctx.Done():
 			c.logger.Log("StartPeriodicFileOperations", "Shutting down due to context.Done()")
+			c.releaseLeases()
 			return
 		}
 	}
 }
 
-// writeFiles will create files in dir for each file object provided
-// The contents of each file struct will always be closed.
+// writeFiles will create files in dir for each file object provided, encrypting them at rest when
+// the Controller has a secrets keeper. The contents of each file struct will always be closed.
 func (c *Controller) writeFiles(files []File, dir string) error {
 	var firstErr error
 	var errordFilenames []string
 
 	os.MkdirAll(dir, 0777) // ignore errors
 	for i := range files {
-		f, err := os.Create(filepath.Join(dir, files[i].Filename))
-		if err != nil {
-			if firstErr == nil {
-				firstErr = err
-			}
-			errordFilenames = append(errordFilenames, files[i].Filename)
-			continue
+		bs, err := ioutil.ReadAll(files[i].Contents)
+		if err == nil {
+			err = writeFile(filepath.Join(dir, files[i].Filename), bs, c.keeper)
 		}
-		if _, err = io.Copy(f, files[i].Contents); err != nil {
+		if err != nil {
 			if firstErr == nil {
 				firstErr = err
 			}
 			errordFilenames = append(errordFilenames, files[i].Filename)
 			continue
 		}
-		if err := f.Sync(); err != nil {
-			return err
-		}
-		if err := f.Close(); err != nil {
-			return err
-		}
 		if err := files[i].Contents.Close(); err != nil {
 			return err
 		}
@@ -319,13 +413,13 @@ func (c *Controller) writeFiles(files []File, dir string) error {
 	return nil
 }
 
-func parseACHFilepath(path string) (*ach.File, error) {
-	fd, err := os.Open(path)
+// parseACHFilepath reads the ACH file at path, decrypting it with keeper if it was encrypted at rest.
+func parseACHFilepath(path string, keeper *secrets.StringKeeper) (*ach.File, error) {
+	bs, err := readFile(path, keeper)
 	if err != nil {
 		return nil, err
 	}
-	defer fd.Close()
-	return parseACHFile(fd)
+	return parseACHFile(bytes.NewReader(bs))
 }
 
 func parseACHFile(r io.Reader) (*ach.File, error) {
@@ -340,6 +434,9 @@ type achFile struct {
 	*ach.File
 
 	filepath string
+
+	// keeper encrypts the file at rest, when nil the file is written in plaintext
+	keeper *secrets.StringKeeper
 }
 
 // lineCount tabulates the line count of the underlying ach.File
@@ -359,18 +456,13 @@ func (f *achFile) lineCount() int {
 }
 
 // write will overwrite f.filepath with the ach.File contents underlying achFile.
+// Contents are encrypted when keeper is non-nil.
 func (f *achFile) write() error {
-	fd, err := os.Create(f.filepath)
-	if err != nil {
-		return err
-	}
-	if err := ach.NewWriter(fd).Write(f.File); err != nil {
-		return err
-	}
-	if err := fd.Sync(); err != nil {
+	var buf bytes.Buffer
+	if err := ach.NewWriter(&buf).Write(f.File); err != nil {
 		return err
 	}
-	return fd.Close()
+	return writeFile(f.filepath, buf.Bytes(), f.keeper)
 }
 
 // notes
@@ -38,10 +38,10 @@ func TestController(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -186,7 +186,7 @@ func TestController__startPeriodicFileOperations(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "startPeriodicFileOperations")
 	defer os.RemoveAll(dir)
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	db := database.CreateTestSqliteDB(t)
 	defer db.Close()
@@ -219,7 +219,7 @@ func TestController__startPeriodicFileOperations(t *testing.T) {
 
 	// setup transfer controller to start a manual merge and upload
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, achClient, nil)
+	controller, err := NewController(cfg, dir, repo, nil, achClient, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -298,7 +298,7 @@ func (a *mockFileTransferAgent) ReturnPath() string   { return "return/" }
 func (a *mockFileTransferAgent) Close() error { return nil }
 
 func TestController__ACHFile(t *testing.T) {
-	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
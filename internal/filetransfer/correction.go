@@ -5,14 +5,19 @@
 package filetransfer
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
 	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/events"
 	"github.com/moov-io/paygate/internal/model"
 	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
 )
 
 func (c *Controller) handleNOCFile(req *periodicFileOperationsRequest, file *ach.File, filename string, depRepo depository.Repository, transferRepo transfers.Repository) error {
@@ -37,6 +42,8 @@ func (c *Controller) handleNOCFile(req *periodicFileOperationsRequest, file *ach
 				break
 			}
 
+			batchHeader := file.NotificationOfChange[i].GetHeader()
+
 			dep, _ := depRepo.LookupDepositoryFromReturn(file.Header.ImmediateDestination, strings.TrimSpace(entries[j].DFIAccountNumber))
 			if dep == nil {
 				c.logger.Log(
@@ -44,7 +51,8 @@ func (c *Controller) handleNOCFile(req *periodicFileOperationsRequest, file *ach
 					"traceNumber", entries[j].TraceNumber,
 					"originalTrace", entries[j].Addenda98.OriginalTrace,
 					"userID", req.userID, "requestID", req.requestID)
-				break
+				c.recordException(exceptionNOC, filename, file.Header, batchHeader, entries[j], errors.New("depository not found"))
+				continue
 			} else {
 				c.logger.Log(
 					"handleNOCFile", fmt.Sprintf("matched depository=%s", dep.ID),
@@ -52,26 +60,10 @@ func (c *Controller) handleNOCFile(req *periodicFileOperationsRequest, file *ach
 					"userID", req.userID, "requestID", req.requestID)
 			}
 
-			batchHeader := file.NotificationOfChange[i].GetHeader()
-			if err := c.rejectRelatedObjects(batchHeader, entries[j], dep, depRepo, transferRepo); err != nil {
+			if err := c.handleNOCEntry(req, file.Header, batchHeader, entries[j], filename, dep, depRepo, transferRepo); err != nil {
 				c.logger.Log(
-					"handleNOCFile", fmt.Sprintf("error updating related objects to depository=%s from NOC code=%s", dep.ID, changeCode.Code), "error", err,
+					"handleNOCFile", fmt.Sprintf("problem with NOC in file=%s", filename), "error", err,
 					"traceNumber", entries[j].TraceNumber,
-					"originalTrace", entries[j].Addenda98.OriginalTrace,
-					"userID", req.userID, "requestID", req.requestID)
-			}
-
-			if err := c.updateDepositoryFromChangeCode(changeCode, entries[j], dep, depRepo); err != nil {
-				c.logger.Log(
-					"handleNOCFile", fmt.Sprintf("error updating depository=%s from NOC code=%s", dep.ID, changeCode.Code), "error", err,
-					"traceNumber", entries[j].TraceNumber,
-					"originalTrace", entries[j].Addenda98.OriginalTrace,
-					"userID", req.userID, "requestID", req.requestID)
-			} else {
-				c.logger.Log(
-					"handleNOCFile", fmt.Sprintf("updated depository=%s from NOC code=%s", dep.ID, changeCode.Code),
-					"traceNumber", entries[j].TraceNumber,
-					"originalTrace", entries[j].Addenda98.OriginalTrace,
 					"userID", req.userID, "requestID", req.requestID)
 			}
 		}
@@ -79,34 +71,228 @@ func (c *Controller) handleNOCFile(req *periodicFileOperationsRequest, file *ach
 	return nil
 }
 
-func (c *Controller) rejectRelatedObjects(header *ach.BatchHeader, ed *ach.EntryDetail, dep *model.Depository, depRepo depository.Repository, transferRepo transfers.Repository) error {
-	// TODO(adam): Should we be updating Originator and/or Receiver objects?
-	// TODO(adam): We should probably write an event about rejecting the Depository
+// handleNOCEntry refuses or applies the corrections of a NOC sent for dep and the Transfer it was sent for.
+func (c *Controller) handleNOCEntry(req *periodicFileOperationsRequest, fileHeader ach.FileHeader, batchHeader *ach.BatchHeader, entry *ach.EntryDetail, filename string, dep *model.Depository, depRepo depository.Repository, transferRepo transfers.Repository) error {
+	if entry.Addenda98 == nil {
+		return errors.New("nil Addenda98")
+	}
+	changeCode := entry.Addenda98.ChangeCodeField()
+	if changeCode == nil {
+		return fmt.Errorf("no ChangeCode found code=%s", entry.Addenda98.ChangeCode)
+	}
 
-	// If we aren't going to be updating Depository fields then Reject the Depository
-	// as the fields being updated will keep the Depository verified.
-	if !c.updateDepositoriesFromNOCs {
-		if err := depRepo.UpdateDepositoryStatus(dep.ID, model.DepositoryRejected); err != nil {
-			return fmt.Errorf("depository error: %v", err)
+	// Refuse invalid NOCs rather than updating or rejecting the Depository.
+	original, err := lookupOriginalEntry(entry, depRepo, transferRepo)
+	if err != nil {
+		return err
+	}
+	if refusalCode := refuseCorrection(fileHeader, batchHeader, entry, original); refusalCode != "" {
+		c.writeNOCEvent(req, changeCode, entry, dep, refusalCode)
+		if path, err := c.writeRefusedCORFile(fileHeader, batchHeader, entry, refusalCode); err != nil {
+			c.logger.Log(
+				"handleNOCFile", fmt.Sprintf("problem creating refused NOC code=%s for depository=%s", refusalCode, dep.ID), "error", err,
+				"traceNumber", entry.TraceNumber,
+				"originalTrace", entry.Addenda98.OriginalTrace,
+				"userID", req.userID, "requestID", req.requestID)
+		} else {
+			c.logger.Log(
+				"handleNOCFile", fmt.Sprintf("refused NOC code=%s with %s for depository=%s in %s", changeCode.Code, refusalCode, dep.ID, path),
+				"traceNumber", entry.TraceNumber,
+				"originalTrace", entry.Addenda98.OriginalTrace,
+				"userID", req.userID, "requestID", req.requestID)
 		}
+		return nil
 	}
+	c.writeNOCEvent(req, changeCode, entry, dep, "")
 
+	// Receiver corrections leave the Depository and Transfer as they are, since the Receiver now has correct data.
+	corrected, err := c.updateRelatedObjectsFromChangeCode(changeCode, batchHeader, entry, transferRepo)
+	if err != nil {
+		c.logger.Log(
+			"handleNOCFile", fmt.Sprintf("error updating receiver from NOC code=%s", changeCode.Code), "error", err,
+			"traceNumber", entry.TraceNumber,
+			"originalTrace", entry.Addenda98.OriginalTrace,
+			"userID", req.userID, "requestID", req.requestID)
+	}
+	if corrected {
+		return nil
+	}
+
+	if err := c.rejectRelatedObjects(batchHeader, entry, dep, depRepo, transferRepo); err != nil {
+		c.logger.Log(
+			"handleNOCFile", fmt.Sprintf("error updating related objects to depository=%s from NOC code=%s", dep.ID, changeCode.Code), "error", err,
+			"traceNumber", entry.TraceNumber,
+			"originalTrace", entry.Addenda98.OriginalTrace,
+			"userID", req.userID, "requestID", req.requestID)
+	}
+
+	if err := c.updateDepositoryFromChangeCode(changeCode, entry, dep, depRepo); err != nil {
+		c.logger.Log(
+			"handleNOCFile", fmt.Sprintf("error updating depository=%s from NOC code=%s", dep.ID, changeCode.Code), "error", err,
+			"traceNumber", entry.TraceNumber,
+			"originalTrace", entry.Addenda98.OriginalTrace,
+			"userID", req.userID, "requestID", req.requestID)
+	} else {
+		c.logger.Log(
+			"handleNOCFile", fmt.Sprintf("updated depository=%s from NOC code=%s", dep.ID, changeCode.Code),
+			"traceNumber", entry.TraceNumber,
+			"originalTrace", entry.Addenda98.OriginalTrace,
+			"userID", req.userID, "requestID", req.requestID)
+	}
+	return nil
+}
+
+// writeNOCEvent writes an event with the corrected data of a NOC for the owner of dep. refusalCode is
+// set when the NOC was refused.
+func (c *Controller) writeNOCEvent(req *periodicFileOperationsRequest, code *ach.ChangeCode, ed *ach.EntryDetail, dep *model.Depository, refusalCode string) {
+	if c.eventRepo == nil {
+		return
+	}
+	metadata := map[string]string{
+		"changeCode":    code.Code,
+		"reason":        code.Reason,
+		"traceNumber":   ed.TraceNumberField(),
+		"originalTrace": ed.Addenda98.OriginalTraceField(),
+		"depositoryID":  string(dep.ID),
+		"correctedData": strings.TrimSpace(ed.Addenda98.CorrectedData),
+	}
+	if cor := ed.Addenda98.ParseCorrectedData(); cor != nil {
+		if cor.AccountNumber != "" {
+			metadata["accountNumber"] = cor.AccountNumber
+		}
+		if cor.RoutingNumber != "" {
+			metadata["routingNumber"] = cor.RoutingNumber
+		}
+		if cor.Name != "" {
+			metadata["individualName"] = cor.Name
+		}
+		if cor.TransactionCode != 0 {
+			metadata["transactionCode"] = fmt.Sprintf("%d", cor.TransactionCode)
+		}
+		if cor.Identification != "" {
+			metadata["identification"] = cor.Identification
+		}
+	}
+	if refusalCode != "" {
+		metadata["refusalCode"] = refusalCode
+	}
+	err := c.eventRepo.WriteEvent(dep.UserID, &events.Event{
+		ID:       events.EventID(base.ID()),
+		Topic:    fmt.Sprintf("%s notification of change for depository %s", code.Code, dep.ID),
+		Message:  code.Description,
+		Type:     events.NotificationOfChangeEvent,
+		Metadata: metadata,
+	})
+	if err != nil {
+		c.logger.Log("handleNOCFile", fmt.Sprintf("problem writing NOC event for depository=%s", dep.ID), "error", err, "userID", req.userID, "requestID", req.requestID)
+	}
+}
+
+// lookupTransferFromNOC finds the processed Transfer a NOC was sent for.
+func lookupTransferFromNOC(header *ach.BatchHeader, ed *ach.EntryDetail, transferRepo transfers.Repository) (*model.Transfer, error) {
 	amount, err := model.NewAmountFromInt("USD", ed.Amount)
 	if err != nil {
-		return fmt.Errorf("invalid amount: %v", ed.Amount)
+		return nil, fmt.Errorf("invalid amount: %v", ed.Amount)
 	}
 	effectiveEntryDate, err := header.LiftEffectiveEntryDate()
 	if err != nil {
-		return fmt.Errorf("invalid EffectiveEntryDate=%q: %v", header.EffectiveEntryDate, err)
+		return nil, fmt.Errorf("invalid EffectiveEntryDate=%q: %v", header.EffectiveEntryDate, err)
 	}
-
-	// Mark the transfer as Reclaimed due to error
 	transfer, err := transferRepo.LookupTransferFromReturn(header.StandardEntryClassCode, amount, ed.TraceNumber, effectiveEntryDate)
 	if err != nil {
-		return fmt.Errorf("problem finding transfer: %v", err)
+		return nil, fmt.Errorf("problem finding transfer: %v", err)
 	}
 	if transfer == nil {
-		return errors.New("transfer not found")
+		return nil, errors.New("transfer not found")
+	}
+	return transfer, nil
+}
+
+// updateRelatedObjectsFromChangeCode applies the corrected individual name (C04) and individual
+// identification number (C09) to the Receiver of the Transfer a NOC was sent for and returns true once
+// it's corrected. Transfers created afterwards read the corrected values. Each change is recorded as a
+// nocCorrection.
+//
+// Originators aren't corrected as no change code applies to them. Their name and identification are
+// sent as the batch's company fields, which NOCs can't correct.
+func (c *Controller) updateRelatedObjectsFromChangeCode(code *ach.ChangeCode, header *ach.BatchHeader, ed *ach.EntryDetail, transferRepo transfers.Repository) (bool, error) {
+	if code.Code != "C04" && code.Code != "C09" {
+		return false, nil
+	}
+	cor := ed.Addenda98.ParseCorrectedData()
+	if cor == nil {
+		return false, errors.New("missing Addenda98 corrected data")
+	}
+	transfer, err := lookupTransferFromNOC(header, ed, transferRepo)
+	if err != nil {
+		return false, err
+	}
+	userID := id.User(transfer.UserID)
+
+	correction := &nocCorrection{
+		ID:            base.ID(),
+		UserID:        userID,
+		ChangeCode:    code.Code,
+		OriginalTrace: ed.Addenda98.OriginalTraceField(),
+		TransferID:    transfer.ID,
+		Created:       time.Now(),
+	}
+	switch code.Code {
+	case "C04": // Incorrect Individual Name
+		if c.receiverRepo == nil {
+			return false, errors.New("skipping receiver individual name update")
+		}
+		receiver, err := c.receiverRepo.GetUserReceiver(transfer.Receiver, userID)
+		if err != nil || receiver == nil {
+			return false, fmt.Errorf("problem reading receiver=%s: %v", transfer.Receiver, err)
+		}
+		correction.ObjectType, correction.ObjectID = "receiver", string(receiver.ID)
+		correction.FieldName, correction.PreviousValue, correction.CorrectedValue = "metadata", receiver.Metadata, cor.Name
+
+		receiver.Metadata = cor.Name
+		if err := c.receiverRepo.UpsertUserReceiver(userID, receiver); err != nil {
+			return false, fmt.Errorf("problem updating receiver=%s: %v", receiver.ID, err)
+		}
+
+	case "C09": // Incorrect Individual Identification Number
+		if c.receiverRepo == nil {
+			return false, errors.New("skipping receiver identification number update")
+		}
+		receiver, err := c.receiverRepo.GetUserReceiver(transfer.Receiver, userID)
+		if err != nil || receiver == nil {
+			return false, fmt.Errorf("problem reading receiver=%s: %v", transfer.Receiver, err)
+		}
+		correction.ObjectType, correction.ObjectID = "receiver", string(receiver.ID)
+		correction.FieldName, correction.PreviousValue, correction.CorrectedValue = "identificationNumber", receiver.IdentificationNumber, cor.Identification
+
+		receiver.IdentificationNumber = cor.Identification
+		if err := c.receiverRepo.UpsertUserReceiver(userID, receiver); err != nil {
+			return false, fmt.Errorf("problem updating receiver=%s: %v", receiver.ID, err)
+		}
+	}
+	c.logger.Log("changeCode", fmt.Sprintf("updated %s=%s %s from changeCode=%s", correction.ObjectType, correction.ObjectID, correction.FieldName, code.Code), "userID", userID)
+
+	if c.corrections != nil {
+		if err := c.corrections.recordCorrection(correction); err != nil {
+			return true, fmt.Errorf("problem recording correction of %s=%s: %v", correction.ObjectType, correction.ObjectID, err)
+		}
+	}
+	return true, nil
+}
+
+func (c *Controller) rejectRelatedObjects(header *ach.BatchHeader, ed *ach.EntryDetail, dep *model.Depository, depRepo depository.Repository, transferRepo transfers.Repository) error {
+	// If we aren't going to be updating Depository fields then Reject the Depository
+	// as the fields being updated will keep the Depository verified.
+	if !c.updateDepositoriesFromNOCs {
+		if err := depRepo.UpdateDepositoryStatus(dep.ID, model.DepositoryRejected); err != nil {
+			return fmt.Errorf("depository error: %v", err)
+		}
+	}
+
+	// Mark the transfer as Reclaimed due to error
+	transfer, err := lookupTransferFromNOC(header, ed, transferRepo)
+	if err != nil {
+		return err
 	}
 	if err := transferRepo.UpdateTransferStatus(transfer.ID, model.TransferReclaimed); err != nil {
 		return fmt.Errorf("problem updating transfer=%q: %v", transfer.ID, err)
@@ -147,14 +333,8 @@ func (c *Controller) updateDepositoryFromChangeCode(code *ach.ChangeCode, ed *ac
 		return err
 	}
 
-	// Fixup individual name
-	if code.Code == "C04" {
-		return errors.New("skipping receiver individual name update")
-	}
-	// fixup identification
-	if code.Code == "C09" {
-		return errors.New("skipping originator identification name update")
-	}
+	// Individual name (C04) and identification (C09) corrections are applied
+	// to the Receiver in updateRelatedObjectsFromChangeCode.
 
 	// Checkout
 	switch code.Code {
@@ -174,3 +354,70 @@ func (c *Controller) updateDepositoryFromChangeCode(code *ach.ChangeCode, ed *ac
 
 	return nil
 }
+
+// nocCorrection is an audit record of a Receiver field changed from a NOC.
+type nocCorrection struct {
+	ID            string      `json:"id"`
+	UserID        id.User     `json:"userID"`
+	ChangeCode    string      `json:"changeCode"`
+	OriginalTrace string      `json:"originalTrace"`
+	TransferID    id.Transfer `json:"transferID"`
+
+	ObjectType     string `json:"objectType"`
+	ObjectID       string `json:"objectID"`
+	FieldName      string `json:"fieldName"`
+	PreviousValue  string `json:"previousValue"`
+	CorrectedValue string `json:"correctedValue"`
+
+	Created time.Time `json:"created"`
+}
+
+type correctionRepository interface {
+	recordCorrection(correction *nocCorrection) error
+	getCorrections(objectType string, objectID string) ([]*nocCorrection, error)
+}
+
+type sqlCorrectionRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlCorrectionRepository) recordCorrection(cor *nocCorrection) error {
+	query := `insert into noc_corrections (correction_id, user_id, change_code, original_trace, transfer_id, object_type, object_id, field_name, previous_value, corrected_value, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("recordCorrection: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(cor.ID, cor.UserID, cor.ChangeCode, cor.OriginalTrace, cor.TransferID, cor.ObjectType, cor.ObjectID, cor.FieldName, cor.PreviousValue, cor.CorrectedValue, cor.Created)
+	if err != nil {
+		return fmt.Errorf("recordCorrection: exec: %v", err)
+	}
+	return nil
+}
+
+func (r *sqlCorrectionRepository) getCorrections(objectType string, objectID string) ([]*nocCorrection, error) {
+	query := `select correction_id, user_id, change_code, original_trace, transfer_id, field_name, previous_value, corrected_value, created_at from noc_corrections
+where object_type = ? and object_id = ? order by created_at asc;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("getCorrections: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(objectType, objectID)
+	if err != nil {
+		return nil, fmt.Errorf("getCorrections: query: %v", err)
+	}
+	defer rows.Close()
+
+	var corrections []*nocCorrection
+	for rows.Next() {
+		cor := &nocCorrection{ObjectType: objectType, ObjectID: objectID}
+		if err := rows.Scan(&cor.ID, &cor.UserID, &cor.ChangeCode, &cor.OriginalTrace, &cor.TransferID, &cor.FieldName, &cor.PreviousValue, &cor.CorrectedValue, &cor.Created); err != nil {
+			return nil, fmt.Errorf("getCorrections: scan: %v", err)
+		}
+		corrections = append(corrections, cor)
+	}
+	return corrections, rows.Err()
+}
@@ -5,8 +5,10 @@
 package filetransfer
 
 import (
+	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -15,10 +17,13 @@ import (
 
 	"github.com/moov-io/ach"
 	"github.com/moov-io/base"
+	"github.com/moov-io/base/admin"
 	"github.com/moov-io/paygate/internal/config"
 	"github.com/moov-io/paygate/internal/database"
 	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/events"
 	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/receivers"
 	"github.com/moov-io/paygate/internal/secrets"
 	"github.com/moov-io/paygate/internal/transfers"
 	"github.com/moov-io/paygate/pkg/id"
@@ -35,12 +40,12 @@ func TestController__rejectRelatedObjects(t *testing.T) {
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	keeper := secrets.TestStringKeeper(t)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,12 +164,12 @@ func TestDepositories__updateDepositoryFromChangeCode(t *testing.T) {
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	keeper := secrets.TestStringKeeper(t)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -202,13 +207,13 @@ func TestController__handleNOCFile(t *testing.T) {
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	keeper := secrets.TestStringKeeper(t)
 	depRepo := depository.NewDepositoryRepo(logger, sqliteDB.DB, keeper)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -250,9 +255,35 @@ func TestController__handleNOCFile(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// write the Transfer the NOC was sent for
+	receiver := &model.Depository{
+		ID:            id.Depository(base.ID()),
+		RoutingNumber: "121042882",
+		BankName:      "bank name",
+		Holder:        "receiver",
+		HolderType:    model.Individual,
+		Type:          model.Checking,
+		Status:        model.DepositoryVerified,
+		Created:       base.NewTime(time.Now()),
+		Keeper:        keeper,
+	}
+	if err := receiver.ReplaceAccountNumber(accountNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := depRepo.UpsertUserDepository(userID, receiver); err != nil {
+		t.Fatal(err)
+	}
+	transferRepo := &transfers.MockRepository{
+		Xfer: &model.Transfer{
+			ID:                 id.Transfer(base.ID()),
+			Type:               model.PushTransfer,
+			ReceiverDepository: receiver.ID,
+		},
+	}
+
 	// run the controller
 	req := &periodicFileOperationsRequest{}
-	if err := controller.handleNOCFile(req, &file, "cor-c01.ach", depRepo, nil); err != nil {
+	if err := controller.handleNOCFile(req, &file, "cor-c01.ach", depRepo, transferRepo); err != nil {
 		t.Error(err)
 	}
 
@@ -284,10 +315,10 @@ func TestController__handleNOCFileEmpty(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "handleNOCFile")
 	defer os.RemoveAll(dir)
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -323,7 +354,7 @@ func TestCorrectionsErr__updateDepositoryFromChangeCode(t *testing.T) {
 	sqliteDB := database.CreateTestSqliteDB(t)
 	defer sqliteDB.Close()
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	cc := &ach.ChangeCode{Code: "C14"}
 	ed := &ach.EntryDetail{Addenda98: &ach.Addenda98{}}
@@ -338,7 +369,7 @@ func TestCorrectionsErr__updateDepositoryFromChangeCode(t *testing.T) {
 
 	keeper := secrets.TestStringKeeper(t)
 
-	controller, _ := NewController(cfg, dir, repo, nil, nil)
+	controller, _ := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	controller.keeper = keeper
 	controller.updateDepositoriesFromNOCs = true
 
@@ -362,18 +393,14 @@ func TestCorrectionsErr__updateDepositoryFromChangeCode(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// not implemented change code
+	// individual name corrections don't change the Depository, they're applied to the Receiver
 	cc.Code = "C04"
 	ed.Addenda98.ChangeCode = cc.Code
 	ed.Addenda98.CorrectedData = ach.WriteCorrectionData(cc.Code, &ach.CorrectedData{
 		Name: "john smith",
 	})
-	if err := controller.updateDepositoryFromChangeCode(cc, ed, dep, depRepo); err == nil {
-		t.Error("expected error")
-	} else {
-		if !strings.Contains(err.Error(), "skipping receiver individual name") {
-			t.Errorf("unexpected error: %v", err)
-		}
+	if err := controller.updateDepositoryFromChangeCode(cc, ed, dep, depRepo); err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
 
 	// unknown change code
@@ -387,3 +414,183 @@ func TestCorrectionsErr__updateDepositoryFromChangeCode(t *testing.T) {
 		}
 	}
 }
+
+func TestCorrections__updateRelatedObjectsFromChangeCode(t *testing.T) {
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	dir, _ := ioutil.TempDir("", "Controller")
+	defer os.RemoveAll(dir)
+
+	controller, err := NewController(config.Empty(), dir, NewRepository("", nil, "", nil), sqliteDB.DB, nil, nil, nil, events.NewRepo(log.NewNopLogger(), sqliteDB.DB), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &model.Receiver{ID: model.ReceiverID(base.ID()), Metadata: "Jane Doe"}
+	controller.receiverRepo = &receivers.MockRepository{Receivers: []*model.Receiver{receiver}}
+	orig := &model.Originator{ID: model.OriginatorID(base.ID()), Identification: "121042882"}
+
+	userID := id.User(base.ID())
+	transferRepo := &transfers.MockRepository{
+		Xfer: &model.Transfer{
+			ID:         id.Transfer(base.ID()),
+			Receiver:   receiver.ID,
+			Originator: orig.ID,
+			UserID:     userID.String(),
+		},
+	}
+	bh := ach.NewBatchHeader()
+	bh.StandardEntryClassCode = ach.COR
+	bh.EffectiveEntryDate = time.Now().Format("060102")
+
+	ed := ach.NewEntryDetail()
+	ed.Addenda98 = ach.NewAddenda98()
+	ed.Addenda98.OriginalTrace = "121042880000001"
+
+	// C04 corrects the Receiver's name
+	cc := &ach.ChangeCode{Code: "C04"}
+	ed.Addenda98.ChangeCode = cc.Code
+	ed.Addenda98.CorrectedData = ach.WriteCorrectionData(cc.Code, &ach.CorrectedData{Name: "Jane Smith"})
+	if corrected, err := controller.updateRelatedObjectsFromChangeCode(cc, bh, ed, transferRepo); !corrected || err != nil {
+		t.Fatalf("corrected=%v error=%v", corrected, err)
+	}
+	if receiver.Metadata != "Jane Smith" {
+		t.Errorf("receiver.Metadata=%q", receiver.Metadata)
+	}
+
+	// C09 corrects the Receiver's identification number, but not the Originator's identification
+	cc = &ach.ChangeCode{Code: "C09"}
+	ed.Addenda98.ChangeCode = cc.Code
+	ed.Addenda98.CorrectedData = ach.WriteCorrectionData(cc.Code, &ach.CorrectedData{Identification: "987654321"})
+	if corrected, err := controller.updateRelatedObjectsFromChangeCode(cc, bh, ed, transferRepo); !corrected || err != nil {
+		t.Fatalf("corrected=%v error=%v", corrected, err)
+	}
+	if receiver.IdentificationNumber != "987654321" {
+		t.Errorf("receiver.IdentificationNumber=%q", receiver.IdentificationNumber)
+	}
+	if orig.Identification != "121042882" {
+		t.Errorf("orig.Identification=%q", orig.Identification)
+	}
+
+	// both changes are in the audit trail
+	corrections, err := controller.corrections.getCorrections("receiver", string(receiver.ID))
+	if err != nil || len(corrections) != 2 {
+		t.Fatalf("got %d corrections: %v", len(corrections), err)
+	}
+	for _, cor := range corrections {
+		switch cor.ChangeCode {
+		case "C04":
+			if cor.FieldName != "metadata" || cor.PreviousValue != "Jane Doe" || cor.CorrectedValue != "Jane Smith" || cor.UserID != userID {
+				t.Errorf("unexpected correction: %#v", cor)
+			}
+		case "C09":
+			if cor.FieldName != "identificationNumber" || cor.PreviousValue != "" || cor.CorrectedValue != "987654321" {
+				t.Errorf("unexpected correction: %#v", cor)
+			}
+		default:
+			t.Errorf("unexpected correction: %#v", cor)
+		}
+	}
+	if corrections, err := controller.corrections.getCorrections("originator", string(orig.ID)); err != nil || len(corrections) != 0 {
+		t.Errorf("got %d originator corrections: %v", len(corrections), err)
+	}
+
+	// other change codes don't touch the Receiver or Originator
+	if corrected, err := controller.updateRelatedObjectsFromChangeCode(&ach.ChangeCode{Code: "C01"}, bh, ed, transferRepo); corrected || err != nil {
+		t.Errorf("corrected=%v error=%v", corrected, err)
+	}
+
+	// the NOC is written as an event
+	dep := &model.Depository{ID: id.Depository(base.ID()), UserID: userID}
+	controller.writeNOCEvent(&periodicFileOperationsRequest{}, cc, ed, dep, "")
+
+	evts, err := controller.eventRepo.GetUserEvents(userID)
+	if err != nil || len(evts) != 1 {
+		t.Fatalf("got %d events: %v", len(evts), err)
+	}
+	if evts[0].Type != events.NotificationOfChangeEvent || evts[0].Metadata["changeCode"] != "C09" || evts[0].Metadata["identification"] != "987654321" {
+		t.Errorf("unexpected event: %#v", evts[0])
+	}
+}
+
+func TestCorrections__handleNOCEntryCorrected(t *testing.T) {
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	dir, _ := ioutil.TempDir("", "Controller")
+	defer os.RemoveAll(dir)
+
+	controller, err := NewController(config.Empty(), dir, NewRepository("", nil, "", nil), sqliteDB.DB, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.updateDepositoriesFromNOCs = false
+
+	receiver := &model.Receiver{ID: model.ReceiverID(base.ID()), Metadata: "Jane Doe"}
+	controller.receiverRepo = &receivers.MockRepository{Receivers: []*model.Receiver{receiver}}
+
+	userID := id.User(base.ID())
+	dep := &model.Depository{ID: id.Depository(base.ID()), UserID: userID, RoutingNumber: "121042882", Status: model.DepositoryVerified}
+	depRepo := &depository.MockRepository{Depositories: []*model.Depository{dep}}
+	transferRepo := &transfers.MockRepository{
+		Xfer: &model.Transfer{
+			ID:                 id.Transfer(base.ID()),
+			Type:               model.PushTransfer,
+			Receiver:           receiver.ID,
+			ReceiverDepository: dep.ID,
+			UserID:             userID.String(),
+			Status:             model.TransferProcessed,
+		},
+	}
+
+	fh := ach.NewFileHeader()
+	fh.ImmediateDestination = "121042882"
+	bh := ach.NewBatchHeader()
+	bh.StandardEntryClassCode = ach.COR
+	bh.CompanyIdentification = "121042882"
+	bh.EffectiveEntryDate = time.Now().Format("060102")
+
+	ed := ach.NewEntryDetail()
+	ed.TransactionCode = ach.CheckingReturnNOCCredit
+	ed.RDFIIdentification = "12104288"
+	ed.DFIAccountNumber = "12345"
+	ed.IdentificationNumber = "#83738AB#"
+	ed.Addenda98 = ach.NewAddenda98()
+	ed.Addenda98.ChangeCode = "C04"
+	ed.Addenda98.OriginalTrace = "121042880000001"
+	ed.Addenda98.OriginalDFI = "12104288"
+	ed.Addenda98.CorrectedData = ach.WriteCorrectionData("C04", &ach.CorrectedData{Name: "Jane Smith"})
+
+	// the Receiver is corrected, so the Depository isn't rejected and the Transfer isn't reclaimed
+	if err := controller.handleNOCEntry(&periodicFileOperationsRequest{}, fh, bh, ed, "cor-c04.ach", dep, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.Metadata != "Jane Smith" {
+		t.Errorf("receiver.Metadata=%q", receiver.Metadata)
+	}
+	if depRepo.Status != "" || transferRepo.Status != "" {
+		t.Errorf("depository status=%q transfer status=%q", depRepo.Status, transferRepo.Status)
+	}
+
+	// the correction is listed on the admin server
+	svc := admin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+	AddCorrectionRoutes(log.NewNopLogger(), svc, controller)
+
+	resp, err := http.Get("http://" + svc.BindAddr() + "/receivers/" + string(receiver.ID) + "/corrections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	var corrections []*nocCorrection
+	if err := json.NewDecoder(resp.Body).Decode(&corrections); err != nil {
+		t.Fatal(err)
+	}
+	if len(corrections) != 1 || corrections[0].FieldName != "metadata" || corrections[0].CorrectedValue != "Jane Smith" {
+		t.Errorf("corrections=%#v", corrections)
+	}
+}
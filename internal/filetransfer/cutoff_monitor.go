@@ -0,0 +1,194 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// cutoffMonitorInterval is how often pending merged files are checked against their cutoff time. This runs
+	// separately from ACH_FILE_TRANSFER_INTERVAL so files which won't be uploaded in time are noticed.
+	cutoffMonitorInterval = time.Minute
+
+	// cutoffWarningDelta is how long before a cutoff time a pending merged file raises an alert. Files are
+	// normally uploaded FORCED_CUTOFF_UPLOAD_DELTA before their cutoff, so this should be shorter.
+	cutoffWarningDelta = func() time.Duration {
+		if v := os.Getenv("ACH_FILE_CUTOFF_WARNING_DELTA"); v != "" {
+			if dur, _ := time.ParseDuration(v); dur > 0 {
+				return dur
+			}
+		}
+		return 2 * time.Minute
+	}()
+
+	oldestPendingFileAge = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "ach_merged_file_oldest_pending_seconds",
+		Help: "Age in seconds of the oldest merged file pending upload",
+	}, []string{"destination"})
+
+	timeToCutoff = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "ach_cutoff_time_remaining_seconds",
+		Help: "Seconds until today's cutoff time, which is negative once it has passed",
+	}, []string{"routing_number"})
+
+	cutoffsMissed = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_cutoffs_missed",
+		Help: "Counter of merged files still pending upload after their cutoff time",
+	}, []string{"destination", "origin"})
+)
+
+// pendingSince returns when a merged file was created, which is from its header or the file's modification
+// time if that's missing.
+func pendingSince(file *achFile) time.Time {
+	created, err := time.ParseInLocation("0601021504", file.Header.FileCreationDate+file.Header.FileCreationTime, time.Local)
+	if err == nil {
+		return created
+	}
+	if info, err := os.Stat(file.filepath); err == nil {
+		return info.ModTime()
+	}
+	return time.Now()
+}
+
+// startCutoffMonitor checks pending merged files against their cutoff time every cutoffMonitorInterval until
+// ctx is done. It runs in its own goroutine so slow merging, uploading or alerting doesn't delay the checks.
+func (c *Controller) startCutoffMonitor(ctx context.Context) {
+	tick := time.NewTicker(cutoffMonitorInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := c.checkCutoffs(); err != nil {
+				c.logger.Log("cutoffMonitor", "ERROR: checking cutoff times", "error", err)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkCutoffs updates our cutoff metrics and raises an Alert for each pending merged file which has missed its
+// cutoff time or is within cutoffWarningDelta of it. Each file is alerted on once for each kind of Alert.
+//
+// Alerts are raised after cutoffAlertsMu is released as Alerters can be slow to deliver them.
+func (c *Controller) checkCutoffs() error {
+	cutoffTimes, err := c.repo.GetCutoffTimes()
+	if err != nil {
+		return fmt.Errorf("cutoff times: %v", err)
+	}
+	now := time.Now()
+	for i := range cutoffTimes {
+		timeToCutoff.With("routing_number", cutoffTimes[i].RoutingNumber).Set(cutoffTimes[i].Diff(now).Seconds())
+	}
+
+	c.mergedFilesMu.Lock()
+	files, err := grabAllFiles(filepath.Join(c.rootDir, "merged"), c.keeper)
+	c.mergedFilesMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("checkCutoffs: %v", err)
+	}
+
+	var alerts []*Alert
+	c.cutoffAlertsMu.Lock()
+
+	pending := make(map[string]bool)
+	oldest := make(map[string]time.Time)
+	for i := range files {
+		filename := filepath.Base(files[i].filepath)
+		pending[filename] = true
+
+		since := pendingSince(files[i])
+		if t, exists := oldest[files[i].Header.ImmediateDestination]; !exists || since.Before(t) {
+			oldest[files[i].Header.ImmediateDestination] = since
+		}
+
+		cutoff := findCutoffTime(cutoffTimes, files[i])
+		if cutoff == nil {
+			continue
+		}
+		diff := cutoff.Diff(now)
+		deadline := now.Add(diff)
+		switch {
+		case diff <= 0 && since.Before(deadline):
+			if c.markCutoffAlert(filename, AlertCutoffMissed) {
+				cutoffsMissed.With("destination", files[i].Header.ImmediateDestination, "origin", files[i].Header.ImmediateOrigin).Add(1)
+				alerts = append(alerts, &Alert{
+					Kind:        AlertCutoffMissed,
+					Message:     fmt.Sprintf("%s missed its %04d cutoff time and is still pending upload", filename, cutoff.Cutoff),
+					Filename:    filename,
+					Destination: files[i].Header.ImmediateDestination,
+					Origin:      files[i].Header.ImmediateOrigin,
+					Deadline:    deadline,
+				})
+			}
+
+		case diff > 0 && diff <= cutoffWarningDelta:
+			if c.markCutoffAlert(filename, AlertCutoffApproaching) {
+				alerts = append(alerts, &Alert{
+					Kind:        AlertCutoffApproaching,
+					Message:     fmt.Sprintf("%s is still pending upload %v before its %04d cutoff time", filename, diff.Round(time.Second), cutoff.Cutoff),
+					Filename:    filename,
+					Destination: files[i].Header.ImmediateDestination,
+					Origin:      files[i].Header.ImmediateOrigin,
+					Deadline:    deadline,
+				})
+			}
+		}
+	}
+
+	// Destinations without pending files have nothing waiting
+	for destination := range c.pendingDestinations {
+		if _, exists := oldest[destination]; !exists {
+			oldestPendingFileAge.With("destination", destination).Set(0)
+		}
+	}
+	c.pendingDestinations = make(map[string]bool)
+	for destination, since := range oldest {
+		oldestPendingFileAge.With("destination", destination).Set(now.Sub(since).Seconds())
+		c.pendingDestinations[destination] = true
+	}
+
+	// Forget alerts for files which have been uploaded or moved
+	for key := range c.cutoffAlerts {
+		if !pending[key.filename] {
+			delete(c.cutoffAlerts, key)
+		}
+	}
+	c.cutoffAlertsMu.Unlock()
+
+	for i := range alerts {
+		c.raiseAlert(alerts[i])
+	}
+	return nil
+}
+
+type cutoffAlertKey struct {
+	filename string
+	kind     string
+}
+
+// markCutoffAlert returns true the first time it's called for filename and kind.
+// Callers must hold cutoffAlertsMu.
+func (c *Controller) markCutoffAlert(filename, kind string) bool {
+	if c.cutoffAlerts == nil {
+		c.cutoffAlerts = make(map[cutoffAlertKey]bool)
+	}
+	key := cutoffAlertKey{filename: filename, kind: kind}
+	if c.cutoffAlerts[key] {
+		return false
+	}
+	c.cutoffAlerts[key] = true
+	return true
+}
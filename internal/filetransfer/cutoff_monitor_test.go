@@ -0,0 +1,209 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+type mockAlerter struct {
+	alerts []*Alert
+	err    error
+	mu     sync.Mutex
+}
+
+func (a *mockAlerter) Alert(alert *Alert) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.alerts = append(a.alerts, alert)
+	return a.err
+}
+
+func TestAlerts__webhook(t *testing.T) {
+	var received Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if received.Kind == AlertCutoffApproaching {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	alerter, err := newWebhookAlerter(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alerter.Alert(&Alert{Kind: AlertCutoffMissed, Filename: "20200101-076401251-1.ach"}); err != nil {
+		t.Fatal(err)
+	}
+	if received.Kind != AlertCutoffMissed || received.Filename != "20200101-076401251-1.ach" {
+		t.Errorf("unexpected alert: %#v", received)
+	}
+	if err := alerter.Alert(&Alert{Kind: AlertCutoffApproaching}); err == nil {
+		t.Error("expected error")
+	}
+
+	if _, err := newWebhookAlerter("ftp://example.com/alerts"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestAlerts__raiseAlert(t *testing.T) {
+	first, second := &mockAlerter{err: errors.New("bad alerter")}, &mockAlerter{}
+
+	controller := &Controller{logger: log.NewNopLogger()}
+	controller.AddAlerter(first)
+	controller.AddAlerter(second)
+	controller.raiseAlert(&Alert{Kind: AlertConfirmationMissed})
+
+	if len(first.alerts) != 1 || len(second.alerts) != 1 {
+		t.Errorf("first=%d second=%d", len(first.alerts), len(second.alerts))
+	}
+}
+
+func TestCutoffMonitor__checkCutoffs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkCutoffs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "merged"), 0777)
+
+	// write a merged file created yesterday
+	file := readPPDDebitFile(t)
+	file.Header.FileCreationDate = time.Now().Add(-24 * time.Hour).Format("060102")
+	path := filepath.Join(dir, "merged", "20200101-076401251-1.ach")
+	if err := (&achFile{File: file, filepath: path}).write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// midnight has always passed, so the file missed its cutoff
+	repo := &mockRepository{
+		cutoffTimes: []*CutoffTime{
+			{RoutingNumber: file.Header.ImmediateDestination, Cutoff: 0, Loc: time.Local},
+		},
+	}
+	alerter := &mockAlerter{}
+	controller := &Controller{rootDir: dir, repo: repo, logger: log.NewNopLogger()}
+	controller.AddAlerter(alerter)
+
+	for i := 0; i < 2; i++ {
+		if err := controller.checkCutoffs(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(alerter.alerts) != 1 {
+		t.Fatalf("got %d alerts", len(alerter.alerts))
+	}
+	if a := alerter.alerts[0]; a.Kind != AlertCutoffMissed || a.Filename != "20200101-076401251-1.ach" || a.Destination != file.Header.ImmediateDestination {
+		t.Errorf("unexpected alert: %#v", a)
+	}
+	if !controller.pendingDestinations[file.Header.ImmediateDestination] {
+		t.Errorf("pendingDestinations=%#v", controller.pendingDestinations)
+	}
+
+	// a cutoff which is about to pass
+	if soon := time.Now().Add(90 * time.Second); soon.Day() == time.Now().Day() {
+		repo.cutoffTimes[0].Cutoff = soon.Hour()*100 + soon.Minute()
+		if err := controller.checkCutoffs(); err != nil {
+			t.Fatal(err)
+		}
+		if len(alerter.alerts) != 2 || alerter.alerts[1].Kind != AlertCutoffApproaching {
+			t.Errorf("unexpected alerts: %#v", alerter.alerts)
+		}
+	}
+
+	// uploaded files are forgotten
+	if err := os.Rename(path, path+".uploaded"); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.checkCutoffs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(controller.cutoffAlerts) != 0 || len(controller.pendingDestinations) != 0 {
+		t.Errorf("cutoffAlerts=%#v pendingDestinations=%#v", controller.cutoffAlerts, controller.pendingDestinations)
+	}
+}
+
+// lockingAlerter takes cutoffAlertsMu while delivering an Alert, which deadlocks if Alerts are raised with it held.
+type lockingAlerter struct {
+	controller *Controller
+	alerts     int
+}
+
+func (a *lockingAlerter) Alert(alert *Alert) error {
+	a.controller.cutoffAlertsMu.Lock()
+	defer a.controller.cutoffAlertsMu.Unlock()
+
+	a.alerts++
+	return nil
+}
+
+func TestCutoffMonitor__alertsWithoutLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkCutoffs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "merged"), 0777)
+
+	file := readPPDDebitFile(t)
+	file.Header.FileCreationDate = time.Now().Add(-24 * time.Hour).Format("060102")
+	if err := (&achFile{File: file, filepath: filepath.Join(dir, "merged", "20200101-076401251-1.ach")}).write(); err != nil {
+		t.Fatal(err)
+	}
+	repo := &mockRepository{
+		cutoffTimes: []*CutoffTime{
+			{RoutingNumber: file.Header.ImmediateDestination, Cutoff: 0, Loc: time.Local},
+		},
+	}
+	controller := &Controller{rootDir: dir, repo: repo, logger: log.NewNopLogger()}
+	alerter := &lockingAlerter{controller: controller}
+	controller.AddAlerter(alerter)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- controller.checkCutoffs()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("checkCutoffs raised alerts while holding cutoffAlertsMu")
+	}
+	if alerter.alerts != 1 {
+		t.Errorf("got %d alerts", alerter.alerts)
+	}
+}
+
+func TestCutoffMonitor__pendingSince(t *testing.T) {
+	file := readPPDDebitFile(t)
+	file.Header.FileCreationDate = "200102"
+	file.Header.FileCreationTime = "1504"
+
+	since := pendingSince(&achFile{File: file})
+	if v := since.Format("2006-01-02 15:04"); v != "2020-01-02 15:04" {
+		t.Errorf("got %s", v)
+	}
+}
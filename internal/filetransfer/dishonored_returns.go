@@ -0,0 +1,235 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/events"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+)
+
+// transferReturnFromEntry records the return entry received for transfer so the return can be dishonored later.
+func transferReturnFromEntry(fileHeader ach.FileHeader, header *ach.BatchHeader, entry *ach.EntryDetail, transfer *model.Transfer) *transfers.TransferReturn {
+	return &transfers.TransferReturn{
+		TransferID:              transfer.ID,
+		UserID:                  id.User(transfer.UserID),
+		ReceiverDepository:      transfer.ReceiverDepository,
+		ReturnCode:              entry.Addenda99.ReturnCode,
+		TraceNumber:             entry.TraceNumberField(),
+		OriginalTrace:           entry.Addenda99.OriginalTraceField(),
+		SettlementDate:          batchSettlementDate(header),
+		Origin:                  fileHeader.ImmediateOrigin,
+		Destination:             fileHeader.ImmediateDestination,
+		StandardEntryClassCode:  header.StandardEntryClassCode,
+		ServiceClassCode:        header.ServiceClassCode,
+		CompanyName:             strings.TrimSpace(header.CompanyName),
+		CompanyIdentification:   strings.TrimSpace(header.CompanyIdentification),
+		CompanyEntryDescription: strings.TrimSpace(header.CompanyEntryDescription),
+		TransactionCode:         entry.TransactionCode,
+		Amount:                  transfer.Amount,
+		IndividualName:          strings.TrimSpace(entry.IndividualName),
+		IdentificationNumber:    strings.TrimSpace(entry.IdentificationNumber),
+		Created:                 time.Now(),
+	}
+}
+
+// batchSettlementDate returns the Julian settlement date the ACH operator inserted into header.
+func batchSettlementDate(header *ach.BatchHeader) string {
+	if line := header.String(); len(line) == 94 {
+		return strings.TrimSpace(line[75:78])
+	}
+	return ""
+}
+
+// processDishonoredReturnEntry handles an ODFI dishonoring (R61-R69) a return we sent for one of our IncomingTransfers.
+// Our return is refused, so the original entry is posted against Accounts again.
+func (c *Controller) processDishonoredReturnEntry(requestID string, entry *ach.EntryDetail, depRepo depository.Repository, transferRepo transfers.Repository) error {
+	returnCode := entry.Addenda99.ReturnCode
+
+	xfer, err := transferRepo.GetIncomingTransferByTraceNumber(entry.Addenda99.OriginalTraceField())
+	if err != nil {
+		return fmt.Errorf("problem reading incoming transfer: %v", err)
+	}
+	if xfer == nil {
+		return fmt.Errorf("unable to match dishonored return originalTrace=%s", entry.Addenda99.OriginalTrace)
+	}
+	if xfer.Status != model.TransferReclaimed {
+		return fmt.Errorf("incoming transfer=%s with status %s was not returned", xfer.ID, xfer.Status)
+	}
+	dep, err := depRepo.GetDepository(xfer.DepositoryID)
+	if err != nil || dep == nil {
+		return fmt.Errorf("problem reading depository=%s: %v", xfer.DepositoryID, err)
+	}
+
+	xfer.Status = model.TransferProcessed
+	xfer.TransactionID = ""
+	if code, err := c.postIncomingTransaction(requestID, dep, xfer); err != nil || code != "" {
+		// The original entry stands, but it needs to be handled manually.
+		c.logger.Log("processDishonoredReturnEntry", fmt.Sprintf("problem posting incoming transfer=%s to accounts (returnCode=%s)", xfer.ID, code), "error", err, "requestID", requestID)
+		xfer.Status = model.TransferFailed
+	}
+	if err := transferRepo.DishonorIncomingReturn(xfer.ID, returnCode, xfer.Status, xfer.TransactionID); err != nil {
+		return err
+	}
+	c.logger.Log("processDishonoredReturnEntry", fmt.Sprintf("return of incoming transfer=%s dishonored with returnCode=%s", xfer.ID, returnCode), "requestID", requestID, "userID", xfer.UserID)
+
+	c.writeReturnEvent(xfer.UserID, events.IncomingTransferEvent, &events.Event{
+		Topic:   fmt.Sprintf("return of incoming %s transfer from %s dishonored", xfer.Type, xfer.CompanyName),
+		Message: fmt.Sprintf("%s return dishonored with %s", xfer.Amount.String(), returnCode),
+		Metadata: map[string]string{
+			"transferID": string(xfer.ID),
+			"returnCode": returnCode,
+			"status":     string(xfer.Status),
+		},
+	}, requestID)
+	return nil
+}
+
+// processContestedDishonoredReturnEntry handles an RDFI contesting (R71-R77) the dishonored return we sent for one of our
+// Transfers. The original return stands, so the Transfer is reclaimed and the transaction we posted when dishonoring is reversed.
+func (c *Controller) processContestedDishonoredReturnEntry(requestID string, entry *ach.EntryDetail, transferRepo transfers.Repository) error {
+	returnCode := entry.Addenda99.ReturnCode
+
+	ret, err := transferRepo.LookupDishonoredTransferReturn(entry.Addenda99.OriginalTraceField())
+	if err != nil {
+		return fmt.Errorf("problem reading transfer return: %v", err)
+	}
+	if ret == nil {
+		return fmt.Errorf("unable to match contested dishonored return originalTrace=%s", entry.Addenda99.OriginalTrace)
+	}
+	if ret.ContestedReturnCode != "" {
+		return fmt.Errorf("dishonored return of transfer=%s was already contested with %s", ret.TransferID, ret.ContestedReturnCode)
+	}
+	if err := transferRepo.ContestTransferReturn(ret.TransferID, returnCode); err != nil {
+		return err
+	}
+	if err := transferRepo.UpdateTransferStatus(ret.TransferID, model.TransferReclaimed); err != nil {
+		return fmt.Errorf("problem updating transfer=%s: %v", ret.TransferID, err)
+	}
+	if c.accountsClient != nil && ret.DishonoredTransactionID != "" {
+		if err := c.accountsClient.ReverseTransaction(requestID, ret.UserID, ret.DishonoredTransactionID); err != nil {
+			return fmt.Errorf("problem with accounts ReverseTransaction: %v", err)
+		}
+	}
+	c.logger.Log("processContestedDishonoredReturnEntry", fmt.Sprintf("dishonored return of transfer=%s contested with returnCode=%s", ret.TransferID, returnCode), "requestID", requestID, "userID", ret.UserID)
+
+	c.writeReturnEvent(ret.UserID, events.TransferEvent, &events.Event{
+		Topic:   fmt.Sprintf("dishonored %s return of transfer contested", ret.ReturnCode),
+		Message: fmt.Sprintf("%s dishonored return contested with %s", ret.Amount.String(), returnCode),
+		Metadata: map[string]string{
+			"transferID": string(ret.TransferID),
+			"returnCode": returnCode,
+		},
+	}, requestID)
+	return nil
+}
+
+func (c *Controller) writeReturnEvent(userID id.User, eventType events.EventType, event *events.Event, requestID string) {
+	if c.eventRepo == nil {
+		return
+	}
+	event.ID = events.EventID(base.ID())
+	event.Type = eventType
+	if err := c.eventRepo.WriteEvent(userID, event); err != nil {
+		c.logger.Log("processReturnEntry", "problem writing event", "error", err, "requestID", requestID, "userID", userID)
+	}
+}
+
+// mergeDishonoredReturns merges our dishonored returns into outbound files destined for the RDFI which sent
+// the original return. Files which are ready for upload are returned.
+func (c *Controller) mergeDishonoredReturns(mergedDir string, transferRepo transfers.Repository, depRepo depository.Repository, leases *mergeLeases) []*achFile {
+	returns, err := transferRepo.GetPendingDishonoredReturns()
+	if err != nil {
+		c.logger.Log("mergeDishonoredReturns", "problem reading pending dishonored returns", "error", err)
+		return nil
+	}
+
+	var filesToUpload []*achFile
+	for i := range returns {
+		ret := returns[i]
+		if !leases.holds(ret.Origin) {
+			continue
+		}
+		dep, err := depRepo.GetUserDepository(ret.ReceiverDepository, ret.UserID)
+		if err != nil || dep == nil {
+			c.logger.Log("mergeDishonoredReturns", fmt.Sprintf("problem reading depository=%s for transfer=%s", ret.ReceiverDepository, ret.TransferID), "error", err)
+			continue
+		}
+		accountNumber, err := dep.DecryptAccountNumber()
+		if err != nil {
+			c.logger.Log("mergeDishonoredReturns", fmt.Sprintf("problem decrypting depository=%s account number", dep.ID), "error", err)
+			continue
+		}
+
+		fileHeader, dishonored := dishonoredTransferReturn(ret, dep.RoutingNumber, accountNumber)
+		file, err := createReturnFile(fileHeader, []*incomingReturn{dishonored})
+		if err != nil {
+			c.logger.Log("mergeDishonoredReturns", fmt.Sprintf("problem creating dishonored return file for transfer=%s", ret.TransferID), "error", err)
+			continue
+		}
+		mergableFile, fileToUpload, err := c.mergeReturnFile(file, mergedDir)
+		if err != nil {
+			c.logger.Log("mergeDishonoredReturns", fmt.Sprintf("problem merging dishonored return of transfer=%s", ret.TransferID), "error", err)
+			continue
+		}
+		if err := transferRepo.MarkDishonoredReturnMerged(ret.TransferID, filepath.Base(mergableFile.filepath)); err != nil {
+			c.logger.Log("mergeDishonoredReturns", fmt.Sprintf("BAD ERROR - unable to mark dishonored return of transfer=%s as merged", ret.TransferID), "error", err)
+			continue
+		}
+		c.logger.Log("mergeDishonoredReturns", fmt.Sprintf("merged dishonored return of transfer=%s with returnCode=%s into %s", ret.TransferID, ret.DishonoredReturnCode, mergableFile.filepath))
+		if fileToUpload != nil {
+			filesToUpload = append(filesToUpload, fileToUpload)
+		}
+	}
+	return filesToUpload
+}
+
+// dishonoredTransferReturn rebuilds the FileHeader and forward entry of a TransferReturn so it can be dishonored.
+// routingNumber and accountNumber are of the Transfer's receiver Depository.
+func dishonoredTransferReturn(ret *transfers.TransferReturn, routingNumber string, accountNumber string) (ach.FileHeader, *incomingReturn) {
+	// createReturnFile swaps the origin and destination, so this looks like the header of the return file we received.
+	fileHeader := ach.NewFileHeader()
+	fileHeader.ImmediateOrigin = ret.Origin
+	fileHeader.ImmediateDestination = ret.Destination
+
+	header := ach.NewBatchHeader()
+	header.ServiceClassCode = ret.ServiceClassCode
+	header.CompanyName = ret.CompanyName
+	header.CompanyIdentification = ret.CompanyIdentification
+	header.StandardEntryClassCode = ret.StandardEntryClassCode
+	header.CompanyEntryDescription = ret.CompanyEntryDescription
+
+	entry := ach.NewEntryDetail()
+	entry.TransactionCode = ret.TransactionCode
+	entry.SetRDFI(routingNumber)
+	entry.DFIAccountNumber = accountNumber
+	entry.Amount = ret.Amount.Int()
+	entry.IdentificationNumber = ret.IdentificationNumber
+	entry.IndividualName = ret.IndividualName
+	entry.TraceNumber = ret.OriginalTrace
+
+	return fileHeader, &incomingReturn{
+		header:             header,
+		entry:              entry,
+		returnCode:         ret.DishonoredReturnCode,
+		addendaInformation: dishonoredAddendaInformation(ret),
+		returnTraceNumber:  ret.TraceNumber,
+	}
+}
+
+// dishonoredAddendaInformation formats the Addenda99 information (positions 36-79) of a dishonored return: three
+// reserved spaces followed by the return's trace number, settlement date, reason code and our addenda information.
+func dishonoredAddendaInformation(ret *transfers.TransferReturn) string {
+	return fmt.Sprintf("%3s%-15.15s%-3.3s%-2.2s%-.21s", "", ret.TraceNumber, ret.SettlementDate, strings.TrimPrefix(ret.ReturnCode, "R"), ret.DishonoredAddendaInformation)
+}
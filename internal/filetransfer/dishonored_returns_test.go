@@ -0,0 +1,247 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/accounts"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+)
+
+func testReturnEntry(returnCode string, originalTrace string) (ach.FileHeader, *ach.BatchHeader, *ach.EntryDetail) {
+	fileHeader := ach.NewFileHeader()
+	fileHeader.ImmediateOrigin = "076401251"
+	fileHeader.ImmediateDestination = "053200019"
+
+	header := ach.NewBatchHeader()
+	header.StandardEntryClassCode = "PPD"
+	header.EffectiveEntryDate = time.Now().Format("060102")
+
+	entry := ach.NewEntryDetail()
+	entry.TransactionCode = 26
+	entry.Amount = 10500
+	entry.TraceNumber = "076401250000001"
+	entry.Addenda99 = ach.NewAddenda99()
+	entry.Addenda99.ReturnCode = returnCode
+	entry.Addenda99.OriginalTrace = originalTrace
+	return fileHeader, header, entry
+}
+
+func TestDishonoredReturns__addendaInformation(t *testing.T) {
+	ret := &transfers.TransferReturn{
+		ReturnCode:                   "R01",
+		TraceNumber:                  "053200010000001",
+		SettlementDate:               "032",
+		DishonoredAddendaInformation: "untimely",
+	}
+	if v := dishonoredAddendaInformation(ret); v != "   05320001000000103201untimely" {
+		t.Errorf("got %q", v)
+	}
+	ret.SettlementDate = ""
+	if v := dishonoredAddendaInformation(ret); v != "   053200010000001   01untimely" {
+		t.Errorf("got %q", v)
+	}
+}
+
+func TestDishonoredReturns__merge(t *testing.T) {
+	controller, depRepo, transferRepo, _, sqliteDB := setupIncomingEntriesController(t, nil)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	userID := id.User(base.ID())
+	dep := writeIncomingDepository(t, depRepo, userID, model.DepositoryVerified)
+
+	amt, _ := model.NewAmount("USD", "105.00")
+	ret := &transfers.TransferReturn{
+		TransferID:              id.Transfer(base.ID()),
+		UserID:                  userID,
+		ReceiverDepository:      dep.ID,
+		ReturnCode:              "R01",
+		TraceNumber:             "053200010000001",
+		OriginalTrace:           "076401250000001",
+		SettlementDate:          "032",
+		Origin:                  "053200019",
+		Destination:             "076401251",
+		StandardEntryClassCode:  "PPD",
+		ServiceClassCode:        225,
+		CompanyName:             "Acme Corp",
+		CompanyIdentification:   "076401251",
+		CompanyEntryDescription: "payroll",
+		TransactionCode:         26,
+		Amount:                  *amt,
+		IndividualName:          "Jane Doe",
+		Created:                 time.Now(),
+	}
+	if err := transferRepo.CreateTransferReturn(ret); err != nil {
+		t.Fatal(err)
+	}
+	if err := transferRepo.DishonorTransferReturn(ret.TransferID, "R68", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	mergedDir := filepath.Join(controller.rootDir, "merged")
+	os.Mkdir(mergedDir, 0777)
+	controller.mergeDishonoredReturns(mergedDir, transferRepo, depRepo, nil)
+
+	files, err := grabAllFiles(mergedDir, nil)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d merged files: %v", len(files), err)
+	}
+	if files[0].Header.ImmediateDestination != "053200019" || files[0].Header.ImmediateOrigin != "076401251" {
+		t.Errorf("unexpected FileHeader: %#v", files[0].Header)
+	}
+	if len(files[0].ReturnEntries) != 1 {
+		t.Fatalf("got %d return batches", len(files[0].ReturnEntries))
+	}
+	ed := files[0].ReturnEntries[0].GetEntries()[0]
+	if ed.RDFIIdentification != "05320001" || ed.TransactionCode != 26 || ed.Amount != 10500 || strings.TrimSpace(ed.DFIAccountNumber) != "12345" {
+		t.Errorf("unexpected dishonored return entry: %#v", ed)
+	}
+	if ed.Addenda99.ReturnCode != "R68" || ed.Addenda99.OriginalTrace != "076401250000001" || ed.Addenda99.OriginalDFI != "05320001" {
+		t.Errorf("unexpected Addenda99: %#v", ed.Addenda99)
+	}
+
+	// Check each field is at its NACHA position (1-indexed) in the dishonored return's Addenda99 as written
+	bs, err := ioutil.ReadFile(files[0].filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record string
+	for _, line := range strings.Split(string(bs), "\n") {
+		if strings.HasPrefix(line, "799") {
+			record = line
+		}
+	}
+	if len(record) != 94 {
+		t.Fatalf("Addenda99 is %d characters: %q", len(record), record)
+	}
+	columns := []struct {
+		start, end int
+		expected   string
+	}{
+		{1, 3, "799"},
+		{4, 6, "R68"},                     // Dishonored Return Reason Code
+		{7, 21, "076401250000001"},        // Original Entry Trace Number
+		{22, 27, "      "},                // Reserved
+		{28, 35, "05320001"},              // Original Receiving DFI Identification
+		{36, 38, "   "},                   // Reserved
+		{39, 53, "053200010000001"},       // Return Trace Number
+		{54, 56, "032"},                   // Return Settlement Date
+		{57, 58, "01"},                    // Return Reason Code
+		{59, 79, strings.Repeat(" ", 21)}, // Addenda Information
+	}
+	for _, col := range columns {
+		if v := record[col.start-1 : col.end]; v != col.expected {
+			t.Errorf("positions %d-%d: got %q expected %q", col.start, col.end, v, col.expected)
+		}
+	}
+
+	// the dishonored return isn't merged again
+	if returns, err := transferRepo.GetPendingDishonoredReturns(); err != nil || len(returns) != 0 {
+		t.Errorf("got %d pending dishonored returns: %v", len(returns), err)
+	}
+}
+
+func TestDishonoredReturns__processDishonoredReturnEntry(t *testing.T) {
+	accountsClient := &accounts.MockClient{
+		Accounts:    []accounts.Account{{ID: base.ID()}},
+		Transaction: &accounts.Transaction{ID: base.ID()},
+	}
+	controller, depRepo, transferRepo, _, sqliteDB := setupIncomingEntriesController(t, accountsClient)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	userID := id.User(base.ID())
+	dep := writeIncomingDepository(t, depRepo, userID, model.DepositoryVerified)
+
+	amt, _ := model.NewAmount("USD", "105.00")
+	xfer := &transfers.IncomingTransfer{
+		ID:           id.Transfer(base.ID()),
+		UserID:       userID,
+		DepositoryID: dep.ID,
+		Type:         model.PullTransfer,
+		Amount:       *amt,
+		TraceNumber:  "076401255655291",
+		Origin:       "076401251",
+		Destination:  "053200019",
+		Status:       model.TransferReclaimed,
+		ReturnCode:   "R10",
+		Created:      time.Now(),
+	}
+	if err := transferRepo.CreateIncomingTransfer(xfer); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown trace number
+	fileHeader, header, entry := testReturnEntry("R68", "076401250000009")
+	if err := controller.processReturnEntry(fileHeader, header, entry, depRepo, transferRepo); err == nil {
+		t.Error("expected error")
+	}
+
+	fileHeader, header, entry = testReturnEntry("R68", xfer.TraceNumber)
+	if err := controller.processReturnEntry(fileHeader, header, entry, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	found, err := transferRepo.GetIncomingTransfer(xfer.ID)
+	if err != nil || found == nil {
+		t.Fatalf("transfer=%v error=%v", found, err)
+	}
+	if found.Status != model.TransferProcessed || found.TransactionID != accountsClient.Transaction.ID {
+		t.Errorf("unexpected incoming transfer: %#v", found)
+	}
+	if len(accountsClient.PostedTransactions) != 1 {
+		t.Errorf("got %d posted transactions", len(accountsClient.PostedTransactions))
+	}
+
+	// a second dishonored return is rejected since the transfer isn't returned
+	if err := controller.processReturnEntry(fileHeader, header, entry, depRepo, transferRepo); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDishonoredReturns__processContestedDishonoredReturnEntry(t *testing.T) {
+	controller, depRepo, _, _, sqliteDB := setupIncomingEntriesController(t, &accounts.MockClient{})
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	ret := &transfers.TransferReturn{
+		TransferID:              id.Transfer(base.ID()),
+		UserID:                  id.User(base.ID()),
+		ReturnCode:              "R01",
+		OriginalTrace:           "053200010000001",
+		DishonoredReturnCode:    "R68",
+		DishonoredTransactionID: base.ID(),
+	}
+	repo := &transfers.MockRepository{TransferReturns: []*transfers.TransferReturn{ret}}
+
+	// unknown trace number
+	fileHeader, header, entry := testReturnEntry("R73", "053200010000009")
+	if err := controller.processReturnEntry(fileHeader, header, entry, depRepo, repo); err == nil {
+		t.Error("expected error")
+	}
+
+	fileHeader, header, entry = testReturnEntry("R73", ret.OriginalTrace)
+	if err := controller.processReturnEntry(fileHeader, header, entry, depRepo, repo); err != nil {
+		t.Fatal(err)
+	}
+	if ret.ContestedReturnCode != "R73" || repo.Status != model.TransferReclaimed {
+		t.Errorf("unexpected return: %#v (status=%s)", ret, repo.Status)
+	}
+
+	// a second contested dishonored return is rejected
+	if err := controller.processReturnEntry(fileHeader, header, entry, depRepo, repo); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dryRunUploads = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_files_dry_run_uploads",
+		Help: "Counter of ACH files written to the outbox instead of being uploaded by dry-run routing numbers",
+	}, []string{"destination", "origin"})
+)
+
+// outboxDir returns the directory where files which would have been uploaded for routingNumber are written
+// while its Config is in dry-run mode.
+func (c *Controller) outboxDir(routingNumber string) string {
+	return filepath.Join(c.rootDir, "outbox", routingNumber)
+}
+
+// writeDryRunUpload saves f into the outbox of cfg as filename rather than uploading it. f is otherwise treated
+// as uploaded, so transfers are marked and files rotated the same way as a live upload.
+func (c *Controller) writeDryRunUpload(cfg *Config, f *achFile, filename string) error {
+	if filename == "" || filename != filepath.Base(filename) {
+		return fmt.Errorf("invalid outbox filename %q", filename)
+	}
+	bs, err := readFile(f.filepath, f.keeper)
+	if err != nil {
+		return fmt.Errorf("problem reading %s for outbox: %v", f.filepath, err)
+	}
+	dir := c.outboxDir(cfg.RoutingNumber)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, filename)
+	if err := writeFile(path, bs, c.keeper); err != nil {
+		return fmt.Errorf("problem writing %s to outbox: %v", f.filepath, err)
+	}
+
+	c.logger.Log("dry-run", fmt.Sprintf("merged: wrote file %s to outbox as %s instead of uploading", f.filepath, path),
+		"origin", f.Header.ImmediateOrigin, "destination", f.Header.ImmediateDestination,
+		"entries", f.Control.EntryAddendaCount, "debits", f.Control.TotalDebitEntryDollarAmountInFile, "credits", f.Control.TotalCreditEntryDollarAmountInFile)
+	dryRunUploads.With("origin", f.Header.ImmediateOrigin, "destination", f.Header.ImmediateDestination).Add(1)
+	c.recordOutboundFile(f, filename)
+
+	return nil
+}
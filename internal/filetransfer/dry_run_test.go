@@ -0,0 +1,112 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/secrets"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestConfig__validateMode(t *testing.T) {
+	for _, mode := range []string{"", "live", "dry-run", "DRY-RUN"} {
+		if err := validateMode(mode); err != nil {
+			t.Errorf("mode %q: %v", mode, err)
+		}
+	}
+	if err := validateMode("shadow"); err == nil {
+		t.Error("expected error")
+	}
+
+	var cfg *Config
+	if cfg.dryRun() {
+		t.Error("nil Config isn't dry-run")
+	}
+	if (&Config{Mode: ModeLive}).dryRun() || !(&Config{Mode: "Dry-Run"}).dryRun() {
+		t.Error("unexpected dryRun()")
+	}
+}
+
+func TestController__dryRunUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	// No FTP or SFTP configs exist, so any upload attempt would fail
+	controller := &Controller{
+		rootDir:       dir,
+		keeper:        secrets.TestStringKeeper(t),
+		logger:        log.NewNopLogger(),
+		outboundFiles: &sqlOutboundFileRepository{db: db.DB},
+		repo: &mockRepository{
+			configs: []*Config{
+				{
+					RoutingNumber: "076401251",
+					Mode:          ModeDryRun,
+				},
+			},
+		},
+	}
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Header.ImmediateOrigin = "076401251"
+	mergedDir := filepath.Join(dir, "merged")
+	if err := os.MkdirAll(mergedDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	f := &achFile{File: file, filepath: filepath.Join(mergedDir, "20200101-076401251-1.ach"), keeper: controller.keeper}
+	if err := f.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := controller.startUpload([]*achFile{f}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the merged file is treated as uploaded
+	if _, err := os.Stat(f.filepath + ".uploaded"); err != nil {
+		t.Error(err)
+	}
+	// and written to our outbox instead, named from the outbound filename template
+	matches, err := filepath.Glob(filepath.Join(controller.outboxDir("076401251"), "*.ach"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("outbox files=%v error=%v", matches, err)
+	}
+	outboxed, err := parseACHFilepath(matches[0], controller.keeper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outboxed.Control.EntryAddendaCount != file.Control.EntryAddendaCount {
+		t.Errorf("unexpected outbox file: %#v", outboxed.Control)
+	}
+	// and recorded as uploaded like live files
+	outbound, err := controller.outboundFiles.getOutboundFiles(10)
+	if err != nil || len(outbound) != 1 {
+		t.Fatalf("outbound files=%#v error=%v", outbound, err)
+	}
+	if outbound[0].UploadedFilename != filepath.Base(matches[0]) || outbound[0].Filename != filepath.Base(f.filepath) {
+		t.Errorf("unexpected outbound file: %#v", outbound[0])
+	}
+
+	// live routing numbers still upload
+	controller.repo.(*mockRepository).configs[0].Mode = ModeLive
+	if err := controller.startUpload([]*achFile{f}); err == nil {
+		t.Error("expected error")
+	}
+}
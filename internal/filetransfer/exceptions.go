@@ -0,0 +1,418 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	exceptionReturn   = "return"
+	exceptionNOC      = "noc"
+	exceptionIncoming = "incoming"
+)
+
+var (
+	exceptionsRecorded = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_entry_exceptions",
+		Help: "Counter of inbound entries which didn't match a Transfer or Depository",
+	}, []string{"type", "origin"})
+
+	errExceptionNotFound = errors.New("exception not found")
+
+	// errExceptionRecorded is returned when an exception already exists for an entry's filename and trace number,
+	// such as when its file is downloaded again.
+	errExceptionRecorded = errors.New("exception already recorded")
+)
+
+// exception is an inbound entry (return, NOC or forward entry) we couldn't match to a Transfer or Depository.
+// Record holds the file header, batch header, entry and addenda records so the entry can be handled again
+// once an operator links it to a Transfer or Depository.
+type exception struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	Filename    string `json:"filename"`
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+	TraceNumber string `json:"traceNumber"`
+	Reason      string `json:"reason"`
+	Record      string `json:"record"`
+
+	Created time.Time `json:"created"`
+
+	// TransferID or DepositoryID is set once the exception is linked and handled
+	TransferID   id.Transfer   `json:"transferID,omitempty"`
+	DepositoryID id.Depository `json:"depositoryID,omitempty"`
+	ResolvedAt   *time.Time    `json:"resolvedAt,omitempty"`
+}
+
+// unmatchedEntryError is returned when an inbound entry doesn't match any Transfer or Depository, or can't be
+// read to find one. Retrying these entries won't help, so they're recorded as exceptions instead.
+type unmatchedEntryError struct {
+	msg string
+}
+
+func (e *unmatchedEntryError) Error() string {
+	return e.msg
+}
+
+// exceptionRecord returns the NACHA records needed to handle entry again.
+func exceptionRecord(fileHeader ach.FileHeader, header *ach.BatchHeader, entry *ach.EntryDetail) string {
+	lines := []string{fileHeader.String(), header.String(), entry.String()}
+	for i := range entry.Addenda05 {
+		lines = append(lines, entry.Addenda05[i].String())
+	}
+	if entry.Addenda98 != nil {
+		lines = append(lines, entry.Addenda98.String())
+	}
+	if entry.Addenda99 != nil {
+		lines = append(lines, entry.Addenda99.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseExceptionRecord reads the records written by exceptionRecord.
+func parseExceptionRecord(record string) (ach.FileHeader, *ach.BatchHeader, *ach.EntryDetail, error) {
+	fileHeader := ach.NewFileHeader()
+	lines := strings.Split(record, "\n")
+	if len(lines) < 3 {
+		return fileHeader, nil, nil, fmt.Errorf("exception record has %d lines", len(lines))
+	}
+	fileHeader.Parse(lines[0])
+
+	header := ach.NewBatchHeader()
+	header.Parse(lines[1])
+
+	entry := ach.NewEntryDetail()
+	entry.Parse(lines[2])
+
+	for _, line := range lines[3:] {
+		if len(line) < 3 {
+			continue
+		}
+		switch line[1:3] {
+		case "05":
+			addenda05 := ach.NewAddenda05()
+			addenda05.Parse(line)
+			entry.AddAddenda05(addenda05)
+		case "98":
+			entry.Addenda98 = ach.NewAddenda98()
+			entry.Addenda98.Parse(line)
+			entry.Category = ach.CategoryNOC
+		case "99":
+			entry.Addenda99 = ach.NewAddenda99()
+			entry.Addenda99.Parse(line)
+			entry.Category = ach.CategoryReturn
+		}
+	}
+	return fileHeader, header, entry, nil
+}
+
+// recordException saves an entry we couldn't match so it can be linked by an operator. Each entry (by filename
+// and trace number) is only recorded once.
+func (c *Controller) recordException(kind string, filename string, fileHeader ach.FileHeader, header *ach.BatchHeader, entry *ach.EntryDetail, reason error) {
+	if c.exceptions == nil {
+		exceptionsRecorded.With("type", kind, "origin", fileHeader.ImmediateOrigin).Add(1)
+		return
+	}
+	ex := &exception{
+		ID:          base.ID(),
+		Type:        kind,
+		Filename:    filename,
+		Origin:      fileHeader.ImmediateOrigin,
+		Destination: fileHeader.ImmediateDestination,
+		TraceNumber: entry.TraceNumberField(),
+		Record:      exceptionRecord(fileHeader, header, entry),
+		Created:     time.Now(),
+	}
+	if reason != nil {
+		ex.Reason = reason.Error()
+	}
+	if err := c.exceptions.recordException(ex); err != nil {
+		if err == errExceptionRecorded {
+			c.logger.Log("exceptions", fmt.Sprintf("%s exception from %s was already recorded", kind, filename), "traceNumber", ex.TraceNumber)
+		} else {
+			c.logger.Log("exceptions", fmt.Sprintf("problem recording %s exception from %s", kind, filename), "error", err, "traceNumber", ex.TraceNumber)
+		}
+		return
+	}
+	exceptionsRecorded.With("type", kind, "origin", fileHeader.ImmediateOrigin).Add(1)
+	c.logger.Log("exceptions", fmt.Sprintf("recorded %s exception=%s from %s", kind, ex.ID, filename), "traceNumber", ex.TraceNumber)
+}
+
+// linkException handles an exception's entry again as the return, NOC or forward entry of the Transfer or Depository
+// an operator has linked it to. Forward entries can only be linked to a Depository.
+func (c *Controller) linkException(exceptionID string, transferID id.Transfer, depositoryID id.Depository, depRepo depository.Repository, transferRepo transfers.Repository) error {
+	if c.exceptions == nil {
+		return errExceptionNotFound
+	}
+	if (transferID == "") == (depositoryID == "") {
+		return errors.New("either transferID or depositoryID is required")
+	}
+	ex, err := c.exceptions.getException(exceptionID)
+	if err != nil {
+		return err
+	}
+	if ex == nil {
+		return errExceptionNotFound
+	}
+	if ex.ResolvedAt != nil {
+		return fmt.Errorf("exception=%s was already resolved", ex.ID)
+	}
+	switch ex.Type {
+	case exceptionReturn, exceptionNOC, exceptionIncoming:
+	default:
+		return fmt.Errorf("unknown exception type %q", ex.Type)
+	}
+	fileHeader, header, entry, err := parseExceptionRecord(ex.Record)
+	if err != nil {
+		return err
+	}
+
+	var transfer *model.Transfer
+	if transferID != "" {
+		if ex.Type == exceptionIncoming {
+			return errors.New("incoming entries can only be linked to a depository")
+		}
+		transfer, err = transferRepo.GetTransfer(transferID)
+		if err != nil || transfer == nil {
+			return fmt.Errorf("problem reading transfer=%s: %v", transferID, err)
+		}
+	}
+	depID := depositoryID
+	if transfer != nil && ex.Type == exceptionNOC {
+		depID = transfer.ReceiverDepository // NOCs correct the Receiver's account
+	}
+	var dep *model.Depository
+	if depID != "" {
+		dep, err = depRepo.GetDepository(depID)
+		if err != nil || dep == nil {
+			return fmt.Errorf("problem reading depository=%s: %v", depID, err)
+		}
+	}
+
+	// The exception is resolved and linked (in one statement) before its entry is handled, so the entry is only
+	// handled once when an exception is linked concurrently. Handling writes through other repositories, which
+	// SQLite blocks while a transaction is open, so the link is undone instead if handling fails.
+	if err := c.exceptions.resolveException(ex.ID, transferID, depositoryID); err != nil {
+		return err
+	}
+
+	// The linked objects are returned from the lookups normally used to match entries
+	var linkedDeps depository.Repository = &linkedDepositoryRepository{Repository: depRepo, dep: dep}
+	var linkedTransfers transfers.Repository = &linkedTransferRepository{Repository: transferRepo, transfer: transfer}
+
+	req := &periodicFileOperationsRequest{requestID: base.ID()}
+	switch ex.Type {
+	case exceptionReturn:
+		err = c.processReturnEntry(fileHeader, header, entry, linkedDeps, linkedTransfers)
+
+	case exceptionNOC:
+		if transfer == nil {
+			linkedTransfers = transferRepo // match the Transfer as we normally would
+		}
+		err = c.handleNOCEntry(req, fileHeader, header, entry, ex.Filename, dep, linkedDeps, linkedTransfers)
+
+	case exceptionIncoming:
+		var returnCode string
+		returnCode, err = c.postIncomingEntry(req, fileHeader, header, entry, ex.Filename, linkedDeps, transferRepo)
+		if err == nil && returnCode != "" {
+			err = c.returnIncomingEntries(fileHeader, []*incomingReturn{{header: header, entry: entry, returnCode: returnCode}})
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("problem handling %s exception=%s: %v rollback=%v", ex.Type, ex.ID, err, c.exceptions.unresolveException(ex.ID))
+	}
+	return nil
+}
+
+// linkedTransferRepository returns the Transfer an exception was linked to from return and NOC lookups.
+// A nil transfer means no Transfer matches.
+type linkedTransferRepository struct {
+	transfers.Repository
+	transfer *model.Transfer
+}
+
+func (r *linkedTransferRepository) LookupTransferFromTrace(traceNumber string, amount *model.Amount) (*model.Transfer, error) {
+	return r.transfer, nil
+}
+
+func (r *linkedTransferRepository) LookupTransferFromNOC(traceNumber string) (*model.Transfer, error) {
+	return r.transfer, nil
+}
+
+func (r *linkedTransferRepository) LookupTransferFromReturn(sec string, amount *model.Amount, traceNumber string, effectiveEntryDate time.Time) (*model.Transfer, error) {
+	return r.transfer, nil
+}
+
+// linkedDepositoryRepository returns the Depository an exception was linked to from return and inbound lookups.
+type linkedDepositoryRepository struct {
+	depository.Repository
+	dep *model.Depository
+}
+
+func (r *linkedDepositoryRepository) LookupMicroDepositFromTrace(traceNumber string, amount *model.Amount) (*model.Depository, *depository.MicroDeposit, error) {
+	if r.dep == nil {
+		return r.Repository.LookupMicroDepositFromTrace(traceNumber, amount)
+	}
+	return nil, nil, nil // match the micro-deposit by amount on the linked Depository
+}
+
+func (r *linkedDepositoryRepository) LookupMicroDepositFromNOC(traceNumber string) (*model.Depository, error) {
+	if r.dep == nil {
+		return r.Repository.LookupMicroDepositFromNOC(traceNumber)
+	}
+	return r.dep, nil
+}
+
+func (r *linkedDepositoryRepository) LookupDepositoryFromReturn(routingNumber string, accountNumber string) (*model.Depository, error) {
+	if r.dep == nil {
+		return r.Repository.LookupDepositoryFromReturn(routingNumber, accountNumber)
+	}
+	return r.dep, nil
+}
+
+type exceptionRepository interface {
+	getExceptions(resolved bool, limit int) ([]*exception, error)
+	getException(id string) (*exception, error)
+
+	recordException(ex *exception) error
+
+	// resolveException links an unresolved exception to a Transfer or Depository, returning an error if it was
+	// already resolved. unresolveException undoes this when its entry couldn't be handled.
+	resolveException(id string, transferID id.Transfer, depositoryID id.Depository) error
+	unresolveException(id string) error
+}
+
+type sqlExceptionRepository struct {
+	db *sql.DB
+}
+
+const exceptionColumns = `exception_id, type, filename, origin, destination, trace_number, reason, record, created_at, transfer_id, depository_id, resolved_at`
+
+func (r *sqlExceptionRepository) getExceptions(resolved bool, limit int) ([]*exception, error) {
+	query := `select ` + exceptionColumns + ` from ach_entry_exceptions where resolved_at is null order by created_at desc limit ?;`
+	if resolved {
+		query = `select ` + exceptionColumns + ` from ach_entry_exceptions where resolved_at is not null order by created_at desc limit ?;`
+	}
+	return r.queryExceptions(query, limit)
+}
+
+func (r *sqlExceptionRepository) getException(exceptionID string) (*exception, error) {
+	query := `select ` + exceptionColumns + ` from ach_entry_exceptions where exception_id = ? limit 1;`
+	exceptions, err := r.queryExceptions(query, exceptionID)
+	if err != nil || len(exceptions) == 0 {
+		return nil, err
+	}
+	return exceptions[0], nil
+}
+
+func (r *sqlExceptionRepository) queryExceptions(query string, args ...interface{}) ([]*exception, error) {
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("queryExceptions: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("queryExceptions: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*exception
+	for rows.Next() {
+		var ex exception
+		var transferID, depositoryID *string
+		err := rows.Scan(&ex.ID, &ex.Type, &ex.Filename, &ex.Origin, &ex.Destination, &ex.TraceNumber, &ex.Reason, &ex.Record,
+			&ex.Created, &transferID, &depositoryID, &ex.ResolvedAt)
+		if err != nil {
+			return nil, fmt.Errorf("queryExceptions: scan: %v", err)
+		}
+		if transferID != nil {
+			ex.TransferID = id.Transfer(*transferID)
+		}
+		if depositoryID != nil {
+			ex.DepositoryID = id.Depository(*depositoryID)
+		}
+		out = append(out, &ex)
+	}
+	return out, rows.Err()
+}
+
+func (r *sqlExceptionRepository) recordException(ex *exception) error {
+	query := `insert into ach_entry_exceptions (exception_id, type, filename, origin, destination, trace_number, reason, record, created_at)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("recordException: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(ex.ID, ex.Type, ex.Filename, ex.Origin, ex.Destination, ex.TraceNumber, ex.Reason, ex.Record, ex.Created)
+	if err != nil {
+		if database.UniqueViolation(err) {
+			return errExceptionRecorded
+		}
+		return fmt.Errorf("recordException: exception=%s: %v", ex.ID, err)
+	}
+	return nil
+}
+
+func (r *sqlExceptionRepository) resolveException(exceptionID string, transferID id.Transfer, depositoryID id.Depository) error {
+	query := `update ach_entry_exceptions set transfer_id = ?, depository_id = ?, resolved_at = ? where exception_id = ? and resolved_at is null;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("resolveException: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	var xferID, depID *string
+	if transferID != "" {
+		v := string(transferID)
+		xferID = &v
+	}
+	if depositoryID != "" {
+		v := string(depositoryID)
+		depID = &v
+	}
+	res, err := stmt.Exec(xferID, depID, time.Now(), exceptionID)
+	if err != nil {
+		return fmt.Errorf("resolveException: exception=%s: %v", exceptionID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("exception=%s was already resolved", exceptionID)
+	}
+	return nil
+}
+
+func (r *sqlExceptionRepository) unresolveException(exceptionID string) error {
+	query := `update ach_entry_exceptions set transfer_id = null, depository_id = null, resolved_at = null where exception_id = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("unresolveException: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(exceptionID); err != nil {
+		return fmt.Errorf("unresolveException: exception=%s: %v", exceptionID, err)
+	}
+	return nil
+}
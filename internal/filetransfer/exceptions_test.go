@@ -0,0 +1,296 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/base/admin"
+	"github.com/moov-io/paygate/internal/config"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+)
+
+func setupExceptionController(t *testing.T) (*Controller, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "exceptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := database.CreateTestSqliteDB(t)
+
+	controller, err := NewController(config.Empty(), dir, NewRepository("", nil, "", nil), nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.exceptions = &sqlExceptionRepository{db: db.DB}
+
+	return controller, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// copyTestFile copies a file from testdata into dir
+func copyTestFile(t *testing.T, name string, dir string) {
+	t.Helper()
+
+	bs, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(dir, 0777)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExceptions__record(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, entry := file.ReturnEntries[0].GetHeader(), file.ReturnEntries[0].GetEntries()[0]
+
+	fileHeader, bh, ed, err := parseExceptionRecord(exceptionRecord(file.Header, header, entry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileHeader.ImmediateOrigin != file.Header.ImmediateOrigin || bh.StandardEntryClassCode != header.StandardEntryClassCode {
+		t.Errorf("fileHeader=%#v header=%#v", fileHeader, bh)
+	}
+	if ed.TraceNumber != entry.TraceNumber || ed.Amount != entry.Amount || ed.Addenda99 == nil || ed.Addenda99.ReturnCode != "R01" {
+		t.Errorf("unexpected entry: %#v", ed)
+	}
+
+	if _, _, _, err := parseExceptionRecord("101"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestExceptions__repository(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	repo := &sqlExceptionRepository{db: db.DB}
+	ex := &exception{ID: base.ID(), Type: exceptionNOC, Filename: "cor-c01.ach", TraceNumber: "121042880000001", Record: "1", Reason: "depository not found"}
+	if err := repo.recordException(ex); err != nil {
+		t.Fatal(err)
+	}
+
+	exceptions, err := repo.getExceptions(false, 10)
+	if err != nil || len(exceptions) != 1 {
+		t.Fatalf("exceptions=%#v error=%v", exceptions, err)
+	}
+	if e := exceptions[0]; e.ID != ex.ID || e.Type != exceptionNOC || e.Reason != "depository not found" || e.ResolvedAt != nil {
+		t.Errorf("unexpected exception: %#v", e)
+	}
+
+	// each entry is only recorded once
+	dup := *ex
+	dup.ID = base.ID()
+	if err := repo.recordException(&dup); err != errExceptionRecorded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// resolving can be undone, but exceptions are only resolved once
+	if err := repo.resolveException(ex.ID, "", id.Depository("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.unresolveException(ex.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.resolveException(ex.ID, "", id.Depository("dep")); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.resolveException(ex.ID, "", id.Depository("other")); err == nil {
+		t.Error("expected error")
+	}
+	if exceptions, err := repo.getExceptions(false, 10); len(exceptions) != 0 || err != nil {
+		t.Errorf("exceptions=%#v error=%v", exceptions, err)
+	}
+	e, err := repo.getException(ex.ID)
+	if err != nil || e == nil {
+		t.Fatalf("exception=%#v error=%v", e, err)
+	}
+	if e.DepositoryID != "dep" || e.TransferID != "" || e.ResolvedAt == nil {
+		t.Errorf("unexpected exception: %#v", e)
+	}
+
+	if e, err := repo.getException(base.ID()); e != nil || err != nil {
+		t.Errorf("exception=%#v error=%v", e, err)
+	}
+}
+
+func TestExceptions__linkReturn(t *testing.T) {
+	controller, cleanup := setupExceptionController(t)
+	defer cleanup()
+
+	// Neither a Transfer or Depository matches our return
+	dir := filepath.Join(controller.rootDir, "returned")
+	copyTestFile(t, "return-WEB.ach", dir)
+	if err := controller.processReturnFiles(dir, &depository.MockRepository{}, &transfers.MockRepository{}); err != nil {
+		t.Fatal(err)
+	}
+	// the same entries aren't recorded again when the file is read again
+	if err := controller.processReturnFiles(dir, &depository.MockRepository{}, &transfers.MockRepository{}); err != nil {
+		t.Fatal(err)
+	}
+	exceptions, err := controller.exceptions.getExceptions(false, 10)
+	if err != nil || len(exceptions) != 2 {
+		t.Fatalf("exceptions=%#v error=%v", exceptions, err)
+	}
+	ex := exceptions[0]
+	if ex.Type != exceptionReturn || ex.Filename != "return-WEB.ach" || ex.Reason == "" {
+		t.Errorf("unexpected exception: %#v", ex)
+	}
+
+	amt, _ := model.NewAmount("USD", "52.12")
+	depRepo := &depository.MockRepository{
+		Depositories: []*model.Depository{{ID: id.Depository(base.ID()), Status: model.DepositoryVerified}},
+	}
+	transferRepo := &transfers.MockRepository{
+		Xfer: &model.Transfer{
+			ID:                   id.Transfer(base.ID()),
+			Type:                 model.PushTransfer,
+			Amount:               *amt,
+			OriginatorDepository: id.Depository("orig-depository"),
+			ReceiverDepository:   id.Depository("rec-depository"),
+			UserID:               base.ID(),
+			TransactionID:        base.ID(),
+		},
+	}
+
+	// either a transfer or depository is required
+	if err := controller.linkException(ex.ID, "", "", depRepo, transferRepo); err == nil {
+		t.Error("expected error")
+	}
+	if err := controller.linkException(base.ID(), transferRepo.Xfer.ID, "", depRepo, transferRepo); err != errExceptionNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the exception stays unresolved when its entry can't be handled
+	if err := controller.linkException(ex.ID, transferRepo.Xfer.ID, "", &depository.MockRepository{Err: errors.New("bad error")}, transferRepo); err == nil {
+		t.Error("expected error")
+	}
+	if exceptions, _ := controller.exceptions.getExceptions(false, 10); len(exceptions) != 2 {
+		t.Errorf("got %d unresolved exceptions", len(exceptions))
+	}
+
+	if err := controller.linkException(ex.ID, transferRepo.Xfer.ID, "", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if transferRepo.ReturnCode == "" || transferRepo.Status != model.TransferReclaimed {
+		t.Errorf("returnCode=%q status=%q", transferRepo.ReturnCode, transferRepo.Status)
+	}
+	if exceptions, _ := controller.exceptions.getExceptions(true, 10); len(exceptions) != 1 || exceptions[0].TransferID != transferRepo.Xfer.ID {
+		t.Errorf("unexpected exceptions: %#v", exceptions)
+	}
+
+	// exceptions are only linked once
+	if err := controller.linkException(ex.ID, transferRepo.Xfer.ID, "", depRepo, transferRepo); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestExceptions__linkNOC(t *testing.T) {
+	controller, cleanup := setupExceptionController(t)
+	defer cleanup()
+
+	dir := filepath.Join(controller.rootDir, "inbound")
+	copyTestFile(t, "cor-c01.ach", dir)
+
+	req := &periodicFileOperationsRequest{}
+	if err := controller.processInboundFiles(req, dir, &depository.MockRepository{}, &transfers.MockRepository{}); err != nil {
+		t.Fatal(err)
+	}
+	exceptions, err := controller.exceptions.getExceptions(false, 10)
+	if err != nil || len(exceptions) != 1 {
+		t.Fatalf("exceptions=%#v error=%v", exceptions, err)
+	}
+	if ex := exceptions[0]; ex.Type != exceptionNOC || ex.Reason != "depository not found" {
+		t.Errorf("unexpected exception: %#v", ex)
+	}
+
+	depRepo := &depository.MockRepository{
+		Depositories: []*model.Depository{{ID: id.Depository(base.ID()), RoutingNumber: "121042882", Status: model.DepositoryVerified}},
+	}
+	if err := controller.linkException(exceptions[0].ID, "", depRepo.Depositories[0].ID, depRepo, &transfers.MockRepository{}); err != nil {
+		t.Fatal(err)
+	}
+	if depRepo.Status != model.DepositoryRejected {
+		t.Errorf("unexpected depository status: %q", depRepo.Status)
+	}
+	if exceptions, _ := controller.exceptions.getExceptions(true, 10); len(exceptions) != 1 || exceptions[0].DepositoryID != depRepo.Depositories[0].ID {
+		t.Errorf("unexpected exceptions: %#v", exceptions)
+	}
+}
+
+func TestExceptions__admin(t *testing.T) {
+	controller, cleanup := setupExceptionController(t)
+	defer cleanup()
+
+	ex := &exception{ID: base.ID(), Type: exceptionReturn, Record: "1"}
+	if err := controller.exceptions.recordException(ex); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := admin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+	AddExceptionRoutes(log.NewNopLogger(), svc, controller, &depository.MockRepository{}, &transfers.MockRepository{})
+
+	resp, err := http.Get("http://" + svc.BindAddr() + "/files/exceptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	var exceptions []*exception
+	if err := json.NewDecoder(resp.Body).Decode(&exceptions); err != nil {
+		t.Fatal(err)
+	}
+	if len(exceptions) != 1 || exceptions[0].ID != ex.ID {
+		t.Errorf("unexpected exceptions: %#v", exceptions)
+	}
+
+	// link an unknown exception
+	body := bytes.NewReader([]byte(`{"depositoryID": "dep"}`))
+	resp, err = http.Post("http://"+svc.BindAddr()+"/files/exceptions/other/link", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	// invalid exception record
+	body = bytes.NewReader([]byte(`{"depositoryID": "dep"}`))
+	resp, err = http.Post("http://"+svc.BindAddr()+"/files/exceptions/"+ex.ID+"/link", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+}
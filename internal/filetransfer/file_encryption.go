@@ -0,0 +1,83 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/moov-io/paygate/internal/secrets"
+)
+
+// encryptedFileHeader is the first line of ACH files we've encrypted at rest. The remainder of the
+// file is the base64 encoded ciphertext of the ACH file.
+//
+// Files without this header are read as plaintext, which keeps files written before encryption was
+// enabled (or by a Controller without a keeper) mergable and uploadable.
+const encryptedFileHeader = "paygate-encrypted-ach-file:v1\n"
+
+var errNilFileKeeper = errors.New("encrypted ACH file with nil secrets keeper")
+
+// encryptFileContents returns contents encrypted with keeper for writing to disk. When keeper is nil
+// contents are returned unchanged.
+func encryptFileContents(keeper *secrets.StringKeeper, contents []byte) ([]byte, error) {
+	if keeper == nil {
+		return contents, nil
+	}
+	enc, err := keeper.EncryptString(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("problem encrypting ACH file: %v", err)
+	}
+	return []byte(encryptedFileHeader + enc + "\n"), nil
+}
+
+// decryptFileContents returns the plaintext of contents read from disk. Plaintext files are returned unchanged.
+func decryptFileContents(keeper *secrets.StringKeeper, contents []byte) ([]byte, error) {
+	if !bytes.HasPrefix(contents, []byte(encryptedFileHeader)) {
+		return contents, nil
+	}
+	if keeper == nil {
+		return nil, errNilFileKeeper
+	}
+	enc := bytes.TrimSpace(contents[len(encryptedFileHeader):])
+	dec, err := keeper.DecryptString(string(enc))
+	if err != nil {
+		return nil, fmt.Errorf("problem decrypting ACH file: %v", err)
+	}
+	return []byte(dec), nil
+}
+
+// readFile returns the plaintext contents of path, decrypting them in memory if needed.
+func readFile(path string, keeper *secrets.StringKeeper) ([]byte, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decryptFileContents(keeper, bs)
+}
+
+// writeFile overwrites path with contents, which are encrypted when keeper is non-nil.
+func writeFile(path string, contents []byte, keeper *secrets.StringKeeper) error {
+	bs, err := encryptFileContents(keeper, contents)
+	if err != nil {
+		return err
+	}
+	fd, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(bs); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
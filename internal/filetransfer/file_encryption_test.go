@@ -0,0 +1,138 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moov-io/paygate/internal/secrets"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFileEncryption__roundTrip(t *testing.T) {
+	keeper := secrets.TestStringKeeper(t)
+
+	contents := []byte("101 076401251 0764012510807291511A094101achdestname            companyname                    \n")
+	enc, err := encryptFileContents(keeper, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(enc, contents) || !bytes.HasPrefix(enc, []byte(encryptedFileHeader)) {
+		t.Errorf("unexpected encrypted contents: %q", string(enc))
+	}
+	dec, err := decryptFileContents(keeper, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, contents) {
+		t.Errorf("got %q", string(dec))
+	}
+
+	// encrypted files can't be read without a keeper
+	if _, err := decryptFileContents(nil, enc); err != errNilFileKeeper {
+		t.Errorf("expected error: %v", err)
+	}
+
+	// plaintext passes through, with or without a keeper
+	if bs, err := encryptFileContents(nil, contents); err != nil || !bytes.Equal(bs, contents) {
+		t.Errorf("got %q: %v", string(bs), err)
+	}
+	if bs, err := decryptFileContents(keeper, contents); err != nil || !bytes.Equal(bs, contents) {
+		t.Errorf("got %q: %v", string(bs), err)
+	}
+}
+
+func TestFileEncryption__achFile(t *testing.T) {
+	keeper := secrets.TestStringKeeper(t)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "file-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &achFile{
+		File:     file,
+		filepath: filepath.Join(dir, "out.ach"),
+		keeper:   keeper,
+	}
+	if err := f.write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// account numbers aren't written to disk
+	bs, err := ioutil.ReadFile(f.filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accountNumber := file.Batches[0].GetEntries()[0].DFIAccountNumber; strings.Contains(string(bs), accountNumber) {
+		t.Errorf("found account number %q in %q", accountNumber, string(bs))
+	}
+
+	// read the file back for merging and uploading
+	if _, err := parseACHFilepath(f.filepath, nil); err == nil {
+		t.Error("expected error")
+	}
+	files, err := grabAllFiles(dir, keeper)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d files: %v", len(files), err)
+	}
+	if files[0].Header.ImmediateDestination != file.Header.ImmediateDestination || files[0].keeper != keeper {
+		t.Errorf("unexpected file: %#v", files[0])
+	}
+
+	agent := &mockFileTransferAgent{}
+	controller := &Controller{logger: log.NewNopLogger(), keeper: keeper}
+	if err := controller.uploadFile(agent, files[0], "out.ach"); err != nil {
+		t.Fatal(err)
+	}
+	uploaded, err := parseACHFile(agent.uploadedFile.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Control.EntryAddendaCount != file.Control.EntryAddendaCount {
+		t.Errorf("uploaded %#v", uploaded.Control)
+	}
+}
+
+func TestFileEncryption__writeFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-encryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	controller := &Controller{keeper: secrets.TestStringKeeper(t)}
+	files := []File{
+		{
+			Filename: "ppd-debit.ach",
+			Contents: readFileAsCloser(filepath.Join("..", "..", "testdata", "ppd-debit.ach")),
+		},
+	}
+	if err := controller.writeFiles(files, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "ppd-debit.ach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(bs, []byte(encryptedFileHeader)) {
+		t.Errorf("file isn't encrypted: %q", string(bs))
+	}
+	if file, err := parseACHFilepath(filepath.Join(dir, "ppd-debit.ach"), controller.keeper); err != nil || file == nil {
+		t.Errorf("file=%v error=%v", file, err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/database"
+)
+
+// maxFilesPerDay is the number of files which can be sent to a destination each day. NACHA limits
+// this by the File ID Modifier, which is one of A-Z followed by 0-9.
+const maxFilesPerDay = 36
+
+// fileSequenceRepository hands out sequence numbers for files we create for a destination (routing number)
+// each day. The sequence numbers start at 1 and are shared across paygate instances.
+type fileSequenceRepository interface {
+	nextFileSequence(destination string, day time.Time) (int, error)
+}
+
+type sqlFileSequenceRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlFileSequenceRepository) nextFileSequence(destination string, day time.Time) (int, error) {
+	date := day.Format("20060102")
+
+	// Retry once when another instance inserts the first sequence number for this day before us.
+	for i := 0; i < 2; i++ {
+		seq, err := r.incrementFileSequence(destination, date)
+		if err != nil {
+			return 0, err
+		}
+		if seq > 0 {
+			return seq, nil
+		}
+
+		query := `insert into file_sequences (destination, day, sequence) values (?, ?, 1);`
+		stmt, err := r.db.Prepare(query)
+		if err != nil {
+			return 0, fmt.Errorf("nextFileSequence: prepare insert: %v", err)
+		}
+		_, err = stmt.Exec(destination, date)
+		stmt.Close()
+		if err == nil {
+			return 1, nil
+		}
+		if !database.UniqueViolation(err) {
+			return 0, fmt.Errorf("nextFileSequence: insert: %v", err)
+		}
+	}
+	return 0, fmt.Errorf("nextFileSequence: unable to reserve sequence for %s on %s", destination, date)
+}
+
+// incrementFileSequence increments and returns the sequence number for destination on date. Zero is returned
+// when no sequence numbers have been handed out yet.
+func (r *sqlFileSequenceRepository) incrementFileSequence(destination string, date string) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("incrementFileSequence: begin: %v", err)
+	}
+
+	query := `update file_sequences set sequence = sequence + 1 where destination = ? and day = ?;`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("incrementFileSequence: prepare update: %v", err)
+	}
+	res, err := stmt.Exec(destination, date)
+	stmt.Close()
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("incrementFileSequence: update: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, tx.Rollback()
+	}
+
+	query = `select sequence from file_sequences where destination = ? and day = ? limit 1;`
+	stmt, err = tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("incrementFileSequence: prepare select: %v", err)
+	}
+	defer stmt.Close()
+
+	var seq int
+	if err := stmt.QueryRow(destination, date).Scan(&seq); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("incrementFileSequence: select: %v", err)
+	}
+	return seq, tx.Commit()
+}
+
+// memoryFileSequenceRepository keeps sequence numbers in memory for Controllers without a database.
+type memoryFileSequenceRepository struct {
+	mu        sync.Mutex
+	sequences map[string]int
+}
+
+func (r *memoryFileSequenceRepository) nextFileSequence(destination string, day time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sequences == nil {
+		r.sequences = make(map[string]int)
+	}
+	key := fmt.Sprintf("%s-%s", destination, day.Format("20060102"))
+	r.sequences[key]++
+	return r.sequences[key], nil
+}
+
+// fileIDModifier returns the File ID Modifier for a sequence number, which is A-Z followed by 0-9.
+func fileIDModifier(seq int) string {
+	if seq <= 26 {
+		return string(rune('A' + seq - 1))
+	}
+	return string(rune('0' + seq - 27))
+}
+
+// fileIDSequence returns the sequence number of a File ID Modifier, or zero if it's invalid.
+func fileIDSequence(modifier string) int {
+	if len(modifier) != 1 {
+		return 0
+	}
+	switch m := modifier[0]; {
+	case m >= 'A' && m <= 'Z':
+		return int(m-'A') + 1
+	case m >= '0' && m <= '9':
+		return int(m-'0') + 27
+	}
+	return 0
+}
+
+// nextFileSequence returns the next sequence number for a file sent to destination today.
+// An error is returned once every File ID Modifier for today has been used.
+func (c *Controller) nextFileSequence(destination string) (int, error) {
+	c.fileSequencesOnce.Do(func() {
+		if c.fileSequences == nil {
+			c.fileSequences = &memoryFileSequenceRepository{}
+		}
+	})
+
+	now := time.Now()
+	seq, err := c.fileSequences.nextFileSequence(destination, now)
+	if err != nil {
+		return 0, err
+	}
+	if seq > maxFilesPerDay {
+		return 0, fmt.Errorf("unable to create file for %s: all %d files (File ID Modifiers A-Z, 0-9) for %s have been created", destination, maxFilesPerDay, now.Format("2006-01-02"))
+	}
+	return seq, nil
+}
+
+// nextACHFilename reserves the next sequence number for file's destination, sets the FileHeader's FileIDModifier
+// and returns the rendered filename. Sequence numbers whose files already exist in dir are skipped.
+func (c *Controller) nextACHFilename(dir string, file *ach.File) (string, error) {
+	cfg := c.findFileTransferConfig(file.Header.ImmediateDestination)
+	for {
+		seq, err := c.nextFileSequence(file.Header.ImmediateDestination)
+		if err != nil {
+			return "", err
+		}
+		file.Header.FileIDModifier = fileIDModifier(seq)
+		filename, err := renderACHFilename(cfg.outboundFilenameTemplate(), newFilenameData(file, seq))
+		if err != nil {
+			return "", err
+		}
+		if fileExists(filepath.Join(dir, filename)) || fileExists(filepath.Join(dir, filename+".uploaded")) {
+			continue
+		}
+		return filename, nil
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
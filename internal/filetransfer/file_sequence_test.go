@@ -0,0 +1,113 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/database"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestFileSequences(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	repo := &sqlFileSequenceRepository{db: db.DB}
+
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if seq, err := repo.nextFileSequence("987654320", now); seq != i || err != nil {
+			t.Fatalf("seq=%d error=%v", seq, err)
+		}
+	}
+
+	// other destinations and days have their own sequence
+	if seq, err := repo.nextFileSequence("076401251", now); seq != 1 || err != nil {
+		t.Fatalf("seq=%d error=%v", seq, err)
+	}
+	if seq, err := repo.nextFileSequence("987654320", now.Add(24*time.Hour)); seq != 1 || err != nil {
+		t.Fatalf("seq=%d error=%v", seq, err)
+	}
+}
+
+func TestFileSequences__fileIDModifier(t *testing.T) {
+	cases := map[int]string{1: "A", 2: "B", 26: "Z", 27: "0", 36: "9"}
+	for seq, expected := range cases {
+		if v := fileIDModifier(seq); v != expected {
+			t.Errorf("seq=%d got %q", seq, v)
+		}
+		if n := fileIDSequence(expected); n != seq {
+			t.Errorf("%s: got %d", expected, n)
+		}
+	}
+	if n := fileIDSequence("a"); n != 0 {
+		t.Errorf("got %d", n)
+	}
+}
+
+func TestController__nextFileSequence(t *testing.T) {
+	controller := &Controller{logger: log.NewNopLogger()}
+
+	for i := 1; i <= maxFilesPerDay; i++ {
+		if seq, err := controller.nextFileSequence("987654320"); seq != i || err != nil {
+			t.Fatalf("seq=%d error=%v", seq, err)
+		}
+	}
+
+	// the 37th file of the day is rejected
+	if _, err := controller.nextFileSequence("987654320"); err == nil || !strings.Contains(err.Error(), "all 36 files") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if seq, err := controller.nextFileSequence("076401251"); seq != 1 || err != nil {
+		t.Errorf("seq=%d error=%v", seq, err)
+	}
+}
+
+func TestController__nextACHFilename(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "nextACHFilename")
+	defer os.RemoveAll(dir)
+
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	controller := &Controller{
+		logger:        log.NewNopLogger(),
+		repo:          &mockRepository{},
+		fileSequences: &sqlFileSequenceRepository{db: db.DB},
+	}
+	today := time.Now().Format("20060102")
+
+	// files from before we tracked sequence numbers are skipped
+	if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%s-987654320-1.ach.uploaded", today)), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := ach.NewFile()
+	file.Header.ImmediateDestination = "987654320"
+	filename, err := controller.nextACHFilename(dir, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != fmt.Sprintf("%s-987654320-2.ach", today) || file.Header.FileIDModifier != "B" {
+		t.Errorf("filename=%s FileIDModifier=%s", filename, file.Header.FileIDModifier)
+	}
+
+	filename, err = controller.nextACHFilename(dir, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != fmt.Sprintf("%s-987654320-3.ach", today) || file.Header.FileIDModifier != "C" {
+		t.Errorf("filename=%s FileIDModifier=%s", filename, file.Header.FileIDModifier)
+	}
+}
@@ -7,11 +7,15 @@ package filetransfer
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 	"time"
 
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/model"
+
 	"github.com/go-kit/kit/log"
 )
 
@@ -25,6 +29,65 @@ type Config struct {
 	OutboundFilenameTemplate string `json:"outboundFilenameTemplate" yaml:"outboundFilenameTemplate"`
 
 	AllowedIPs string
+
+	// Mode is either live (the default) or dry-run. Files for dry-run routing numbers are merged and
+	// named like live files, but written to a local outbox instead of being uploaded.
+	Mode string `json:"mode" yaml:"mode"`
+
+	// BalanceEntries makes merged files "balanced" for ODFIs which require them. Each batch gets an offset entry
+	// to the settlement account at OffsetRoutingNumber which nets its debits and credits to zero.
+	//
+	// OffsetAccountNumber is stored encrypted in the database.
+	BalanceEntries      bool   `json:"balanceEntries" yaml:"balanceEntries"`
+	OffsetRoutingNumber string `json:"offsetRoutingNumber" yaml:"offsetRoutingNumber"`
+	OffsetAccountNumber string `json:"offsetAccountNumber" yaml:"offsetAccountNumber"`
+	OffsetAccountType   string `json:"offsetAccountType" yaml:"offsetAccountType"`
+
+	// ConfirmationFormat is the format of the confirmations this ODFI sends after we upload a file, either
+	// nacha (ACK and ATX entries) or one registered with RegisterConfirmationParser. Empty means no confirmations
+	// are expected.
+	ConfirmationFormat string `json:"confirmationFormat" yaml:"confirmationFormat"`
+}
+
+const (
+	ModeLive   = "live"
+	ModeDryRun = "dry-run"
+)
+
+// validateMode returns an error if mode isn't a valid Config Mode. An empty mode is live.
+func validateMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case "", ModeLive, ModeDryRun:
+		return nil
+	}
+	return fmt.Errorf("unknown file transfer mode %q", mode)
+}
+
+// validateConfig returns an error if cfg has an unknown mode or confirmation format, or is missing the offset
+// account for balanced files.
+func validateConfig(cfg *Config) error {
+	if err := validateMode(cfg.Mode); err != nil {
+		return err
+	}
+	if err := validateConfirmationFormat(cfg.ConfirmationFormat); err != nil {
+		return err
+	}
+	if cfg.BalanceEntries {
+		if err := ach.CheckRoutingNumber(cfg.OffsetRoutingNumber); err != nil {
+			return fmt.Errorf("invalid offset routing number: %v", err)
+		}
+		if cfg.OffsetAccountNumber == "" {
+			return errors.New("missing offset account number")
+		}
+		if err := model.AccountType(strings.ToLower(cfg.OffsetAccountType)).Validate(); err != nil {
+			return fmt.Errorf("invalid offset account type: %v", err)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) dryRun() bool {
+	return cfg != nil && strings.EqualFold(cfg.Mode, ModeDryRun)
 }
 
 func (cfg *Config) outboundFilenameTemplate() string {
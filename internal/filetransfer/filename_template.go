@@ -7,13 +7,22 @@ package filetransfer
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
+
+	"github.com/moov-io/ach"
+	moovhttp "github.com/moov-io/base/http"
+
+	"github.com/go-kit/kit/log"
 )
 
 var (
@@ -28,14 +37,92 @@ var (
 )
 
 type filenameData struct {
-	RoutingNumber string
-	TransferType  string
+	RoutingNumber string `json:"routingNumber"`
+
+	// TransferType is "push" when every entry is a credit, "pull" when every entry is a debit and "mixed" otherwise
+	TransferType string `json:"transferType"`
 
 	// N is the sequence number for this file
-	N string
+	N string `json:"n"`
 
 	// GPG is true if the file has been encrypted with GPG
-	GPG bool
+	GPG bool `json:"gpg"`
+
+	// CompanyIdentification is from the first batch of the file
+	CompanyIdentification string `json:"companyIdentification"`
+
+	// FileIDModifier is from the FileHeader, which is A-Z followed by 0-9
+	FileIDModifier string `json:"fileIDModifier"`
+
+	// SameDay is true when a batch of the file settles on the day it's created
+	SameDay bool `json:"sameDay"`
+
+	// EntryCount is the number of entries in the file, which doesn't include addenda records
+	EntryCount int `json:"entryCount"`
+
+	// Checksum is the entry hash of the file, the sum of every entry's RDFI routing number (last 10 digits)
+	Checksum string `json:"checksum"`
+}
+
+// newFilenameData returns the template data for file with sequence number seq.
+func newFilenameData(file *ach.File, seq int) filenameData {
+	data := filenameData{
+		RoutingNumber:  file.Header.ImmediateDestination,
+		N:              strconv.Itoa(seq),
+		FileIDModifier: file.Header.FileIDModifier,
+	}
+
+	creationDate := file.Header.FileCreationDate
+	if creationDate == "" {
+		creationDate = time.Now().Format("060102") // YYMMDD
+	}
+
+	var credits, debits, hash int
+	for i := range file.Batches {
+		bh := file.Batches[i].GetHeader()
+		if i == 0 {
+			data.CompanyIdentification = strings.TrimSpace(bh.CompanyIdentification)
+		}
+		if bh.EffectiveEntryDate == creationDate {
+			data.SameDay = true
+		}
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			switch entries[j].CreditOrDebit() {
+			case "C":
+				credits++
+			case "D":
+				debits++
+			}
+			n, _ := strconv.Atoi(entries[j].RDFIIdentification)
+			hash += n
+		}
+		data.EntryCount += len(entries)
+	}
+	data.Checksum = fmt.Sprintf("%010d", hash%10000000000)
+
+	switch {
+	case credits > 0 && debits == 0:
+		data.TransferType = "push"
+	case debits > 0 && credits == 0:
+		data.TransferType = "pull"
+	case credits > 0 && debits > 0:
+		data.TransferType = "mixed"
+	}
+	return data
+}
+
+// sampleFilenameData is used to validate and preview templates.
+func sampleFilenameData() filenameData {
+	return filenameData{
+		RoutingNumber:         "987654320",
+		TransferType:          "push",
+		N:                     "1",
+		CompanyIdentification: "1234567890",
+		FileIDModifier:        "A",
+		EntryCount:            1,
+		Checksum:              "0009876543",
+	}
 }
 
 var filenameFunctions template.FuncMap = map[string]interface{}{
@@ -63,45 +150,28 @@ func renderACHFilename(raw string, data filenameData) (string, error) {
 	return buf.String(), nil
 }
 
-// roundSequenceNumber converts a sequence (int) to it's string value, which means 0-9 followed by A-Z
-func roundSequenceNumber(seq int) string {
-	if seq < 10 {
-		return fmt.Sprintf("%d", seq)
-	}
-	// 65 is ASCII/UTF-8 value for A
-	return string(65 + seq - 10) // A, B, ...
-}
-
-// achFilenameSeq returns the sequence number from a given achFilename
-// A sequence number of 0 indicates an error
-func achFilenameSeq(filename string) int {
-	replacer := strings.NewReplacer(".ach", "", ".gpg", "")
-	parts := strings.Split(replacer.Replace(filename), "-")
-	for i := range parts {
-		if parts[i] >= "A" && parts[i] <= "Z" {
-			return int(parts[i][0]) - 65 + 10 // A=65 in ASCII/UTF-8
-		}
-		// Assume routing numbers could be a minimum of 010,000,000
-		// and a number is a sequence number which we can increment
-		if n, err := strconv.Atoi(parts[i]); err == nil && (n > 0 && n < 10000000) {
-			return n
-		}
-	}
-	return 0
-}
-
 func ValidateTemplates(repo Repository) error {
-	if r, ok := repo.(*sqlRepository); ok {
-		templates, err := r.getOutboundFilenameTemplates()
+	var templates []string
+	switch r := repo.(type) {
+	case *sqlRepository:
+		tmpls, err := r.getOutboundFilenameTemplates()
 		if err != nil {
 			return fmt.Errorf("ValidateTemplates: %v", err)
 		}
-		for i := range templates {
-			if err := validateTemplate(templates[i]); err != nil {
-				return fmt.Errorf("ValidateTemplates: error parsing:\n  %s\n  %v", templates[i], err)
+		templates = tmpls
+	case *staticRepository:
+		configs, _ := r.GetConfigs()
+		for i := range configs {
+			if configs[i].OutboundFilenameTemplate != "" {
+				templates = append(templates, configs[i].OutboundFilenameTemplate)
 			}
 		}
 	}
+	for i := range templates {
+		if err := validateTemplate(templates[i]); err != nil {
+			return fmt.Errorf("ValidateTemplates: error parsing:\n  %s\n  %v", templates[i], err)
+		}
+	}
 	return validateTemplate(defaultFilenameTemplate)
 }
 
@@ -112,6 +182,52 @@ func validateTemplate(tmpl string) error {
 		return err
 	}
 
-	_, err = template.New(fmt.Sprintf("validate-%d", n)).Funcs(filenameFunctions).Parse(tmpl)
-	return err
+	t, err := template.New(fmt.Sprintf("validate-%d", n)).Funcs(filenameFunctions).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+	// Render the template to catch fields which don't exist
+	return t.Execute(ioutil.Discard, sampleFilenameData())
+}
+
+// previewFilenameTemplate renders a template against sample data (which can be overridden) so bank naming
+// specs can be checked before they're saved.
+func previewFilenameTemplate(logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		type request struct {
+			Template string       `json:"template"`
+			Data     filenameData `json:"data"`
+		}
+		req := request{
+			Data: sampleFilenameData(),
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if req.Template == "" {
+			moovhttp.Problem(w, errors.New("missing template"))
+			return
+		}
+		if err := validateTemplate(req.Template); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		filename, err := renderACHFilename(req.Template, req.Data)
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"filename": filename,
+		})
+	}
 }
@@ -5,10 +5,18 @@
 package filetransfer
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/moov-io/base/admin"
+
+	"github.com/go-kit/kit/log"
 )
 
 func TestFilenameTemplate(t *testing.T) {
@@ -75,15 +83,6 @@ func TestFilenameTemplate__functions(t *testing.T) {
 	}
 }
 
-func TestFilenameTemplate__roundSequenceNumber(t *testing.T) {
-	if n := roundSequenceNumber(0); n != "0" {
-		t.Errorf("got %s", n)
-	}
-	if n := roundSequenceNumber(10); n != "A" {
-		t.Errorf("got %s", n)
-	}
-}
-
 func TestFilenameTemplate__validateTemplate(t *testing.T) {
 	if err := validateTemplate(defaultFilenameTemplate); err != nil {
 		t.Fatal(err)
@@ -97,7 +96,7 @@ func TestFilenameTemplate__validateTemplate(t *testing.T) {
 }
 
 func TestFilenameTemplate__ValidateTemplates(t *testing.T) {
-	if err := ValidateTemplates(NewRepository("", nil, "")); err != nil {
+	if err := ValidateTemplates(NewRepository("", nil, "", nil)); err != nil {
 		t.Errorf("expected no error: %v", err)
 	}
 
@@ -132,17 +131,83 @@ func TestFilenameTemplate__ValidateTemplates(t *testing.T) {
 	}
 }
 
-func TestFilenameTemplate__achFilenameSeq(t *testing.T) {
-	if n := achFilenameSeq("20060102-987654320-1.ach"); n != 1 {
-		t.Errorf("n=%d", n)
+func TestFilenameTemplate__newFilenameData(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := newFilenameData(file, 2)
+	if data.RoutingNumber != "076401251" || data.N != "2" || data.FileIDModifier != "A" {
+		t.Errorf("unexpected filenameData: %#v", data)
+	}
+	if data.TransferType != "pull" || data.CompanyIdentification != "origid" || data.EntryCount != 1 || data.Checksum != "0005320001" {
+		t.Errorf("unexpected filenameData: %#v", data)
+	}
+	if data.SameDay {
+		t.Error("expected SameDay=false")
+	}
+
+	// settle the batch today
+	file.Header.FileCreationDate = time.Now().Format("060102")
+	file.Batches[0].GetHeader().EffectiveEntryDate = file.Header.FileCreationDate
+	if data := newFilenameData(file, 2); !data.SameDay {
+		t.Error("expected SameDay=true")
+	}
+
+	tmpl := `{{ .CompanyIdentification }}_{{ .FileIDModifier }}_{{ if .SameDay }}SD{{ else }}ND{{ end }}_{{ .EntryCount }}_{{ .Checksum }}.ach`
+	filename, err := renderACHFilename(tmpl, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "origid_A_ND_1_0005320001.ach" {
+		t.Errorf("filename=%s", filename)
+	}
+}
+
+func TestFilenameTemplate__validateTemplateFields(t *testing.T) {
+	if err := validateTemplate(`{{ .EntryCount }}-{{ .Checksum }}.ach`); err != nil {
+		t.Error(err)
+	}
+	if err := validateTemplate(`{{ .Missing }}.ach`); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestFilenameTemplate__previewRoute(t *testing.T) {
+	svc := admin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+
+	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, &mockRepository{})
+
+	address := "http://" + svc.BindAddr() + "/configs/filetransfers/filename-templates/preview"
+	body := strings.NewReader(`{"template": "{{ .RoutingNumber }}-{{ .FileIDModifier }}-{{ .EntryCount }}.ach", "data": {"entryCount": 12}}`)
+	resp, err := http.DefaultClient.Post(address, "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	var preview struct {
+		Filename string `json:"filename"`
 	}
-	if n := achFilenameSeq("20060102-987654320-2.ach.gpg"); n != 2 {
-		t.Errorf("n=%d", n)
+	if err := json.NewDecoder(resp.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.Filename != "987654320-A-12.ach" {
+		t.Errorf("filename=%s", preview.Filename)
 	}
-	if n := achFilenameSeq("my-20060102-987654320-3.ach"); n != 3 {
-		t.Errorf("n=%d", n)
+
+	// invalid template
+	resp, err = http.DefaultClient.Post(address, "application/json", strings.NewReader(`{"template": "{{ .Missing }}"}`))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if n := achFilenameSeq("20060102-B-987654320.ach"); n != 11 {
-		t.Errorf("n=%d", n)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
 	}
 }
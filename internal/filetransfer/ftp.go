@@ -8,9 +8,12 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strings"
@@ -42,17 +45,103 @@ type FTPConfig struct {
 	Hostname      string `yaml:"hostname"`
 	Username      string `yaml:"username"`
 	Password      string `yaml:"password"`
+
+	// TLSMode is "implicit" or "explicit" (AUTH TLS) for FTPS connections. Plain FTP is used when empty,
+	// unless ACH_FILE_TRANSFERS_CAFILE is set which uses implicit TLS.
+	TLSMode string `yaml:"tlsMode"`
+
+	// CACertificates is a PEM encoded bundle of certificates trusted for FTPS connections
+	// along with the system's root certificates.
+	CACertificates string `yaml:"caCertificates"`
+
+	// ClientCertificate and ClientPrivateKey are PEM encoded and presented to the server for mutual TLS.
+	ClientCertificate string `yaml:"clientCertificate"`
+	ClientPrivateKey  string `yaml:"clientPrivateKey"`
+
+	// DisableEPSV turns off extended passive mode, which some servers don't support.
+	// FTP_DIAL_WITH_DISABLED_ESPV disables it for every server.
+	DisableEPSV bool `yaml:"disableEPSV"`
 }
 
+const (
+	ftpTLSImplicit = "implicit"
+	ftpTLSExplicit = "explicit"
+)
+
 func (cfg *FTPConfig) String() string {
 	var buf bytes.Buffer
 	buf.WriteString(fmt.Sprintf("FTPConfig{RoutingNumber=%s, ", cfg.RoutingNumber))
 	buf.WriteString(fmt.Sprintf("Hostname=%s, ", cfg.Hostname))
 	buf.WriteString(fmt.Sprintf("Username=%s, ", cfg.Username))
-	buf.WriteString(fmt.Sprintf("Password=%s}", maskPassword(cfg.Password)))
+	buf.WriteString(fmt.Sprintf("Password=%s", maskPassword(cfg.Password)))
+	if cfg.TLSMode != "" {
+		buf.WriteString(fmt.Sprintf(", TLSMode=%s", cfg.TLSMode))
+	}
+	buf.WriteString("}")
 	return buf.String()
 }
 
+// tlsMode returns the normalized TLSMode of cfg, falling back to implicit TLS when ACH_FILE_TRANSFERS_CAFILE is set.
+func (cfg *FTPConfig) tlsMode() string {
+	mode := strings.ToLower(strings.TrimSpace(cfg.TLSMode))
+	if mode == "" && os.Getenv("ACH_FILE_TRANSFERS_CAFILE") != "" {
+		return ftpTLSImplicit
+	}
+	return mode
+}
+
+// validate checks the TLS settings of cfg can be used to connect.
+func (cfg *FTPConfig) validate() error {
+	_, err := cfg.tlsConfig()
+	return err
+}
+
+// tlsConfig returns the TLS settings for connecting to the server of cfg, or nil for plain FTP.
+func (cfg *FTPConfig) tlsConfig() (*tls.Config, error) {
+	mode := cfg.tlsMode()
+	switch mode {
+	case "":
+		if cfg.CACertificates != "" || cfg.ClientCertificate != "" {
+			return nil, errors.New("ftp: certificates require a tlsMode of implicit or explicit")
+		}
+		return nil, nil
+	case ftpTLSImplicit, ftpTLSExplicit:
+	default:
+		return nil, fmt.Errorf("ftp: unknown tlsMode %q", cfg.TLSMode)
+	}
+
+	conf, err := ftpTLSConfig(os.Getenv("ACH_FILE_TRANSFERS_CAFILE"))
+	if err != nil {
+		return nil, err
+	}
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	if cfg.CACertificates != "" {
+		if conf.RootCAs == nil {
+			if conf.RootCAs, err = x509.SystemCertPool(); conf.RootCAs == nil || err != nil {
+				conf.RootCAs = x509.NewCertPool()
+			}
+		}
+		if !conf.RootCAs.AppendCertsFromPEM([]byte(cfg.CACertificates)) {
+			return nil, errors.New("ftp: problem reading caCertificates")
+		}
+	}
+	if cfg.ClientCertificate != "" || cfg.ClientPrivateKey != "" {
+		cert, err := tls.X509KeyPair([]byte(cfg.ClientCertificate), []byte(cfg.ClientPrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("ftp: problem reading client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if host, _, err := net.SplitHostPort(cfg.Hostname); err == nil {
+		conf.ServerName = host
+	} else {
+		conf.ServerName = cfg.Hostname
+	}
+	return conf, nil
+}
+
 // FTPTransferAgent is an FTP implementation of a Agent
 type FTPTransferAgent struct {
 	conn *ftp.ServerConn
@@ -93,16 +182,19 @@ func newFTPTransferAgent(logger log.Logger, cfg *Config, ftpConfigs []*FTPConfig
 	if ftpConf == nil {
 		return nil, fmt.Errorf("ftp: unable to find config for %s", cfg.RoutingNumber)
 	}
-	opts := []ftp.DialOption{
-		ftp.DialWithTimeout(ftpDialTimeout),
-		ftp.DialWithDisabledEPSV(ftpDialWithDisabledEPSV),
-	}
-	tlsOpt, err := tlsDialOption(os.Getenv("ACH_FILE_TRANSFERS_CAFILE"))
+	tlsConfig, err := ftpConf.tlsConfig()
 	if err != nil {
 		return nil, err
 	}
-	if tlsOpt != nil {
-		opts = append(opts, *tlsOpt)
+	opts := []ftp.DialOption{
+		ftp.DialWithTimeout(ftpDialTimeout),
+		ftp.DialWithDisabledEPSV(ftpDialWithDisabledEPSV || ftpConf.DisableEPSV),
+		// Every connection (including data connections) is checked against AllowedIPs.
+		ftp.DialWithDialFunc(ftpDialFunc(logger, cfg, ftpConf.tlsMode(), tlsConfig)),
+	}
+	if tlsConfig != nil {
+		// Our dial function sets up TLS, but this protects data connections after login (PBSZ and PROT)
+		opts = append(opts, ftp.DialWithTLS(tlsConfig))
 	}
 
 	// Make the first connection
@@ -117,13 +209,15 @@ func newFTPTransferAgent(logger log.Logger, cfg *Config, ftpConfigs []*FTPConfig
 	return agent, nil
 }
 
-func tlsDialOption(caFilePath string) (*ftp.DialOption, error) {
+// ftpTLSConfig returns the TLS config for FTP connections which trusts the certificates in caFilePath.
+// A nil config is returned when caFilePath is empty.
+func ftpTLSConfig(caFilePath string) (*tls.Config, error) {
 	if caFilePath == "" {
 		return nil, nil
 	}
 	bs, err := ioutil.ReadFile(caFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("tlsDialOption: failed to read %s: %v", caFilePath, err)
+		return nil, fmt.Errorf("ftpTLSConfig: failed to read %s: %v", caFilePath, err)
 	}
 	pool, err := x509.SystemCertPool()
 	if pool == nil || err != nil {
@@ -131,13 +225,82 @@ func tlsDialOption(caFilePath string) (*ftp.DialOption, error) {
 	}
 	ok := pool.AppendCertsFromPEM(bs)
 	if !ok {
-		return nil, fmt.Errorf("tlsDialOption: problem with AppendCertsFromPEM from %s", caFilePath)
+		return nil, fmt.Errorf("ftpTLSConfig: problem with AppendCertsFromPEM from %s", caFilePath)
 	}
-	cfg := &tls.Config{
+	return &tls.Config{
 		RootCAs: pool,
+	}, nil
+}
+
+// ftpDialFunc returns a dial function for FTP connections which only connects to addresses allowed by cfg.
+// Connections are wrapped with TLS when tlsConfig is non-nil. With explicit TLS the control connection (which
+// is dialed first) is upgraded with AUTH TLS.
+func ftpDialFunc(logger log.Logger, cfg *Config, mode string, tlsConfig *tls.Config) func(network, address string) (net.Conn, error) {
+	dial := allowedDialer(logger, cfg, &net.Dialer{Timeout: ftpDialTimeout})
+
+	var mu sync.Mutex
+	controlDialed := false
+
+	return func(network, address string) (net.Conn, error) {
+		conn, err := dial(network, address)
+		if err != nil || tlsConfig == nil {
+			return conn, err
+		}
+
+		mu.Lock()
+		control := !controlDialed
+		controlDialed = true
+		mu.Unlock()
+
+		if mode == ftpTLSExplicit && control {
+			return explicitTLS(conn, tlsConfig)
+		}
+		return tls.Client(conn, tlsConfig), nil
 	}
-	opt := ftp.DialWithTLS(cfg)
-	return &opt, nil
+}
+
+// explicitTLS upgrades an FTP control connection to TLS with AUTH TLS (RFC 4217). The server's greeting
+// is read before upgrading, so it's replayed for the FTP client over the returned connection.
+func explicitTLS(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(ftpDialTimeout))
+
+	r := textproto.NewConn(conn)
+	_, greeting, err := r.ReadResponse(ftp.StatusReady)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ftp: reading greeting: %v", err)
+	}
+	if err := r.PrintfLine("AUTH TLS"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ftp: AUTH TLS: %v", err)
+	}
+	if _, msg, err := r.ReadResponse(234); err != nil { // 234: security data exchange complete
+		conn.Close()
+		return nil, fmt.Errorf("ftp: AUTH TLS refused: %s: %v", msg, err)
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ftp: TLS handshake: %v", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	greeting = strings.Replace(greeting, "\n", " ", -1)
+	return &greetingConn{
+		Conn: tlsConn,
+		r:    io.MultiReader(strings.NewReader(fmt.Sprintf("%d %s\r\n", ftp.StatusReady, greeting)), tlsConn),
+	}, nil
+}
+
+// greetingConn replays an FTP server's greeting before reading from the connection.
+type greetingConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *greetingConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
 }
 
 func (agent *FTPTransferAgent) Close() error {
@@ -6,10 +6,18 @@ package filetransfer
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -66,7 +74,7 @@ func createTestFTPServer(t *testing.T) (*server.Server, error) {
 }
 
 func TestFTPConfig__String(t *testing.T) {
-	cfg := &FTPConfig{"routing", "host", "user", "pass"}
+	cfg := &FTPConfig{RoutingNumber: "routing", Hostname: "host", Username: "user", Password: "pass"}
 	if !strings.Contains(cfg.String(), "Password=p**s") {
 		t.Error(cfg.String())
 	}
@@ -188,7 +196,7 @@ func TestFTPAgent__hostname(t *testing.T) {
 	}
 }
 
-func TestFTP__tlsDialOption(t *testing.T) {
+func TestFTP__ftpTLSConfig(t *testing.T) {
 	if testing.Short() {
 		return // skip network calls
 	}
@@ -199,12 +207,45 @@ func TestFTP__tlsDialOption(t *testing.T) {
 	}
 	defer os.Remove(cafile)
 
-	opt, err := tlsDialOption(cafile)
+	conf, err := ftpTLSConfig(cafile)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if opt == nil {
-		t.Fatal("nil tls DialOption")
+	if conf == nil || conf.RootCAs == nil {
+		t.Fatal("nil tls Config")
+	}
+}
+
+func TestFTP__allowedIPs(t *testing.T) {
+	svc, err := createTestFTPServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Shutdown()
+
+	auth := svc.Auth.(*server.SimpleAuth)
+	ftpConfigs := []*FTPConfig{
+		{
+			Hostname: fmt.Sprintf("%s:%d", svc.Hostname, svc.Port),
+			Username: auth.Name,
+			Password: auth.Password,
+		},
+	}
+
+	// the server's address is allowed, which is checked on data connections too
+	conf := &Config{InboundPath: "inbound", AllowedIPs: "127.0.0.0/8,::1"}
+	agent, err := newFTPTransferAgent(log.NewNopLogger(), conf, ftpConfigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err := agent.GetInboundFiles(); err != nil || len(files) != 2 {
+		t.Errorf("got %d files: %v", len(files), err)
+	}
+	agent.Close()
+
+	conf.AllowedIPs = "10.0.0.0/8"
+	if _, err := newFTPTransferAgent(log.NewNopLogger(), conf, ftpConfigs); err == nil {
+		t.Error("expected error")
 	}
 }
 
@@ -328,3 +369,134 @@ func TestFTP__uploadFile(t *testing.T) {
 		t.Error("expected error")
 	}
 }
+
+// writeTestCertificate creates a self-signed certificate for localhost and returns the paths of its PEM encoded
+// certificate and private key.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestFTP__explicitTLS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping due to -short")
+	}
+
+	dir, _ := ioutil.TempDir("", "ftp-tls")
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := writeTestCertificate(t, dir)
+	caCertificates, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// goftp/server rejects logins over implicit TLS connections, so only explicit mode (AUTH TLS) is tested.
+	opts := &server.ServerOpts{
+		Auth: &server.SimpleAuth{
+			Name:     "moov",
+			Password: "password",
+		},
+		Factory: &filedriver.FileDriverFactory{
+			RootPath: filepath.Join("..", "..", "testdata", "ftp-server"),
+			Perm:     server.NewSimplePerm("test", "test"),
+		},
+		Hostname:     "localhost",
+		Port:         port(),
+		Logger:       &server.DiscardLogger{},
+		TLS:          true,
+		CertFile:     certPath,
+		KeyFile:      keyPath,
+		ExplicitFTPS: true,
+	}
+	svc := server.NewServer(opts)
+	go svc.ListenAndServe()
+	defer svc.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	conf := &Config{
+		InboundPath:  "inbound",
+		OutboundPath: "outbound",
+		ReturnPath:   "returned",
+	}
+	ftpConfigs := []*FTPConfig{
+		{
+			Hostname:       fmt.Sprintf("%s:%d", svc.Hostname, svc.Port),
+			Username:       "moov",
+			Password:       "password",
+			TLSMode:        ftpTLSExplicit,
+			CACertificates: string(caCertificates),
+		},
+	}
+	agent, err := newFTPTransferAgent(log.NewNopLogger(), conf, ftpConfigs)
+	if err != nil {
+		t.Fatalf("problem creating FileTransferAgent: %v", err)
+	}
+	defer agent.Close()
+
+	files, err := agent.GetInboundFiles()
+	if err != nil || len(files) == 0 {
+		t.Errorf("found %d inbound files: %v", len(files), err)
+	}
+}
+
+func TestFTPConfig__tlsConfig(t *testing.T) {
+	cfg := &FTPConfig{Hostname: "ftp.bank.com:21"}
+	if conf, err := cfg.tlsConfig(); conf != nil || err != nil {
+		t.Errorf("expected plain FTP: %v", err)
+	}
+
+	cfg.TLSMode = "other"
+	if err := cfg.validate(); err == nil {
+		t.Error("expected error")
+	}
+
+	cfg.TLSMode = ""
+	cfg.CACertificates = "bundle"
+	if err := cfg.validate(); err == nil {
+		t.Error("expected error with certificates but no TLSMode")
+	}
+
+	cfg.TLSMode = "Explicit"
+	cfg.CACertificates = ""
+	conf, err := cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ServerName != "ftp.bank.com" {
+		t.Errorf("ServerName=%s", conf.ServerName)
+	}
+}
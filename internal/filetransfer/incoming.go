@@ -35,6 +35,13 @@ func (c *Controller) downloadAndProcessIncomingFiles(req *periodicFileOperations
 	}
 	defer os.RemoveAll(dir)
 
+	// Post inbound entries which previously failed before reading newer files
+	if err := c.retryIncomingEntries(req, depRepo, transferRepo); err != nil {
+		c.logger.Log(
+			"downloadAndProcessIncomingFiles", "problem retrying inbound entries", "error", err,
+			"userID", req.userID, "requestID", req.requestID)
+	}
+
 	cutoffTimes, err := c.repo.GetCutoffTimes()
 	if err != nil {
 		return fmt.Errorf("cutoff times: %v", err)
@@ -55,6 +62,13 @@ func (c *Controller) downloadAndProcessIncomingFiles(req *periodicFileOperations
 			continue
 		}
 
+		// Match confirmations of our uploaded files before reading inbound and returned files
+		if err := c.processConfirmationFiles(fileTransferConf, filepath.Join(dir, fileTransferConf.InboundPath)); err != nil {
+			c.logger.Log(
+				"downloadAndProcessIncomingFiles", fmt.Sprintf("problem reading confirmation files in %s", dir), "error", err,
+				"userID", req.userID, "requestID", req.requestID)
+		}
+
 		// Read and process inbound and returned files
 		if err := c.processInboundFiles(req, filepath.Join(dir, fileTransferConf.InboundPath), depRepo, transferRepo); err != nil {
 			c.logger.Log(
@@ -70,6 +84,13 @@ func (c *Controller) downloadAndProcessIncomingFiles(req *periodicFileOperations
 		}
 	}
 
+	// Alert on files which should have been confirmed by now
+	if err := c.alertUnconfirmedFiles(); err != nil {
+		c.logger.Log(
+			"downloadAndProcessIncomingFiles", "problem checking for unconfirmed files", "error", err,
+			"userID", req.userID, "requestID", req.requestID)
+	}
+
 	return nil
 }
 
@@ -95,7 +116,7 @@ func (c *Controller) processInboundFiles(req *periodicFileOperationsRequest, dir
 			return nil // Ignore SkipDir and directories
 		}
 
-		file, err := parseACHFilepath(path)
+		file, err := parseACHFilepath(path, c.keeper)
 		if err != nil {
 			c.logger.Log(
 				"processInboundFiles", fmt.Sprintf("problem parsing inbound file %s", path), "error", err,
@@ -106,17 +127,21 @@ func (c *Controller) processInboundFiles(req *periodicFileOperationsRequest, dir
 			"file-transfer-controller", fmt.Sprintf("processing inbound file %s from %s (%s)", info.Name(), file.Header.ImmediateOriginName, file.Header.ImmediateOrigin),
 			"userID", req.userID, "requestID", req.requestID)
 
+		inboundFilesProcessed.With("destination", file.Header.ImmediateDestination, "origin", file.Header.ImmediateOrigin).Add(1)
+
 		// Handle any NOC Batches
 		if len(file.NotificationOfChange) > 0 {
-			inboundFilesProcessed.With("destination", file.Header.ImmediateDestination, "origin", file.Header.ImmediateOrigin).Add(1)
 			if err := c.handleNOCFile(req, file, info.Name(), depRepo, transferRepo); err != nil {
 				c.logger.Log(
 					"processInboundFiles", fmt.Sprintf("problem with inbound NOC file %s", path), "error", err,
 					"userID", req.userID, "requestID", req.requestID)
 			}
-		} else {
+		}
+
+		// Post (or return) entries other financial institutions have sent to our Depositories
+		if err := c.handleIncomingEntries(req, file, info.Name(), depRepo, transferRepo); err != nil {
 			c.logger.Log(
-				"file-transfer-controller", fmt.Sprintf("skipping file %s with zero NOC entres", info.Name()),
+				"processInboundFiles", fmt.Sprintf("problem with inbound entries in %s", path), "error", err,
 				"userID", req.userID, "requestID", req.requestID)
 		}
 
@@ -0,0 +1,585 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/accounts"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/events"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	incomingEntriesPosted = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "incoming_ach_entries_posted",
+		Help: "Counter of incoming entries posted to our Depositories",
+	}, []string{"destination", "origin"})
+
+	incomingEntriesReturned = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "incoming_ach_entries_returned",
+		Help: "Counter of incoming entries automatically returned to their ODFI",
+	}, []string{"destination", "origin", "return_code"})
+
+	// accountNumberPattern matches DFIAccountNumber values we're able to post to, anything else is returned as R04.
+	accountNumberPattern = regexp.MustCompile(`^[0-9A-Za-z\-]+$`)
+)
+
+// incomingReturn is a forward entry we're unable to post and will return to its ODFI
+type incomingReturn struct {
+	header     *ach.BatchHeader
+	entry      *ach.EntryDetail
+	returnCode string
+
+	// dateOfDeath and addendaInformation are optionally included in the return's Addenda99
+	dateOfDeath        *time.Time
+	addendaInformation string
+
+	// returnTraceNumber is set on dishonored returns to the trace number of the return being dishonored.
+	// Dishonored returns go back to the RDFI which sent that return.
+	returnTraceNumber string
+}
+
+// handleIncomingEntries posts each forward entry in file (where we're the RDFI) against the Depository it's for.
+// Entries which can't be posted are returned to their ODFI by merging return entries into our outbound files.
+func (c *Controller) handleIncomingEntries(req *periodicFileOperationsRequest, file *ach.File, filename string, depRepo depository.Repository, transferRepo transfers.Repository) error {
+	var returns []*incomingReturn
+	var failed []string // trace numbers of entries to try again
+	var firstErr error
+	for i := range file.Batches {
+		if file.Batches[i].Category() != ach.CategoryForward {
+			continue // NOCs and returns are handled elsewhere
+		}
+		header := file.Batches[i].GetHeader()
+		if isAcknowledgement(header) {
+			continue // matched against our uploaded files as confirmations
+		}
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			returnCode, err := c.postIncomingEntry(req, file.Header, header, entries[j], filename, depRepo, transferRepo)
+			if err != nil {
+				c.logger.Log(
+					"handleIncomingEntries", fmt.Sprintf("problem posting incoming entry from %s", filename), "error", err,
+					"traceNumber", entries[j].TraceNumber,
+					"userID", req.userID, "requestID", req.requestID)
+				if _, ok := err.(*unmatchedEntryError); ok {
+					c.recordException(exceptionIncoming, filename, file.Header, header, entries[j], err)
+					continue // retrying won't help, so an operator links the entry
+				}
+				failed = append(failed, entries[j].TraceNumberField())
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if returnCode != "" {
+				incomingEntriesReturned.With("destination", file.Header.ImmediateDestination, "origin", file.Header.ImmediateOrigin, "return_code", returnCode).Add(1)
+				c.logger.Log(
+					"handleIncomingEntries", fmt.Sprintf("returning incoming entry from %s with returnCode=%s", filename, returnCode),
+					"traceNumber", entries[j].TraceNumber,
+					"userID", req.userID, "requestID", req.requestID)
+				returns = append(returns, &incomingReturn{header: header, entry: entries[j], returnCode: returnCode})
+			} else {
+				incomingEntriesPosted.With("destination", file.Header.ImmediateDestination, "origin", file.Header.ImmediateOrigin).Add(1)
+			}
+		}
+	}
+	if len(returns) > 0 {
+		if err := c.returnIncomingEntries(file.Header, returns); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		if err := c.saveIncomingEntriesForRetry(file, filename, failed); err != nil {
+			return fmt.Errorf("problem saving %d entries from %s to retry: %v", len(failed), filename, err)
+		}
+		return fmt.Errorf("%d entries from %s will be retried: %v", len(failed), filename, firstErr)
+	}
+	return nil
+}
+
+// saveIncomingEntriesForRetry writes the forward entries of file with traceNumbers into our inbound-retry directory,
+// where they're handled again on the following intervals. Only the failed entries are saved so the others aren't
+// posted or returned twice.
+func (c *Controller) saveIncomingEntriesForRetry(file *ach.File, filename string, traceNumbers []string) error {
+	retry := ach.NewFile()
+	retry.Header = file.Header
+	for i := range file.Batches {
+		if file.Batches[i].Category() != ach.CategoryForward || isAcknowledgement(file.Batches[i].GetHeader()) {
+			continue
+		}
+		var batch ach.Batcher
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			if !containsTraceNumber(traceNumbers, entries[j].TraceNumberField()) {
+				continue
+			}
+			if batch == nil {
+				b, err := ach.NewBatch(file.Batches[i].GetHeader())
+				if err != nil {
+					return err
+				}
+				batch = b
+			}
+			batch.AddEntry(entries[j])
+		}
+		if batch == nil {
+			continue
+		}
+		if err := batch.Create(); err != nil {
+			return err
+		}
+		retry.AddBatch(batch)
+	}
+	if err := retry.Create(); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(c.rootDir, "inbound-retry")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	return (&achFile{File: retry, filepath: filepath.Join(dir, filepath.Base(filename)), keeper: c.keeper}).write()
+}
+
+func containsTraceNumber(traceNumbers []string, traceNumber string) bool {
+	for i := range traceNumbers {
+		if traceNumbers[i] == traceNumber {
+			return true
+		}
+	}
+	return false
+}
+
+// retryIncomingEntries handles entries saved by saveIncomingEntriesForRetry again. Files are removed once
+// every entry has been posted or returned.
+func (c *Controller) retryIncomingEntries(req *periodicFileOperationsRequest, depRepo depository.Repository, transferRepo transfers.Repository) error {
+	matches, err := filepath.Glob(filepath.Join(c.rootDir, "inbound-retry", "*"))
+	if err != nil {
+		return err
+	}
+	for i := range matches {
+		file, err := parseACHFilepath(matches[i], c.keeper)
+		if err != nil {
+			c.logger.Log("retryIncomingEntries", fmt.Sprintf("problem parsing %s", matches[i]), "error", err, "requestID", req.requestID)
+			continue
+		}
+		if err := c.handleIncomingEntries(req, file, filepath.Base(matches[i]), depRepo, transferRepo); err != nil {
+			c.logger.Log("retryIncomingEntries", fmt.Sprintf("problem with inbound entries in %s", matches[i]), "error", err, "requestID", req.requestID)
+			continue
+		}
+		if err := os.Remove(matches[i]); err != nil {
+			return err
+		}
+		c.logger.Log("retryIncomingEntries", fmt.Sprintf("finished retrying inbound entries in %s", matches[i]), "requestID", req.requestID)
+	}
+	return nil
+}
+
+// postIncomingEntry records an IncomingTransfer for entry and posts it against Accounts. A non-empty return code
+// is returned when the entry needs to be returned to its ODFI.
+func (c *Controller) postIncomingEntry(req *periodicFileOperationsRequest, fileHeader ach.FileHeader, header *ach.BatchHeader, entry *ach.EntryDetail, filename string, depRepo depository.Repository, transferRepo transfers.Repository) (string, error) {
+	amount, err := model.NewAmountFromInt("USD", entry.Amount)
+	if err != nil {
+		return "", &unmatchedEntryError{fmt.Sprintf("invalid amount: %v", entry.Amount)}
+	}
+	effectiveEntryDate, err := header.LiftEffectiveEntryDate()
+	if err != nil {
+		return "", &unmatchedEntryError{fmt.Sprintf("invalid EffectiveEntryDate=%q: %v", header.EffectiveEntryDate, err)}
+	}
+
+	accountNumber := strings.TrimSpace(entry.DFIAccountNumber)
+	if !accountNumberPattern.MatchString(accountNumber) {
+		return "R04", nil // Invalid Account Number Structure
+	}
+	routingNumber := entry.RDFIIdentificationField() + entry.CheckDigit
+	dep, err := depRepo.LookupDepositoryFromReturn(routingNumber, accountNumber)
+	if err != nil {
+		return "", fmt.Errorf("problem looking up Depository: %v", err)
+	}
+	if dep == nil {
+		return "R03", nil // No Account/Unable to Locate Account
+	}
+	if dep.Status == model.DepositoryRejected {
+		return "R16", nil // Account Frozen
+	}
+
+	requestID := req.requestID
+	if requestID == "" {
+		requestID = base.ID()
+	}
+
+	// Entries are retried with their original filename, so look for an earlier attempt at this entry.
+	existing, err := transferRepo.GetIncomingTransferForEntry(filename, entry.TraceNumberField(), effectiveEntryDate)
+	if err != nil {
+		return "", fmt.Errorf("problem looking up incoming transfer: %v", err)
+	}
+	if existing != nil {
+		if existing.Status == model.TransferPending {
+			// We recorded the entry but don't know if it was posted, so don't risk posting it twice.
+			c.logger.Log("postIncomingEntry", fmt.Sprintf("BAD ERROR - incoming transfer=%s was never marked as posted, not posting again", existing.ID),
+				"traceNumber", entry.TraceNumber, "userID", existing.UserID, "requestID", requestID)
+		}
+		return "", nil
+	}
+
+	xfer := &transfers.IncomingTransfer{
+		ID:                      id.Transfer(base.ID()),
+		UserID:                  dep.UserID,
+		DepositoryID:            dep.ID,
+		Type:                    model.PushTransfer,
+		Amount:                  *amount,
+		StandardEntryClassCode:  header.StandardEntryClassCode,
+		ServiceClassCode:        header.ServiceClassCode,
+		TransactionCode:         entry.TransactionCode,
+		TraceNumber:             entry.TraceNumberField(),
+		CompanyName:             strings.TrimSpace(header.CompanyName),
+		CompanyIdentification:   strings.TrimSpace(header.CompanyIdentification),
+		CompanyEntryDescription: strings.TrimSpace(header.CompanyEntryDescription),
+		IndividualName:          strings.TrimSpace(entry.IndividualName),
+		IdentificationNumber:    strings.TrimSpace(entry.IdentificationNumber),
+		DiscretionaryData:       strings.TrimSpace(entry.DiscretionaryData),
+		EffectiveEntryDate:      effectiveEntryDate,
+		Origin:                  fileHeader.ImmediateOrigin,
+		Destination:             fileHeader.ImmediateDestination,
+		Filename:                filename,
+		Status:                  model.TransferPending,
+		Created:                 time.Now(),
+	}
+	if entry.CreditOrDebit() == "D" {
+		xfer.Type = model.PullTransfer
+	}
+
+	// Record the entry before posting it so a failure to save it can't lead to posting it again.
+	if err := transferRepo.CreateIncomingTransfer(xfer); err != nil {
+		return "", err
+	}
+	returnCode, err := c.postIncomingTransaction(requestID, dep, xfer)
+	if err != nil {
+		// We couldn't post the entry, but it's not one we should return. Our record is removed so the entry is
+		// posted when it's tried again.
+		if err := transferRepo.DeleteIncomingTransfer(xfer.ID); err != nil {
+			c.logger.Log("postIncomingEntry", fmt.Sprintf("problem removing unposted incoming transfer=%s", xfer.ID), "error", err, "requestID", requestID)
+		}
+		return "", fmt.Errorf("problem posting incoming transfer to accounts: %v", err)
+	}
+	xfer.Status = model.TransferProcessed
+	if returnCode != "" {
+		xfer.Status = model.TransferReclaimed
+		xfer.ReturnCode = returnCode
+	}
+	if err := transferRepo.MarkIncomingTransferPosted(xfer.ID, xfer.Status, xfer.ReturnCode, xfer.TransactionID); err != nil {
+		// The entry was posted (or needs returning) so carry on rather than retrying it.
+		c.logger.Log("postIncomingEntry", fmt.Sprintf("BAD ERROR - unable to mark incoming transfer=%s as %s", xfer.ID, xfer.Status), "error", err, "requestID", requestID)
+	}
+	c.logger.Log(
+		"postIncomingEntry", fmt.Sprintf("matched incoming transfer=%s to depository=%s with status=%s", xfer.ID, dep.ID, xfer.Status),
+		"traceNumber", entry.TraceNumber,
+		"userID", dep.UserID, "requestID", requestID)
+
+	if c.eventRepo != nil {
+		err := c.eventRepo.WriteEvent(dep.UserID, &events.Event{
+			ID:      events.EventID(base.ID()),
+			Topic:   fmt.Sprintf("incoming %s transfer from %s", xfer.Type, xfer.CompanyName),
+			Message: fmt.Sprintf("%s %s %s", xfer.CompanyEntryDescription, xfer.Amount.String(), xfer.Status),
+			Type:    events.IncomingTransferEvent,
+			Metadata: map[string]string{
+				"transferID":   string(xfer.ID),
+				"depositoryID": dep.ID.String(),
+				"traceNumber":  xfer.TraceNumber,
+				"status":       string(xfer.Status),
+				"returnCode":   xfer.ReturnCode,
+			},
+		})
+		if err != nil {
+			c.logger.Log("postIncomingEntry", fmt.Sprintf("problem writing incoming transfer=%s event", xfer.ID), "error", err, "userID", dep.UserID, "requestID", requestID)
+		}
+	}
+	return returnCode, nil
+}
+
+// postIncomingTransaction posts xfer against the Depository's account and our ODFI account. A return code is returned
+// for entries Accounts refuses (missing accounts or insufficient funds), otherwise errors signal the entry could not be
+// posted right now and should be tried again.
+func (c *Controller) postIncomingTransaction(requestID string, dep *model.Depository, xfer *transfers.IncomingTransfer) (string, error) {
+	if c.accountsClient == nil || xfer.Amount.Int() == 0 {
+		return "", nil // Accounts is disabled or the entry is a prenote
+	}
+	if c.odfiAccount == nil {
+		return "", errors.New("nil ODFI account")
+	}
+
+	acct, err := c.accountsClient.SearchAccounts(requestID, dep.UserID, dep)
+	if err != nil {
+		return "", fmt.Errorf("problem reading account for depository=%s: %v", dep.ID, err)
+	}
+	if acct == nil {
+		c.logger.Log("postIncomingTransaction", fmt.Sprintf("account not found for depository=%s", dep.ID), "requestID", requestID)
+		return "R03", nil // No Account/Unable to Locate Account
+	}
+	odfiAccountID, err := c.odfiAccount.AccountID(requestID, dep.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	lines := []accounts.TransactionLine{
+		{AccountID: acct.ID, Purpose: "ACHCredit", Amount: int32(xfer.Amount.Int())},
+		{AccountID: odfiAccountID, Purpose: "ACHDebit", Amount: int32(xfer.Amount.Int())},
+	}
+	if xfer.Type == model.PullTransfer {
+		lines[0].Purpose, lines[1].Purpose = "ACHDebit", "ACHCredit"
+	}
+	tx, err := c.accountsClient.PostTransaction(requestID, dep.UserID, lines)
+	if err != nil {
+		if err == accounts.ErrInsufficientFunds && xfer.Type == model.PullTransfer {
+			c.logger.Log("postIncomingTransaction", fmt.Sprintf("unable to debit depository=%s", dep.ID), "error", err, "requestID", requestID)
+			return "R01", nil // Insufficient Funds
+		}
+		return "", err
+	}
+	xfer.TransactionID = tx.ID
+	return "", nil
+}
+
+// returnIncomingEntries creates return entries for each incomingReturn and merges them into an outbound file
+// destined to the ODFI of fileHeader.
+func (c *Controller) returnIncomingEntries(fileHeader ach.FileHeader, returns []*incomingReturn) error {
+	file, err := createReturnFile(fileHeader, returns)
+	if err != nil {
+		return fmt.Errorf("problem creating return file: %v", err)
+	}
+
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	mergedDir := filepath.Join(c.rootDir, "merged")
+	os.Mkdir(mergedDir, 0777) // ensure dir is created
+
+	mergableFile, _, err := c.mergeReturnFile(file, mergedDir)
+	if err != nil {
+		return err
+	}
+	c.logger.Log("returnIncomingEntries", fmt.Sprintf("merged %d returns to %s into %s", len(returns), file.Header.ImmediateDestination, mergableFile.filepath))
+	return nil
+}
+
+// mergeReturnFile merges file into the latest mergable file for its destination. The caller needs to hold mergedFilesMu.
+//
+// The file merged into is returned along with a file that's ready for upload if the merged file was full.
+func (c *Controller) mergeReturnFile(file *ach.File, mergedDir string) (*achFile, *achFile, error) {
+	mergableFile, err := c.grabLatestMergedACHFile(file.Header.ImmediateDestination, file, mergedDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to find mergable file for returns to %s: %v", file.Header.ImmediateDestination, err)
+	}
+	fileToUpload, err := c.mergeTransfer(file, mergableFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem merging returns to %s: %v", file.Header.ImmediateDestination, err)
+	}
+	return mergableFile, fileToUpload, nil
+}
+
+// mergeIncomingReturns merges returns which have been requested for IncomingTransfers into our outbound files.
+// Files which are ready for upload are returned.
+func (c *Controller) mergeIncomingReturns(mergedDir string, transferRepo transfers.Repository, depRepo depository.Repository, leases *mergeLeases) []*achFile {
+	returns, err := transferRepo.GetPendingIncomingReturns()
+	if err != nil {
+		c.logger.Log("mergeIncomingReturns", "problem reading pending returns", "error", err)
+		return nil
+	}
+
+	var filesToUpload []*achFile
+	for i := range returns {
+		xfer, err := transferRepo.GetIncomingTransfer(returns[i].TransferID)
+		if err != nil || xfer == nil {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("problem reading incoming transfer=%s", returns[i].TransferID), "error", err)
+			continue
+		}
+		if !leases.holds(xfer.Origin) {
+			continue
+		}
+		dep, err := depRepo.GetDepository(xfer.DepositoryID)
+		if err != nil || dep == nil {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("problem reading depository=%s for incoming transfer=%s", xfer.DepositoryID, xfer.ID), "error", err)
+			continue
+		}
+		accountNumber, err := dep.DecryptAccountNumber()
+		if err != nil {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("problem decrypting depository=%s account number", dep.ID), "error", err)
+			continue
+		}
+
+		fileHeader, ret := incomingTransferReturn(xfer, dep.RoutingNumber, accountNumber, returns[i])
+		file, err := createReturnFile(fileHeader, []*incomingReturn{ret})
+		if err != nil {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("problem creating return file for incoming transfer=%s", xfer.ID), "error", err)
+			continue
+		}
+		mergableFile, fileToUpload, err := c.mergeReturnFile(file, mergedDir)
+		if err != nil {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("problem merging return of incoming transfer=%s", xfer.ID), "error", err)
+			continue
+		}
+		if err := transferRepo.MarkIncomingReturnMerged(xfer.ID, filepath.Base(mergableFile.filepath)); err != nil {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("BAD ERROR - unable to mark return of incoming transfer=%s as merged", xfer.ID), "error", err)
+			continue
+		}
+		c.logger.Log("mergeIncomingReturns", fmt.Sprintf("merged return of incoming transfer=%s with returnCode=%s into %s", xfer.ID, returns[i].ReturnCode, mergableFile.filepath))
+		if time.Until(returns[i].Deadline) < transfers.ReturnDeadlineWarning {
+			c.logger.Log("mergeIncomingReturns", fmt.Sprintf("WARNING: return of incoming transfer=%s needs to be uploaded before %v", xfer.ID, returns[i].Deadline))
+		}
+		if fileToUpload != nil {
+			filesToUpload = append(filesToUpload, fileToUpload)
+		}
+	}
+	return filesToUpload
+}
+
+// incomingTransferReturn rebuilds the FileHeader and entry of an IncomingTransfer so it can be returned.
+func incomingTransferReturn(xfer *transfers.IncomingTransfer, routingNumber string, accountNumber string, ret *transfers.IncomingReturn) (ach.FileHeader, *incomingReturn) {
+	fileHeader := ach.NewFileHeader()
+	fileHeader.ImmediateOrigin = xfer.Origin
+	fileHeader.ImmediateDestination = xfer.Destination
+
+	header := ach.NewBatchHeader()
+	header.ServiceClassCode = xfer.ServiceClassCode
+	header.CompanyName = xfer.CompanyName
+	header.CompanyIdentification = xfer.CompanyIdentification
+	header.StandardEntryClassCode = xfer.StandardEntryClassCode
+	header.CompanyEntryDescription = xfer.CompanyEntryDescription
+	header.EffectiveEntryDate = xfer.EffectiveEntryDate.Format("060102") // YYMMDD
+	header.ODFIIdentification = xfer.TraceNumber[:8]
+
+	entry := ach.NewEntryDetail()
+	entry.TransactionCode = xfer.TransactionCode
+	entry.SetRDFI(routingNumber)
+	entry.DFIAccountNumber = accountNumber
+	entry.Amount = xfer.Amount.Int()
+	entry.IdentificationNumber = xfer.IdentificationNumber
+	entry.IndividualName = xfer.IndividualName
+	entry.DiscretionaryData = xfer.DiscretionaryData
+	entry.TraceNumber = xfer.TraceNumber
+
+	return fileHeader, &incomingReturn{
+		header:             header,
+		entry:              entry,
+		returnCode:         ret.ReturnCode,
+		dateOfDeath:        ret.DateOfDeath,
+		addendaInformation: ret.AddendaInformation,
+	}
+}
+
+// createReturnFile builds an ACH file (from us back to the ODFI of fileHeader) which returns each entry with its return code.
+func createReturnFile(fileHeader ach.FileHeader, returns []*incomingReturn) (*ach.File, error) {
+	now := time.Now()
+
+	file := ach.NewFile()
+	file.Header = ach.NewFileHeader()
+	file.Header.ImmediateOrigin = fileHeader.ImmediateDestination
+	file.Header.ImmediateOriginName = fileHeader.ImmediateDestinationName
+	file.Header.ImmediateDestination = fileHeader.ImmediateOrigin
+	file.Header.ImmediateDestinationName = fileHeader.ImmediateOriginName
+	file.Header.FileCreationDate = now.Format("060102") // YYMMDD
+	file.Header.FileCreationTime = now.Format("1504")   // HHMM
+	file.Header.FileIDModifier = "A"
+
+	rdfi := fileHeader.ImmediateDestination
+	if len(rdfi) >= 8 {
+		rdfi = rdfi[:8]
+	}
+
+	// Group returns by their original batch so each return batch shares the original company information.
+	var batches []ach.Batcher
+	byHeader := make(map[*ach.BatchHeader]ach.Batcher)
+	for i := range returns {
+		batch, exists := byHeader[returns[i].header]
+		if !exists {
+			bh := *returns[i].header
+			bh.ID = ""
+			bh.ODFIIdentification = rdfi
+			bh.EffectiveEntryDate = now.Format("060102") // YYMMDD
+			bh.BatchNumber = len(batches) + 1
+
+			b, err := ach.NewBatch(&bh)
+			if err != nil {
+				return nil, err
+			}
+			batch = b
+			byHeader[returns[i].header] = batch
+			batches = append(batches, batch)
+		}
+		batch.AddEntry(createReturnEntry(returns[i], rdfi, len(batch.GetEntries())+1))
+	}
+	for i := range batches {
+		if err := batches[i].Create(); err != nil {
+			return nil, err
+		}
+		file.AddBatch(batches[i])
+	}
+	if err := file.Create(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// createReturnEntry returns an EntryDetail with Addenda99 which sends ret's entry back to its ODFI. rdfi is the first
+// eight digits of our routing number which is used for the return's trace number.
+func createReturnEntry(ret *incomingReturn, rdfi string, seq int) *ach.EntryDetail {
+	orig := ret.entry
+
+	ed := ach.NewEntryDetail()
+	ed.TransactionCode = returnTransactionCode(orig.TransactionCode)
+
+	// The return goes back to the ODFI, whose routing number prefixes the original trace number
+	odfi := orig.TraceNumberField()[:8]
+	if ret.returnTraceNumber != "" {
+		odfi = ret.returnTraceNumber[:8]
+	}
+	ed.RDFIIdentification = odfi
+	ed.CheckDigit = fmt.Sprintf("%d", ed.CalculateCheckDigit(odfi))
+
+	ed.DFIAccountNumber = orig.DFIAccountNumber
+	ed.Amount = orig.Amount
+	ed.IdentificationNumber = orig.IdentificationNumber
+	ed.IndividualName = orig.IndividualName
+	ed.DiscretionaryData = orig.DiscretionaryData
+	ed.SetTraceNumber(rdfi, seq)
+
+	addenda99 := ach.NewAddenda99()
+	addenda99.ReturnCode = ret.returnCode
+	addenda99.OriginalTrace = orig.TraceNumberField()
+	addenda99.OriginalDFI = orig.RDFIIdentificationField()
+	addenda99.AddendaInformation = ret.addendaInformation
+	if ret.dateOfDeath != nil {
+		addenda99.DateOfDeath = ret.dateOfDeath.Format("060102") // YYMMDD
+	}
+	addenda99.TraceNumber = ed.TraceNumber
+	ed.Addenda99 = addenda99
+	ed.AddendaRecordIndicator = 1
+	ed.Category = ach.CategoryReturn
+	return ed
+}
+
+// returnTransactionCode returns the "automated return" TransactionCode for an original entry's TransactionCode.
+// (e.g. 22 becomes 21 and 27 becomes 26)
+func returnTransactionCode(code int) int {
+	if code%10 <= 4 {
+		return code - code%10 + 1 // credits
+	}
+	return code - code%10 + 6 // debits
+}
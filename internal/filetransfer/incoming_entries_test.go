@@ -0,0 +1,455 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/accounts"
+	"github.com/moov-io/paygate/internal/config"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/events"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/secrets"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestIncomingEntries__returnTransactionCode(t *testing.T) {
+	cases := map[int]int{
+		22: 21, 23: 21, 27: 26, 28: 26,
+		32: 31, 37: 36, 42: 41, 47: 46,
+		52: 51, 55: 56,
+	}
+	for code, expected := range cases {
+		if v := returnTransactionCode(code); v != expected {
+			t.Errorf("TransactionCode %d: got %d expected %d", code, v, expected)
+		}
+	}
+}
+
+func setupIncomingEntriesController(t *testing.T, accountsClient accounts.Client) (*Controller, *depository.SQLRepo, *transfers.SQLRepo, *events.SQLRepository, *database.TestSQLiteDB) {
+	t.Helper()
+
+	dir, _ := ioutil.TempDir("", "incomingEntries")
+
+	sqliteDB := database.CreateTestSqliteDB(t)
+	logger := log.NewNopLogger()
+	keeper := secrets.TestStringKeeper(t)
+
+	depRepo := depository.NewDepositoryRepo(logger, sqliteDB.DB, keeper)
+	transferRepo := transfers.NewTransferRepo(logger, sqliteDB.DB)
+	eventRepo := events.NewRepo(logger, sqliteDB.DB)
+
+	odfiAccount := depository.NewODFIAccount(accountsClient, "123", "987654320", model.Savings, keeper)
+	controller, err := NewController(config.Empty(), dir, NewRepository("", nil, "", nil), nil, nil, accountsClient, odfiAccount, eventRepo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return controller, depRepo, transferRepo, eventRepo, sqliteDB
+}
+
+func writeIncomingDepository(t *testing.T, depRepo *depository.SQLRepo, userID id.User, status model.DepositoryStatus) *model.Depository {
+	t.Helper()
+
+	dep := &model.Depository{
+		ID:            id.Depository(base.ID()),
+		RoutingNumber: "053200019",
+		BankName:      "bank name",
+		Holder:        "holder",
+		HolderType:    model.Individual,
+		Type:          model.Checking,
+		Status:        status,
+		Created:       base.NewTime(time.Now().Add(-1 * time.Second)),
+	}
+	if err := depRepo.UpsertUserDepository(userID, dep); err != nil {
+		t.Fatal(err)
+	}
+	dep, _ = depRepo.GetDepository(dep.ID) // this method sets the keeper
+	if err := dep.ReplaceAccountNumber("12345"); err != nil {
+		t.Fatal(err)
+	}
+	if err := depRepo.UpsertUserDepository(userID, dep); err != nil {
+		t.Fatal(err)
+	}
+	return dep
+}
+
+func TestIncomingEntries__post(t *testing.T) {
+	accountsClient := &accounts.MockClient{
+		Accounts:    []accounts.Account{{ID: base.ID()}},
+		Transaction: &accounts.Transaction{ID: base.ID()},
+	}
+	controller, depRepo, transferRepo, eventRepo, sqliteDB := setupIncomingEntriesController(t, accountsClient)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	userID := id.User(base.ID())
+	dep := writeIncomingDepository(t, depRepo, userID, model.DepositoryVerified)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &periodicFileOperationsRequest{}
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+
+	// the debit was posted against Accounts
+	if n := len(accountsClient.PostedTransactions); n != 1 {
+		t.Fatalf("got %d posted transactions", n)
+	}
+	if lines := accountsClient.PostedTransactions[0].Lines; lines[0].Purpose != "ACHDebit" || lines[0].Amount != 10500 || lines[1].Purpose != "ACHCredit" {
+		t.Errorf("unexpected transaction lines: %#v", lines)
+	}
+
+	// an event was written for the incoming transfer
+	evts, err := eventRepo.GetUserEvents(userID)
+	if err != nil || len(evts) != 1 {
+		t.Fatalf("got %d events: %v", len(evts), err)
+	}
+	if evts[0].Type != events.IncomingTransferEvent {
+		t.Errorf("unexpected event: %#v", evts[0])
+	}
+	xfer, err := transferRepo.GetIncomingTransfer(id.Transfer(evts[0].Metadata["transferID"]))
+	if err != nil || xfer == nil {
+		t.Fatalf("transfer=%v error=%v", xfer, err)
+	}
+	if xfer.DepositoryID != dep.ID || xfer.Type != model.PullTransfer || xfer.Status != model.TransferProcessed {
+		t.Errorf("unexpected incoming transfer: %#v", xfer)
+	}
+	if xfer.TransactionID != accountsClient.Transaction.ID || xfer.Amount.Int() != 10500 || xfer.CompanyName != "companyname" {
+		t.Errorf("unexpected incoming transfer: %#v", xfer)
+	}
+
+	// nothing was returned
+	if files, _ := grabAllFiles(filepath.Join(controller.rootDir, "merged"), nil); len(files) != 0 {
+		t.Errorf("unexpected merged files: %d", len(files))
+	}
+}
+
+// refusingAccountsClient fails every PostTransaction call with err
+type refusingAccountsClient struct {
+	*accounts.MockClient
+	err error
+}
+
+func (c *refusingAccountsClient) PostTransaction(requestID string, userID id.User, lines []accounts.TransactionLine) (*accounts.Transaction, error) {
+	return nil, c.err
+}
+
+func TestIncomingEntries__returns(t *testing.T) {
+	accountsClient := &refusingAccountsClient{
+		MockClient: &accounts.MockClient{
+			Accounts: []accounts.Account{{ID: base.ID()}},
+		},
+		err: accounts.ErrInsufficientFunds,
+	}
+	controller, depRepo, transferRepo, _, sqliteDB := setupIncomingEntriesController(t, accountsClient)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readReturn := func(t *testing.T) (string, string) {
+		t.Helper()
+		files, err := grabAllFiles(filepath.Join(controller.rootDir, "merged"), nil)
+		if err != nil || len(files) != 1 {
+			t.Fatalf("got %d merged files: %v", len(files), err)
+		}
+		defer os.Remove(files[0].filepath)
+
+		if files[0].Header.ImmediateDestination != file.Header.ImmediateOrigin || files[0].Header.ImmediateOrigin != file.Header.ImmediateDestination {
+			t.Errorf("unexpected FileHeader: %#v", files[0].Header)
+		}
+		if len(files[0].ReturnEntries) != 1 {
+			t.Fatalf("got %d return batches", len(files[0].ReturnEntries))
+		}
+		ed := files[0].ReturnEntries[0].GetEntries()[0]
+		if ed.TransactionCode != 26 || ed.Amount != 10500 {
+			t.Errorf("unexpected return entry: %#v", ed)
+		}
+		return ed.Addenda99.ReturnCode, ed.Addenda99.OriginalTrace
+	}
+
+	// no Depository exists
+	req := &periodicFileOperationsRequest{}
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if code, trace := readReturn(t); code != "R03" || trace != "076401255655291" {
+		t.Errorf("returnCode=%s originalTrace=%s", code, trace)
+	}
+
+	// rejected Depository
+	userID := id.User(base.ID())
+	dep := writeIncomingDepository(t, depRepo, userID, model.DepositoryRejected)
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := readReturn(t); code != "R16" {
+		t.Errorf("returnCode=%s", code)
+	}
+
+	// Accounts refuses the debit
+	if err := depRepo.UpdateDepositoryStatus(dep.ID, model.DepositoryVerified); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := readReturn(t); code != "R01" {
+		t.Errorf("returnCode=%s", code)
+	}
+}
+
+func TestIncomingEntries__retry(t *testing.T) {
+	accountsClient := &refusingAccountsClient{
+		MockClient: &accounts.MockClient{
+			Accounts:    []accounts.Account{{ID: base.ID()}},
+			Transaction: &accounts.Transaction{ID: base.ID()},
+		},
+		err: errors.New("accounts: PostTransaction: 500 Internal Server Error"),
+	}
+	controller, depRepo, transferRepo, _, sqliteDB := setupIncomingEntriesController(t, accountsClient)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+	controller.exceptions = &sqlExceptionRepository{db: sqliteDB.DB}
+
+	userID := id.User(base.ID())
+	writeIncomingDepository(t, depRepo, userID, model.DepositoryVerified)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Accounts is failing, so the entry is neither posted nor returned (or recorded as an exception)
+	req := &periodicFileOperationsRequest{}
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err == nil {
+		t.Fatal("expected error")
+	}
+	if xfers, err := transferRepo.GetUserIncomingTransfers(userID); len(xfers) != 0 || err != nil {
+		t.Fatalf("got %d incoming transfers: %v", len(xfers), err)
+	}
+	if files, _ := grabAllFiles(filepath.Join(controller.rootDir, "merged"), nil); len(files) != 0 {
+		t.Errorf("unexpected merged files: %d", len(files))
+	}
+	path := filepath.Join(controller.rootDir, "inbound-retry", "ppd-debit.ach")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected entries saved for retry: %v", err)
+	}
+	if exceptions, err := controller.exceptions.getExceptions(false, 10); len(exceptions) != 0 || err != nil {
+		t.Errorf("exceptions=%#v error=%v", exceptions, err)
+	}
+
+	// still failing
+	if err := controller.retryIncomingEntries(req, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected entries saved for retry: %v", err)
+	}
+
+	// Accounts recovers and the entry is posted
+	controller.accountsClient = accountsClient.MockClient
+	if err := controller.retryIncomingEntries(req, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected retry file to be removed: %v", err)
+	}
+	xfers, err := transferRepo.GetUserIncomingTransfers(userID)
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("got %d incoming transfers: %v", len(xfers), err)
+	}
+	if xfers[0].Status != model.TransferProcessed || xfers[0].Filename != "ppd-debit.ach" || len(accountsClient.PostedTransactions) != 1 {
+		t.Errorf("unexpected incoming transfer: %#v", xfers[0])
+	}
+}
+
+// failingIncomingTransferRepo fails to record or update IncomingTransfers while its errors are set
+type failingIncomingTransferRepo struct {
+	*transfers.SQLRepo
+
+	createErr error
+	markErr   error
+}
+
+func (r *failingIncomingTransferRepo) CreateIncomingTransfer(xfer *transfers.IncomingTransfer) error {
+	if r.createErr != nil {
+		return r.createErr
+	}
+	return r.SQLRepo.CreateIncomingTransfer(xfer)
+}
+
+func (r *failingIncomingTransferRepo) MarkIncomingTransferPosted(id id.Transfer, status model.TransferStatus, returnCode string, transactionID string) error {
+	if r.markErr != nil {
+		return r.markErr
+	}
+	return r.SQLRepo.MarkIncomingTransferPosted(id, status, returnCode, transactionID)
+}
+
+func TestIncomingEntries__retryDatabaseError(t *testing.T) {
+	accountsClient := &accounts.MockClient{
+		Accounts:    []accounts.Account{{ID: base.ID()}},
+		Transaction: &accounts.Transaction{ID: base.ID()},
+	}
+	controller, depRepo, sqlTransferRepo, _, sqliteDB := setupIncomingEntriesController(t, accountsClient)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	userID := id.User(base.ID())
+	writeIncomingDepository(t, depRepo, userID, model.DepositoryVerified)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the entry can't be recorded, so it isn't posted
+	transferRepo := &failingIncomingTransferRepo{SQLRepo: sqlTransferRepo, createErr: errors.New("database is down")}
+	req := &periodicFileOperationsRequest{}
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := len(accountsClient.PostedTransactions); n != 0 {
+		t.Fatalf("got %d posted transactions", n)
+	}
+
+	// the database recovers, but fails after posting the entry
+	transferRepo.createErr = nil
+	transferRepo.markErr = errors.New("database is down")
+	if err := controller.retryIncomingEntries(req, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(controller.rootDir, "inbound-retry", "ppd-debit.ach")); !os.IsNotExist(err) {
+		t.Errorf("expected retry file to be removed: %v", err)
+	}
+	if n := len(accountsClient.PostedTransactions); n != 1 {
+		t.Fatalf("got %d posted transactions", n)
+	}
+
+	// handling the entry again doesn't post it twice
+	transferRepo.markErr = nil
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(accountsClient.PostedTransactions); n != 1 {
+		t.Errorf("got %d posted transactions", n)
+	}
+	if xfers, err := transferRepo.GetUserIncomingTransfers(userID); err != nil || len(xfers) != 1 {
+		t.Errorf("got %d incoming transfers: %v", len(xfers), err)
+	}
+}
+
+func TestIncomingEntries__exceptions(t *testing.T) {
+	controller, depRepo, transferRepo, _, sqliteDB := setupIncomingEntriesController(t, &accounts.MockClient{})
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+	controller.exceptions = &sqlExceptionRepository{db: sqliteDB.DB}
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Batches[0].GetHeader().EffectiveEntryDate = "201399"
+
+	// the entry can't be read, so it's recorded as an exception rather than retried
+	req := &periodicFileOperationsRequest{}
+	for i := 0; i < 2; i++ {
+		if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exceptions, err := controller.exceptions.getExceptions(false, 10)
+	if err != nil || len(exceptions) != 1 {
+		t.Fatalf("exceptions=%#v error=%v", exceptions, err)
+	}
+	if ex := exceptions[0]; ex.Type != exceptionIncoming || ex.Filename != "ppd-debit.ach" || ex.TraceNumber != "076401255655291" {
+		t.Errorf("unexpected exception: %#v", ex)
+	}
+	if _, err := os.Stat(filepath.Join(controller.rootDir, "inbound-retry", "ppd-debit.ach")); !os.IsNotExist(err) {
+		t.Errorf("unexpected retry file: %v", err)
+	}
+}
+
+func TestIncomingEntries__mergeIncomingReturns(t *testing.T) {
+	accountsClient := &accounts.MockClient{
+		Accounts:    []accounts.Account{{ID: base.ID()}},
+		Transaction: &accounts.Transaction{ID: base.ID()},
+	}
+	controller, depRepo, transferRepo, _, sqliteDB := setupIncomingEntriesController(t, accountsClient)
+	defer os.RemoveAll(controller.rootDir)
+	defer sqliteDB.Close()
+
+	userID := id.User(base.ID())
+	writeIncomingDepository(t, depRepo, userID, model.DepositoryVerified)
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &periodicFileOperationsRequest{}
+	if err := controller.handleIncomingEntries(req, file, "ppd-debit.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	xfers, err := transferRepo.GetUserIncomingTransfers(userID)
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("got %d incoming transfers: %v", len(xfers), err)
+	}
+
+	// queue a return of the incoming transfer
+	if err := transferRepo.CreateIncomingReturn(&transfers.IncomingReturn{
+		TransferID:         xfers[0].ID,
+		UserID:             userID,
+		ReturnCode:         "R10",
+		AddendaInformation: "not authorized",
+		Deadline:           time.Now().Add(48 * time.Hour),
+		Created:            time.Now(),
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mergedDir := filepath.Join(controller.rootDir, "merged")
+	os.Mkdir(mergedDir, 0777)
+	controller.mergeIncomingReturns(mergedDir, transferRepo, depRepo, nil)
+
+	files, err := grabAllFiles(mergedDir, nil)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d merged files: %v", len(files), err)
+	}
+	if files[0].Header.ImmediateDestination != file.Header.ImmediateOrigin {
+		t.Errorf("unexpected FileHeader: %#v", files[0].Header)
+	}
+	if len(files[0].ReturnEntries) != 1 {
+		t.Fatalf("got %d return batches", len(files[0].ReturnEntries))
+	}
+	ed := files[0].ReturnEntries[0].GetEntries()[0]
+	if ed.TransactionCode != 26 || ed.Amount != 10500 || ed.Addenda99.ReturnCode != "R10" {
+		t.Errorf("unexpected return entry: %#v", ed)
+	}
+	if ed.Addenda99.OriginalTrace != "076401255655291" || ed.Addenda99.AddendaInformation != "not authorized" {
+		t.Errorf("unexpected Addenda99: %#v", ed.Addenda99)
+	}
+
+	// the return isn't merged again
+	if returns, err := transferRepo.GetPendingIncomingReturns(); err != nil || len(returns) != 0 {
+		t.Errorf("got %d pending returns: %v", len(returns), err)
+	}
+}
@@ -69,14 +69,14 @@ func TestController__saveRemoteFiles(t *testing.T) {
 	}
 
 	// read written files
-	file, err := parseACHFilepath(filepath.Join(dir, agent.InboundPath(), "ppd-debit.ach"))
+	file, err := parseACHFilepath(filepath.Join(dir, agent.InboundPath(), "ppd-debit.ach"), nil)
 	if err != nil {
 		t.Error(err)
 	}
 	if v := file.Batches[0].GetHeader().StandardEntryClassCode; v != "PPD" {
 		t.Errorf("SEC code found is %s", v)
 	}
-	file, err = parseACHFilepath(filepath.Join(dir, agent.ReturnPath(), "return-WEB.ach"))
+	file, err = parseACHFilepath(filepath.Join(dir, agent.ReturnPath(), "return-WEB.ach"), nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,432 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/transfers"
+)
+
+// leaseRepository offers distributed locks (leases) which are shared across multiple paygate instances.
+//
+// A lease is held by one owner until it expires or is released. The owner renews (heartbeats) the lease
+// by acquiring it again before it expires. When an owner crashes their lease expires and another
+// instance is able to acquire it.
+type leaseRepository interface {
+	// acquireLease attempts to acquire (or renew) the lease for name, returning true
+	// if owner holds the lease after the call. expiredOwner is set when the lease was taken
+	// over from another owner whose lease expired or was released.
+	acquireLease(name string, owner string, ttl time.Duration) (held bool, expiredOwner string, err error)
+
+	// releaseLease gives up a lease held by owner so it can be taken over immediately.
+	// Leases held by other owners are not modified.
+	releaseLease(name string, owner string) error
+
+	// expiredLeases returns the names of leases which have expired or been released.
+	expiredLeases() ([]string, error)
+}
+
+type sqlLeaseRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlLeaseRepository) acquireLease(name string, owner string, ttl time.Duration) (bool, string, error) {
+	now := time.Now()
+
+	// Renew the lease if we already own it.
+	query := `update file_transfer_leases set expires_at = ? where name = ? and owner = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return false, "", fmt.Errorf("acquireLease: prepare renew: %v", err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(now.Add(ttl), name, owner)
+	if err != nil {
+		return false, "", fmt.Errorf("acquireLease: renew: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return true, "", nil
+	}
+
+	// Take over the lease if the previous owner let it expire, remembering who they were.
+	query = `select owner from file_transfer_leases where name = ? and expires_at < ?;`
+	stmt, err = r.db.Prepare(query)
+	if err != nil {
+		return false, "", fmt.Errorf("acquireLease: prepare select: %v", err)
+	}
+	defer stmt.Close()
+
+	var expiredOwner string
+	if err := stmt.QueryRow(name, now).Scan(&expiredOwner); err != nil && err != sql.ErrNoRows {
+		return false, "", fmt.Errorf("acquireLease: select: %v", err)
+	}
+	if expiredOwner != "" {
+		query = `update file_transfer_leases set owner = ?, expires_at = ? where name = ? and owner = ? and expires_at < ?;`
+		stmt, err = r.db.Prepare(query)
+		if err != nil {
+			return false, "", fmt.Errorf("acquireLease: prepare update: %v", err)
+		}
+		defer stmt.Close()
+
+		res, err := stmt.Exec(owner, now.Add(ttl), name, expiredOwner, now)
+		if err != nil {
+			return false, "", fmt.Errorf("acquireLease: update: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			return true, expiredOwner, nil
+		}
+		return false, "", nil // another instance took it over first
+	}
+
+	// The lease has never been created or someone else holds it, so try to insert the row.
+	// Only one instance can insert due to the primary key.
+	query = `insert into file_transfer_leases (name, owner, expires_at) values (?, ?, ?);`
+	stmt, err = r.db.Prepare(query)
+	if err != nil {
+		return false, "", fmt.Errorf("acquireLease: prepare insert: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(name, owner, now.Add(ttl)); err != nil {
+		if database.UniqueViolation(err) {
+			return false, "", nil // held by another owner
+		}
+		return false, "", fmt.Errorf("acquireLease: insert: %v", err)
+	}
+	return true, "", nil
+}
+
+// releaseLease expires owner's lease rather than deleting it so the next owner knows whose merged files to requeue.
+func (r *sqlLeaseRepository) releaseLease(name string, owner string) error {
+	query := `update file_transfer_leases set expires_at = ? where name = ? and owner = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("releaseLease: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(time.Now().Add(-1*time.Second), name, owner); err != nil {
+		return fmt.Errorf("releaseLease: name=%s: %v", name, err)
+	}
+	return nil
+}
+
+func (r *sqlLeaseRepository) expiredLeases() ([]string, error) {
+	query := `select name from file_transfer_leases where expires_at < ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("expiredLeases: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("expiredLeases: query: %v", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("expiredLeases: scan: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+const leaseNamePrefix = "merge-upload-"
+
+// leaseName returns the name of a merge and upload lease for routingNumber.
+func leaseName(routingNumber string) string {
+	return leaseNamePrefix + routingNumber
+}
+
+// instanceID returns a name unique to this paygate process to identify leases and claims it holds.
+func instanceID() string {
+	if v := os.Getenv("ACH_FILE_LEASE_OWNER"); v != "" {
+		return v
+	}
+	hostname, _ := os.Hostname()
+	return strings.Trim(fmt.Sprintf("%s-%s", hostname, base.ID()[:8]), "-")
+}
+
+// leaseDuration returns how long merge and upload leases are held for without renewal.
+// Leases are renewed every interval, so by default they are held for three intervals.
+func leaseDuration(interval time.Duration) time.Duration {
+	if v := os.Getenv("ACH_FILE_LEASE_DURATION"); v != "" {
+		if dur, _ := time.ParseDuration(v); dur > 0 {
+			return dur
+		}
+	}
+	return 3 * interval
+}
+
+// holdsLease returns true when this Controller holds (or was able to acquire) the merge and upload
+// lease for routingNumber. Controllers without a lease repository always hold every lease.
+//
+// When a lease is newly acquired (i.e. from a crashed or stopped instance) newlyAcquired is true so
+// callers can rescan records the previous leader may have left behind.
+func (c *Controller) holdsLease(routingNumber string) (held bool, newlyAcquired bool) {
+	if c.leases == nil {
+		return true, false
+	}
+
+	c.heldLeasesMu.Lock()
+	defer c.heldLeasesMu.Unlock()
+
+	ok, expiredOwner, err := c.leases.acquireLease(leaseName(routingNumber), c.instanceID, c.leaseDuration)
+	if err != nil {
+		c.logger.Log("leases", fmt.Sprintf("problem acquiring lease for %s", routingNumber), "error", err)
+		ok = false
+	}
+	if !ok {
+		if c.heldLeases[routingNumber] {
+			c.logger.Log("leases", fmt.Sprintf("lost merge and upload lease for %s as %s", routingNumber, c.instanceID))
+			if c.lostLeases == nil {
+				c.lostLeases = make(map[string]bool)
+			}
+			c.lostLeases[routingNumber] = true
+		}
+		delete(c.heldLeases, routingNumber)
+		return false, false
+	}
+	if _, exists := c.heldLeases[routingNumber]; !exists {
+		c.heldLeases[routingNumber] = true
+		c.logger.Log("leases", fmt.Sprintf("acquired merge and upload lease for %s as %s", routingNumber, c.instanceID))
+		if expiredOwner != "" && expiredOwner != c.instanceID {
+			if c.takenOverLeases == nil {
+				c.takenOverLeases = make(map[string]string)
+			}
+			c.takenOverLeases[routingNumber] = expiredOwner
+		}
+		return true, true
+	}
+	return true, false
+}
+
+// renewLeases extends every lease held by this Controller and takes over leases which expired (i.e. their holder
+// crashed) so the files they merged are requeued even when nothing new arrives for their routing number. Merged files
+// of leases which were lost to another instance are abandoned, so their Transfers and micro-deposits are merged again
+// by the new lease holder rather than sitting in our local merged directory.
+func (c *Controller) renewLeases(transferRepo transfers.Repository, depRepo *depository.SQLRepo) {
+	if c.leases == nil {
+		return
+	}
+
+	c.heldLeasesMu.Lock()
+	var routingNumbers []string
+	for routingNumber := range c.heldLeases {
+		routingNumbers = append(routingNumbers, routingNumber)
+	}
+	c.heldLeasesMu.Unlock()
+
+	expired, err := c.leases.expiredLeases()
+	if err != nil {
+		c.logger.Log("leases", "problem reading expired leases", "error", err)
+	}
+	for i := range expired {
+		routingNumbers = append(routingNumbers, strings.TrimPrefix(expired[i], leaseNamePrefix))
+	}
+
+	for i := range routingNumbers {
+		c.holdsLease(routingNumbers[i])
+	}
+
+	c.heldLeasesMu.Lock()
+	var lost []string
+	for routingNumber := range c.lostLeases {
+		lost = append(lost, routingNumber)
+	}
+	c.heldLeasesMu.Unlock()
+
+	for i := range lost {
+		if err := c.abandonMergedFiles(lost[i], transferRepo, depRepo); err != nil {
+			c.logger.Log("leases", fmt.Sprintf("problem abandoning merged files for %s", lost[i]), "error", err)
+			continue
+		}
+		c.heldLeasesMu.Lock()
+		delete(c.lostLeases, lost[i])
+		c.heldLeasesMu.Unlock()
+	}
+}
+
+// abandonMergedFiles removes our merged files destined for routingNumber after moving everything merged into them
+// back to pending. Files are skipped if we've since re-acquired the lease for routingNumber.
+func (c *Controller) abandonMergedFiles(routingNumber string, transferRepo transfers.Repository, depRepo *depository.SQLRepo) error {
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	c.heldLeasesMu.Lock()
+	held := c.heldLeases[routingNumber]
+	c.heldLeasesMu.Unlock()
+	if held {
+		return nil
+	}
+
+	files, err := grabAllFiles(filepath.Join(c.rootDir, "merged"), c.keeper)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		if files[i].Header.ImmediateDestination != routingNumber {
+			continue
+		}
+		filename := filepath.Base(files[i].filepath)
+		if transferRepo != nil {
+			if err := transferRepo.RequeueMergedFile(filename); err != nil {
+				return err
+			}
+		}
+		if depRepo != nil {
+			if err := depRepo.UnmergeMicroDeposits(filename); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(files[i].filepath); err != nil {
+			return fmt.Errorf("problem removing abandoned file %s: %v", filename, err)
+		}
+		c.logger.Log("leases", fmt.Sprintf("abandoned merged file %s after losing the lease for %s", filename, routingNumber))
+	}
+	return nil
+}
+
+// requeueTakenOverFiles moves everything the previous holders of leases we took over merged, but never uploaded,
+// back to pending so we merge it again. Those files are on the previous holder's disk (which may have crashed),
+// so they're found from the claims on their Transfers. The caller must hold mergedFilesMu.
+func (c *Controller) requeueTakenOverFiles(transferRepo transfers.Repository, depRepo *depository.SQLRepo) {
+	c.heldLeasesMu.Lock()
+	takenOver := make(map[string]string)
+	for routingNumber, owner := range c.takenOverLeases {
+		takenOver[routingNumber] = owner
+	}
+	c.heldLeasesMu.Unlock()
+
+	for routingNumber, owner := range takenOver {
+		if err := c.requeueAbandonedFiles(routingNumber, owner, transferRepo, depRepo); err != nil {
+			c.logger.Log("leases", fmt.Sprintf("problem requeueing merged files of %s for %s", owner, routingNumber), "error", err)
+			continue
+		}
+		c.heldLeasesMu.Lock()
+		delete(c.takenOverLeases, routingNumber)
+		c.heldLeasesMu.Unlock()
+	}
+}
+
+func (c *Controller) requeueAbandonedFiles(routingNumber string, owner string, transferRepo transfers.Repository, depRepo *depository.SQLRepo) error {
+	if transferRepo == nil {
+		return nil
+	}
+	filenames, err := transferRepo.GetAbandonedMergedFiles(owner, routingNumber)
+	if err != nil {
+		return err
+	}
+	for i := range filenames {
+		if err := transferRepo.RequeueMergedFile(filenames[i]); err != nil {
+			return err
+		}
+		if depRepo != nil {
+			if err := depRepo.UnmergeMicroDeposits(filenames[i]); err != nil {
+				return err
+			}
+		}
+		// We could have a copy of the file from before we were restarted, which would duplicate its Transfers.
+		path := filepath.Join(c.rootDir, "merged", filenames[i])
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("problem removing abandoned file %s: %v", filenames[i], err)
+		}
+		c.logger.Log("leases", fmt.Sprintf("requeued merged file %s of %s after taking over the lease for %s", filenames[i], owner, routingNumber))
+	}
+	return nil
+}
+
+// releaseLeases will give up every lease held by this Controller so other instances can take over immediately.
+func (c *Controller) releaseLeases() {
+	if c.leases == nil {
+		return
+	}
+
+	c.heldLeasesMu.Lock()
+	defer c.heldLeasesMu.Unlock()
+
+	for routingNumber := range c.heldLeases {
+		if err := c.leases.releaseLease(leaseName(routingNumber), c.instanceID); err != nil {
+			c.logger.Log("leases", fmt.Sprintf("problem releasing lease for %s", routingNumber), "error", err)
+		}
+		delete(c.heldLeases, routingNumber)
+	}
+}
+
+// mergeLeases caches lease checks for one run of mergeAndUploadFiles.
+type mergeLeases struct {
+	controller *Controller
+	held       map[string]bool
+
+	// onAcquire is called when a lease is taken over from another instance
+	onAcquire func()
+}
+
+// newMergeLeases returns a mergeLeases whose takeovers rewind transferCur and microDepositCur. The files of previous
+// lease holders are requeued with transferRepo when it's non-nil, which requires the caller to hold mergedFilesMu.
+func (c *Controller) newMergeLeases(transferCur *transfers.Cursor, microDepositCur *depository.MicroDepositCursor, transferRepo transfers.Repository) *mergeLeases {
+	return &mergeLeases{
+		controller: c,
+		held:       make(map[string]bool),
+		onAcquire: func() {
+			var depRepo *depository.SQLRepo
+			if microDepositCur != nil {
+				depRepo = microDepositCur.DepRepo
+			}
+			c.requeueTakenOverFiles(transferRepo, depRepo)
+
+			// Rewind our cursors so any records the previous lease holder didn't merge are read again.
+			if transferCur != nil {
+				transferCur.Rewind()
+			}
+			if microDepositCur != nil {
+				microDepositCur.Rewind()
+			}
+		},
+	}
+}
+
+// holds returns true if the Controller holds the merge and upload lease for routingNumber.
+// A nil *mergeLeases holds every lease.
+func (l *mergeLeases) holds(routingNumber string) bool {
+	if l == nil {
+		return true
+	}
+	if held, exists := l.held[routingNumber]; exists {
+		return held
+	}
+	held, newlyAcquired := l.controller.holdsLease(routingNumber)
+	if newlyAcquired && l.onAcquire != nil {
+		l.onAcquire()
+	}
+	l.held[routingNumber] = held
+	return held
+}
+
+// filter returns the files whose destination routing number we hold a lease for.
+func (l *mergeLeases) filter(files []*achFile) []*achFile {
+	var out []*achFile
+	for i := range files {
+		if files[i] != nil && files[i].File != nil && l.holds(files[i].Header.ImmediateDestination) {
+			out = append(out, files[i])
+		}
+	}
+	return out
+}
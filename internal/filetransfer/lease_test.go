@@ -0,0 +1,343 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/secrets"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/achclient"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestLeases(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	repo := &sqlLeaseRepository{db: db.DB}
+
+	// first instance grabs the lease
+	if held, _, err := repo.acquireLease("lease", "instance-a", time.Minute); !held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+	// second instance is blocked
+	if held, _, err := repo.acquireLease("lease", "instance-b", time.Minute); held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+	// renew the lease with a short duration
+	if held, _, err := repo.acquireLease("lease", "instance-a", time.Millisecond); !held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// second instance takes over the expired lease
+	if held, _, err := repo.acquireLease("lease", "instance-b", time.Minute); !held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+	if held, _, err := repo.acquireLease("lease", "instance-a", time.Minute); held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+
+	// releasing someone else's lease does nothing
+	if err := repo.releaseLease("lease", "instance-a"); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, err := repo.acquireLease("lease", "instance-a", time.Minute); held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+	if err := repo.releaseLease("lease", "instance-b"); err != nil {
+		t.Fatal(err)
+	}
+	// the released lease is taken over and we're told who held it
+	if held, expiredOwner, err := repo.acquireLease("lease", "instance-a", time.Minute); !held || expiredOwner != "instance-b" || err != nil {
+		t.Fatalf("held=%v expiredOwner=%q error=%v", held, expiredOwner, err)
+	}
+	if held, expiredOwner, err := repo.acquireLease("lease", "instance-a", time.Minute); !held || expiredOwner != "" || err != nil {
+		t.Fatalf("held=%v expiredOwner=%q error=%v", held, expiredOwner, err)
+	}
+}
+
+func TestController__holdsLease(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	first := &Controller{
+		leases:        &sqlLeaseRepository{db: db.DB},
+		leaseDuration: time.Minute,
+		instanceID:    "first",
+		heldLeases:    make(map[string]bool),
+		logger:        log.NewNopLogger(),
+	}
+	second := &Controller{
+		leases:        &sqlLeaseRepository{db: db.DB},
+		leaseDuration: time.Minute,
+		instanceID:    "second",
+		heldLeases:    make(map[string]bool),
+		logger:        log.NewNopLogger(),
+	}
+
+	if held, newlyAcquired := first.holdsLease("987654320"); !held || !newlyAcquired {
+		t.Errorf("held=%v newlyAcquired=%v", held, newlyAcquired)
+	}
+	if held, newlyAcquired := first.holdsLease("987654320"); !held || newlyAcquired {
+		t.Errorf("held=%v newlyAcquired=%v", held, newlyAcquired)
+	}
+	if held, _ := second.holdsLease("987654320"); held {
+		t.Error("expected lease to be held by first controller")
+	}
+
+	// a mergeLeases only checks each routing number once
+	acquired := 0
+	leases := &mergeLeases{controller: second, held: make(map[string]bool), onAcquire: func() { acquired++ }}
+	if leases.holds("987654320") {
+		t.Error("expected lease to be held by first controller")
+	}
+
+	// shutdown the first controller and have the second take over
+	first.releaseLeases()
+	if leases.holds("987654320") {
+		t.Error("expected cached lease check")
+	}
+	leases = &mergeLeases{controller: second, held: make(map[string]bool), onAcquire: func() { acquired++ }}
+	if !leases.holds("987654320") || acquired != 1 {
+		t.Errorf("expected second controller to take over lease, acquired=%d", acquired)
+	}
+
+	// nil *mergeLeases and Controllers without a repository hold every lease
+	var nilLeases *mergeLeases
+	if !nilLeases.holds("987654320") {
+		t.Error("nil mergeLeases should hold every lease")
+	}
+	if held, _ := (&Controller{}).holdsLease("987654320"); !held {
+		t.Error("expected lease without repository")
+	}
+}
+
+func TestController__renewLeases(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	dir, _ := ioutil.TempDir("", "renew-leases")
+	defer os.RemoveAll(dir)
+
+	controller := &Controller{
+		rootDir:       dir,
+		leases:        &sqlLeaseRepository{db: db.DB},
+		leaseDuration: time.Minute,
+		instanceID:    "first",
+		heldLeases:    make(map[string]bool),
+		logger:        log.NewNopLogger(),
+	}
+	path := writeTwoEntryMergedFile(t, dir)
+
+	if held, _ := controller.holdsLease("076401251"); !held {
+		t.Fatal("expected to hold lease")
+	}
+	transferRepo := &transfers.MockRepository{Status: model.TransferProcessed}
+
+	// renewing a held lease keeps our merged file
+	controller.renewLeases(transferRepo, nil)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance takes over our expired lease
+	if _, err := db.DB.Exec(`update file_transfer_leases set expires_at = ?`, time.Now().Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if held, _, err := controller.leases.acquireLease(leaseName("076401251"), "second", time.Minute); !held || err != nil {
+		t.Fatalf("held=%v error=%v", held, err)
+	}
+
+	controller.renewLeases(transferRepo, nil)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected merged file to be abandoned: %v", err)
+	}
+	if transferRepo.Status != model.TransferPending {
+		t.Errorf("transfer status=%s", transferRepo.Status)
+	}
+	if len(controller.heldLeases) != 0 || len(controller.lostLeases) != 0 {
+		t.Errorf("heldLeases=%v lostLeases=%v", controller.heldLeases, controller.lostLeases)
+	}
+}
+
+// leaseTakeoverTest is two paygate instances merging a pending Transfer destined for 076401251 (testdata/ppd-debit.ach)
+type leaseTakeoverTest struct {
+	first, second *Controller
+
+	db           *database.TestSQLiteDB
+	depRepo      *depository.SQLRepo
+	transferRepo *transfers.SQLRepo
+	transferID   id.Transfer
+}
+
+func setupLeaseTakeoverTest(t *testing.T) *leaseTakeoverTest {
+	t.Helper()
+
+	achClient, _, achServer := achclient.MockClientServer("leaseTakeover", func(r *mux.Router) {
+		achFileContentsRoute(r)
+	})
+	t.Cleanup(achServer.Close)
+
+	db := database.CreateTestSqliteDB(t)
+	t.Cleanup(func() { db.Close() })
+
+	test := &leaseTakeoverTest{
+		db:           db,
+		depRepo:      depository.NewDepositoryRepo(log.NewNopLogger(), db.DB, secrets.TestStringKeeper(t)),
+		transferRepo: transfers.NewTransferRepo(log.NewNopLogger(), db.DB),
+		transferID:   id.Transfer(base.ID()),
+	}
+	newController := func(name string) *Controller {
+		dir, _ := ioutil.TempDir("", "lease-takeover")
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		os.Mkdir(filepath.Join(dir, "merged"), 0777)
+
+		return &Controller{
+			rootDir: dir,
+			ach:     achClient,
+			logger:  log.NewNopLogger(),
+			repo: &mockRepository{
+				configs: []*Config{{RoutingNumber: "076401251", OutboundFilenameTemplate: defaultFilenameTemplate}},
+			},
+			leases:        &sqlLeaseRepository{db: db.DB},
+			leaseDuration: time.Minute,
+			instanceID:    name,
+			heldLeases:    make(map[string]bool),
+		}
+	}
+	test.first, test.second = newController("first"), newController("second")
+
+	userID := id.User(base.ID())
+	dep := &model.Depository{
+		ID:                     id.Depository(base.ID()),
+		BankName:               "bank name",
+		Holder:                 "holder",
+		HolderType:             model.Individual,
+		Type:                   model.Checking,
+		RoutingNumber:          "076401251",
+		EncryptedAccountNumber: "151",
+		Status:                 model.DepositoryVerified,
+	}
+	if err := test.depRepo.UpsertUserDepository(userID, dep); err != nil {
+		t.Fatal(err)
+	}
+	query := `insert into transfers (transfer_id, user_id, type, amount, originator_id, originator_depository, receiver, receiver_depository, description, standard_entry_class_code, status, same_day, file_id, created_at)
+values (?, ?, 'push', 'USD 12.12', 'originator', 'originator', 'receiver', ?, 'money', 'PPD', 'pending', false, 'fileID', ?);`
+	if _, err := db.DB.Exec(query, test.transferID, userID, dep.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	return test
+}
+
+func (test *leaseTakeoverTest) expireLeases(t *testing.T) {
+	t.Helper()
+	if _, err := test.db.DB.Exec(`update file_transfer_leases set expires_at = ?`, time.Now().Add(-1*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mergedBy returns the merged files of controller which hold our Transfer
+func (test *leaseTakeoverTest) mergedBy(t *testing.T, controller *Controller) []string {
+	t.Helper()
+	filenames, err := test.transferRepo.GetAbandonedMergedFiles(controller.instanceID, "076401251")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range filenames {
+		if _, err := os.Stat(filepath.Join(controller.rootDir, "merged", filenames[i])); err != nil {
+			t.Errorf("%s isn't in %s's merged directory: %v", filenames[i], controller.instanceID, err)
+		}
+	}
+	return filenames
+}
+
+func TestController__leaseLostRequeuesTransfers(t *testing.T) {
+	test := setupLeaseTakeoverTest(t)
+
+	firstCur := test.transferRepo.GetCursor(10, test.depRepo)
+	secondCur := test.transferRepo.GetCursor(10, test.depRepo)
+	secondMicroDepositCur := test.depRepo.GetMicroDepositCursor(10)
+	mergeSecond := func() {
+		if err := test.second.mergeAndUploadFiles(secondCur, secondMicroDepositCur, test.transferRepo, &periodicFileOperationsRequest{}, &mergeUploadOpts{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first instance holds the lease, so the second's cursor passes over our transfer
+	if held, _ := test.first.holdsLease("076401251"); !held {
+		t.Fatal("expected first instance to hold the lease")
+	}
+	mergeSecond()
+	if filenames := test.mergedBy(t, test.second); len(filenames) != 0 {
+		t.Fatalf("second instance merged %v", filenames)
+	}
+
+	// the second instance takes over the lease, but the first is already merging our transfer
+	test.expireLeases(t)
+	test.second.renewLeases(test.transferRepo, test.depRepo)
+	mergeSecond()
+
+	xfers, err := firstCur.Next()
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("transfers=%#v error=%v", xfers, err)
+	}
+	test.first.mergeGroupableTransfer(filepath.Join(test.first.rootDir, "merged"), xfers[0], test.transferRepo)
+	if filenames := test.mergedBy(t, test.first); len(filenames) != 1 {
+		t.Fatalf("first instance merged %v", filenames)
+	}
+
+	// the first instance notices it lost the lease and requeues its file, which the second instance merges
+	test.first.renewLeases(test.transferRepo, test.depRepo)
+	if filenames := test.mergedBy(t, test.first); len(filenames) != 0 {
+		t.Fatalf("first instance merged %v", filenames)
+	}
+	mergeSecond()
+	if filenames := test.mergedBy(t, test.second); len(filenames) != 1 {
+		t.Errorf("second instance merged %v", filenames)
+	}
+}
+
+func TestController__leaseExpiredRequeuesTransfers(t *testing.T) {
+	test := setupLeaseTakeoverTest(t)
+
+	// the first instance merges our transfer and then crashes
+	firstCur := test.transferRepo.GetCursor(10, test.depRepo)
+	if err := test.first.mergeAndUploadFiles(firstCur, test.depRepo.GetMicroDepositCursor(10), test.transferRepo, &periodicFileOperationsRequest{}, &mergeUploadOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if filenames := test.mergedBy(t, test.first); len(filenames) != 1 {
+		t.Fatalf("first instance merged %v", filenames)
+	}
+	test.expireLeases(t)
+
+	// the second instance takes over the expired lease and merges our transfer again
+	test.second.renewLeases(test.transferRepo, test.depRepo)
+	if held, _ := test.second.holdsLease("076401251"); !held {
+		t.Fatal("expected second instance to hold the lease")
+	}
+	secondCur := test.transferRepo.GetCursor(10, test.depRepo)
+	if err := test.second.mergeAndUploadFiles(secondCur, test.depRepo.GetMicroDepositCursor(10), test.transferRepo, &periodicFileOperationsRequest{}, &mergeUploadOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if filenames, err := test.transferRepo.GetAbandonedMergedFiles("first", "076401251"); len(filenames) != 0 || err != nil {
+		t.Errorf("filenames=%v error=%v", filenames, err)
+	}
+	if filenames := test.mergedBy(t, test.second); len(filenames) != 1 {
+		t.Errorf("second instance merged %v", filenames)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base/admin"
+	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errMergedFileNotFound       = errors.New("merged file not found")
+	errTransferNotInMergedFile  = errors.New("transfer not found in merged file")
+	errMergedTransferTraceEmpty = errors.New("transfer has no trace number recorded")
+)
+
+// mergedFile summarizes an ACH file in our merged directory which is pending upload
+type mergedFile struct {
+	Filename    string `json:"filename"`
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+
+	LineCount  int `json:"lineCount"`
+	EntryCount int `json:"entryCount"`
+
+	// TotalDebitAmount and TotalCreditAmount are in cents
+	TotalDebitAmount  int `json:"totalDebitAmount"`
+	TotalCreditAmount int `json:"totalCreditAmount"`
+
+	Transfers     []*transfers.MergedTransfer `json:"transfers"`
+	MicroDeposits []*mergedMicroDeposit       `json:"microDeposits"`
+}
+
+type mergedMicroDeposit struct {
+	DepositoryID id.Depository `json:"depositoryID"`
+	UserID       id.User       `json:"userID"`
+	Amount       *model.Amount `json:"amount"`
+}
+
+// mergedFilepath returns the path of filename in our merged directory, or an error if it's not a pending file.
+func (c *Controller) mergedFilepath(filename string) (string, error) {
+	if filename == "" || filename != filepath.Base(filename) || !strings.HasSuffix(filename, ".ach") {
+		return "", fmt.Errorf("invalid filename %q", filename)
+	}
+	path := filepath.Join(c.rootDir, "merged", filename)
+	if _, err := os.Stat(path); err != nil {
+		return "", errMergedFileNotFound
+	}
+	return path, nil
+}
+
+func (c *Controller) getMergedFiles(depRepo depository.Repository, transferRepo transfers.Repository) ([]*mergedFile, error) {
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	files, err := grabAllFiles(filepath.Join(c.rootDir, "merged"), c.keeper)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].filepath < files[j].filepath })
+
+	out := make([]*mergedFile, 0, len(files))
+	for i := range files {
+		summary, err := summarizeMergedFile(files[i], depRepo, transferRepo)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, summary)
+	}
+	return out, nil
+}
+
+func summarizeMergedFile(file *achFile, depRepo depository.Repository, transferRepo transfers.Repository) (*mergedFile, error) {
+	filename := filepath.Base(file.filepath)
+	summary := &mergedFile{
+		Filename:          filename,
+		Origin:            file.Header.ImmediateOrigin,
+		Destination:       file.Header.ImmediateDestination,
+		LineCount:         file.lineCount(),
+		TotalDebitAmount:  file.Control.TotalDebitEntryDollarAmountInFile,
+		TotalCreditAmount: file.Control.TotalCreditEntryDollarAmountInFile,
+	}
+	for i := range file.Batches {
+		summary.EntryCount += len(file.Batches[i].GetEntries())
+	}
+
+	xfers, err := transferRepo.GetMergedTransfers(filename)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading transfers of %s: %v", filename, err)
+	}
+	summary.Transfers = xfers
+
+	microDeposits, err := depRepo.GetMergedMicroDeposits(filename)
+	if err != nil {
+		return nil, fmt.Errorf("problem reading micro-deposits of %s: %v", filename, err)
+	}
+	for i := range microDeposits {
+		summary.MicroDeposits = append(summary.MicroDeposits, &mergedMicroDeposit{
+			DepositoryID: id.Depository(microDeposits[i].DepositoryID),
+			UserID:       id.User(microDeposits[i].UserID),
+			Amount:       microDeposits[i].Amount,
+		})
+	}
+	return summary, nil
+}
+
+func (c *Controller) getMergedFile(filename string) (*achFile, error) {
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	path, err := c.mergedFilepath(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := parseACHFilepath(path, c.keeper)
+	if err != nil {
+		return nil, err
+	}
+	return &achFile{File: file, filepath: path, keeper: c.keeper}, nil
+}
+
+// removeTransferFromMergedFile pulls a Transfer's entries out of a pending merged file, rebuilds the file's
+// controls and cancels the Transfer so it isn't uploaded.
+func (c *Controller) removeTransferFromMergedFile(filename string, transferID id.Transfer, transferRepo transfers.Repository) error {
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	path, err := c.mergedFilepath(filename)
+	if err != nil {
+		return err
+	}
+	xfers, err := transferRepo.GetMergedTransfers(filename)
+	if err != nil {
+		return err
+	}
+	var xfer *transfers.MergedTransfer
+	for i := range xfers {
+		if xfers[i].TransferID == transferID {
+			xfer = xfers[i]
+			break
+		}
+	}
+	if xfer == nil {
+		return errTransferNotInMergedFile
+	}
+	if len(xfer.TraceNumbers) == 0 {
+		return errMergedTransferTraceEmpty
+	}
+
+	file, err := parseACHFilepath(path, c.keeper)
+	if err != nil {
+		return err
+	}
+	removed, err := removeEntries(file, xfer.TraceNumbers)
+	if err != nil {
+		return fmt.Errorf("problem removing transfer %s from %s: %v", transferID, filename, err)
+	}
+	if removed == 0 {
+		return fmt.Errorf("no entries with trace numbers %s found in %s", strings.Join(xfer.TraceNumbers, ", "), filename)
+	}
+
+	if len(file.Batches) == 0 {
+		// Nothing is left to upload, so remove the file entirely once the Transfer is canceled
+		if err := transferRepo.UnmergeTransfer(transferID, filename); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	}
+
+	// Offsets are re-calculated without the removed entries
+	if err := c.balanceFile(file); err != nil {
+		return fmt.Errorf("problem balancing %s: %v", filename, err)
+	}
+	if err := file.Create(); err != nil {
+		return fmt.Errorf("problem rebuilding %s: %v", filename, err)
+	}
+	// Write the rebuilt file aside and only replace the merged file after the Transfer is canceled,
+	// so a failed update leaves the merged file untouched.
+	tmp := path + ".tmp"
+	if err := (&achFile{File: file, filepath: tmp, keeper: c.keeper}).write(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := transferRepo.UnmergeTransfer(transferID, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeEntries deletes every EntryDetail whose trace number is in traceNumbers from file. Batches are rebuilt
+// with their remaining entries and empty batches are removed.
+func removeEntries(file *ach.File, traceNumbers []string) (int, error) {
+	shouldRemove := func(ed *ach.EntryDetail) bool {
+		for i := range traceNumbers {
+			if ed.TraceNumberField() == traceNumbers[i] {
+				return true
+			}
+		}
+		return false
+	}
+
+	removed := 0
+	var batches []ach.Batcher
+	for i := range file.Batches {
+		entries := file.Batches[i].GetEntries()
+		var kept []*ach.EntryDetail
+		for j := range entries {
+			if shouldRemove(entries[j]) {
+				removed++
+			} else {
+				kept = append(kept, entries[j])
+			}
+		}
+		if len(kept) == len(entries) {
+			batches = append(batches, file.Batches[i])
+			continue
+		}
+		if len(kept) == 0 {
+			continue // drop the empty batch
+		}
+		batch, err := ach.NewBatch(file.Batches[i].GetHeader())
+		if err != nil {
+			return removed, err
+		}
+		for j := range kept {
+			batch.AddEntry(kept[j])
+		}
+		if err := batch.Create(); err != nil {
+			return removed, err
+		}
+		batches = append(batches, batch)
+	}
+	file.Batches = batches
+	return removed, nil
+}
+
+// AddMergedFileRoutes registers admin routes to inspect pending merged files and pull Transfers out of them.
+func AddMergedFileRoutes(logger log.Logger, svc *admin.Server, controller *Controller, depRepo depository.Repository, transferRepo transfers.Repository) {
+	svc.AddHandler("/files/merged", getMergedFiles(logger, controller, depRepo, transferRepo))
+	svc.AddHandler("/files/merged/{filename}", getMergedFile(logger, controller))
+	svc.AddHandler("/files/merged/{filename}/transfers/{transferId}", removeMergedTransfer(logger, controller, transferRepo))
+}
+
+func getMergedFiles(logger log.Logger, controller *Controller, depRepo depository.Repository, transferRepo transfers.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		files, err := controller.getMergedFiles(depRepo, transferRepo)
+		if err != nil {
+			logger.Log("files", "problem listing merged files", "error", err, "requestID", moovhttp.GetRequestID(r))
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(files)
+	}
+}
+
+func getMergedFile(logger log.Logger, controller *Controller) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		file, err := controller.getMergedFile(mux.Vars(r)["filename"])
+		if err != nil {
+			if err == errMergedFileNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		switch format := strings.ToLower(r.URL.Query().Get("format")); format {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(file.File)
+
+		case "nacha", "ach":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			ach.NewWriter(w).Write(file.File)
+
+		default:
+			moovhttp.Problem(w, fmt.Errorf("unknown format %q", format))
+		}
+	}
+}
+
+func removeMergedTransfer(logger log.Logger, controller *Controller, transferRepo transfers.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		filename, transferID := mux.Vars(r)["filename"], id.Transfer(mux.Vars(r)["transferId"])
+		if err := controller.removeTransferFromMergedFile(filename, transferID, transferRepo); err != nil {
+			if err == errMergedFileNotFound || err == errTransferNotInMergedFile {
+				http.NotFound(w, r)
+				return
+			}
+			logger.Log("files", fmt.Sprintf("problem removing transfer=%s from %s", transferID, filename), "error", err, "requestID", moovhttp.GetRequestID(r))
+			moovhttp.Problem(w, err)
+			return
+		}
+		logger.Log("files", fmt.Sprintf("removed transfer=%s from merged file %s", transferID, filename), "requestID", moovhttp.GetRequestID(r))
+		w.WriteHeader(http.StatusOK)
+	}
+}
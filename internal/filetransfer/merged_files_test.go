@@ -0,0 +1,249 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base/admin"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+)
+
+// writeTwoEntryMergedFile writes an ACH file with two entries (trace numbers 076401255655291 and 076401255655292)
+// into dir/merged/
+func writeTwoEntryMergedFile(t *testing.T, dir string) string {
+	t.Helper()
+
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := *file.Batches[0].GetEntries()[0]
+	ed.TraceNumber = "076401255655292"
+	ed.Amount = 2500
+	file.Batches[0].AddEntry(&ed)
+	if err := file.Batches[0].Create(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "merged"), 0777)
+	path := filepath.Join(dir, "merged", "20200101-076401251-1.ach")
+	if err := (&achFile{File: file, filepath: path}).write(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMergedFiles__removeEntries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "merged-files")
+	defer os.RemoveAll(dir)
+
+	file, err := parseACHFilepath(writeTwoEntryMergedFile(t, dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := removeEntries(file, []string{"999999999999999"}); n != 0 || err != nil {
+		t.Fatalf("n=%d error=%v", n, err)
+	}
+	if n, err := removeEntries(file, []string{"076401255655292"}); n != 1 || err != nil {
+		t.Fatalf("n=%d error=%v", n, err)
+	}
+	if err := file.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Batches) != 1 || len(file.Batches[0].GetEntries()) != 1 {
+		t.Fatalf("unexpected batches: %#v", file.Batches)
+	}
+	if file.Control.TotalDebitEntryDollarAmountInFile != 10500 {
+		t.Errorf("unexpected debit total: %d", file.Control.TotalDebitEntryDollarAmountInFile)
+	}
+
+	// remove the last entry and its batch
+	if n, err := removeEntries(file, []string{"076401255655291"}); n != 1 || err != nil {
+		t.Fatalf("n=%d error=%v", n, err)
+	}
+	if len(file.Batches) != 0 {
+		t.Errorf("expected no batches: %#v", file.Batches)
+	}
+}
+
+func TestMergedFiles__admin(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "merged-files")
+	defer os.RemoveAll(dir)
+
+	path := writeTwoEntryMergedFile(t, dir)
+	controller := &Controller{rootDir: dir, repo: &mockRepository{}, logger: log.NewNopLogger()}
+
+	amt, _ := model.NewAmount("USD", "25.00")
+	transferRepo := &transfers.MockRepository{
+		MergedTransfers: []*transfers.MergedTransfer{
+			{TransferID: id.Transfer("xfer1"), UserID: id.User("user"), Amount: *amt, TraceNumber: "076401255655292", TraceNumbers: []string{"076401255655292"}},
+		},
+	}
+	depRepo := &depository.MockRepository{
+		MergedMicroDeposits: []depository.UploadableMicroDeposit{
+			{DepositoryID: "dep1", UserID: "user", Amount: amt},
+		},
+	}
+
+	svc := admin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+	AddMergedFileRoutes(log.NewNopLogger(), svc, controller, depRepo, transferRepo)
+
+	// list merged files
+	resp, err := http.Get("http://" + svc.BindAddr() + "/files/merged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	var files []*mergedFile
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("files=%#v", files)
+	}
+	if f := files[0]; f.Filename != "20200101-076401251-1.ach" || f.Destination != "076401251" || f.EntryCount != 2 || f.LineCount != 10 {
+		t.Errorf("unexpected merged file: %#v", f)
+	}
+	if f := files[0]; f.TotalDebitAmount != 13000 || len(f.Transfers) != 1 || len(f.MicroDeposits) != 1 {
+		t.Errorf("unexpected merged file: %#v", f)
+	}
+
+	// render the file
+	resp, err = http.Get("http://" + svc.BindAddr() + "/files/merged/20200101-076401251-1.ach?format=nacha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(bs), "101 076401251") {
+		t.Errorf("bogus HTTP status: %d: %s", resp.StatusCode, string(bs))
+	}
+	resp, err = http.Get("http://" + svc.BindAddr() + "/files/merged/20200101-076401251-1.ach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	file, err := ach.FileFromJSON(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Header.ImmediateDestination != "076401251" {
+		t.Errorf("unexpected file: %#v", file.Header)
+	}
+	resp, err = http.Get("http://" + svc.BindAddr() + "/files/merged/missing.ach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	// remove a transfer
+	req, _ := http.NewRequest("DELETE", "http://"+svc.BindAddr()+"/files/merged/20200101-076401251-1.ach/transfers/other", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("DELETE", "http://"+svc.BindAddr()+"/files/merged/20200101-076401251-1.ach/transfers/xfer1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	if transferRepo.Status != model.TransferCanceled {
+		t.Errorf("unexpected transfer status: %v", transferRepo.Status)
+	}
+	merged, err := parseACHFilepath(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Batches[0].GetEntries()) != 1 || merged.Control.TotalDebitEntryDollarAmountInFile != 10500 {
+		t.Errorf("unexpected file after removal: %#v", merged.Control)
+	}
+}
+
+type unmergeErrorRepository struct {
+	*transfers.MockRepository
+}
+
+func (r *unmergeErrorRepository) UnmergeTransfer(id id.Transfer, filename string) error {
+	return errors.New("bad error")
+}
+
+func TestMergedFiles__removeTransferTraceNumbers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "merged-files")
+	defer os.RemoveAll(dir)
+
+	path := writeTwoEntryMergedFile(t, dir)
+	original, _ := ioutil.ReadFile(path)
+	controller := &Controller{rootDir: dir, repo: &mockRepository{}, logger: log.NewNopLogger()}
+
+	amt, _ := model.NewAmount("USD", "130.00")
+	transferRepo := &transfers.MockRepository{
+		MergedTransfers: []*transfers.MergedTransfer{
+			{
+				TransferID:   id.Transfer("xfer1"),
+				Amount:       *amt,
+				TraceNumber:  "076401255655291",
+				TraceNumbers: []string{"076401255655291", "076401255655292"},
+			},
+		},
+	}
+
+	// the merged file is left alone when the Transfer can't be updated
+	if err := controller.removeTransferFromMergedFile("20200101-076401251-1.ach", "xfer1", &unmergeErrorRepository{transferRepo}); err == nil {
+		t.Fatal("expected error")
+	}
+	if bs, _ := ioutil.ReadFile(path); string(bs) != string(original) {
+		t.Error("merged file was modified")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "merged", "*")); len(matches) != 1 {
+		t.Errorf("unexpected files: %v", matches)
+	}
+
+	// every entry of the Transfer is removed, which leaves nothing to upload
+	if err := controller.removeTransferFromMergedFile("20200101-076401251-1.ach", "xfer1", transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected merged file to be removed: %v", err)
+	}
+	if transferRepo.Status != model.TransferCanceled {
+		t.Errorf("unexpected transfer status: %v", transferRepo.Status)
+	}
+}
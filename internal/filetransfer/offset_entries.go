@@ -0,0 +1,157 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/model"
+)
+
+// offsetIndividualName marks offset entries, which matches what moov-io/ach uses for its offsets.
+const offsetIndividualName = "OFFSET"
+
+// offsetAccount is the settlement account offset entries are posted against in balanced files.
+type offsetAccount struct {
+	routingNumber string
+	accountNumber string
+	accountType   model.AccountType
+}
+
+func (cfg *Config) offsetAccount() *offsetAccount {
+	if cfg == nil || !cfg.BalanceEntries {
+		return nil
+	}
+	return &offsetAccount{
+		routingNumber: cfg.OffsetRoutingNumber,
+		accountNumber: cfg.OffsetAccountNumber,
+		accountType:   model.AccountType(strings.ToLower(cfg.OffsetAccountType)),
+	}
+}
+
+// balanceFile appends an offset entry to each batch of file when its ODFI requires balanced files.
+// Existing offset entries are replaced, so files can be balanced again after entries are added or removed.
+func (c *Controller) balanceFile(file *ach.File) error {
+	acct := c.findFileTransferConfig(file.Header.ImmediateOrigin).offsetAccount()
+	if acct == nil {
+		return nil
+	}
+	return balanceBatches(file, acct)
+}
+
+// balanceBatches replaces the offset entries in each forward batch of file with one which nets the batch to zero.
+// Batches left with only an offset entry are removed.
+func balanceBatches(file *ach.File, acct *offsetAccount) error {
+	var batches []ach.Batcher
+	for i := range file.Batches {
+		if file.Batches[i].Category() != ach.CategoryForward {
+			batches = append(batches, file.Batches[i]) // returns and NOCs aren't offset
+			continue
+		}
+		batch, err := balanceBatch(file.Batches[i], acct)
+		if err != nil {
+			return fmt.Errorf("batch %d: %v", file.Batches[i].GetHeader().BatchNumber, err)
+		}
+		if batch != nil {
+			batches = append(batches, batch)
+		}
+	}
+	file.Batches = batches
+	return nil
+}
+
+// balanceBatch returns a copy of batch whose offset entry debits or credits acct by the difference of the
+// batch's credits and debits. A nil Batcher is returned when batch has no entries other than offsets.
+func balanceBatch(batch ach.Batcher, acct *offsetAccount) (ach.Batcher, error) {
+	var entries []*ach.EntryDetail
+	credits, debits := 0, 0
+	for _, ed := range batch.GetEntries() {
+		if isOffsetEntry(ed, acct) {
+			continue
+		}
+		entries = append(entries, ed)
+		switch ed.CreditOrDebit() {
+		case "C":
+			credits += ed.Amount
+		case "D":
+			debits += ed.Amount
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	header := *batch.GetHeader()
+	header.ServiceClassCode = ach.MixedDebitsAndCredits
+	out, err := ach.NewBatch(&header)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		out.AddEntry(entries[i])
+	}
+	if credits != debits {
+		ed, err := createOffsetEntry(acct, credits-debits, entries)
+		if err != nil {
+			return nil, err
+		}
+		out.AddEntry(ed)
+	}
+	if err := out.Create(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// createOffsetEntry returns an entry which debits acct when amount is positive (the batch has more credits)
+// or credits acct when amount is negative. Its trace number follows the last of entries.
+func createOffsetEntry(acct *offsetAccount, amount int, entries []*ach.EntryDetail) (*ach.EntryDetail, error) {
+	if err := ach.CheckRoutingNumber(acct.routingNumber); err != nil {
+		return nil, fmt.Errorf("invalid offset routing number %s: %v", acct.routingNumber, err)
+	}
+	if acct.accountNumber == "" {
+		return nil, errors.New("missing offset account number")
+	}
+
+	ed := ach.NewEntryDetail()
+	ed.RDFIIdentification = acct.routingNumber[:8]
+	ed.CheckDigit = acct.routingNumber[8:9]
+	ed.DFIAccountNumber = acct.accountNumber
+	ed.IndividualName = offsetIndividualName
+	ed.Category = entries[0].Category
+
+	switch {
+	case amount > 0 && acct.accountType == model.Checking:
+		ed.TransactionCode = ach.CheckingDebit
+	case amount > 0:
+		ed.TransactionCode = ach.SavingsDebit
+	case acct.accountType == model.Checking:
+		ed.TransactionCode = ach.CheckingCredit
+	default:
+		ed.TransactionCode = ach.SavingsCredit
+	}
+	if amount < 0 {
+		amount = -amount
+	}
+	ed.Amount = amount
+
+	last := entries[len(entries)-1].TraceNumberField()
+	seq, _ := strconv.Atoi(last[8:])
+	ed.SetTraceNumber(last[:8], seq+1)
+
+	return ed, nil
+}
+
+// isOffsetEntry returns true if ed is an offset entry we created against acct.
+func isOffsetEntry(ed *ach.EntryDetail, acct *offsetAccount) bool {
+	if len(acct.routingNumber) < 8 || !strings.EqualFold(strings.TrimSpace(ed.IndividualName), offsetIndividualName) {
+		return false
+	}
+	return ed.RDFIIdentification == acct.routingNumber[:8] && strings.TrimSpace(ed.DFIAccountNumber) == acct.accountNumber
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/model"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestConfig__validateConfig(t *testing.T) {
+	cfg := &Config{RoutingNumber: "987654320", BalanceEntries: true}
+	if err := validateConfig(cfg); err == nil {
+		t.Error("expected error")
+	}
+	cfg.OffsetRoutingNumber = "121042882"
+	if err := validateConfig(cfg); err == nil {
+		t.Error("expected error")
+	}
+	cfg.OffsetAccountNumber = "123456"
+	if err := validateConfig(cfg); err == nil {
+		t.Error("expected error")
+	}
+	cfg.OffsetAccountType = "Checking"
+	if err := validateConfig(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Mode = "other"
+	if err := validateConfig(cfg); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestOffsetEntries__balanceBatches(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debits := file.Batches[0].GetControl().TotalDebitEntryDollarAmount
+	entries := len(file.Batches[0].GetEntries())
+
+	acct := &offsetAccount{routingNumber: "121042882", accountNumber: "123456", accountType: model.Checking}
+	if err := balanceBatches(file, acct); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := file.Batches[0]
+	if n := len(batch.GetEntries()); n != entries+1 {
+		t.Fatalf("got %d entries", n)
+	}
+	offset := batch.GetEntries()[entries]
+	if offset.TransactionCode != ach.CheckingCredit || offset.Amount != debits || offset.IndividualName != "OFFSET" {
+		t.Errorf("unexpected offset: %#v", offset)
+	}
+	if offset.TraceNumberField() == batch.GetEntries()[0].TraceNumberField() {
+		t.Errorf("duplicate trace number: %s", offset.TraceNumberField())
+	}
+	if batch.GetHeader().ServiceClassCode != ach.MixedDebitsAndCredits {
+		t.Errorf("ServiceClassCode=%d", batch.GetHeader().ServiceClassCode)
+	}
+	if ctrl := batch.GetControl(); ctrl.TotalCreditEntryDollarAmount != ctrl.TotalDebitEntryDollarAmount {
+		t.Errorf("unbalanced batch: %#v", ctrl)
+	}
+	if file.Control.TotalCreditEntryDollarAmountInFile != file.Control.TotalDebitEntryDollarAmountInFile {
+		t.Errorf("unbalanced file: %#v", file.Control)
+	}
+
+	// balancing again replaces the offset
+	if err := balanceBatches(file, acct); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(file.Batches[0].GetEntries()); n != entries+1 {
+		t.Errorf("got %d entries", n)
+	}
+
+	// batches with only an offset left are removed
+	if _, err := removeEntries(file, []string{file.Batches[0].GetEntries()[0].TraceNumberField()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := balanceBatches(file, acct); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Batches) != 0 {
+		t.Errorf("got %d batches", len(file.Batches))
+	}
+}
+
+func TestController__balanceFile(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := len(file.Batches[0].GetEntries())
+
+	repo := &mockRepository{
+		configs: []*Config{
+			{RoutingNumber: file.Header.ImmediateOrigin},
+		},
+	}
+	controller := &Controller{logger: log.NewNopLogger(), repo: repo}
+
+	// unbalanced ODFIs are left alone
+	if err := controller.balanceFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(file.Batches[0].GetEntries()); n != entries {
+		t.Errorf("got %d entries", n)
+	}
+
+	repo.configs[0].BalanceEntries = true
+	repo.configs[0].OffsetRoutingNumber = "121042882"
+	repo.configs[0].OffsetAccountNumber = "123456"
+	repo.configs[0].OffsetAccountType = "savings"
+	if err := controller.balanceFile(file); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(file.Batches[0].GetEntries()); n != entries+1 {
+		t.Errorf("got %d entries", n)
+	}
+	if code := file.Batches[0].GetEntries()[entries].TransactionCode; code != ach.SavingsCredit {
+		t.Errorf("TransactionCode=%d", code)
+	}
+}
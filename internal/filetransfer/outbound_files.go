@@ -0,0 +1,127 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// outboundFile is a merged file we've uploaded to its ODFI, which is kept to match ODFI confirmations against.
+type outboundFile struct {
+	// Filename is the merged file in our storage directory, UploadedFilename is what the ODFI received
+	Filename         string `json:"filename"`
+	UploadedFilename string `json:"uploadedFilename"`
+
+	Destination      string `json:"destination"`
+	Origin           string `json:"origin"`
+	FileCreationDate string `json:"fileCreationDate"`
+	FileIDModifier   string `json:"fileIDModifier"`
+
+	EntryCount  int `json:"entryCount"`
+	TotalDebit  int `json:"totalDebit"`
+	TotalCredit int `json:"totalCredit"`
+
+	UploadedAt  time.Time  `json:"uploadedAt"`
+	ConfirmedAt *time.Time `json:"confirmedAt,omitempty"`
+	SLAMissedAt *time.Time `json:"slaMissedAt,omitempty"`
+}
+
+type outboundFileRepository interface {
+	getOutboundFiles(limit int) ([]*outboundFile, error)
+	getUnconfirmedFiles() ([]*outboundFile, error)
+
+	recordUpload(file *outboundFile) error
+	markConfirmed(filename string) error
+	markSLAMissed(filename string) error
+}
+
+type sqlOutboundFileRepository struct {
+	db *sql.DB
+}
+
+const outboundFileColumns = `filename, uploaded_filename, destination, origin, file_creation_date, file_id_modifier, entry_count, total_debit, total_credit, uploaded_at, confirmed_at, sla_missed_at`
+
+func (r *sqlOutboundFileRepository) getOutboundFiles(limit int) ([]*outboundFile, error) {
+	query := `select ` + outboundFileColumns + ` from ach_file_uploads order by uploaded_at desc limit ?;`
+	return r.queryOutboundFiles(query, limit)
+}
+
+func (r *sqlOutboundFileRepository) getUnconfirmedFiles() ([]*outboundFile, error) {
+	query := `select ` + outboundFileColumns + ` from ach_file_uploads where confirmed_at is null order by uploaded_at asc;`
+	return r.queryOutboundFiles(query)
+}
+
+func (r *sqlOutboundFileRepository) queryOutboundFiles(query string, args ...interface{}) ([]*outboundFile, error) {
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("queryOutboundFiles: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("queryOutboundFiles: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*outboundFile
+	for rows.Next() {
+		var file outboundFile
+		err := rows.Scan(&file.Filename, &file.UploadedFilename, &file.Destination, &file.Origin, &file.FileCreationDate, &file.FileIDModifier,
+			&file.EntryCount, &file.TotalDebit, &file.TotalCredit, &file.UploadedAt, &file.ConfirmedAt, &file.SLAMissedAt)
+		if err != nil {
+			return nil, fmt.Errorf("queryOutboundFiles: scan: %v", err)
+		}
+		out = append(out, &file)
+	}
+	return out, rows.Err()
+}
+
+func (r *sqlOutboundFileRepository) recordUpload(file *outboundFile) error {
+	query := `replace into ach_file_uploads (filename, uploaded_filename, destination, origin, file_creation_date, file_id_modifier, entry_count, total_debit, total_credit, uploaded_at)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("recordUpload: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(file.Filename, file.UploadedFilename, file.Destination, file.Origin, file.FileCreationDate, file.FileIDModifier,
+		file.EntryCount, file.TotalDebit, file.TotalCredit, file.UploadedAt)
+	if err != nil {
+		return fmt.Errorf("recordUpload: filename=%s: %v", file.Filename, err)
+	}
+	return nil
+}
+
+func (r *sqlOutboundFileRepository) markConfirmed(filename string) error {
+	query := `update ach_file_uploads set confirmed_at = ? where filename = ? and confirmed_at is null;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("markConfirmed: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(time.Now(), filename); err != nil {
+		return fmt.Errorf("markConfirmed: filename=%s: %v", filename, err)
+	}
+	return nil
+}
+
+func (r *sqlOutboundFileRepository) markSLAMissed(filename string) error {
+	query := `update ach_file_uploads set sla_missed_at = ? where filename = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("markSLAMissed: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(time.Now(), filename); err != nil {
+		return fmt.Errorf("markSLAMissed: filename=%s: %v", filename, err)
+	}
+	return nil
+}
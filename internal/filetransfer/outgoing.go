@@ -5,17 +5,19 @@
 package filetransfer
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
-	"net"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
-	"strings"
 	"time"
 
 	"github.com/moov-io/ach"
 	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/secrets"
 	"github.com/moov-io/paygate/internal/transfers"
 	"github.com/moov-io/paygate/pkg/id"
 
@@ -40,13 +42,20 @@ var (
 	}, []string{"destination", "origin"})
 )
 
-// mergeTransfer will attempt to add the Batches from `file` into our mergableFile. If mergableFile exceeds ACH
-// file size/length limitations then a new file will be created and the old returned for uplaod.
+// mergeTransfer will attempt to add the Batches from `file` into our mergableFile. Entries of forward batches are
+// consolidated into one batch per originator, SEC code, effective date and service class (see consolidateBatch).
+// If mergableFile exceeds ACH file size/length limitations then a new file will be created and the old returned for uplaod.
 func (c *Controller) mergeTransfer(file *ach.File, mergableFile *achFile) (*achFile, error) {
-	// TODO(adam): could we just call file.MergeFiles(mergableFile) ???
 	if len(file.Batches) == 0 {
 		return nil, errors.New("mergeTransfer: empty batches")
 	}
+	if file == mergableFile.File {
+		return nil, nil // new mergable files are created from the transfer's file
+	}
+	// Balance batches before they're merged so their service class matches balanced merged batches
+	if err := c.balanceFile(file); err != nil {
+		return nil, fmt.Errorf("mergeTransfer: problem balancing %s: %v", file.ID, err)
+	}
 	for i := range file.Batches {
 		batchExistsInMerged := false
 		for j := range mergableFile.Batches {
@@ -58,8 +67,16 @@ func (c *Controller) mergeTransfer(file *ach.File, mergableFile *achFile) (*achF
 		if !batchExistsInMerged {
 			c.logger.Log("mergeTransfer", fmt.Sprintf("adding batch %d to merged file %s", file.Batches[i].GetHeader().BatchNumber, mergableFile.filepath))
 
-			// Add Batch, but if we surpass LoC limit then create a new file
-			mergableFile.AddBatch(file.Batches[i])
+			// Consolidate the batch, but if we surpass LoC limit then create a new file
+			batches := mergableFile.Batches
+			added, err := consolidateBatch(mergableFile.File, file.Batches[i])
+			if err != nil {
+				return nil, fmt.Errorf("mergable file %s failed to consolidate batch: %v", mergableFile.filepath, err)
+			}
+			// Offsets are re-calculated for the consolidated entries
+			if err := c.balanceFile(mergableFile.File); err != nil {
+				return nil, fmt.Errorf("mergable file %s failed to balance: %v", mergableFile.filepath, err)
+			}
 			if err := mergableFile.Create(); err != nil {
 				return nil, fmt.Errorf("mergable file %s failed to build: %v", mergableFile.filepath, err)
 			}
@@ -70,7 +87,7 @@ func (c *Controller) mergeTransfer(file *ach.File, mergableFile *achFile) (*achF
 				return nil, fmt.Errorf("mergable file %s has no lineCount", mergableFile.filepath)
 			}
 			if lines > fileMaxLines {
-				mergableFile.File.RemoveBatch(file.Batches[i])
+				mergableFile.Batches = batches
 				if err := mergableFile.Create(); err != nil {
 					c.logger.Log("mergeTransfer", fmt.Sprintf("problem with mergable file %s Create", mergableFile.filepath), "error", err)
 					continue
@@ -82,23 +99,18 @@ func (c *Controller) mergeTransfer(file *ach.File, mergableFile *achFile) (*achF
 
 				// trim off batches we added to current mergableFile
 				file.Batches = file.Batches[i:]
+				renumberTraceNumbers(file)
 
 				// create a new mergableFile
-				cfg := c.findFileTransferConfig(file.Header.ImmediateDestination)
-				dir, filename := filepath.Split(mergableFile.filepath)
-				filename, err := renderACHFilename(cfg.outboundFilenameTemplate(), filenameData{
-					RoutingNumber: file.Header.ImmediateDestination,
-					TransferType:  "push", // TODO(adam): where does this come from? We can only fill this in when files are segmented
-					N:             roundSequenceNumber(achFilenameSeq(filename) + 1),
-					GPG:           false,
-				})
+				dir := filepath.Dir(mergableFile.filepath)
+				filename, err := c.nextACHFilename(dir, file)
 				if err != nil {
-					c.logger.Log("mergeTransfer", "error building ACH filename", "error", err)
-					continue
+					return nil, fmt.Errorf("mergeTransfer: problem creating next file for %s: %v", file.Header.ImmediateDestination, err)
 				}
 				newMergableFile := &achFile{
 					File:     file,
 					filepath: filepath.Join(dir, filename),
+					keeper:   c.keeper,
 				}
 				if err := newMergableFile.Create(); err != nil {
 					c.logger.Log("mergeTransfer", fmt.Sprintf("problem with mergable file %s Create", newMergableFile.filepath), "error", err)
@@ -113,6 +125,11 @@ func (c *Controller) mergeTransfer(file *ach.File, mergableFile *achFile) (*achF
 			if err := mergableFile.write(); err != nil {
 				return nil, fmt.Errorf("problem writing mergable file %s: %v", mergableFile.filepath, err)
 			}
+			// Give the transfer's entries the trace numbers they have in the merged file
+			entries := file.Batches[i].GetEntries()
+			for k := range added {
+				entries[k].TraceNumber = added[k].TraceNumber
+			}
 		}
 	}
 	return nil, nil
@@ -130,25 +147,35 @@ func (c *Controller) mergeAndUploadFiles(transferCur *transfers.Cursor, microDep
 	//
 	// FI's pay for each file that's uploaded, so it's important to merge and consolidate files to reduce their cost. ACH files have a maximum
 	// of 10k lines before needing to be split up.
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
 	mergedDir := filepath.Join(c.rootDir, "merged")
 	os.Mkdir(mergedDir, 0777) // ensure dir is created
 	c.logger.Log("file-transfer-controller", "Starting file merge and upload operations")
 
 	var filesToUpload []*achFile // accumulator
 
-	// Read the next batch of Transfers to merge and upload. Currently no marking is done on these rows to indicate they've been picked up
-	// so any attempt to run multiple paygate instances will result in duplicating Transfers on the remote FI server. We do store merged_filename
-	// on Transfers, but that's only after they have been merged into a file (not in the stage of "read from DB, merging into file."
-	//
-	// Should we mark Transfers? We need to have a code branch that sweeps all transfers to ensure we aren't missing any.
+	// Multiple paygate instances can run at once, so each routing number is merged and uploaded by the instance
+	// holding its lease. Transfers are also claimed before they're merged so a Transfer is never merged into
+	// multiple files. Leases and claims from a crashed instance expire and are taken over by another instance.
 	//
 	// See: https://github.com/moov-io/paygate/issues/178
+	leases := c.newMergeLeases(transferCur, microDepositCur, transferRepo)
+
+	// Requeue files left behind by the previous holders of leases we took over outside of merging (i.e. retrying uploads)
+	c.requeueTakenOverFiles(transferRepo, microDepositCur.DepRepo)
+
+	// Read the next batch of Transfers to merge and upload.
 	groupedTransfers, err := groupTransfers(transferCur.Next())
 	if err != nil {
 		return fmt.Errorf("problem grouping transfers: %v", err)
 	}
 	// Group transfers by ABA and add to mergable files
 	for i := range groupedTransfers {
+		if len(groupedTransfers[i]) == 0 || !leases.holds(groupedTransfers[i][0].Destination) {
+			continue
+		}
 		for j := range groupedTransfers[i] {
 			if fileToUpload := c.mergeGroupableTransfer(mergedDir, groupedTransfers[i][j], transferRepo); fileToUpload != nil {
 				filesToUpload = append(filesToUpload, fileToUpload)
@@ -163,15 +190,27 @@ func (c *Controller) mergeAndUploadFiles(transferCur *transfers.Cursor, microDep
 		return fmt.Errorf("problem getting micro-deposits: %v", err)
 	}
 	// Group micro-deposits by ABA and add to mergable files
+	mergedMicroDepositFiles := make(map[string]bool)
 	for i := range microDeposits {
-		if file := c.mergeMicroDeposit(mergedDir, microDeposits[i], microDepositCur.DepRepo); file != nil {
+		// A Depository's micro-deposits share one ACH file, which is merged (and marked as merged) once
+		if mergedMicroDepositFiles[microDeposits[i].FileID] {
+			continue
+		}
+		mergedMicroDepositFiles[microDeposits[i].FileID] = true
+
+		if file := c.mergeMicroDeposit(mergedDir, microDeposits[i], microDepositCur.DepRepo, leases); file != nil {
 			filesToUpload = append(filesToUpload, file)
 		}
 	}
 
+	// Merge returns requested for incoming transfers and our dishonored returns
+	filesToUpload = append(filesToUpload, c.mergeIncomingReturns(mergedDir, transferRepo, microDepositCur.DepRepo, leases)...)
+	filesToUpload = append(filesToUpload, c.mergeDishonoredReturns(mergedDir, transferRepo, microDepositCur.DepRepo, leases)...)
+
 	// If we're being forced to upload everything then grab all files and upload them
+	var cutoffTimes []*CutoffTime
 	if opts.force {
-		files, err := grabAllFiles(mergedDir)
+		files, err := grabAllFiles(mergedDir, c.keeper)
 		if err != nil {
 			return fmt.Errorf("problem forcing upload of all files: %v", err)
 		}
@@ -179,26 +218,52 @@ func (c *Controller) mergeAndUploadFiles(transferCur *transfers.Cursor, microDep
 		filesToUpload = files // upload everything found
 	} else {
 		// Find files close to their cutoff to enqueue
-		cutoffTimes, err := c.repo.GetCutoffTimes()
+		cutoffTimes, err = c.repo.GetCutoffTimes()
 		if err != nil {
 			return fmt.Errorf("cutoff times: %v", err)
 		}
-		toUpload, err := filesNearTheirCutoff(cutoffTimes, mergedDir)
+		toUpload, err := filesNearTheirCutoff(cutoffTimes, mergedDir, c.keeper)
 		if err != nil {
 			return fmt.Errorf("problem with filesNearTheirCutoff: %v", err)
 		}
+		// Skip files which failed to upload recently, they're retried after their backoff.
+		toUpload = c.filterDueUploads(toUpload)
 		c.logger.Log("file-transfer-controller", fmt.Sprintf("found %d files near their cutoff for upload", len(toUpload)), "requestID", req.requestID)
 		filesToUpload = append(filesToUpload, toUpload...)
 	}
 
-	// Upload any merged files that are ready
-	if err := c.startUpload(filesToUpload); err != nil {
-		return fmt.Errorf("problem uploading ACH files: %v", err)
+	// Refused NOCs are in their own files since they can't be merged (see writeRefusedCORFile), but they're
+	// uploaded alongside merged files near their cutoff.
+	if refused, err := grabRefusedCORFiles(filepath.Join(c.rootDir, "refused"), c.keeper); err != nil {
+		c.logger.Log("file-transfer-controller", "problem reading refused NOC files", "error", err, "requestID", req.requestID)
+	} else if opts.force {
+		filesToUpload = append(filesToUpload, refused...)
+	} else if anyNearCutoff(cutoffTimes) {
+		filesToUpload = append(filesToUpload, c.filterDueUploads(refused)...)
+	}
+
+	// Upload any merged files that are ready and we hold the lease for
+	filesToUpload = leases.filter(filesToUpload)
+	uploadErr := c.startUpload(filesToUpload)
+
+	// Move files which have repeatedly failed and missed their cutoff aside
+	if !opts.force {
+		files, err := grabAllFiles(mergedDir, c.keeper)
+		if err == nil {
+			err = c.deadLetterMissedUploads(cutoffTimes, leases.filter(files))
+		}
+		if err != nil {
+			c.logger.Log("file-transfer-controller", "problem moving files to dead-letter directory", "error", err, "requestID", req.requestID)
+		}
+	}
+	if uploadErr != nil {
+		return fmt.Errorf("problem uploading ACH files: %v", uploadErr)
 	}
 	return nil
 }
 
-func grabAllFiles(dir string) ([]*achFile, error) {
+// grabAllFiles reads every ACH file in dir, decrypting them with keeper.
+func grabAllFiles(dir string, keeper *secrets.StringKeeper) ([]*achFile, error) {
 	var out []*achFile
 
 	matches, err := filepath.Glob(filepath.Join(dir, "*.ach"))
@@ -207,12 +272,13 @@ func grabAllFiles(dir string) ([]*achFile, error) {
 	}
 
 	for i := range matches {
-		if file, err := parseACHFilepath(matches[i]); err != nil {
+		if file, err := parseACHFilepath(matches[i], keeper); err != nil {
 			return nil, fmt.Errorf("grabAllFiles: problem reading %s: %v", matches[i], err)
 		} else {
 			out = append(out, &achFile{
 				File:     file,
 				filepath: matches[i],
+				keeper:   keeper,
 			})
 		}
 	}
@@ -220,7 +286,7 @@ func grabAllFiles(dir string) ([]*achFile, error) {
 	return out, nil
 }
 
-func filesNearTheirCutoff(cutoffTimes []*CutoffTime, dir string) ([]*achFile, error) {
+func filesNearTheirCutoff(cutoffTimes []*CutoffTime, dir string, keeper *secrets.StringKeeper) ([]*achFile, error) {
 	var filesToUpload []*achFile
 
 	for i := range cutoffTimes {
@@ -230,17 +296,16 @@ func filesNearTheirCutoff(cutoffTimes []*CutoffTime, dir string) ([]*achFile, er
 		}
 
 		// If we're close to the cutoffTime then enqueue for upload
-		diff := cutoffTimes[i].Diff(time.Now().In(cutoffTimes[i].Loc))
-
-		if diff > 0*time.Second && diff <= forcedCutoffUploadDelta {
+		if nearCutoff(cutoffTimes[i]) {
 			for j := range matches {
-				file, err := parseACHFilepath(matches[j])
+				file, err := parseACHFilepath(matches[j], keeper)
 				if err != nil {
 					return nil, fmt.Errorf("matches[%d]=%s: %v", j, matches[j], err)
 				}
 				filesToUpload = append(filesToUpload, &achFile{
 					File:     file,
 					filepath: matches[j],
+					keeper:   keeper,
 				})
 			}
 		}
@@ -249,6 +314,22 @@ func filesNearTheirCutoff(cutoffTimes []*CutoffTime, dir string) ([]*achFile, er
 	return filesToUpload, nil
 }
 
+// nearCutoff returns true when files should be enqueued for upload ahead of cutoff.
+func nearCutoff(cutoff *CutoffTime) bool {
+	diff := cutoff.Diff(time.Now().In(cutoff.Loc))
+	return diff > 0*time.Second && diff <= forcedCutoffUploadDelta
+}
+
+// anyNearCutoff returns true when any of cutoffTimes is near (see nearCutoff).
+func anyNearCutoff(cutoffTimes []*CutoffTime) bool {
+	for i := range cutoffTimes {
+		if nearCutoff(cutoffTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
 // loadRemoteACHFile will retrieve a transfer's ACH file contents and parse into an ach.File object
 func (c *Controller) loadRemoteACHFile(fileId string) (*ach.File, error) {
 	buf, err := c.ach.GetFileContents(fileId) // read from our ACH service
@@ -265,40 +346,55 @@ func (c *Controller) loadRemoteACHFile(fileId string) (*ach.File, error) {
 
 // mergeGroupableTransfer will inspect a Transfer, load the backing ACH file and attempt to merge that transfer into an existing merge file for upload.
 func (c *Controller) mergeGroupableTransfer(mergedDir string, xfer *transfers.GroupableTransfer, transferRepo transfers.Repository) *achFile {
+	if claimed, err := transferRepo.ClaimTransfer(xfer.ID, c.instanceID, c.leaseDuration); !claimed || err != nil {
+		c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("skipping transfer %s claimed by another instance", xfer.ID), "error", err)
+		return nil
+	}
+	// Give up our claim when the transfer isn't merged so another instance can merge it right away
+	releaseClaim := func() *achFile {
+		if err := transferRepo.ReleaseTransferClaim(xfer.ID, c.instanceID); err != nil {
+			c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("problem releasing claim on transfer %s", xfer.ID), "error", err)
+		}
+		return nil
+	}
 	fileId, err := transferRepo.GetFileIDForTransfer(xfer.ID, xfer.UserID)
 	if err != nil || fileId == "" {
-		return nil
+		return releaseClaim()
 	}
 	file, err := c.loadRemoteACHFile(fileId)
 	if err != nil {
 		c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("problem loading ACH file conents for transfer %s", xfer.ID), "error", err)
-		return nil
+		return releaseClaim()
 	}
 
 	// Find (or create) a mergable file for this transfer's destination
 	mergableFile, err := c.grabLatestMergedACHFile(xfer.Destination, file, mergedDir)
 	if err != nil {
 		c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("unable to find mergable file for transfer %s", xfer.ID), "error", err)
-		return nil
+		return releaseClaim()
 	}
 	// Merge our transfer's file into mergableFile
 	fileToUpload, err := c.mergeTransfer(file, mergableFile)
 	if err != nil {
 		c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("merging: %v", err))
-		return nil
+		return releaseClaim()
 	}
 
 	transfersMerged.With("destination", file.Header.ImmediateDestination, "origin", file.Header.ImmediateOrigin).Add(1)
 
 	// Assume the transfer was merged into mergableFile and so we can update its DB record.
-	traceNumber := ""
-	if len(file.Batches) > 0 && len(file.Batches[0].GetEntries()) > 0 {
-		traceNumber = file.Batches[0].GetEntries()[0].TraceNumberField()
+	var traceNumbers []string
+	for _, ed := range c.mergedEntries(file) {
+		traceNumbers = append(traceNumbers, ed.TraceNumberField())
 	}
-	if err := transferRepo.MarkTransferAsMerged(xfer.ID, filepath.Base(mergableFile.filepath), traceNumber); err != nil {
+	effectiveEntryDate, err := file.Batches[0].GetHeader().LiftEffectiveEntryDate()
+	if err != nil {
+		c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("transfer %s has an invalid EffectiveEntryDate: %v", xfer.ID, err))
+	}
+	if err := transferRepo.MarkTransferAsMerged(xfer.ID, filepath.Base(mergableFile.filepath), effectiveEntryDate, traceNumbers); err != nil {
 		c.logger.Log("mergeGroupableTransfer", fmt.Sprintf("BAD ERROR - unable to mark transfer %s as merged: %v", xfer.ID, err))
 		// TODO(adam): This error is bad because we could end up merging the transfer into multiple files (i.e. duplicate it)
-		return nil
+		return releaseClaim()
 	}
 	if fileToUpload != nil { // this is only set if existing mergableFile surpasses ACH file line limit
 		c.logger.Log("mergeGroupableTransfer",
@@ -308,8 +404,29 @@ func (c *Controller) mergeGroupableTransfer(mergedDir string, xfer *transfers.Gr
 	return nil
 }
 
+// mergedEntries returns the forward entries of a file which has been merged, other than offset entries. Merging
+// gives each entry the trace number it has in the merged file.
+func (c *Controller) mergedEntries(file *ach.File) []*ach.EntryDetail {
+	acct := c.findFileTransferConfig(file.Header.ImmediateOrigin).offsetAccount()
+
+	var out []*ach.EntryDetail
+	for i := range file.Batches {
+		if file.Batches[i].Category() != ach.CategoryForward {
+			continue
+		}
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			if acct != nil && isOffsetEntry(entries[j], acct) {
+				continue
+			}
+			out = append(out, entries[j])
+		}
+	}
+	return out
+}
+
 // mergeMicroDeposit will grab the ACH file for a micro-deposit and merge it into a larger ACH file for upload to the ODFI.
-func (c *Controller) mergeMicroDeposit(mergedDir string, mc depository.UploadableMicroDeposit, depRepo *depository.SQLRepo) *achFile {
+func (c *Controller) mergeMicroDeposit(mergedDir string, mc depository.UploadableMicroDeposit, depRepo *depository.SQLRepo, leases *mergeLeases) *achFile {
 	file, err := c.loadRemoteACHFile(mc.FileID)
 	if err != nil {
 		c.logger.Log("mergeMicroDeposit", fmt.Sprintf("error reading ACH file=%s: %v", mc.FileID, err))
@@ -320,6 +437,9 @@ func (c *Controller) mergeMicroDeposit(mergedDir string, mc depository.Uploadabl
 		c.logger.Log("mergeMicroDeposit", fmt.Sprintf("problem reading micro-deposit depository=%s: %v", mc.DepositoryID, err))
 		return nil
 	}
+	if !leases.holds(dep.RoutingNumber) {
+		return nil
+	}
 
 	// Find (or create) a mergable file for this transfer's destination
 	mergableFile, err := c.grabLatestMergedACHFile(dep.RoutingNumber, file, mergedDir)
@@ -339,6 +459,19 @@ func (c *Controller) mergeMicroDeposit(mergedDir string, mc depository.Uploadabl
 		// TODO(adam): This error is bad because we could end up merging the transfer into multiple files (i.e. duplicate it)
 		return nil
 	}
+	// Record the trace number of each micro-deposit (the credits) so returns can be matched against them
+	var traces []*depository.MicroDeposit
+	for _, ed := range c.mergedEntries(file) {
+		if ed.CreditOrDebit() != "C" {
+			continue // the withdrawal of our micro-deposits
+		}
+		if amt, err := model.NewAmountFromInt("USD", ed.Amount); err == nil {
+			traces = append(traces, &depository.MicroDeposit{Amount: *amt, TraceNumber: ed.TraceNumberField()})
+		}
+	}
+	if err := depRepo.RecordMicroDepositTraceNumbers(filepath.Base(mergableFile.filepath), mc, traces); err != nil {
+		c.logger.Log("mergeMicroDeposit", fmt.Sprintf("problem recording micro-deposit trace numbers: %v", err), "userId", mc.UserID)
+	}
 	if fileToUpload != nil { // this is only set if existing mergableFile surpasses ACH file line limit
 		c.logger.Log("mergeMicroDeposit",
 			fmt.Sprintf("merging: scheduling %s for upload ABA:%s", fileToUpload.filepath, fileToUpload.File.Header.ImmediateDestination))
@@ -347,46 +480,25 @@ func (c *Controller) mergeMicroDeposit(mergedDir string, mc depository.Uploadabl
 	return nil
 }
 
-func rejectOutboundIPRange(cfg *Config, hostname string) error {
-	if cfg.AllowedIPs == "" {
-		return nil
-	}
-
-	addrs, err := net.LookupIP(hostname)
-	if len(addrs) == 0 || err != nil {
-		return fmt.Errorf("unable to resolve (found %d) %s: %v", len(addrs), hostname, err)
-	}
-
-	ips := strings.Split(cfg.AllowedIPs, ",")
-	for i := range ips {
-		if strings.Contains(ips[i], "/") {
-			ip, ipnet, err := net.ParseCIDR(ips[i])
-			if err != nil {
-				return err
-			}
-			if ip.Equal(addrs[0]) || ipnet.Contains(addrs[0]) {
-				return nil // whitelisted
-			}
-		} else {
-			if net.ParseIP(ips[i]).Equal(addrs[0]) {
-				return nil // whitelisted
-			}
-		}
-	}
-	return fmt.Errorf("%s is not whitelisted", addrs[0].String())
-}
-
 // startUpload looks for ACH files which are ready to be uploaded and matches a CutoffTime
 // to them (so we can find their upload configs).
 //
 // After uploading a file this method renames it to avoid uploading the file multiple times.
+//
+// Files which fail to upload are recorded for retry and the remaining files are still uploaded.
 func (c *Controller) startUpload(filesToUpload []*achFile) error {
+	var firstErr error
 	for i := range filesToUpload {
 		file := filesToUpload[i]
 
 		if err := c.maybeUploadFile(file); err != nil {
-			return fmt.Errorf("problem uploading %s: %v", file.filepath, err)
+			c.recordUploadFailure(file, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("problem uploading %s: %v", file.filepath, err)
+			}
+			continue
 		}
+		c.clearUploadAttempts(file)
 
 		// rename the file so grabLatestMergedACHFile ignores it next time
 		if err := os.Rename(file.filepath, file.filepath+".uploaded"); err != nil {
@@ -395,7 +507,7 @@ func (c *Controller) startUpload(filesToUpload []*achFile) error {
 			return fmt.Errorf("error renaming %s after upload: %v", file.filepath, err)
 		}
 	}
-	return nil
+	return firstErr
 }
 
 // maybeUploadFile will grab the needed configs and upload an given file to the ODFI's server
@@ -405,40 +517,56 @@ func (c *Controller) maybeUploadFile(file *achFile) error {
 		return fmt.Errorf("missing file transfer config for %s", file.Header.ImmediateOrigin)
 	}
 
+	if cfg.dryRun() {
+		filename, err := c.outboundFilename(file)
+		if err != nil {
+			return fmt.Errorf("problem rendering filename for %s: %v", file.filepath, err)
+		}
+		return c.writeDryRunUpload(cfg, file, filename)
+	}
+
 	agent, err := New(c.logger, c.findTransferType(cfg.RoutingNumber), cfg, c.repo)
 	if err != nil {
 		return fmt.Errorf("problem creating fileTransferAgent for %s: %v", cfg.RoutingNumber, err)
 	}
 	defer agent.Close()
 
-	if err := rejectOutboundIPRange(cfg, agent.hostname()); err != nil {
-		fileUploadError.With("origin", file.Header.ImmediateOrigin, "destination", file.Header.ImmediateDestination).Add(1)
-		return fmt.Errorf("blocking upload for IP address: %v", err)
-	}
-
 	c.logger.Log("maybeUploadFile", fmt.Sprintf("uploading %s for routing number %s", file.filepath, cfg.RoutingNumber))
 
-	// TODO(adam): I think we should have a DB table for tracking file uploads (?ach_file_uploads?)
-	// with the following fields: routing number, filename, timestamp.
+	filename, err := c.outboundFilename(file)
+	if err != nil {
+		return fmt.Errorf("problem rendering filename for %s: %v", file.filepath, err)
+	}
+	return c.uploadFile(agent, file, filename)
+}
 
-	return c.uploadFile(agent, file)
+// outboundFilename renders the name a file is uploaded as from its destination's template. Files are named
+// when they're created, which is before every entry is merged, so this is rendered again from the final contents.
+func (c *Controller) outboundFilename(f *achFile) (string, error) {
+	seq := fileIDSequence(f.Header.FileIDModifier)
+	if seq == 0 {
+		return filepath.Base(f.filepath), nil // created before we managed FileIDModifier
+	}
+	cfg := c.findFileTransferConfig(f.Header.ImmediateDestination)
+	return renderACHFilename(cfg.outboundFilenameTemplate(), newFilenameData(f.File, seq))
 }
 
-func (c *Controller) uploadFile(agent Agent, f *achFile) error {
-	fd, err := os.Open(f.filepath)
+func (c *Controller) uploadFile(agent Agent, f *achFile, filename string) error {
+	// Files are encrypted at rest, so only the plaintext read into memory is uploaded
+	bs, err := readFile(f.filepath, f.keeper)
 	if err != nil {
 		fileUploadError.With("origin", f.Header.ImmediateOrigin, "destination", f.Header.ImmediateDestination).Add(1)
 		return fmt.Errorf("problem opening %s for upload: %v", f.filepath, err)
 	}
-	defer fd.Close()
 
-	if err := agent.UploadFile(File{Filename: filepath.Base(f.filepath), Contents: fd}); err != nil {
+	if err := agent.UploadFile(File{Filename: filename, Contents: ioutil.NopCloser(bytes.NewReader(bs))}); err != nil {
 		fileUploadError.With("origin", f.Header.ImmediateOrigin, "destination", f.Header.ImmediateDestination).Add(1)
 		return fmt.Errorf("problem uploading %s: %v", f.filepath, err)
 	}
 
-	c.logger.Log("uploadFile", fmt.Sprintf("merged: uploaded file %s", f.filepath))
+	c.logger.Log("uploadFile", fmt.Sprintf("merged: uploaded file %s as %s", f.filepath, filename))
 	filesUploaded.With("origin", f.Header.ImmediateOrigin, "destination", f.Header.ImmediateDestination).Add(1)
+	c.recordOutboundFile(f, filename)
 
 	return nil
 }
@@ -463,24 +591,23 @@ func (c *Controller) grabLatestMergedACHFile(destinationRoutingNumber string, in
 		now := time.Now()
 		incoming.Header.FileCreationDate = now.Format("060102") // YYMMDD
 		incoming.Header.FileCreationTime = now.Format("1504")   // HHMM
+		renumberTraceNumbers(incoming)
 
-		cfg := c.findFileTransferConfig(destinationRoutingNumber)
-		filename, err := renderACHFilename(cfg.outboundFilenameTemplate(), filenameData{
-			RoutingNumber: incoming.Header.ImmediateDestination,
-			N:             "1",
-		})
+		// Each new file has the next FileIDModifier and sequence number for its destination today.
+		filename, err := c.nextACHFilename(dir, incoming)
 		if err != nil {
 			return nil, err
 		}
 		mergableFile := &achFile{
 			File:     incoming,
 			filepath: filepath.Join(dir, filename),
+			keeper:   c.keeper,
 		}
 
-		// We need to increment the FileIDModifier in the FileHeader when creating a new file.
-		mergableFile.Header.FileIDModifier = roundSequenceNumber(achFilenameSeq(filepath.Base(mergableFile.filepath))) // 0-9 followed by A-Z
-
 		// flush new file to disk
+		if err := c.balanceFile(mergableFile.File); err != nil {
+			return mergableFile, err
+		}
 		if err := mergableFile.Create(); err != nil {
 			return mergableFile, err
 		}
@@ -494,7 +621,7 @@ func (c *Controller) grabLatestMergedACHFile(destinationRoutingNumber string, in
 	sort.Strings(matches) // ascending sorting
 	for i := len(matches) - 1; i >= 0; i-- {
 		// When we encounter the first file whose destination matches ours let's use that
-		file, err := parseACHFilepath(matches[i])
+		file, err := parseACHFilepath(matches[i], c.keeper)
 		if err != nil {
 			return nil, err
 		}
@@ -502,22 +629,24 @@ func (c *Controller) grabLatestMergedACHFile(destinationRoutingNumber string, in
 			return &achFile{
 				File:     file,
 				filepath: matches[i],
+				keeper:   c.keeper,
 			}, nil
 		}
 	}
 
 	// Otherwise, we had matches but found nothing so create a file.
-	cfg := c.findFileTransferConfig(destinationRoutingNumber)
-	filename, err := renderACHFilename(cfg.outboundFilenameTemplate(), filenameData{
-		RoutingNumber: incoming.Header.ImmediateDestination,
-		N:             "1",
-	})
+	renumberTraceNumbers(incoming)
+	filename, err := c.nextACHFilename(dir, incoming)
 	if err != nil {
 		return nil, err
 	}
 	mergableFile := &achFile{
 		File:     incoming,
 		filepath: filepath.Join(dir, filename),
+		keeper:   c.keeper,
+	}
+	if err := c.balanceFile(mergableFile.File); err != nil {
+		return mergableFile, err
 	}
 	if err := mergableFile.Create(); err != nil {
 		return mergableFile, err
@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -32,7 +31,7 @@ import (
 
 func TestController__grabAllFiles(t *testing.T) {
 	// grab ACH files from our testdata directory
-	files, err := grabAllFiles(filepath.Join("..", "..", "testdata"))
+	files, err := grabAllFiles(filepath.Join("..", "..", "testdata"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,7 +53,7 @@ func TestController__grabAllFiles(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	files, err = grabAllFiles(dir)
+	files, err = grabAllFiles(dir, nil)
 	if len(files) != 0 || err == nil {
 		t.Errorf("error=%v files=%#v", err, files)
 	}
@@ -102,7 +101,7 @@ func TestController__filesNearTheirCutoff(t *testing.T) {
 		},
 	}
 
-	outFiles, err := filesNearTheirCutoff(cutoffTimes, dir)
+	outFiles, err := filesNearTheirCutoff(cutoffTimes, dir, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -121,7 +120,7 @@ func TestController__filesNearTheirCutoff(t *testing.T) {
 
 	// bump out time ahead
 	cutoffTimes[0].Cutoff += 100 // add one hour
-	outFiles, err = filesNearTheirCutoff(cutoffTimes, dir)
+	outFiles, err = filesNearTheirCutoff(cutoffTimes, dir, nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -130,9 +129,35 @@ func TestController__filesNearTheirCutoff(t *testing.T) {
 	}
 }
 
+func TestController__anyNearCutoff(t *testing.T) {
+	nyc, _ := time.LoadLocation("America/New_York")
+	now := time.Now().In(nyc)
+
+	cutoffTimes := []*CutoffTime{
+		{RoutingNumber: "987654320", Cutoff: (now.Hour() * 100) + now.Minute() + 1, Loc: nyc},
+		{RoutingNumber: "121042882", Cutoff: (now.Hour() * 100) + now.Minute() + 1, Loc: nyc},
+	}
+	if !anyNearCutoff(cutoffTimes) {
+		t.Error("expected a cutoff near")
+	}
+
+	// refused NOCs wait until a cutoff is near
+	cutoffTimes[0].Cutoff += 100
+	if !anyNearCutoff(cutoffTimes) {
+		t.Error("expected a cutoff near")
+	}
+	cutoffTimes[1].Cutoff += 100
+	if anyNearCutoff(cutoffTimes) {
+		t.Error("expected no cutoff near")
+	}
+	if anyNearCutoff(nil) {
+		t.Error("expected no cutoff near")
+	}
+}
+
 func TestController__mergeTransfer(t *testing.T) {
 	// build a mergableFile from an example WEB entry
-	webFile, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"))
+	webFile, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,7 +189,7 @@ func TestController__mergeTransfer(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -334,7 +359,7 @@ func TestController__mergeMicroDeposit(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if fileToUpload := controller.mergeMicroDeposit(dir, mc, depRepo); fileToUpload != nil {
+	if fileToUpload := controller.mergeMicroDeposit(dir, mc, depRepo, nil); fileToUpload != nil {
 		t.Errorf("didn't expect an ACH file to upload: %#v", fileToUpload)
 	}
 
@@ -384,14 +409,14 @@ func TestController__startUploadError(t *testing.T) {
 
 func TestController__uploadFile(t *testing.T) {
 	agent := &mockFileTransferAgent{}
-	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	controller := &Controller{
 		logger: log.NewNopLogger(),
 	}
-	if err := controller.uploadFile(agent, &achFile{File: file, filepath: filepath.Join("..", "..", "testdata", "ppd-debit.ach")}); err != nil {
+	if err := controller.uploadFile(agent, &achFile{File: file, filepath: filepath.Join("..", "..", "testdata", "ppd-debit.ach")}, "ppd-debit.ach"); err != nil {
 		t.Error(err)
 	}
 
@@ -479,7 +504,7 @@ func TestController__grabLatestMergedACHFile(t *testing.T) {
 		},
 	}
 
-	incoming, _ := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	incoming, _ := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
 	file, err := controller.grabLatestMergedACHFile(origin, incoming, dir)
 	if err != nil {
 		t.Fatal(err)
@@ -492,7 +517,7 @@ func TestController__grabLatestMergedACHFile(t *testing.T) {
 	}
 
 	// Then look for a new ABA and ensure we get a new achFile created
-	incoming, _ = parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	incoming, _ = parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -533,54 +558,86 @@ func TestController__grabLatestMergedACHFile(t *testing.T) {
 	}
 }
 
-func TestOutgoing__rejectOutboundIPRange(t *testing.T) {
-	addrs, err := net.LookupIP("moov.io")
+func TestController__outboundFilename(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "ppd-debit.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	controller := &Controller{
+		logger: log.NewNopLogger(),
+		repo: &mockRepository{
+			configs: []*Config{
+				{
+					RoutingNumber:            "076401251",
+					OutboundFilenameTemplate: `{{ .RoutingNumber }}-{{ .FileIDModifier }}-{{ .TransferType }}-{{ .EntryCount }}.ach`,
+				},
+			},
+		},
+	}
 
-	cfg := &Config{AllowedIPs: addrs[0].String()}
-
-	// exact IP match
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err != nil {
-		t.Error(err)
+	// the filename is rendered from the file's contents
+	filename, err := controller.outboundFilename(&achFile{File: file, filepath: "20200101-076401251-1.ach"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "076401251-A-pull-1.ach" {
+		t.Errorf("filename=%s", filename)
 	}
 
-	// multiple whitelisted, but exact IP match
-	cfg.AllowedIPs = fmt.Sprintf("127.0.0.1/24,%s", addrs[0].String())
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err != nil {
-		t.Error(err)
+	// files created without a managed FileIDModifier keep their name
+	file.Header.FileIDModifier = ""
+	if filename, err := controller.outboundFilename(&achFile{File: file, filepath: "20200101-076401251-1.ach"}); filename != "20200101-076401251-1.ach" || err != nil {
+		t.Errorf("filename=%s error=%v", filename, err)
 	}
+}
 
-	// multiple whitelisted, match range (convert IP to /24)
-	cfg.AllowedIPs = fmt.Sprintf("%s/24", addrs[0].Mask(net.IPv4Mask(0xFF, 0xFF, 0xFF, 0x0)).String())
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err != nil {
-		t.Error(err)
+func TestController__mergedEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mergedEntries")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
 
-	// no match
-	cfg.AllowedIPs = "8.8.8.0/24"
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err == nil {
-		t.Error("expected error")
+	mergableFile := &achFile{
+		File:     readPPDDebitFile(t),
+		filepath: filepath.Join(dir, "20200101-076401251-1.ach"),
+	}
+	repo := &mockRepository{
+		configs: []*Config{
+			{
+				RoutingNumber:       mergableFile.Header.ImmediateOrigin,
+				BalanceEntries:      true,
+				OffsetRoutingNumber: "121042882",
+				OffsetAccountNumber: "123456",
+				OffsetAccountType:   "checking",
+			},
+		},
+	}
+	controller := &Controller{repo: repo, logger: log.NewNopLogger()}
+	if err := controller.balanceFile(mergableFile.File); err != nil {
+		t.Fatal(err)
 	}
 
-	// empty whitelist, allow all
-	cfg.AllowedIPs = ""
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err != nil {
-		t.Errorf("expected no error: %v", err)
+	file := readPPDDebitFile(t)
+	file.Batches[0].GetEntries()[0].Amount += 1
+	if _, err := controller.mergeTransfer(file, mergableFile); err != nil {
+		t.Fatal(err)
 	}
 
-	// error cases
-	cfg.AllowedIPs = "afkjsafkjahfa"
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err == nil {
-		t.Error("expected error")
+	// the offset entry isn't part of the transfer
+	entries := controller.mergedEntries(file)
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries", len(entries))
 	}
-	cfg.AllowedIPs = "10.0.0.0/8"
-	if err := rejectOutboundIPRange(cfg, "lsjafkshfaksjfhas"); err == nil {
-		t.Error("expected error")
+	found := false
+	for i := range mergableFile.Batches {
+		for _, ed := range mergableFile.Batches[i].GetEntries() {
+			if ed.TraceNumberField() == entries[0].TraceNumberField() && ed.Amount == entries[0].Amount {
+				found = true
+			}
+		}
 	}
-	cfg.AllowedIPs = "10...../8"
-	if err := rejectOutboundIPRange(cfg, "moov.io"); err == nil {
-		t.Error("expected error")
+	if !found {
+		t.Errorf("trace number %s isn't in the merged file", entries[0].TraceNumberField())
 	}
 }
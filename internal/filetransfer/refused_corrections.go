@@ -0,0 +1,327 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/secrets"
+	"github.com/moov-io/paygate/internal/transfers"
+)
+
+// refuseCorrection validates a NOC against the entry we originated and returns the refused NOC code (C61-C69) an
+// ODFI sends back to the RDFI when it can't be applied. An empty string is returned for valid NOCs.
+//
+// The fields a NOC copies from the original entry are checked for being present and well formed, and its trace
+// number, RDFI routing number, account number and transaction code are compared with original. A nil original means
+// no Transfer or micro-deposit was merged with the NOC's original trace number. We don't keep the Discretionary Data,
+// Company Identification or Individual Identification Number of the original entry, so those are only checked for
+// being present and NOCs are never refused with C66.
+//
+// Change codes without corrected data we apply (i.e. C08, C13, C14) only have those fields checked.
+func refuseCorrection(fileHeader ach.FileHeader, header *ach.BatchHeader, entry *ach.EntryDetail, original *originalEntry) string {
+	if odfi := fileHeader.ImmediateDestination; len(odfi) < 8 || entry.RDFIIdentificationField() != odfi[:8] {
+		return "C61" // Misrouted Notification of Change
+	}
+	if !isNumeric(entry.Addenda98.OriginalTrace, 15) || original == nil {
+		return "C62" // Incorrect Trace Number
+	}
+	if strings.TrimSpace(header.CompanyIdentification) == "" {
+		return "C63" // Incorrect Company Identification Number
+	}
+	if strings.TrimSpace(entry.IdentificationNumber) == "" {
+		return "C64" // Incorrect Individual Identification Number
+	}
+	if !isNumeric(entry.Addenda98.OriginalDFI, 8) || !strings.HasPrefix(original.dep.RoutingNumber, entry.Addenda98.OriginalDFI) {
+		return "C67" // Routing Number not from Original Entry Detail Record
+	}
+	accountNumber := strings.TrimSpace(entry.DFIAccountNumber)
+	if num, err := original.dep.DecryptAccountNumber(); accountNumber == "" || (err == nil && accountNumber != num) {
+		return "C68" // DFI Account Number not from Original Entry Detail Record
+	}
+	if !validNOCTransactionCode(entry.TransactionCode) || !original.matchesTransactionCode(entry.TransactionCode) {
+		return "C69" // Incorrect Transaction Code
+	}
+
+	switch entry.Addenda98.ChangeCode {
+	case "C01", "C02", "C03", "C04", "C05", "C06", "C07", "C09":
+	default:
+		return ""
+	}
+
+	cor := entry.Addenda98.ParseCorrectedData()
+	if cor == nil {
+		return "C65" // Incorrectly Formatted Corrected Data
+	}
+	switch entry.Addenda98.ChangeCode {
+	case "C02", "C03", "C07":
+		if err := ach.CheckRoutingNumber(cor.RoutingNumber); err != nil {
+			return "C65"
+		}
+	}
+	switch entry.Addenda98.ChangeCode {
+	case "C01", "C03", "C06", "C07":
+		if !validCorrectedAccountNumber(cor.AccountNumber) {
+			return "C65"
+		}
+	}
+	switch entry.Addenda98.ChangeCode {
+	case "C05", "C06", "C07":
+		if !validCorrectedTransactionCode(cor.TransactionCode) {
+			return "C65"
+		}
+	}
+	return ""
+}
+
+// originalEntry is the entry we originated which a NOC was sent for.
+type originalEntry struct {
+	// transfer is nil when the entry was a micro-deposit
+	transfer *model.Transfer
+
+	// dep is the receiving Depository of the entry
+	dep *model.Depository
+}
+
+// lookupOriginalEntry finds the Transfer or micro-deposit merged with the original trace number of a NOC. A nil
+// originalEntry is returned when neither is found.
+func lookupOriginalEntry(entry *ach.EntryDetail, depRepo depository.Repository, transferRepo transfers.Repository) (*originalEntry, error) {
+	traceNumber := entry.Addenda98.OriginalTraceField()
+	transfer, err := transferRepo.LookupTransferFromNOC(traceNumber)
+	if err != nil {
+		return nil, fmt.Errorf("problem finding transfer with trace number %s: %v", traceNumber, err)
+	}
+	if transfer != nil {
+		dep, err := depRepo.GetDepository(transfer.ReceiverDepository)
+		if err != nil || dep == nil {
+			return nil, fmt.Errorf("problem reading depository=%s of transfer=%s: %v", transfer.ReceiverDepository, transfer.ID, err)
+		}
+		return &originalEntry{transfer: transfer, dep: dep}, nil
+	}
+	dep, err := depRepo.LookupMicroDepositFromNOC(traceNumber)
+	if err != nil {
+		return nil, fmt.Errorf("problem finding micro-deposit with trace number %s: %v", traceNumber, err)
+	}
+	if dep != nil {
+		return &originalEntry{dep: dep}, nil
+	}
+	return nil, nil
+}
+
+// matchesTransactionCode returns true if a NOC's transaction code is for a credit (push) or debit (pull) like
+// the original Transfer. Micro-deposits have credit and debit entries, so any code matches them.
+func (o *originalEntry) matchesTransactionCode(code int) bool {
+	if o.transfer == nil {
+		return true
+	}
+	switch code {
+	case ach.CheckingReturnNOCCredit, ach.SavingsReturnNOCCredit, ach.GLReturnNOCCredit, ach.LoanReturnNOCCredit:
+		return o.transfer.Type == model.PushTransfer
+	}
+	return o.transfer.Type == model.PullTransfer
+}
+
+func isNumeric(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validNOCTransactionCode returns true for the automated NOC codes of demand, savings, general ledger
+// and loan accounts.
+func validNOCTransactionCode(code int) bool {
+	switch code {
+	case ach.CheckingReturnNOCCredit, ach.CheckingReturnNOCDebit,
+		ach.SavingsReturnNOCCredit, ach.SavingsReturnNOCDebit,
+		ach.GLReturnNOCCredit, ach.GLReturnNOCDebit,
+		ach.LoanReturnNOCCredit, ach.LoanReturnNOCDebit:
+		return true
+	}
+	return false
+}
+
+func validCorrectedAccountNumber(num string) bool {
+	if num == "" || len(num) > 17 {
+		return false
+	}
+	for _, r := range num {
+		if !(r >= '0' && r <= '9') && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// validCorrectedTransactionCode returns true for live and prenote credit and debit codes of demand, savings,
+// general ledger and loan accounts.
+func validCorrectedTransactionCode(code int) bool {
+	switch code {
+	case ach.CheckingCredit, ach.CheckingPrenoteCredit, ach.CheckingDebit, ach.CheckingPrenoteDebit,
+		ach.SavingsCredit, ach.SavingsPrenoteCredit, ach.SavingsDebit, ach.SavingsPrenoteDebit,
+		ach.GLCredit, ach.GLPrenoteCredit, ach.GLDebit, ach.GLPrenoteDebit,
+		ach.LoanCredit, ach.LoanPrenoteCredit, ach.LoanDebit:
+		return true
+	}
+	return false
+}
+
+// writeRefusedCORFile creates an outbound file in our refused directory which refuses the NOC in entry.
+//
+// The version of moov-io/ach we use doesn't know about refused NOC codes and rejects them when reading files,
+// so refused NOCs can't be merged with our other outbound files. Instead each is written into its own file
+// which is uploaded during the next mergeAndUploadFiles.
+func (c *Controller) writeRefusedCORFile(fileHeader ach.FileHeader, header *ach.BatchHeader, entry *ach.EntryDetail, refusalCode string) (string, error) {
+	// Refused NOCs are sent back to the NOC's origin, so they use one of its File ID Modifiers for today
+	seq, err := c.nextFileSequence(fileHeader.ImmediateOrigin)
+	if err != nil {
+		return "", err
+	}
+	contents, err := createRefusedCORFile(fileHeader, header, entry, refusalCode, fileIDModifier(seq))
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(c.rootDir, "refused")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("%s-%s-refused-%s.ach", time.Now().Format("20060102"), fileHeader.ImmediateOrigin, entry.TraceNumberField())
+	path := filepath.Join(dir, filename)
+	if err := writeFile(path, contents, c.keeper); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// createRefusedCORFile returns an ACH file with a single refused COR entry sent back to the RDFI of the NOC.
+// fileHeader and header are from the file and batch the NOC was received in.
+func createRefusedCORFile(fileHeader ach.FileHeader, header *ach.BatchHeader, noc *ach.EntryDetail, refusalCode string, modifier string) ([]byte, error) {
+	now := time.Now()
+
+	file := ach.NewFile()
+	file.Header = ach.NewFileHeader()
+	file.Header.ImmediateOrigin = fileHeader.ImmediateDestination
+	file.Header.ImmediateOriginName = fileHeader.ImmediateDestinationName
+	file.Header.ImmediateDestination = fileHeader.ImmediateOrigin
+	file.Header.ImmediateDestinationName = fileHeader.ImmediateOriginName
+	file.Header.FileCreationDate = now.Format("060102") // YYMMDD
+	file.Header.FileCreationTime = now.Format("1504")   // HHMM
+	file.Header.FileIDModifier = modifier
+
+	odfi := fileHeader.ImmediateDestination
+	if len(odfi) >= 8 {
+		odfi = odfi[:8]
+	}
+
+	bh := *header
+	bh.ID = ""
+	bh.ODFIIdentification = odfi
+	bh.EffectiveEntryDate = now.Format("060102") // YYMMDD
+	bh.BatchNumber = 1
+
+	// The refused NOC goes back to the RDFI which sent the NOC, whose routing number prefixes the NOC's trace number
+	ed := ach.NewEntryDetail()
+	ed.TransactionCode = noc.TransactionCode
+	ed.RDFIIdentification = noc.TraceNumberField()[:8]
+	ed.CheckDigit = fmt.Sprintf("%d", ed.CalculateCheckDigit(ed.RDFIIdentification))
+	ed.DFIAccountNumber = noc.DFIAccountNumber
+	ed.IdentificationNumber = noc.IdentificationNumber
+	ed.IndividualName = noc.IndividualName
+	ed.DiscretionaryData = noc.DiscretionaryData
+	seq, _ := strconv.Atoi(noc.TraceNumberField()[8:])
+	ed.SetTraceNumber(odfi, seq)
+
+	// Write the entry with a placeholder Addenda98 using the NOC's change code, which is swapped for the
+	// refused NOC addenda after the file is written.
+	placeholder := ach.NewAddenda98()
+	placeholder.ChangeCode = noc.Addenda98.ChangeCode
+	placeholder.OriginalTrace = noc.Addenda98.OriginalTrace
+	placeholder.OriginalDFI = noc.Addenda98.OriginalDFI
+	placeholder.CorrectedData = noc.Addenda98.CorrectedData
+	if strings.TrimSpace(placeholder.CorrectedData) == "" {
+		placeholder.CorrectedData = "0"
+	}
+	placeholder.TraceNumber = ed.TraceNumber
+	ed.Addenda98 = placeholder
+	ed.AddendaRecordIndicator = 1
+	ed.Category = ach.CategoryNOC
+
+	batch, err := ach.NewBatch(&bh)
+	if err != nil {
+		return nil, err
+	}
+	batch.AddEntry(ed)
+	if err := batch.Create(); err != nil {
+		return nil, err
+	}
+	file.AddBatch(batch)
+	if err := file.Create(); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := ach.NewWriter(&buf).Write(file); err != nil {
+		return nil, err
+	}
+	refused := refusedAddenda98(refusalCode, noc, ed.TraceNumberField())
+	return bytes.Replace(buf.Bytes(), []byte(placeholder.String()), []byte(refused), 1), nil
+}
+
+// refusedAddenda98 formats the Addenda98 record of a refused NOC, which carries the refusal code along
+// with the NOC's change code and trace sequence number.
+func refusedAddenda98(refusalCode string, noc *ach.EntryDetail, traceNumber string) string {
+	a := noc.Addenda98
+	return fmt.Sprintf("798%-3.3s%s      %s%-29.29s%-3.3s%7.7s     %s",
+		refusalCode,
+		a.OriginalTraceField(),
+		a.OriginalDFIField(),
+		a.CorrectedData,
+		a.ChangeCode,
+		noc.TraceNumberField()[8:], // Trace Sequence Number
+		traceNumber,
+	)
+}
+
+// grabRefusedCORFiles returns the refused NOC files in dir which need to be uploaded. Only their FileHeader is read.
+func grabRefusedCORFiles(dir string, keeper *secrets.StringKeeper) ([]*achFile, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.ach"))
+	if err != nil {
+		return nil, err
+	}
+	var out []*achFile
+	for i := range matches {
+		bs, err := readFile(matches[i], keeper)
+		if err != nil {
+			return nil, err
+		}
+		line, err := bufio.NewReader(bytes.NewReader(bs)).ReadString('\n')
+		if err != nil || len(line) < 94 {
+			return nil, fmt.Errorf("grabRefusedCORFiles: problem reading %s: %v", matches[i], err)
+		}
+		file := ach.NewFile()
+		file.Header.Parse(line[:94])
+		out = append(out, &achFile{
+			File:     file,
+			filepath: matches[i],
+			keeper:   keeper,
+		})
+	}
+	return out, nil
+}
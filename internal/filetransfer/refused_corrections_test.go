@@ -0,0 +1,293 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/config"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/secrets"
+	"github.com/moov-io/paygate/internal/transfers"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestRefusedCorrections__refuseCorrection(t *testing.T) {
+	cases := []struct {
+		code     string
+		data     *ach.CorrectedData
+		expected string
+	}{
+		{"C01", &ach.CorrectedData{AccountNumber: "1918171614"}, ""},
+		{"C01", &ach.CorrectedData{AccountNumber: "19181716$4"}, "C65"},
+		{"C02", &ach.CorrectedData{RoutingNumber: "121042882"}, ""},
+		{"C02", &ach.CorrectedData{RoutingNumber: "121042881"}, "C65"},
+		{"C03", &ach.CorrectedData{RoutingNumber: "12104288", AccountNumber: "1918171614"}, "C65"},
+		{"C04", &ach.CorrectedData{Name: "Jane Smith"}, ""},
+		{"C05", &ach.CorrectedData{TransactionCode: ach.SavingsCredit}, ""},
+		{"C05", &ach.CorrectedData{TransactionCode: 99}, "C65"},
+		{"C09", &ach.CorrectedData{}, "C65"},
+		{"C13", &ach.CorrectedData{}, ""},
+	}
+	original := refusableOriginal(t)
+	for i := range cases {
+		fh, bh, ed := refusableNOC(cases[i].code)
+		ed.Addenda98.CorrectedData = ach.WriteCorrectionData(cases[i].code, cases[i].data)
+		if code := refuseCorrection(fh, bh, ed, original); code != cases[i].expected {
+			t.Errorf("%s (%q): got %q", cases[i].code, ed.Addenda98.CorrectedData, code)
+		}
+	}
+}
+
+func TestRefusedCorrections__refuseCorrectionFields(t *testing.T) {
+	cases := []struct {
+		expected string
+		modify   func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry
+	}{
+		{"", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			return original
+		}},
+		{"C61", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			fh.ImmediateDestination = "121042882"
+			return original
+		}},
+		{"C62", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.Addenda98.OriginalTrace = "12104288000001"
+			return original
+		}},
+		{"C62", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.Addenda98.OriginalTrace = "12104288000000A"
+			return original
+		}},
+		{"C62", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			return nil // no Transfer or micro-deposit has the original trace number
+		}},
+		{"C63", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			bh.CompanyIdentification = " "
+			return original
+		}},
+		{"C64", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.IdentificationNumber = ""
+			return original
+		}},
+		{"C67", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.Addenda98.OriginalDFI = "1210428"
+			return original
+		}},
+		{"C67", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.Addenda98.OriginalDFI = "23138010"
+			return original
+		}},
+		{"C68", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.DFIAccountNumber = ""
+			return original
+		}},
+		{"C68", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.DFIAccountNumber = "744-5678-98"
+			return original
+		}},
+		{"C69", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.TransactionCode = ach.CheckingCredit
+			return original
+		}},
+		{"C69", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.TransactionCode = ach.CheckingReturnNOCDebit // the original Transfer was a credit
+			return original
+		}},
+		{"", func(fh *ach.FileHeader, bh *ach.BatchHeader, ed *ach.EntryDetail, original *originalEntry) *originalEntry {
+			ed.TransactionCode = ach.CheckingReturnNOCDebit
+			original.transfer = nil // micro-deposits are credits and debits
+			return original
+		}},
+	}
+	for i := range cases {
+		fh, bh, ed := refusableNOC("C01")
+		original := cases[i].modify(&fh, bh, ed, refusableOriginal(t))
+		if code := refuseCorrection(fh, bh, ed, original); code != cases[i].expected {
+			t.Errorf("expected %q: got %q", cases[i].expected, code)
+		}
+	}
+}
+
+// refusableOriginal returns the Transfer and receiving Depository refusableNOC was sent for.
+func refusableOriginal(t *testing.T) *originalEntry {
+	t.Helper()
+
+	dep := &model.Depository{
+		ID:            id.Depository(base.ID()),
+		RoutingNumber: "121042882",
+		Keeper:        secrets.TestStringKeeper(t),
+	}
+	if err := dep.ReplaceAccountNumber("744-5678-99"); err != nil {
+		t.Fatal(err)
+	}
+	transfer := &model.Transfer{
+		ID:                 id.Transfer(base.ID()),
+		Type:               model.PushTransfer,
+		ReceiverDepository: dep.ID,
+	}
+	return &originalEntry{transfer: transfer, dep: dep}
+}
+
+// refusableNOC returns a valid NOC with changeCode, along with the File and Batch headers it was received in.
+func refusableNOC(changeCode string) (ach.FileHeader, *ach.BatchHeader, *ach.EntryDetail) {
+	fh := ach.NewFileHeader()
+	fh.ImmediateDestination = "231380104"
+	fh.ImmediateOrigin = "121042882"
+
+	bh := ach.NewBatchHeader()
+	bh.StandardEntryClassCode = ach.COR
+	bh.CompanyIdentification = "121042882"
+
+	ed := ach.NewEntryDetail()
+	ed.TransactionCode = ach.CheckingReturnNOCCredit
+	ed.RDFIIdentification = "23138010"
+	ed.DFIAccountNumber = "744-5678-99"
+	ed.IdentificationNumber = "location #23"
+	ed.IndividualName = "Best Co. #23"
+	ed.TraceNumber = "121042880000001"
+	ed.Addenda98 = ach.NewAddenda98()
+	ed.Addenda98.ChangeCode = changeCode
+	ed.Addenda98.OriginalTrace = "121042880000001"
+	ed.Addenda98.OriginalDFI = "12104288"
+	ed.Addenda98.CorrectedData = ach.WriteCorrectionData("C01", &ach.CorrectedData{AccountNumber: "1918171614"})
+
+	return fh, bh, ed
+}
+
+func TestRefusedCorrections__handleNOCFile(t *testing.T) {
+	userID := id.User(base.ID())
+	dir, _ := ioutil.TempDir("", "handleNOCFile")
+	defer os.RemoveAll(dir)
+
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	keeper := secrets.TestStringKeeper(t)
+	depRepo := depository.NewDepositoryRepo(log.NewNopLogger(), sqliteDB.DB, keeper)
+
+	controller, err := NewController(config.Empty(), dir, NewRepository("", nil, "", nil), nil, nil, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.keeper = keeper
+	controller.updateDepositoriesFromNOCs = true
+
+	fd, err := os.Open(filepath.Join("..", "..", "testdata", "cor-c01.ach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ach.NewReader(fd).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	// the RDFI sends an invalid routing number
+	noc := file.NotificationOfChange[0].GetEntries()[0]
+	noc.Addenda98.ChangeCode = "C02"
+	noc.Addenda98.CorrectedData = "121042881"
+
+	accountNumber := strings.TrimSpace(noc.DFIAccountNumber)
+	dep := &model.Depository{
+		ID:            id.Depository(base.ID()),
+		RoutingNumber: file.Header.ImmediateDestination,
+		BankName:      "bank name",
+		Holder:        "holder",
+		HolderType:    model.Individual,
+		Type:          model.Checking,
+		Status:        model.DepositoryVerified,
+		Created:       base.NewTime(time.Now().Add(-1 * time.Second)),
+	}
+	if err := depRepo.UpsertUserDepository(userID, dep); err != nil {
+		t.Fatal(err)
+	}
+	dep, _ = depRepo.GetDepository(dep.ID) // this method sets the keeper
+	if err := dep.ReplaceAccountNumber(accountNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := depRepo.UpsertUserDepository(userID, dep); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Transfer the NOC was sent for
+	receiver := &model.Depository{
+		ID:            id.Depository(base.ID()),
+		RoutingNumber: "121042882",
+		BankName:      "bank name",
+		Holder:        "receiver",
+		HolderType:    model.Individual,
+		Type:          model.Checking,
+		Status:        model.DepositoryVerified,
+		Created:       base.NewTime(time.Now()),
+		Keeper:        keeper,
+	}
+	if err := receiver.ReplaceAccountNumber(accountNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := depRepo.UpsertUserDepository(userID, receiver); err != nil {
+		t.Fatal(err)
+	}
+	transferRepo := &transfers.MockRepository{
+		Xfer: &model.Transfer{
+			ID:                 id.Transfer(base.ID()),
+			Type:               model.PushTransfer,
+			ReceiverDepository: receiver.ID,
+		},
+	}
+
+	if err := controller.handleNOCFile(&periodicFileOperationsRequest{}, &file, "cor-c02.ach", depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+
+	// the Depository isn't updated or rejected
+	dep, err = depRepo.GetUserDepository(dep.ID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep.Status != model.DepositoryVerified || dep.RoutingNumber != file.Header.ImmediateDestination {
+		t.Errorf("unexpected depository: %#v", dep)
+	}
+
+	// a refused NOC is ready for upload
+	files, err := grabRefusedCORFiles(filepath.Join(dir, "refused"), controller.keeper)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got %d refused files: %v", len(files), err)
+	}
+	if files[0].Header.ImmediateOrigin != file.Header.ImmediateDestination || files[0].Header.ImmediateDestination != file.Header.ImmediateOrigin {
+		t.Errorf("unexpected FileHeader: %#v", files[0].Header)
+	}
+	bs, err := readFile(files[0].filepath, controller.keeper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	var addenda string
+	for i := range lines {
+		if len(lines[i]) != 94 {
+			t.Errorf("line %d is %d characters", i, len(lines[i]))
+		}
+		if strings.HasPrefix(lines[i], "798") {
+			addenda = lines[i]
+		}
+	}
+	if addenda[3:6] != "C65" || addenda[6:21] != noc.Addenda98.OriginalTraceField() || addenda[64:67] != "C02" || addenda[67:74] != noc.TraceNumberField()[8:] {
+		t.Errorf("unexpected refused addenda: %q", addenda)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(addenda[35:64]), "121042881") {
+		t.Errorf("unexpected corrected data: %q", addenda[35:64])
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/moov-io/ach"
 	"github.com/moov-io/base"
@@ -35,7 +36,7 @@ func (c *Controller) processReturnFiles(dir string, depRepo depository.Repositor
 			return nil // Ignore SkipDir and directories
 		}
 
-		file, err := parseACHFilepath(path)
+		file, err := parseACHFilepath(path, c.keeper)
 		if err != nil {
 			c.logger.Log("processReturnFiles", fmt.Sprintf("problem parsing return file %s", path), "error", err)
 			return nil
@@ -58,6 +59,9 @@ func (c *Controller) processReturnFiles(dir string, depRepo depository.Repositor
 				}
 				if err := c.processReturnEntry(file.Header, file.ReturnEntries[i].GetHeader(), entries[j], depRepo, transferRepo); err != nil {
 					c.logger.Log("processReturnFiles", "error processing EntryDetail", "traceNumber", entries[j].TraceNumber, "error", err)
+					if _, ok := err.(*unmatchedEntryError); ok {
+						c.recordException(exceptionReturn, info.Name(), file.Header, file.ReturnEntries[i].GetHeader(), entries[j], err)
+					}
 					continue
 				}
 			}
@@ -79,14 +83,45 @@ func (c *Controller) processReturnEntry(fileHeader ach.FileHeader, header *ach.B
 	requestID := base.ID()
 	returnCode := entry.Addenda99.ReturnCodeField()
 
-	// Do we find a Transfer related to the ach.EntryDetail?
-	transfer, err := transferRepo.LookupTransferFromReturn(header.StandardEntryClassCode, amount, entry.TraceNumber, effectiveEntryDate)
+	// Dishonored returns are for returns we sent and contested dishonored returns are for our dishonored returns,
+	// so both are matched by the original entry's trace number.
+	switch {
+	case transfers.IsDishonoredReturnCode(returnCode.Code):
+		return c.processDishonoredReturnEntry(requestID, entry, depRepo, transferRepo)
+	case transfers.IsContestedDishonoredReturnCode(returnCode.Code):
+		return c.processContestedDishonoredReturnEntry(requestID, entry, transferRepo)
+	}
+
+	// Do we find a Transfer related to the ach.EntryDetail? Returns carry the trace number of the entry we uploaded,
+	// but if that doesn't match fallback to matching on the return's other fields.
+	originalTrace := entry.Addenda99.OriginalTraceField()
+	transfer, err := transferRepo.LookupTransferFromTrace(originalTrace, amount)
+	if transfer == nil && err == nil {
+		transfer, err = transferRepo.LookupTransferFromReturn(header.StandardEntryClassCode, amount, entry.TraceNumber, effectiveEntryDate)
+		if transfer != nil {
+			c.logger.Log("processReturnEntry", fmt.Sprintf("WARNING: matched transfer=%s without originalTrace=%s", transfer.ID, originalTrace), "traceNumber", entry.TraceNumber, "requestID", requestID)
+		}
+	}
 	if transfer != nil {
-		if err := c.processTransferReturn(requestID, transfer, transferRepo, returnCode); err != nil {
+		// Returns received after their deadline don't reclaim the transfer
+		late := isLateTransferReturn(transfer, returnCode.Code, time.Now())
+		if err := c.processTransferReturn(requestID, transfer, transferRepo, returnCode, late); err != nil {
 			return fmt.Errorf("processTransferReturn: %v", err)
 		}
 		c.logger.Log("processReturnEntry", fmt.Sprintf("matched traceNumber=%s to transfer=%s with returnCode=%s", entry.TraceNumber, transfer.ID, returnCode), "requestID", requestID)
 
+		// Save the return so it can be dishonored
+		ret := transferReturnFromEntry(fileHeader, header, entry, transfer)
+		if err := transferRepo.CreateTransferReturn(ret); err != nil {
+			return fmt.Errorf("problem saving return of transfer=%s: %v", transfer.ID, err)
+		}
+		if late {
+			ret.DishonorDeadline = transfers.DishonorDeadline(ret.Created)
+			if err := c.processLateReturn(requestID, transfer, ret, transferRepo); err != nil {
+				return fmt.Errorf("processLateReturn: %v", err)
+			}
+		}
+
 		// Grab the full Depository objects for our Transfer
 		origDep, err := depRepo.GetUserDepository(transfer.OriginatorDepository, id.User(transfer.UserID))
 		if err != nil {
@@ -110,11 +145,23 @@ func (c *Controller) processReturnEntry(fileHeader ach.FileHeader, header *ach.B
 	}
 
 	// No Transfer, so maybe a Depository? It could be a micro-deposit.
-	dep, err := depRepo.LookupDepositoryFromReturn(fileHeader.ImmediateDestination, entry.DFIAccountNumber)
-	if dep == nil || err != nil {
-		return fmt.Errorf("problem looking up Depository: %v", err)
+	dep, microDeposit, err := depRepo.LookupMicroDepositFromTrace(originalTrace, amount)
+	if err != nil {
+		return fmt.Errorf("problem looking up micro-deposit: %v", err)
+	}
+	if microDeposit == nil {
+		dep, err = depRepo.LookupDepositoryFromReturn(fileHeader.ImmediateDestination, entry.DFIAccountNumber)
+		if err != nil {
+			return fmt.Errorf("problem looking up Depository: %v", err)
+		}
+		if dep == nil {
+			return &unmatchedEntryError{fmt.Sprintf("unable to match return file origin=%s traceNumber=%s to a transfer or depository", fileHeader.ImmediateOrigin, entry.TraceNumber)}
+		}
+		microDeposit, err = depRepo.LookupMicroDepositFromReturn(dep.ID, amount)
+		if microDeposit != nil {
+			c.logger.Log("processReturnEntry", fmt.Sprintf("WARNING: matched micro-deposit to depository=%s without originalTrace=%s", dep.ID, originalTrace), "traceNumber", entry.TraceNumber, "requestID", requestID)
+		}
 	}
-	microDeposit, err := depRepo.LookupMicroDepositFromReturn(dep.ID, amount)
 	if microDeposit != nil {
 		if err := c.processMicroDepositReturn(requestID, dep.UserID, dep.ID, microDeposit, depRepo, returnCode); err != nil {
 			return fmt.Errorf("processMicroDepositReturn: %v", err)
@@ -132,7 +179,7 @@ func (c *Controller) processReturnEntry(fileHeader ach.FileHeader, header *ach.B
 		}
 	}
 
-	return fmt.Errorf("unable to match return file origin=%s traceNumber=%s", fileHeader.ImmediateOrigin, entry.TraceNumber)
+	return &unmatchedEntryError{fmt.Sprintf("unable to match return file origin=%s traceNumber=%s", fileHeader.ImmediateOrigin, entry.TraceNumber)}
 }
 
 // updateDepositoryFromReturnCode will inspect the ach.ReturnCode and optionally update either the originating or receiving Depository.
@@ -13,7 +13,7 @@ import (
 )
 
 func (c *Controller) processMicroDepositReturn(requestID string, userID id.User, depID id.Depository, md *depository.MicroDeposit, depRepo depository.Repository, code *ach.ReturnCode) error {
-	if err := depRepo.SetReturnCode(depID, md.Amount, code.Code); err != nil {
+	if err := depRepo.SetReturnCode(depID, md, code.Code); err != nil {
 		return fmt.Errorf("problem setting micro-deposit code=%s: %v", code.Code, err)
 	}
 
@@ -21,7 +21,7 @@ import (
 )
 
 func TestController__processReturnMicroDeposit(t *testing.T) {
-	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"))
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,10 +68,10 @@ func TestController__processReturnMicroDeposit(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "processReturnEntry")
 	defer os.RemoveAll(dir)
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
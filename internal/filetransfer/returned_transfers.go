@@ -6,21 +6,65 @@ package filetransfer
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/events"
 	"github.com/moov-io/paygate/internal/model"
 	"github.com/moov-io/paygate/internal/transfers"
 	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lateReturnsReceived = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_late_returns_received",
+		Help: "Counter of returns received for our Transfers after their NACHA deadline",
+	}, []string{"return_code", "dishonored"})
 )
 
-func (c *Controller) processTransferReturn(requestID string, transfer *model.Transfer, transferRepo transfers.Repository, returnCode *ach.ReturnCode) error {
+// untimelyReturnCode is the dishonored return code we send back for late returns
+const untimelyReturnCode = "R68"
+
+// transferEffectiveEntryDate returns when transfer's entry settled. Transfers merged before their EffectiveEntryDate was
+// recorded are assumed to settle the banking day after they were created, which is the date their file was created with.
+func transferEffectiveEntryDate(transfer *model.Transfer) time.Time {
+	if !transfer.EffectiveEntryDate.IsZero() || transfer.Created.IsZero() {
+		return transfer.EffectiveEntryDate
+	}
+	return base.NewTime(transfer.Created.Time).AddBankingDay(1).Time
+}
+
+// isLateTransferReturn returns true if a return with code received at received is past the deadline of transfer's entry.
+func isLateTransferReturn(transfer *model.Transfer, code string, received time.Time) bool {
+	effectiveEntryDate := transferEffectiveEntryDate(transfer)
+	if effectiveEntryDate.IsZero() {
+		return false
+	}
+	return transfers.IsLateReturn(code, effectiveEntryDate, received)
+}
+
+// processTransferReturn records returnCode on transfer and reverses its Accounts transaction. Late returns mark the
+// Transfer as a late return instead of reclaimed and keep the transaction when we're going to dishonor them.
+func (c *Controller) processTransferReturn(requestID string, transfer *model.Transfer, transferRepo transfers.Repository, returnCode *ach.ReturnCode, late bool) error {
+	status := model.TransferReclaimed
+	if late {
+		status = model.TransferLateReturn
+	}
+
 	// Set the ReturnCode and update the transfer's status
 	if err := transferRepo.SetReturnCode(transfer.ID, returnCode.Code); err != nil {
 		return fmt.Errorf("problem updating ReturnCode transfer=%q: %v", transfer.ID, err)
 	}
-	if err := transferRepo.UpdateTransferStatus(transfer.ID, model.TransferReclaimed); err != nil {
+	if err := transferRepo.UpdateTransferStatus(transfer.ID, status); err != nil {
 		return fmt.Errorf("problem updating transfer=%q: %v", transfer.ID, err)
 	}
+	if late && c.dishonorLateReturns {
+		return nil // the transfer stands, so its transaction isn't reversed
+	}
 
 	// Reverse the transaction against Accounts
 	if c.accountsClient != nil && transfer.TransactionID != "" {
@@ -35,3 +79,42 @@ func (c *Controller) processTransferReturn(requestID string, transfer *model.Tra
 
 	return nil
 }
+
+// processLateReturn handles a return received after its deadline for transfer. The return is dishonored as untimely (R68)
+// when configured, otherwise it's left for the user to dishonor or accept.
+func (c *Controller) processLateReturn(requestID string, transfer *model.Transfer, ret *transfers.TransferReturn, transferRepo transfers.Repository) error {
+	deadline := transfers.ReturnDeadline(ret.ReturnCode, transferEffectiveEntryDate(transfer))
+	c.logger.Log("processLateReturn", fmt.Sprintf("transfer=%s returned with returnCode=%s after deadline=%s", transfer.ID, ret.ReturnCode, deadline.Format(time.RFC3339)), "requestID", requestID, "userID", transfer.UserID)
+
+	if !c.dishonorLateReturns {
+		lateReturnsReceived.With("return_code", ret.ReturnCode, "dishonored", "no").Add(1)
+		c.writeReturnEvent(ret.UserID, events.TransferEvent, &events.Event{
+			Topic:   fmt.Sprintf("late %s return of transfer", ret.ReturnCode),
+			Message: fmt.Sprintf("%s returned after the deadline of %s and can be dishonored until %s or accepted", ret.Amount.String(), deadline.Format(time.RFC3339), ret.DishonorDeadline.Format(time.RFC3339)),
+			Metadata: map[string]string{
+				"transferID": string(transfer.ID),
+				"returnCode": ret.ReturnCode,
+			},
+		}, requestID)
+		return nil
+	}
+
+	// Our transaction was kept when the return was processed, so it's what gets reversed if the RDFI contests our dishonored return.
+	if err := transferRepo.DishonorTransferReturn(transfer.ID, untimelyReturnCode, "", transfer.TransactionID); err != nil {
+		return fmt.Errorf("problem dishonoring late return: %v", err)
+	}
+	if err := transferRepo.UpdateTransferStatus(transfer.ID, model.TransferProcessed); err != nil {
+		return fmt.Errorf("problem updating transfer=%s: %v", transfer.ID, err)
+	}
+	lateReturnsReceived.With("return_code", ret.ReturnCode, "dishonored", "yes").Add(1)
+
+	c.writeReturnEvent(ret.UserID, events.TransferEvent, &events.Event{
+		Topic:   fmt.Sprintf("dishonored late %s return of transfer", ret.ReturnCode),
+		Message: fmt.Sprintf("%s returned after the deadline of %s and dishonored with %s", ret.Amount.String(), deadline.Format(time.RFC3339), untimelyReturnCode),
+		Metadata: map[string]string{
+			"transferID": string(transfer.ID),
+			"returnCode": untimelyReturnCode,
+		},
+	}, requestID)
+	return nil
+}
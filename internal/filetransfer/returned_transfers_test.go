@@ -5,22 +5,27 @@
 package filetransfer
 
 import (
+	"database/sql"
 	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/accounts"
 	"github.com/moov-io/paygate/internal/config"
 	"github.com/moov-io/paygate/internal/depository"
 	"github.com/moov-io/paygate/internal/model"
 	"github.com/moov-io/paygate/internal/transfers"
 	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
 )
 
 func TestController__processReturnTransfer(t *testing.T) {
-	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"))
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -76,10 +81,10 @@ func TestController__processReturnTransfer(t *testing.T) {
 	dir, _ := ioutil.TempDir("", "processReturnEntry")
 	defer os.RemoveAll(dir)
 
-	repo := NewRepository("", nil, "")
+	repo := NewRepository("", nil, "", nil)
 
 	cfg := config.Empty()
-	controller, err := NewController(cfg, dir, repo, nil, nil)
+	controller, err := NewController(cfg, dir, repo, nil, nil, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -113,3 +118,152 @@ func TestController__processReturnTransfer(t *testing.T) {
 	}
 	transferRepo.Err = nil
 }
+
+// traceTransferRepository only matches Transfers by their original trace number
+type traceTransferRepository struct {
+	*transfers.MockRepository
+	traceNumber string
+}
+
+func (r *traceTransferRepository) LookupTransferFromTrace(traceNumber string, amount *model.Amount) (*model.Transfer, error) {
+	if traceNumber == r.traceNumber {
+		return r.Xfer, nil
+	}
+	return nil, nil
+}
+
+func (r *traceTransferRepository) LookupTransferFromReturn(sec string, amount *model.Amount, traceNumber string, effectiveEntryDate time.Time) (*model.Transfer, error) {
+	return nil, sql.ErrNoRows
+}
+
+func TestController__processReturnEntryOriginalTrace(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := file.Batches[0]
+	entry := b.GetEntries()[0]
+
+	amt, _ := model.NewAmount("USD", "52.12")
+	depRepo := &depository.MockRepository{
+		Depositories: []*model.Depository{{ID: id.Depository(base.ID()), Status: model.DepositoryVerified}},
+	}
+	transferRepo := &traceTransferRepository{
+		MockRepository: &transfers.MockRepository{
+			Xfer: &model.Transfer{
+				ID:                   id.Transfer(base.ID()),
+				Amount:               *amt,
+				OriginatorDepository: id.Depository("orig-depository"),
+				ReceiverDepository:   id.Depository("rec-depository"),
+				UserID:               base.ID(),
+			},
+		},
+		traceNumber: "other",
+	}
+	controller := &Controller{logger: log.NewNopLogger()}
+
+	// the return's own trace number isn't used
+	transferRepo.traceNumber = entry.TraceNumberField()
+	if err := controller.processReturnEntry(file.Header, b.GetHeader(), entry, depRepo, transferRepo); err == nil {
+		t.Error("expected error")
+	}
+	if transferRepo.Status != "" {
+		t.Errorf("unexpected status: %q", transferRepo.Status)
+	}
+
+	transferRepo.traceNumber = entry.Addenda99.OriginalTraceField()
+	if err := controller.processReturnEntry(file.Header, b.GetHeader(), entry, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if transferRepo.ReturnCode != entry.Addenda99.ReturnCode || transferRepo.Status != model.TransferReclaimed {
+		t.Errorf("returnCode=%q status=%q", transferRepo.ReturnCode, transferRepo.Status)
+	}
+}
+
+func TestController__processLateReturn(t *testing.T) {
+	file, err := parseACHFilepath(filepath.Join("..", "..", "testdata", "return-WEB.ach"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := file.Batches[0]
+	entry := b.GetEntries()[0] // R01
+
+	setup := func() (*depository.MockRepository, *transfers.MockRepository) {
+		amt, _ := model.NewAmount("USD", "52.12")
+		depRepo := &depository.MockRepository{
+			Depositories: []*model.Depository{{ID: id.Depository(base.ID()), Status: model.DepositoryVerified}},
+		}
+		transferRepo := &transfers.MockRepository{
+			Xfer: &model.Transfer{
+				ID:                   id.Transfer(base.ID()),
+				Amount:               *amt,
+				OriginatorDepository: id.Depository("orig-depository"),
+				ReceiverDepository:   id.Depository("rec-depository"),
+				Status:               model.TransferProcessed,
+				EffectiveEntryDate:   time.Now().Add(-30 * 24 * time.Hour),
+				UserID:               base.ID(),
+				TransactionID:        base.ID(),
+			},
+		}
+		return depRepo, transferRepo
+	}
+
+	// late returns aren't reclaimed
+	controller := &Controller{logger: log.NewNopLogger()}
+	depRepo, transferRepo := setup()
+	if err := controller.processReturnEntry(file.Header, b.GetHeader(), entry, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if transferRepo.Status != model.TransferLateReturn || transferRepo.ReturnCode != "R01" {
+		t.Errorf("status=%q returnCode=%q", transferRepo.Status, transferRepo.ReturnCode)
+	}
+	if len(transferRepo.TransferReturns) != 1 || transferRepo.TransferReturns[0].DishonoredReturnCode != "" {
+		t.Errorf("unexpected returns: %#v", transferRepo.TransferReturns)
+	}
+
+	// they're dishonored when enabled, keeping the original transaction
+	controller = &Controller{
+		logger:              log.NewNopLogger(),
+		accountsClient:      &accounts.MockClient{Err: errors.New("bad error")},
+		dishonorLateReturns: true,
+	}
+	depRepo, transferRepo = setup()
+	if err := controller.processReturnEntry(file.Header, b.GetHeader(), entry, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if transferRepo.Status != model.TransferProcessed {
+		t.Errorf("unexpected status: %q", transferRepo.Status)
+	}
+	if len(transferRepo.TransferReturns) != 1 {
+		t.Fatalf("got %d returns", len(transferRepo.TransferReturns))
+	}
+	if ret := transferRepo.TransferReturns[0]; ret.DishonoredReturnCode != "R68" || ret.DishonoredTransactionID != transferRepo.Xfer.TransactionID {
+		t.Errorf("unexpected return: %#v", ret)
+	}
+
+	// timely returns are reclaimed
+	controller = &Controller{logger: log.NewNopLogger(), dishonorLateReturns: true}
+	depRepo, transferRepo = setup()
+	transferRepo.Xfer.EffectiveEntryDate = time.Now()
+	if err := controller.processReturnEntry(file.Header, b.GetHeader(), entry, depRepo, transferRepo); err != nil {
+		t.Fatal(err)
+	}
+	if transferRepo.Status != model.TransferReclaimed || transferRepo.TransferReturns[0].DishonoredReturnCode != "" {
+		t.Errorf("status=%q returns=%#v", transferRepo.Status, transferRepo.TransferReturns)
+	}
+}
+
+func TestController__transferEffectiveEntryDate(t *testing.T) {
+	effective := time.Date(2020, time.March, 2, 0, 0, 0, 0, time.UTC)
+	if when := transferEffectiveEntryDate(&model.Transfer{EffectiveEntryDate: effective}); !when.Equal(effective) {
+		t.Errorf("got %v", when)
+	}
+	// Transfers created on Friday settle on Monday
+	created := base.NewTime(time.Date(2020, time.February, 28, 14, 0, 0, 0, time.UTC))
+	if when := transferEffectiveEntryDate(&model.Transfer{Created: created}); when.Format("2006-01-02") != "2020-03-02" {
+		t.Errorf("got %v", when)
+	}
+	if isLateTransferReturn(&model.Transfer{}, "R01", time.Now()) {
+		t.Error("transfers without dates aren't late")
+	}
+}
@@ -7,9 +7,11 @@ package filetransfer
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,9 +19,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/moov-io/paygate/internal/util"
+
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
@@ -52,6 +57,9 @@ var (
 		}
 		return 20480
 	}()
+
+	// sftpStrictHostKeyChecking refuses connections to SFTP servers without a configured host public key.
+	sftpStrictHostKeyChecking = util.Yes(os.Getenv("SFTP_STRICT_HOST_KEY_CHECKING"))
 )
 
 type SFTPConfig struct {
@@ -63,6 +71,8 @@ type SFTPConfig struct {
 	Password         string `yaml:"password"`
 	ClientPrivateKey string `yaml:"clientPrivateKey"`
 
+	// HostPublicKey is either a single public key of the server or lines in known_hosts format. known_hosts
+	// lines allow multiple keys per host (for key rotation) and @cert-authority keys which sign host certificates.
 	HostPublicKey string `yaml:"hostPublicKey"`
 }
 
@@ -110,7 +120,7 @@ func newSFTPTransferAgent(logger log.Logger, cfg *Config, sftpConfigs []*SFTPCon
 		return nil, fmt.Errorf("sftp: unable to find config for %s", cfg.RoutingNumber)
 	}
 
-	conn, stdin, stdout, err := sftpConnect(logger, sftpConf)
+	conn, stdin, stdout, err := sftpConnect(logger, cfg, sftpConf)
 	if err != nil {
 		return nil, fmt.Errorf("filetransfer: %v", err)
 	}
@@ -139,24 +149,18 @@ var (
 	}
 )
 
-func sftpConnect(logger log.Logger, sftpConf *SFTPConfig) (*ssh.Client, io.WriteCloser, io.Reader, error) {
+// sftpConnect opens an SSH connection to the server of sftpConf, which must resolve to an address allowed by cfg.
+func sftpConnect(logger log.Logger, cfg *Config, sftpConf *SFTPConfig) (*ssh.Client, io.WriteCloser, io.Reader, error) {
 	conf := &ssh.ClientConfig{
 		User:    sftpConf.Username,
 		Timeout: sftpDialTimeout,
 	}
 	conf.SetDefaults()
 
-	if sftpConf.HostPublicKey != "" {
-		pubKey, err := readPubKey(sftpConf.HostPublicKey)
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf("problem parsing ssh public key: %v", err)
-		}
-		conf.HostKeyCallback = ssh.FixedHostKey(pubKey)
+	if cb, err := sftpHostKeyCallback(logger, sftpConf); err != nil {
+		return nil, nil, nil, err
 	} else {
-		hostKeyCallbackOnce.Do(func() {
-			hostKeyCallback(logger)
-		})
-		conf.HostKeyCallback = ssh.InsecureIgnoreHostKey() // insecure default
+		conf.HostKeyCallback = cb
 	}
 	switch {
 	case sftpConf.Password != "":
@@ -176,7 +180,7 @@ func sftpConnect(logger log.Logger, sftpConf *SFTPConfig) (*ssh.Client, io.Write
 	var err error
 	for i := 0; i < 3; i++ {
 		if client == nil {
-			client, err = ssh.Dial("tcp", sftpConf.Hostname, conf) // retry connection
+			client, err = sshDial(logger, cfg, sftpConf.Hostname, conf) // retry connection
 			time.Sleep(250 * time.Millisecond)
 		}
 	}
@@ -207,6 +211,111 @@ func sftpConnect(logger log.Logger, sftpConf *SFTPConfig) (*ssh.Client, io.Write
 	return client, pw, pr, nil
 }
 
+// sftpHostKeyCallback returns the ssh.HostKeyCallback which verifies the server of sftpConf.
+//
+// Servers without a HostPublicKey aren't verified unless SFTP_STRICT_HOST_KEY_CHECKING is enabled,
+// in which case connecting to them is refused.
+func sftpHostKeyCallback(logger log.Logger, sftpConf *SFTPConfig) (ssh.HostKeyCallback, error) {
+	if sftpConf.HostPublicKey == "" {
+		if sftpStrictHostKeyChecking {
+			return nil, fmt.Errorf("sftpConnect: missing host public key for routingNumber=%s with strict host key checking", sftpConf.RoutingNumber)
+		}
+		hostKeyCallbackOnce.Do(func() {
+			hostKeyCallback(logger)
+		})
+		return ssh.InsecureIgnoreHostKey(), nil // insecure default
+	}
+	if isKnownHosts(sftpConf.HostPublicKey) {
+		cb, err := readKnownHosts(sftpConf.HostPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("problem parsing ssh known_hosts: %v", err)
+		}
+		return cb, nil
+	}
+	pubKey, err := readPubKey(sftpConf.HostPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("problem parsing ssh public key: %v", err)
+	}
+	return ssh.FixedHostKey(pubKey), nil
+}
+
+// isKnownHosts returns true when the first line of raw (optionally base64 encoded) is in the known_hosts
+// format rather than a single public key.
+func isKnownHosts(raw string) bool {
+	if decoded, err := base64.StdEncoding.DecodeString(raw); len(decoded) > 0 && err == nil {
+		raw = string(decoded)
+	}
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		marker, hosts, _, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		return err == nil && (marker != "" || len(hosts) > 0)
+	}
+	return false
+}
+
+// readKnownHosts parses raw (optionally base64 encoded) as lines in the OpenSSH known_hosts format.
+func readKnownHosts(raw string) (ssh.HostKeyCallback, error) {
+	if decoded, err := base64.StdEncoding.DecodeString(raw); len(decoded) > 0 && err == nil {
+		raw = string(decoded)
+	}
+	all, err := knownHostsCallback(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// knownhosts only compares the first key of each type for a host, so check every line on its own
+	// to allow multiple keys of the same type while a server rotates its keys.
+	var lines []ssh.HostKeyCallback
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		cb, err := knownHostsCallback(line)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, cb)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := all(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		if _, revoked := err.(*knownhosts.RevokedError); revoked {
+			return err
+		}
+		for i := range lines {
+			if lines[i](hostname, remote, key) == nil {
+				return nil
+			}
+		}
+		return err
+	}, nil
+}
+
+func knownHostsCallback(raw string) (ssh.HostKeyCallback, error) {
+	// knownhosts only reads files, so copy the lines into a temporary one.
+	fd, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.WriteString(raw)
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return knownhosts.New(fd.Name())
+}
+
 func readPubKey(raw string) (ssh.PublicKey, error) {
 	readAuthd := func(raw string) (ssh.PublicKey, error) {
 		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(raw))
@@ -352,3 +461,90 @@ func (agent *SFTPTransferAgent) readFiles(dir string) ([]File, error) {
 	}
 	return files, nil
 }
+
+// SFTPHostKey is the host key an SFTP server presents, which is displayed for trust on first use.
+type SFTPHostKey struct {
+	Hostname string `json:"hostname"`
+	KeyType  string `json:"keyType"`
+
+	FingerprintSHA256 string `json:"fingerprintSHA256"`
+	FingerprintMD5    string `json:"fingerprintMD5"`
+
+	// PublicKey is in the authorized_keys format and KnownHostsLine can be added to HostPublicKey
+	PublicKey      string `json:"publicKey"`
+	KnownHostsLine string `json:"knownHostsLine"`
+
+	// CertificateAuthority is the SHA256 fingerprint of the key which signed a host certificate
+	CertificateAuthority string `json:"certificateAuthority,omitempty"`
+
+	// Trusted is true when the configured HostPublicKey accepts this key
+	Trusted bool `json:"trusted"`
+}
+
+// sshDial connects to addr like ssh.Dial, but only to addresses allowed by cfg.
+func sshDial(logger log.Logger, cfg *Config, addr string, conf *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := allowedDialer(logger, cfg, &net.Dialer{Timeout: conf.Timeout})("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, conf)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+var errHostKeyCaptured = errors.New("sftp: host key captured")
+
+// fetchSFTPHostKey connects to the server of sftpConf and returns its host key. The connection is closed
+// during the key exchange, so no authentication is attempted.
+func fetchSFTPHostKey(logger log.Logger, cfg *Config, sftpConf *SFTPConfig) (*SFTPHostKey, error) {
+	var hostKey ssh.PublicKey
+	conf := &ssh.ClientConfig{
+		User:    sftpConf.Username,
+		Timeout: sftpDialTimeout,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyCaptured
+		},
+	}
+	conf.SetDefaults()
+
+	client, err := sshDial(logger, cfg, sftpConf.Hostname, conf)
+	if client != nil {
+		client.Close()
+	}
+	if hostKey == nil {
+		return nil, fmt.Errorf("sftp: unable to read host key from %s: %v", sftpConf.Hostname, err)
+	}
+
+	out := &SFTPHostKey{
+		Hostname:          sftpConf.Hostname,
+		KeyType:           hostKey.Type(),
+		FingerprintSHA256: ssh.FingerprintSHA256(hostKey),
+		FingerprintMD5:    ssh.FingerprintLegacyMD5(hostKey),
+		PublicKey:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey))),
+		KnownHostsLine:    knownhosts.Line([]string{knownhosts.Normalize(sftpConf.Hostname)}, hostKey),
+	}
+	if cert, ok := hostKey.(*ssh.Certificate); ok {
+		out.CertificateAuthority = ssh.FingerprintSHA256(cert.SignatureKey)
+	}
+	if sftpConf.HostPublicKey != "" {
+		if cb, err := sftpHostKeyCallback(logger, sftpConf); err == nil {
+			out.Trusted = cb(sftpConf.Hostname, dummyAddr(sftpConf.Hostname), hostKey) == nil
+		}
+	}
+	return out, nil
+}
+
+// dummyAddr returns a net.Addr for hostname, which knownhosts requires but doesn't match keys against
+// unless hostname is an IP address.
+func dummyAddr(hostname string) net.Addr {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, "22"
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
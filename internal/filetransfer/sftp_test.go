@@ -7,10 +7,15 @@
 package filetransfer
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -19,10 +24,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/moov-io/base/admin"
 	"github.com/moov-io/base/docker"
 
 	"github.com/go-kit/kit/log"
 	"github.com/ory/dockertest/v3"
+	"golang.org/x/crypto/ssh"
 )
 
 type sftpDeployment struct {
@@ -359,7 +366,7 @@ wg/HcAJWY60xZTJDFN+Qfx8ZQvBEin6c2/h+zZi5IVY=
 }
 
 func TestSFTP__sftpConnect(t *testing.T) {
-	client, _, _, err := sftpConnect(log.NewNopLogger(), &SFTPConfig{
+	client, _, _, err := sftpConnect(log.NewNopLogger(), nil, &SFTPConfig{
 		Username: "foo",
 	})
 	if client != nil || err == nil {
@@ -367,7 +374,7 @@ func TestSFTP__sftpConnect(t *testing.T) {
 	}
 
 	// bad host public key
-	_, _, _, err = sftpConnect(log.NewNopLogger(), &SFTPConfig{
+	_, _, _, err = sftpConnect(log.NewNopLogger(), nil, &SFTPConfig{
 		HostPublicKey: "bad key material",
 	})
 	if err == nil {
@@ -419,3 +426,255 @@ func TestSFTPConfig__String(t *testing.T) {
 		t.Error(cfg.String())
 	}
 }
+
+func testHostSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testSSHServer accepts SSH connections on localhost and presents hostKey until the returned listener is closed.
+func testSSHServer(t *testing.T, hostKey ssh.Signer) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(hostKey)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				ssh.NewServerConn(conn, conf)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestSFTP__strictHostKeyChecking(t *testing.T) {
+	defer func(strict bool) {
+		sftpStrictHostKeyChecking = strict
+	}(sftpStrictHostKeyChecking)
+
+	sftpStrictHostKeyChecking = false
+	if cb, err := sftpHostKeyCallback(log.NewNopLogger(), &SFTPConfig{}); cb == nil || err != nil {
+		t.Errorf("callback=%v error=%v", cb, err)
+	}
+
+	sftpStrictHostKeyChecking = true
+	if _, err := sftpHostKeyCallback(log.NewNopLogger(), &SFTPConfig{RoutingNumber: "121042882"}); err == nil {
+		t.Error("expected error")
+	}
+	_, _, _, err := sftpConnect(log.NewNopLogger(), nil, &SFTPConfig{Username: "foo", Password: "bar"})
+	if err == nil || !strings.Contains(err.Error(), "strict host key checking") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSFTP__knownHosts(t *testing.T) {
+	current, next, other := testHostSigner(t), testHostSigner(t), testHostSigner(t)
+	hostname := "sftp.example.com:22"
+	addr := dummyAddr(hostname)
+
+	// multiple keys of the same type for rotation
+	lines := fmt.Sprintf("# our bank\nsftp.example.com %s\nsftp.example.com %s\n", authorizedKey(current.PublicKey()), authorizedKey(next.PublicKey()))
+	for _, raw := range []string{lines, base64.StdEncoding.EncodeToString([]byte(lines))} {
+		cb, err := sftpHostKeyCallback(log.NewNopLogger(), &SFTPConfig{HostPublicKey: raw})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cb(hostname, addr, current.PublicKey()); err != nil {
+			t.Errorf("current key: %v", err)
+		}
+		if err := cb(hostname, addr, next.PublicKey()); err != nil {
+			t.Errorf("next key: %v", err)
+		}
+		if err := cb(hostname, addr, other.PublicKey()); err == nil {
+			t.Error("other key: expected error")
+		}
+		if err := cb("other.example.com:22", dummyAddr("other.example.com:22"), current.PublicKey()); err == nil {
+			t.Error("other host: expected error")
+		}
+	}
+
+	// revoked keys are rejected
+	revoked := lines + fmt.Sprintf("@revoked * %s\n", authorizedKey(current.PublicKey()))
+	cb, err := sftpHostKeyCallback(log.NewNopLogger(), &SFTPConfig{HostPublicKey: revoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb(hostname, addr, current.PublicKey()); err == nil {
+		t.Error("revoked key: expected error")
+	}
+	if err := cb(hostname, addr, next.PublicKey()); err != nil {
+		t.Errorf("next key: %v", err)
+	}
+
+	// a single key is still pinned
+	cb, err = sftpHostKeyCallback(log.NewNopLogger(), &SFTPConfig{HostPublicKey: authorizedKey(current.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb(hostname, addr, current.PublicKey()); err != nil {
+		t.Error(err)
+	}
+	if err := cb(hostname, addr, next.PublicKey()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSFTP__knownHostsCertificateAuthority(t *testing.T) {
+	ca, hostKey := testHostSigner(t), testHostSigner(t)
+
+	signCert := func(principal string) *ssh.Certificate {
+		cert := &ssh.Certificate{
+			Key:             hostKey.PublicKey(),
+			CertType:        ssh.HostCert,
+			KeyId:           "sftp",
+			ValidPrincipals: []string{principal},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		if err := cert.SignCert(rand.Reader, ca); err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	raw := fmt.Sprintf("@cert-authority *.example.com %s\n", authorizedKey(ca.PublicKey()))
+	cb, err := sftpHostKeyCallback(log.NewNopLogger(), &SFTPConfig{HostPublicKey: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := "sftp.example.com:22"
+	if err := cb(hostname, dummyAddr(hostname), signCert("sftp.example.com")); err != nil {
+		t.Errorf("signed host certificate: %v", err)
+	}
+	if err := cb(hostname, dummyAddr(hostname), signCert("other.example.org")); err == nil {
+		t.Error("certificate for another host: expected error")
+	}
+	if err := cb(hostname, dummyAddr(hostname), hostKey.PublicKey()); err == nil {
+		t.Error("unsigned host key: expected error")
+	}
+}
+
+func TestSFTP__fetchSFTPHostKey(t *testing.T) {
+	hostKey := testHostSigner(t)
+	ln := testSSHServer(t, hostKey)
+	defer ln.Close()
+
+	sftpConf := &SFTPConfig{Hostname: ln.Addr().String(), Username: "moov"}
+	key, err := fetchSFTPHostKey(log.NewNopLogger(), nil, sftpConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.FingerprintSHA256 != ssh.FingerprintSHA256(hostKey.PublicKey()) || key.KeyType != ssh.KeyAlgoED25519 || key.Trusted {
+		t.Errorf("unexpected host key: %#v", key)
+	}
+
+	// the knownHostsLine is accepted as our HostPublicKey
+	sftpConf.HostPublicKey = key.KnownHostsLine
+	key, err = fetchSFTPHostKey(log.NewNopLogger(), nil, sftpConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Trusted {
+		t.Errorf("expected trusted host key: %#v", key)
+	}
+
+	// nothing listening
+	ln.Close()
+	if _, err := fetchSFTPHostKey(log.NewNopLogger(), nil, sftpConf); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestSFTP__getSFTPHostKeyRoute(t *testing.T) {
+	hostKey := testHostSigner(t)
+	ln := testSSHServer(t, hostKey)
+	defer ln.Close()
+
+	svc := admin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+
+	repo := &mockRepository{
+		sftpConfigs: []*SFTPConfig{
+			{RoutingNumber: "121042882", Hostname: ln.Addr().String(), Username: "moov"},
+		},
+	}
+	AddFileTransferConfigRoutes(log.NewNopLogger(), svc, repo)
+
+	resp, err := http.DefaultClient.Get("http://" + svc.BindAddr() + "/configs/filetransfers/sftp/121042882/fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	var key SFTPHostKey
+	if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	if key.FingerprintSHA256 != ssh.FingerprintSHA256(hostKey.PublicKey()) {
+		t.Errorf("unexpected host key: %#v", key)
+	}
+
+	// unknown routing number
+	resp, err = http.DefaultClient.Get("http://" + svc.BindAddr() + "/configs/filetransfers/sftp/987654320/fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	// invalid host keys are rejected
+	body := strings.NewReader(`{"hostname": "sftp.example.com:22", "username": "moov", "password": "secret", "hostPublicKey": "bad key material"}`)
+	req, _ := http.NewRequest("PUT", "http://"+svc.BindAddr()+"/configs/filetransfers/sftp/121042882", body)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+}
+
+func TestSFTP__allowedIPs(t *testing.T) {
+	hostKey := testHostSigner(t)
+	ln := testSSHServer(t, hostKey)
+	defer ln.Close()
+
+	sftpConf := &SFTPConfig{RoutingNumber: "121042882", Hostname: ln.Addr().String(), Username: "moov"}
+
+	cfg := &Config{RoutingNumber: "121042882", AllowedIPs: "127.0.0.0/8"}
+	if _, err := fetchSFTPHostKey(log.NewNopLogger(), cfg, sftpConf); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.AllowedIPs = "10.0.0.0/8"
+	if _, err := fetchSFTPHostKey(log.NewNopLogger(), cfg, sftpConf); err == nil || !strings.Contains(err.Error(), "refusing connection") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,465 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/transfers"
+
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// uploadRetryBackoff is the initial delay before retrying a failed upload. Each following
+	// failure doubles the delay, up to maxUploadRetryBackoff.
+	uploadRetryBackoff = func() time.Duration {
+		if v := os.Getenv("ACH_FILE_UPLOAD_RETRY_BACKOFF"); v != "" {
+			if dur, _ := time.ParseDuration(v); dur > 0 {
+				return dur
+			}
+		}
+		return 30 * time.Second
+	}()
+	maxUploadRetryBackoff = 30 * time.Minute
+
+	// uploadMaxAttempts is how many failed uploads of a file are allowed before it's no longer retried
+	// and waits to be moved to the dead-letter directory once its cutoff is missed.
+	uploadMaxAttempts = func() int {
+		if n, err := strconv.Atoi(os.Getenv("ACH_FILE_UPLOAD_MAX_ATTEMPTS")); err == nil && n > 0 {
+			return n
+		}
+		return 3
+	}()
+
+	filesDeadLettered = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_files_dead_lettered",
+		Help: "Counter of ACH files moved to the dead-letter directory after missing their cutoff",
+	}, []string{"destination", "origin"})
+)
+
+// uploadAttempt tracks failed uploads of a merged file so they can be retried with backoff.
+type uploadAttempt struct {
+	Filename       string     `json:"filename"`
+	RoutingNumber  string     `json:"routingNumber"`
+	Attempts       int        `json:"attempts"`
+	LastError      string     `json:"lastError"`
+	LastAttemptAt  time.Time  `json:"lastAttemptAt"`
+	NextAttemptAt  time.Time  `json:"nextAttemptAt"`
+	DeadLetteredAt *time.Time `json:"deadLetteredAt,omitempty"`
+}
+
+// due returns true if the file can be uploaded again at when
+func (a *uploadAttempt) due(when time.Time) bool {
+	if a == nil {
+		return true
+	}
+	return a.DeadLetteredAt == nil && a.Attempts < uploadMaxAttempts && !a.NextAttemptAt.After(when)
+}
+
+// nextUploadBackoff returns the exponential delay before retrying a file which has failed attempts times.
+func nextUploadBackoff(attempts int) time.Duration {
+	backoff := uploadRetryBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= maxUploadRetryBackoff {
+			return maxUploadRetryBackoff
+		}
+	}
+	return backoff
+}
+
+type uploadAttemptRepository interface {
+	getUploadAttempt(filename string) (*uploadAttempt, error)
+	getUploadAttempts() ([]*uploadAttempt, error)
+
+	// recordUploadFailure increments the attempts for filename and schedules its next attempt
+	recordUploadFailure(filename string, routingNumber string, uploadErr error) (*uploadAttempt, error)
+	markDeadLettered(filename string) error
+
+	deleteUploadAttempt(filename string) error
+}
+
+type sqlUploadAttemptRepository struct {
+	db *sql.DB
+}
+
+func (r *sqlUploadAttemptRepository) getUploadAttempt(filename string) (*uploadAttempt, error) {
+	query := `select filename, routing_number, attempts, last_error, last_attempt_at, next_attempt_at, dead_lettered_at from ach_file_upload_attempts where filename = ? limit 1;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("getUploadAttempt: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	attempt, err := scanUploadAttempt(stmt.QueryRow(filename))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return attempt, err
+}
+
+func (r *sqlUploadAttemptRepository) getUploadAttempts() ([]*uploadAttempt, error) {
+	query := `select filename, routing_number, attempts, last_error, last_attempt_at, next_attempt_at, dead_lettered_at from ach_file_upload_attempts order by last_attempt_at asc;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("getUploadAttempts: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("getUploadAttempts: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*uploadAttempt
+	for rows.Next() {
+		attempt, err := scanUploadAttempt(rows)
+		if err != nil {
+			return nil, fmt.Errorf("getUploadAttempts: scan: %v", err)
+		}
+		out = append(out, attempt)
+	}
+	return out, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUploadAttempt(row scanner) (*uploadAttempt, error) {
+	var attempt uploadAttempt
+	var lastError *string
+	if err := row.Scan(&attempt.Filename, &attempt.RoutingNumber, &attempt.Attempts, &lastError, &attempt.LastAttemptAt, &attempt.NextAttemptAt, &attempt.DeadLetteredAt); err != nil {
+		return nil, err
+	}
+	if lastError != nil {
+		attempt.LastError = *lastError
+	}
+	return &attempt, nil
+}
+
+func (r *sqlUploadAttemptRepository) recordUploadFailure(filename string, routingNumber string, uploadErr error) (*uploadAttempt, error) {
+	attempt, err := r.getUploadAttempt(filename)
+	if err != nil {
+		return nil, err
+	}
+	if attempt == nil {
+		attempt = &uploadAttempt{
+			Filename:      filename,
+			RoutingNumber: routingNumber,
+		}
+	}
+	attempt.Attempts++
+	attempt.LastAttemptAt = time.Now()
+	attempt.NextAttemptAt = attempt.LastAttemptAt.Add(nextUploadBackoff(attempt.Attempts))
+	if uploadErr != nil {
+		attempt.LastError = uploadErr.Error()
+	}
+
+	query := `replace into ach_file_upload_attempts (filename, routing_number, attempts, last_error, last_attempt_at, next_attempt_at) values (?, ?, ?, ?, ?, ?);`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("recordUploadFailure: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(attempt.Filename, attempt.RoutingNumber, attempt.Attempts, attempt.LastError, attempt.LastAttemptAt, attempt.NextAttemptAt)
+	if err != nil {
+		return nil, fmt.Errorf("recordUploadFailure: filename=%s: %v", filename, err)
+	}
+	return attempt, nil
+}
+
+func (r *sqlUploadAttemptRepository) markDeadLettered(filename string) error {
+	query := `update ach_file_upload_attempts set dead_lettered_at = ? where filename = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("markDeadLettered: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(time.Now(), filename); err != nil {
+		return fmt.Errorf("markDeadLettered: filename=%s: %v", filename, err)
+	}
+	return nil
+}
+
+func (r *sqlUploadAttemptRepository) deleteUploadAttempt(filename string) error {
+	query := `delete from ach_file_upload_attempts where filename = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("deleteUploadAttempt: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(filename); err != nil {
+		return fmt.Errorf("deleteUploadAttempt: filename=%s: %v", filename, err)
+	}
+	return nil
+}
+
+// recordUploadFailure saves a failed upload of file so it's retried with backoff.
+func (c *Controller) recordUploadFailure(file *achFile, uploadErr error) {
+	if c.uploadAttempts == nil {
+		return
+	}
+	filename := filepath.Base(file.filepath)
+	attempt, err := c.uploadAttempts.recordUploadFailure(filename, file.Header.ImmediateDestination, uploadErr)
+	if err != nil {
+		c.logger.Log("upload-retries", fmt.Sprintf("problem recording failed upload of %s", filename), "error", err)
+		return
+	}
+	c.logger.Log("upload-retries", fmt.Sprintf("upload %d of %s failed, next attempt at %v", attempt.Attempts, filename, attempt.NextAttemptAt.Format(time.RFC3339)), "error", uploadErr)
+}
+
+// clearUploadAttempts removes retry state for file after a successful upload.
+func (c *Controller) clearUploadAttempts(file *achFile) {
+	if c.uploadAttempts == nil {
+		return
+	}
+	if err := c.uploadAttempts.deleteUploadAttempt(filepath.Base(file.filepath)); err != nil {
+		c.logger.Log("upload-retries", fmt.Sprintf("problem clearing upload attempts of %s", file.filepath), "error", err)
+	}
+}
+
+// filterDueUploads drops files which have failed to upload and are still waiting out their backoff.
+func (c *Controller) filterDueUploads(files []*achFile) []*achFile {
+	if c.uploadAttempts == nil {
+		return files
+	}
+	now := time.Now()
+	var out []*achFile
+	for i := range files {
+		attempt, err := c.uploadAttempts.getUploadAttempt(filepath.Base(files[i].filepath))
+		if err != nil {
+			c.logger.Log("upload-retries", fmt.Sprintf("problem reading upload attempts of %s", files[i].filepath), "error", err)
+		}
+		if attempt.due(now) {
+			out = append(out, files[i])
+		}
+	}
+	return out
+}
+
+// findCutoffTime returns the CutoffTime which applies to an outbound file.
+func findCutoffTime(cutoffTimes []*CutoffTime, file *achFile) *CutoffTime {
+	for _, routingNumber := range []string{file.Header.ImmediateDestination, file.Header.ImmediateOrigin} {
+		for i := range cutoffTimes {
+			if cutoffTimes[i].RoutingNumber == routingNumber {
+				return cutoffTimes[i]
+			}
+		}
+	}
+	return nil
+}
+
+// retryFailedUploads will attempt another upload of files whose backoff has passed and are still before
+// their cutoff time. Files which failed to upload and have missed their cutoff are moved to the dead-letter
+// directory.
+func (c *Controller) retryFailedUploads() error {
+	if c.uploadAttempts == nil {
+		return nil
+	}
+
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	cutoffTimes, err := c.repo.GetCutoffTimes()
+	if err != nil {
+		return fmt.Errorf("cutoff times: %v", err)
+	}
+	files, err := grabAllFiles(filepath.Join(c.rootDir, "merged"), c.keeper)
+	if err != nil {
+		return fmt.Errorf("retryFailedUploads: %v", err)
+	}
+	files = c.newMergeLeases(nil, nil, nil).filter(files)
+
+	now := time.Now()
+	var toUpload []*achFile
+	for i := range files {
+		attempt, err := c.uploadAttempts.getUploadAttempt(filepath.Base(files[i].filepath))
+		if err != nil || attempt == nil || !attempt.due(now) {
+			continue // only retry files which have failed before
+		}
+		if cutoff := findCutoffTime(cutoffTimes, files[i]); cutoff != nil && cutoff.Diff(now) > 0 {
+			toUpload = append(toUpload, files[i])
+		}
+	}
+	if len(toUpload) > 0 {
+		c.logger.Log("upload-retries", fmt.Sprintf("retrying upload of %d files", len(toUpload)))
+	}
+	uploadErr := c.startUpload(toUpload)
+
+	if err := c.deadLetterMissedUploads(cutoffTimes, files); err != nil {
+		return err
+	}
+	return uploadErr
+}
+
+// deadLetterMissedUploads moves files which failed to upload and have since missed their cutoff into the
+// dead-letter directory. Those files would otherwise be retried (and miss their cutoff) every day.
+func (c *Controller) deadLetterMissedUploads(cutoffTimes []*CutoffTime, files []*achFile) error {
+	if c.uploadAttempts == nil {
+		return nil
+	}
+	deadLetterDir := filepath.Join(c.rootDir, "deadletter")
+	now := time.Now()
+	for i := range files {
+		if _, err := os.Stat(files[i].filepath); err != nil {
+			continue // uploaded or moved
+		}
+		filename := filepath.Base(files[i].filepath)
+		attempt, err := c.uploadAttempts.getUploadAttempt(filename)
+		if err != nil || attempt == nil || attempt.DeadLetteredAt != nil {
+			continue
+		}
+		// The file missed its cutoff if we last tried before the cutoff and it has since passed.
+		cutoff := findCutoffTime(cutoffTimes, files[i])
+		if cutoff == nil || cutoff.Diff(attempt.LastAttemptAt) <= 0 || cutoff.Diff(now) > 0 {
+			continue
+		}
+		if err := os.MkdirAll(deadLetterDir, 0777); err != nil {
+			return fmt.Errorf("deadLetterMissedUploads: %v", err)
+		}
+		if err := os.Rename(files[i].filepath, filepath.Join(deadLetterDir, filename)); err != nil {
+			return fmt.Errorf("deadLetterMissedUploads: moving %s: %v", filename, err)
+		}
+		if err := c.uploadAttempts.markDeadLettered(filename); err != nil {
+			return fmt.Errorf("deadLetterMissedUploads: %v", err)
+		}
+		c.logger.Log("upload-retries", fmt.Sprintf("moved %s to dead-letter directory after %d failed uploads: %s", filename, attempt.Attempts, attempt.LastError))
+		filesDeadLettered.With("destination", files[i].Header.ImmediateDestination, "origin", files[i].Header.ImmediateOrigin).Add(1)
+	}
+	return nil
+}
+
+// deadLetterFile describes a file in the dead-letter directory
+type deadLetterFile struct {
+	Filename string         `json:"filename"`
+	Attempt  *uploadAttempt `json:"attempt,omitempty"`
+}
+
+// getDeadLetterFiles returns every file in the dead-letter directory along with its failed upload attempts.
+func (c *Controller) getDeadLetterFiles() ([]*deadLetterFile, error) {
+	matches, err := filepath.Glob(filepath.Join(c.rootDir, "deadletter", "*.ach"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	out := make([]*deadLetterFile, 0, len(matches))
+	for i := range matches {
+		file := &deadLetterFile{Filename: filepath.Base(matches[i])}
+		if c.uploadAttempts != nil {
+			file.Attempt, _ = c.uploadAttempts.getUploadAttempt(file.Filename)
+		}
+		out = append(out, file)
+	}
+	return out, nil
+}
+
+var (
+	errDeadLetterFileNotFound = errors.New("dead-letter file not found")
+	errMergedFileExists       = errors.New("a merged file with the same name is pending upload")
+)
+
+// requeueDeadLetterFile moves a file from the dead-letter directory back into the merged directory
+// where it's uploaded during the next cutoff window.
+//
+// The file keeps its name since Transfers and micro-deposits record the file they were merged into, so
+// requeueing fails rather than replacing a merged file with the same name. Its creation and effective
+// entry dates are moved forward (see refreshFileDates) as the original dates have passed.
+func (c *Controller) requeueDeadLetterFile(filename string, transferRepo transfers.Repository) error {
+	if filename == "" || filename != filepath.Base(filename) {
+		return fmt.Errorf("invalid filename %q", filename)
+	}
+	c.mergedFilesMu.Lock()
+	defer c.mergedFilesMu.Unlock()
+
+	src := filepath.Join(c.rootDir, "deadletter", filename)
+	if _, err := os.Stat(src); err != nil {
+		return errDeadLetterFileNotFound
+	}
+	mergedDir := filepath.Join(c.rootDir, "merged")
+	if err := os.MkdirAll(mergedDir, 0777); err != nil {
+		return err
+	}
+	dst := filepath.Join(mergedDir, filename)
+	if _, err := os.Stat(dst); err == nil {
+		return errMergedFileExists
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("requeueDeadLetterFile: %v", err)
+	}
+
+	file, err := parseACHFilepath(src, c.keeper)
+	if err != nil {
+		return fmt.Errorf("requeueDeadLetterFile: %v", err)
+	}
+	effectiveEntryDates := refreshFileDates(file, time.Now())
+	if transferRepo != nil {
+		for traceNumber, effectiveEntryDate := range effectiveEntryDates {
+			if err := transferRepo.UpdateEffectiveEntryDate(filename, traceNumber, effectiveEntryDate); err != nil {
+				return fmt.Errorf("requeueDeadLetterFile: %v", err)
+			}
+		}
+	}
+	requeued := &achFile{
+		File:     file,
+		filepath: dst,
+		keeper:   c.keeper,
+	}
+	if err := requeued.write(); err != nil {
+		return fmt.Errorf("requeueDeadLetterFile: %v", err)
+	}
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("requeueDeadLetterFile: %v", err)
+	}
+	if c.uploadAttempts != nil {
+		return c.uploadAttempts.deleteUploadAttempt(filename)
+	}
+	return nil
+}
+
+// refreshFileDates moves a file's creation date to now along with the EffectiveEntryDate of each batch. Same-day
+// batches settle today and every other batch settles on the next banking day. The new EffectiveEntryDate of each
+// forward entry is returned by its trace number.
+func refreshFileDates(file *ach.File, now time.Time) map[string]time.Time {
+	creationDate := file.Header.FileCreationDate
+	file.Header.FileCreationDate = now.Format("060102") // YYMMDD
+	file.Header.FileCreationTime = now.Format("1504")   // HHMM
+
+	nextBankingDay := base.NewTime(now).AddBankingDay(1).Format("060102")
+
+	effectiveEntryDates := make(map[string]time.Time)
+	for i := range file.Batches {
+		bh := file.Batches[i].GetHeader()
+		if bh.EffectiveEntryDate == creationDate {
+			bh.EffectiveEntryDate = file.Header.FileCreationDate
+		} else {
+			bh.EffectiveEntryDate = nextBankingDay
+		}
+		if file.Batches[i].Category() != ach.CategoryForward {
+			continue
+		}
+		effectiveEntryDate, _ := bh.LiftEffectiveEntryDate()
+		entries := file.Batches[i].GetEntries()
+		for j := range entries {
+			effectiveEntryDates[entries[j].TraceNumberField()] = effectiveEntryDate
+		}
+	}
+	return effectiveEntryDates
+}
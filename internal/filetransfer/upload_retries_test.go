@@ -0,0 +1,288 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package filetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/base/admin"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/transfers"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestUploadRetries__nextUploadBackoff(t *testing.T) {
+	if d := nextUploadBackoff(1); d != uploadRetryBackoff {
+		t.Errorf("got %v", d)
+	}
+	if d := nextUploadBackoff(3); d != 4*uploadRetryBackoff {
+		t.Errorf("got %v", d)
+	}
+	if d := nextUploadBackoff(100); d != maxUploadRetryBackoff {
+		t.Errorf("got %v", d)
+	}
+}
+
+func TestUploadRetries__repository(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	repo := &sqlUploadAttemptRepository{db: db.DB}
+
+	attempt, err := repo.getUploadAttempt("20200101-987654320-1.ach")
+	if attempt != nil || err != nil {
+		t.Fatalf("attempt=%#v error=%v", attempt, err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		attempt, err = repo.recordUploadFailure("20200101-987654320-1.ach", "987654320", errors.New("bad upload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempt.Attempts != i || attempt.LastError != "bad upload" {
+			t.Errorf("attempt=%#v", attempt)
+		}
+	}
+	if attempt.due(time.Now()) {
+		t.Error("expected backoff")
+	}
+
+	attempt, err = repo.getUploadAttempt("20200101-987654320-1.ach")
+	if err != nil || attempt == nil {
+		t.Fatalf("attempt=%#v error=%v", attempt, err)
+	}
+	if attempt.Attempts != 2 || attempt.RoutingNumber != "987654320" || attempt.DeadLetteredAt != nil {
+		t.Errorf("attempt=%#v", attempt)
+	}
+
+	if err := repo.markDeadLettered("20200101-987654320-1.ach"); err != nil {
+		t.Fatal(err)
+	}
+	attempts, err := repo.getUploadAttempts()
+	if err != nil || len(attempts) != 1 {
+		t.Fatalf("attempts=%#v error=%v", attempts, err)
+	}
+	if attempts[0].DeadLetteredAt == nil || attempts[0].due(time.Now().Add(time.Hour)) {
+		t.Errorf("attempt=%#v", attempts[0])
+	}
+
+	if err := repo.deleteUploadAttempt("20200101-987654320-1.ach"); err != nil {
+		t.Fatal(err)
+	}
+	if attempt, err := repo.getUploadAttempt("20200101-987654320-1.ach"); attempt != nil || err != nil {
+		t.Fatalf("attempt=%#v error=%v", attempt, err)
+	}
+}
+
+func setupDeadLetterController(t *testing.T) (*Controller, *database.TestSQLiteDB) {
+	t.Helper()
+
+	dir, _ := ioutil.TempDir("", "upload-retries")
+
+	db := database.CreateTestSqliteDB(t)
+	controller := &Controller{
+		rootDir:        dir,
+		logger:         log.NewNopLogger(),
+		uploadAttempts: &sqlUploadAttemptRepository{db: db.DB},
+		repo: &mockRepository{
+			cutoffTimes: []*CutoffTime{
+				{RoutingNumber: "987654320", Cutoff: 0, Loc: time.UTC}, // midnight, so always passed
+			},
+		},
+	}
+
+	// copy a file into our merged directory
+	bs, err := ioutil.ReadFile(filepath.Join("..", "..", "testdata", "ppd-debit.ach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "merged"), 0777)
+	if err := ioutil.WriteFile(filepath.Join(dir, "merged", "20200101-987654320-1.ach"), bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return controller, db
+}
+
+func TestUploadRetries__deadLetter(t *testing.T) {
+	controller, db := setupDeadLetterController(t)
+	defer os.RemoveAll(controller.rootDir)
+	defer db.Close()
+
+	files, err := grabAllFiles(filepath.Join(controller.rootDir, "merged"), nil)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files=%#v error=%v", files, err)
+	}
+	files[0].Header.ImmediateDestination = "987654320"
+
+	// failed uploads leave the file in place
+	for i := 0; i < uploadMaxAttempts; i++ {
+		if err := controller.startUpload(files); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if files := controller.filterDueUploads(files); len(files) != 0 {
+		t.Errorf("expected file to be in backoff: %#v", files)
+	}
+	cutoffTimes, _ := controller.repo.GetCutoffTimes()
+	if err := controller.deadLetterMissedUploads(cutoffTimes, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[0].filepath); err != nil {
+		t.Fatalf("attempts were after the cutoff, file should remain: %v", err)
+	}
+
+	// last attempt before the cutoff
+	if _, err := db.DB.Exec(`update ach_file_upload_attempts set last_attempt_at = ?`, time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.deadLetterMissedUploads(cutoffTimes, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[0].filepath); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be moved: %v", err)
+	}
+
+	deadLetters, err := controller.getDeadLetterFiles()
+	if err != nil || len(deadLetters) != 1 {
+		t.Fatalf("files=%#v error=%v", deadLetters, err)
+	}
+	if deadLetters[0].Filename != "20200101-987654320-1.ach" || deadLetters[0].Attempt == nil || deadLetters[0].Attempt.Attempts != uploadMaxAttempts {
+		t.Errorf("file=%#v", deadLetters[0])
+	}
+
+	// re-queue the file
+	if err := controller.requeueDeadLetterFile("../merged", nil); err == nil {
+		t.Error("expected error")
+	}
+	if err := controller.requeueDeadLetterFile("missing.ach", nil); err != errDeadLetterFileNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// a merged file with the same name isn't replaced
+	if err := ioutil.WriteFile(files[0].filepath, []byte("pending"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.requeueDeadLetterFile("20200101-987654320-1.ach", nil); err != errMergedFileExists {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if bs, _ := ioutil.ReadFile(files[0].filepath); string(bs) != "pending" {
+		t.Errorf("merged file was replaced: %q", string(bs))
+	}
+	if _, err := os.Stat(filepath.Join(controller.rootDir, "deadletter", "20200101-987654320-1.ach")); err != nil {
+		t.Fatalf("dead-letter file should remain: %v", err)
+	}
+	os.Remove(files[0].filepath)
+
+	if err := controller.requeueDeadLetterFile("20200101-987654320-1.ach", &transfers.MockRepository{}); err != nil {
+		t.Fatal(err)
+	}
+	// the requeued file is created today and settles on the next banking day
+	file, err := parseACHFilepath(files[0].filepath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := time.Now().Format("060102"); file.Header.FileCreationDate != v {
+		t.Errorf("FileCreationDate=%s expected %s", file.Header.FileCreationDate, v)
+	}
+	if v := base.Now().AddBankingDay(1).Format("060102"); file.Batches[0].GetHeader().EffectiveEntryDate != v {
+		t.Errorf("EffectiveEntryDate=%s expected %s", file.Batches[0].GetHeader().EffectiveEntryDate, v)
+	}
+	if attempt, err := controller.uploadAttempts.getUploadAttempt("20200101-987654320-1.ach"); attempt != nil || err != nil {
+		t.Errorf("attempt=%#v error=%v", attempt, err)
+	}
+}
+
+func TestUploadRetries__deadLetterAfterOneAttempt(t *testing.T) {
+	controller, db := setupDeadLetterController(t)
+	defer os.RemoveAll(controller.rootDir)
+	defer db.Close()
+
+	files, err := grabAllFiles(filepath.Join(controller.rootDir, "merged"), nil)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("files=%#v error=%v", files, err)
+	}
+	files[0].Header.ImmediateDestination = "987654320"
+
+	// a single failed upload before the cutoff is enough to dead-letter the file once its cutoff passes
+	if err := controller.startUpload(files); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := db.DB.Exec(`update ach_file_upload_attempts set last_attempt_at = ?`, time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	cutoffTimes, _ := controller.repo.GetCutoffTimes()
+	if err := controller.deadLetterMissedUploads(cutoffTimes, files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(files[0].filepath); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be moved: %v", err)
+	}
+	if attempt, err := controller.uploadAttempts.getUploadAttempt("20200101-987654320-1.ach"); err != nil || attempt.Attempts != 1 || attempt.DeadLetteredAt == nil {
+		t.Errorf("attempt=%#v error=%v", attempt, err)
+	}
+}
+
+func TestUploadRetries__adminRoutes(t *testing.T) {
+	controller, db := setupDeadLetterController(t)
+	defer os.RemoveAll(controller.rootDir)
+	defer db.Close()
+
+	os.MkdirAll(filepath.Join(controller.rootDir, "deadletter"), 0777)
+	err := os.Rename(filepath.Join(controller.rootDir, "merged", "20200101-987654320-1.ach"), filepath.Join(controller.rootDir, "deadletter", "20200101-987654320-1.ach"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := admin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+	AddDeadLetterRoutes(log.NewNopLogger(), svc, controller, &transfers.MockRepository{})
+
+	resp, err := http.Get("http://" + svc.BindAddr() + "/files/deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	var files []*deadLetterFile
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Filename != "20200101-987654320-1.ach" {
+		t.Errorf("files=%#v", files)
+	}
+
+	// missing file
+	resp, err = http.Post("http://"+svc.BindAddr()+"/files/deadletter/missing.ach/requeue", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post("http://"+svc.BindAddr()+"/files/deadletter/20200101-987654320-1.ach/requeue", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("bogus HTTP status: %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(controller.rootDir, "merged", "20200101-987654320-1.ach")); err != nil {
+		t.Fatal(err)
+	}
+}
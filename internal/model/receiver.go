@@ -47,6 +47,10 @@ type Receiver struct {
 	// Metadata provides additional data to be used for display and search only
 	Metadata string `json:"metadata"`
 
+	// IdentificationNumber is the Receiver's Individual Identification Number written on each EntryDetail,
+	// which is set from Notification of Change (C09) corrections.
+	IdentificationNumber string `json:"identificationNumber,omitempty"`
+
 	// Created a timestamp representing the initial creation date of the object in ISO 8601
 	Created base.Time `json:"created"`
 
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/moov-io/ach"
 	"github.com/moov-io/base"
@@ -70,6 +71,9 @@ type Transfer struct {
 	// Hidden fields (populated in LookupTransferFromReturn) which aren't marshaled
 	TransactionID string `json:"-"`
 	UserID        string `json:"-"`
+
+	// EffectiveEntryDate is when the Transfer's entry settles, which is recorded once it's merged into a file
+	EffectiveEntryDate time.Time `json:"-"`
 }
 
 func (t *Transfer) Validate() error {
@@ -124,6 +128,11 @@ const (
 	TransferPending   TransferStatus = "pending"
 	TransferProcessed TransferStatus = "processed"
 	TransferReclaimed TransferStatus = "reclaimed"
+
+	// TransferLateReturn is a Transfer whose return was received after its NACHA deadline. The return can be
+	// dishonored (marking the Transfer processed) or accepted (marking it reclaimed), but until then the Transfer
+	// isn't considered reclaimed.
+	TransferLateReturn TransferStatus = "late_return"
 )
 
 func (ts TransferStatus) Equal(other TransferStatus) bool {
@@ -132,7 +141,7 @@ func (ts TransferStatus) Equal(other TransferStatus) bool {
 
 func (ts TransferStatus) Validate() error {
 	switch ts {
-	case TransferCanceled, TransferFailed, TransferPending, TransferProcessed, TransferReclaimed:
+	case TransferCanceled, TransferFailed, TransferPending, TransferProcessed, TransferReclaimed, TransferLateReturn:
 		return nil
 	default:
 		return fmt.Errorf("TransferStatus(%s) is invalid", ts)
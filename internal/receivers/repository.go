@@ -75,7 +75,7 @@ func (r *SQLReceiverRepo) getUserReceivers(userID id.User) ([]*model.Receiver, e
 }
 
 func (r *SQLReceiverRepo) GetUserReceiver(id model.ReceiverID, userID id.User) (*model.Receiver, error) {
-	query := `select receiver_id, email, default_depository, customer_id, status, metadata, created_at, last_updated_at
+	query := `select receiver_id, email, default_depository, customer_id, status, metadata, identification_number, created_at, last_updated_at
 from receivers
 where receiver_id = ?
 and user_id = ?
@@ -90,7 +90,8 @@ limit 1`
 	row := stmt.QueryRow(id, userID)
 
 	var receiver model.Receiver
-	err = row.Scan(&receiver.ID, &receiver.Email, &receiver.DefaultDepository, &receiver.CustomerID, &receiver.Status, &receiver.Metadata, &receiver.Created.Time, &receiver.Updated.Time)
+	var identificationNumber *string
+	err = row.Scan(&receiver.ID, &receiver.Email, &receiver.DefaultDepository, &receiver.CustomerID, &receiver.Status, &receiver.Metadata, &identificationNumber, &receiver.Created.Time, &receiver.Updated.Time)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -100,6 +101,9 @@ limit 1`
 	if receiver.ID == "" || receiver.Email == "" {
 		return nil, nil // no records found
 	}
+	if identificationNumber != nil {
+		receiver.IdentificationNumber = *identificationNumber
+	}
 	return &receiver, nil
 }
 
@@ -125,14 +129,14 @@ func (r *SQLReceiverRepo) UpsertUserReceiver(userID id.User, receiver *model.Rec
 
 	receiver.Updated = base.NewTime(time.Now().Truncate(1 * time.Second))
 
-	query := `insert into receivers (receiver_id, user_id, email, default_depository, customer_id, status, metadata, created_at, last_updated_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	query := `insert into receivers (receiver_id, user_id, email, default_depository, customer_id, status, metadata, identification_number, created_at, last_updated_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
 		return fmt.Errorf("UpsertUserReceiver: prepare err=%v: rollback=%v", err, tx.Rollback())
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(receiver.ID, userID, receiver.Email, receiver.DefaultDepository, receiver.CustomerID, receiver.Status, receiver.Metadata, receiver.Created.Time, receiver.Updated.Time)
+	res, err := stmt.Exec(receiver.ID, userID, receiver.Email, receiver.DefaultDepository, receiver.CustomerID, receiver.Status, receiver.Metadata, receiver.IdentificationNumber, receiver.Created.Time, receiver.Updated.Time)
 	stmt.Close()
 	if err != nil && !database.UniqueViolation(err) {
 		return fmt.Errorf("problem upserting receiver=%q, userID=%q error=%v rollback=%v", receiver.ID, userID, err, tx.Rollback())
@@ -145,7 +149,7 @@ func (r *SQLReceiverRepo) UpsertUserReceiver(userID id.User, receiver *model.Rec
 		}
 	}
 	query = `update receivers
-set email = ?, default_depository = ?, customer_id = ?, status = ?, metadata = ?, last_updated_at = ?
+set email = ?, default_depository = ?, customer_id = ?, status = ?, metadata = ?, identification_number = ?, last_updated_at = ?
 where receiver_id = ? and user_id = ? and deleted_at is null`
 	stmt, err = tx.Prepare(query)
 	if err != nil {
@@ -153,7 +157,7 @@ where receiver_id = ? and user_id = ? and deleted_at is null`
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(receiver.Email, receiver.DefaultDepository, receiver.CustomerID, receiver.Status, receiver.Metadata, receiver.Updated.Time, receiver.ID, userID)
+	_, err = stmt.Exec(receiver.Email, receiver.DefaultDepository, receiver.CustomerID, receiver.Status, receiver.Metadata, receiver.IdentificationNumber, receiver.Updated.Time, receiver.ID, userID)
 	stmt.Close()
 	if err != nil {
 		return fmt.Errorf("UpsertUserReceiver: exec error=%v rollback=%v", err, tx.Rollback())
@@ -143,6 +143,15 @@ func createIdentificationNumber() string {
 	return base.ID()[:15]
 }
 
+// receiverIdentificationNumber returns the Receiver's Individual Identification Number, which is set
+// from NOCs (C09), or a random one when the Receiver has none.
+func receiverIdentificationNumber(receiver *model.Receiver) string {
+	if receiver != nil && receiver.IdentificationNumber != "" {
+		return receiver.IdentificationNumber
+	}
+	return createIdentificationNumber()
+}
+
 func createTraceNumber(odfiRoutingNumber string) string {
 	v := fmt.Sprintf("%s%d", aba8(odfiRoutingNumber), traceNumberSource.Int63())
 	if utf8.RuneCountInString(v) > 15 {
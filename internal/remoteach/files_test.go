@@ -36,6 +36,15 @@ func TestTransfers__createTraceNumber(t *testing.T) {
 	}
 }
 
+func TestTransfers__receiverIdentificationNumber(t *testing.T) {
+	if v := receiverIdentificationNumber(&model.Receiver{IdentificationNumber: "987654321"}); v != "987654321" {
+		t.Errorf("got %s", v)
+	}
+	if v := receiverIdentificationNumber(&model.Receiver{}); len(v) != 15 {
+		t.Errorf("got %s", v)
+	}
+}
+
 func TestTransfers__ConstructFile(t *testing.T) {
 	// The fields on each struct are minimized to help throttle this file's size
 	receiverDep := &model.Depository{
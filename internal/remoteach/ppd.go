@@ -32,7 +32,7 @@ func createPPDBatch(id string, transfer *model.Transfer, receiver *model.Receive
 	entryDetail.RDFIIdentification = aba8(receiverDep.RoutingNumber)
 	entryDetail.CheckDigit = abaCheckDigit(receiverDep.RoutingNumber)
 	entryDetail.Amount = transfer.Amount.Int()
-	entryDetail.IdentificationNumber = createIdentificationNumber()
+	entryDetail.IdentificationNumber = receiverIdentificationNumber(receiver)
 	entryDetail.IndividualName = receiver.Metadata
 	entryDetail.DiscretionaryData = transfer.Description
 	entryDetail.TraceNumber = createTraceNumber(origDep.RoutingNumber)
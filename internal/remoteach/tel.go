@@ -42,7 +42,7 @@ func createTELBatch(id string, transfer *model.Transfer, receiver *model.Receive
 		r := strings.NewReplacer("-", "", ".", "", " ", "")
 		entryDetail.IdentificationNumber = r.Replace(transfer.Description) // phone number (which TEL requires)
 	} else {
-		entryDetail.IdentificationNumber = createIdentificationNumber()
+		entryDetail.IdentificationNumber = receiverIdentificationNumber(receiver)
 	}
 	entryDetail.IndividualName = receiver.Metadata
 	entryDetail.TraceNumber = createTraceNumber(origDep.RoutingNumber)
@@ -25,6 +25,10 @@ type Cursor struct {
 	// The value starts at today's first instant and progresses towards time.Now() with each
 	// batch by being set to the batch's newest time.
 	newerThan time.Time
+
+	// requeuedAfter is the newest requeued_at value read. Transfers requeued after it move newerThan back
+	// so they're returned again.
+	requeuedAfter time.Time
 }
 
 // GroupableTransfer holds metadata of a Transfer used in grouping for generating and merging ACH files
@@ -45,6 +49,10 @@ type GroupableTransfer struct {
 // TODO(adam): should we have a field on transfers for marking when the ACH file is uploaded?
 // "after the file is uploaded we mark the items in the DB with the batch number and upload time and update the status" -- Wade
 func (cur *Cursor) Next() ([]*GroupableTransfer, error) {
+	if err := cur.rewindToRequeued(); err != nil {
+		return nil, err
+	}
+
 	query := `select transfer_id, user_id, created_at from transfers where status = ? and merged_filename is null and created_at > ? and deleted_at is null order by created_at asc limit ?`
 	stmt, err := cur.TransferRepo.db.Prepare(query)
 	if err != nil {
@@ -98,6 +106,44 @@ func (cur *Cursor) Next() ([]*GroupableTransfer, error) {
 	return transfers, rows.Err()
 }
 
+// rewindToRequeued moves the Cursor back to the oldest Transfer requeued since our last read. Transfers are requeued
+// when any paygate instance abandons a merged file, which can happen after our Cursor has passed them.
+func (cur *Cursor) rewindToRequeued() error {
+	query := `select created_at, requeued_at from transfers where requeued_at > ? and status = ? and merged_filename is null and deleted_at is null`
+	stmt, err := cur.TransferRepo.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("Cursor.Next: prepare requeued: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(cur.requeuedAfter, model.TransferPending)
+	if err != nil {
+		return fmt.Errorf("Cursor.Next: query requeued: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var createdAt, requeuedAt time.Time
+		if err := rows.Scan(&createdAt, &requeuedAt); err != nil {
+			return fmt.Errorf("Cursor.Next: scan requeued: %v", err)
+		}
+		if !createdAt.After(cur.newerThan) {
+			cur.newerThan = createdAt.Add(-1 * time.Second)
+		}
+		if requeuedAt.After(cur.requeuedAfter) {
+			cur.requeuedAfter = requeuedAt
+		}
+	}
+	return rows.Err()
+}
+
+// Rewind moves the Cursor back to the start of the current day so Transfers skipped over
+// (i.e. while another paygate instance held their merge lease) are returned again by Next.
+func (cur *Cursor) Rewind() {
+	now := time.Now()
+	cur.newerThan = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
 // GetCursor returns a Cursor for iterating through Transfers in ascending order (by CreatedAt)
 // beginning at the start of the current day.
 func (r *SQLRepo) GetCursor(batchSize int, depRepo depository.Repository) *Cursor {
@@ -112,15 +158,295 @@ func (r *SQLRepo) GetCursor(batchSize int, depRepo depository.Repository) *Curso
 
 // MarkTransferAsMerged will set the merged_filename on Pending transfers so they aren't merged into multiple files
 // and the file uploaded to the FED can be tracked.
-func (r *SQLRepo) MarkTransferAsMerged(id id.Transfer, filename string, traceNumber string) error {
-	query := `update transfers set merged_filename = ?, trace_number = ?, status = ?
+//
+// traceNumbers are the trace numbers assigned to each of the Transfer's entries in the merged file, which returns
+// are matched against, and effectiveEntryDate is when those entries settle.
+func (r *SQLRepo) MarkTransferAsMerged(id id.Transfer, filename string, effectiveEntryDate time.Time, traceNumbers []string) error {
+	traceNumber := ""
+	if len(traceNumbers) > 0 {
+		traceNumber = traceNumbers[0]
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("MarkTransferAsMerged: transfer=%s filename=%s: %v", id, filename, err)
+	}
+
+	query := `update transfers set merged_filename = ?, trace_number = ?, effective_entry_date = ?, status = ?
 where status = ? and transfer_id = ? and (merged_filename is null or merged_filename = '') and deleted_at is null`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("MarkTransferAsMerged: transfer=%s filename=%s: %v rollback=%v", id, filename, err, tx.Rollback())
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(filename, traceNumber, effectiveEntryDate, model.TransferProcessed, model.TransferPending, id)
+	if err != nil {
+		return fmt.Errorf("MarkTransferAsMerged: transfer=%s filename=%s: %v rollback=%v", id, filename, err, tx.Rollback())
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// The transfer was already merged (or isn't pending) so don't record trace numbers for it again.
+		return fmt.Errorf("MarkTransferAsMerged: transfer=%s is not pending or already merged rollback=%v", id, tx.Rollback())
+	}
+
+	query = `insert into transfer_trace_numbers (trace_number, transfer_id, merged_filename, created_at) values (?, ?, ?, ?)`
+	traceStmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("MarkTransferAsMerged: transfer=%s trace numbers: %v rollback=%v", id, err, tx.Rollback())
+	}
+	defer traceStmt.Close()
+
+	now := time.Now()
+	for i := range traceNumbers {
+		if _, err := traceStmt.Exec(traceNumbers[i], id, filename, now); err != nil {
+			return fmt.Errorf("MarkTransferAsMerged: transfer=%s traceNumber=%s: %v rollback=%v", id, traceNumbers[i], err, tx.Rollback())
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateEffectiveEntryDate records a new effectiveEntryDate for the Transfer whose entry was merged into filename
+// with traceNumber. This is used when a merged file is requeued after missing its cutoff.
+func (r *SQLRepo) UpdateEffectiveEntryDate(filename string, traceNumber string, effectiveEntryDate time.Time) error {
+	query := `update transfers set effective_entry_date = ?
+where transfer_id in (select transfer_id from transfer_trace_numbers where trace_number = ? and merged_filename = ?) and deleted_at is null`
 	stmt, err := r.db.Prepare(query)
 	if err != nil {
-		return fmt.Errorf("MarkTransferAsMerged: transfer=%s filename=%s: %v", id, filename, err)
+		return fmt.Errorf("UpdateEffectiveEntryDate: filename=%s traceNumber=%s: %v", filename, traceNumber, err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(effectiveEntryDate, traceNumber, filename); err != nil {
+		return fmt.Errorf("UpdateEffectiveEntryDate: filename=%s traceNumber=%s: %v", filename, traceNumber, err)
+	}
+	return nil
+}
+
+// ClaimTransfer marks a pending Transfer as being merged by owner. Only one owner can hold a claim at a time,
+// but claims older than ttl are considered abandoned (i.e. the owner crashed) and can be taken over.
+func (r *SQLRepo) ClaimTransfer(id id.Transfer, owner string, ttl time.Duration) (bool, error) {
+	query := `update transfers set claimed_by = ?, claimed_at = ?
+where transfer_id = ? and status = ? and merged_filename is null and (claimed_by is null or claimed_by = ? or claimed_at < ?) and deleted_at is null`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return false, fmt.Errorf("ClaimTransfer: transfer=%s: %v", id, err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	res, err := stmt.Exec(owner, now, id, model.TransferPending, owner, now.Add(-1*ttl))
+	if err != nil {
+		return false, fmt.Errorf("ClaimTransfer: transfer=%s: %v", id, err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// ReleaseTransferClaim gives up owner's claim on a Transfer which wasn't merged so it can be claimed again right away.
+func (r *SQLRepo) ReleaseTransferClaim(id id.Transfer, owner string) error {
+	query := `update transfers set claimed_by = null, claimed_at = null
+where transfer_id = ? and claimed_by = ? and merged_filename is null and deleted_at is null`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("ReleaseTransferClaim: transfer=%s: %v", id, err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(id, owner); err != nil {
+		return fmt.Errorf("ReleaseTransferClaim: transfer=%s: %v", id, err)
+	}
+	return nil
+}
+
+// GetAbandonedMergedFiles returns the merged files holding Transfers claimed by owner and destined for routingNumber
+// which were never uploaded. This is used to requeue the files of a paygate instance whose lease expired.
+func (r *SQLRepo) GetAbandonedMergedFiles(owner string, routingNumber string) ([]string, error) {
+	query := `select distinct t.merged_filename from transfers as t
+inner join depositories as deps on t.receiver_depository = deps.depository_id
+where t.claimed_by = ? and deps.routing_number = ? and t.status = ? and t.merged_filename is not null and t.merged_filename <> ''
+and t.merged_filename not in (select filename from ach_file_uploads) and t.deleted_at is null`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetAbandonedMergedFiles: prepare: %v", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(filename, traceNumber, model.TransferProcessed, model.TransferPending, id)
-	return err
+	rows, err := stmt.Query(owner, routingNumber, model.TransferProcessed)
+	if err != nil {
+		return nil, fmt.Errorf("GetAbandonedMergedFiles: query: %v", err)
+	}
+	defer rows.Close()
+
+	var filenames []string
+	for rows.Next() {
+		var filename string
+		if err := rows.Scan(&filename); err != nil {
+			return nil, fmt.Errorf("GetAbandonedMergedFiles: scan: %v", err)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, rows.Err()
+}
+
+// MergedTransfer is a Transfer which has been merged into a file that's pending upload.
+type MergedTransfer struct {
+	TransferID  id.Transfer  `json:"transferID"`
+	UserID      id.User      `json:"userID"`
+	Amount      model.Amount `json:"amount"`
+	TraceNumber string       `json:"traceNumber"`
+
+	// TraceNumbers are every trace number assigned to the Transfer's entries in the merged file
+	TraceNumbers []string `json:"traceNumbers"`
+}
+
+// GetMergedTransfers returns the Transfers which have been merged into filename.
+func (r *SQLRepo) GetMergedTransfers(filename string) ([]*MergedTransfer, error) {
+	query := `select transfer_id, user_id, amount, trace_number from transfers where merged_filename = ? and deleted_at is null order by created_at asc`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetMergedTransfers: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(filename)
+	if err != nil {
+		return nil, fmt.Errorf("GetMergedTransfers: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*MergedTransfer
+	for rows.Next() {
+		var xfer MergedTransfer
+		var amount string
+		var traceNumber *string
+		if err := rows.Scan(&xfer.TransferID, &xfer.UserID, &amount, &traceNumber); err != nil {
+			return nil, fmt.Errorf("GetMergedTransfers: scan: %v", err)
+		}
+		if err := xfer.Amount.FromString(amount); err != nil {
+			return nil, fmt.Errorf("GetMergedTransfers: transfer=%s amount: %v", xfer.TransferID, err)
+		}
+		if traceNumber != nil {
+			xfer.TraceNumber = *traceNumber
+		}
+		out = append(out, &xfer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetMergedTransfers: rows: %v", err)
+	}
+	if err := r.readMergedTraceNumbers(filename, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// readMergedTraceNumbers fills in TraceNumbers of each Transfer merged into filename. Transfers merged before
+// their trace numbers were recorded only have their first trace number.
+func (r *SQLRepo) readMergedTraceNumbers(filename string, xfers []*MergedTransfer) error {
+	query := `select transfer_id, trace_number from transfer_trace_numbers where merged_filename = ? order by trace_number asc`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("GetMergedTransfers: prepare trace numbers: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(filename)
+	if err != nil {
+		return fmt.Errorf("GetMergedTransfers: query trace numbers: %v", err)
+	}
+	defer rows.Close()
+
+	traceNumbers := make(map[id.Transfer][]string)
+	for rows.Next() {
+		var transferID id.Transfer
+		var traceNumber string
+		if err := rows.Scan(&transferID, &traceNumber); err != nil {
+			return fmt.Errorf("GetMergedTransfers: scan trace numbers: %v", err)
+		}
+		traceNumbers[transferID] = append(traceNumbers[transferID], traceNumber)
+	}
+	for i := range xfers {
+		xfers[i].TraceNumbers = traceNumbers[xfers[i].TransferID]
+		if len(xfers[i].TraceNumbers) == 0 && xfers[i].TraceNumber != "" {
+			xfers[i].TraceNumbers = []string{xfers[i].TraceNumber}
+		}
+	}
+	return rows.Err()
+}
+
+// UnmergeTransfer resets merged_filename on a Transfer pulled out of its merged file and cancels the Transfer
+// so it's not merged again.
+func (r *SQLRepo) UnmergeTransfer(id id.Transfer, filename string) error {
+	query := `update transfers set merged_filename = null, trace_number = null, status = ?
+where transfer_id = ? and merged_filename = ? and status = ? and deleted_at is null`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("UnmergeTransfer: transfer=%s filename=%s: %v", id, filename, err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(model.TransferCanceled, id, filename, model.TransferProcessed)
+	if err != nil {
+		return fmt.Errorf("UnmergeTransfer: transfer=%s filename=%s: %v", id, filename, err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("UnmergeTransfer: transfer=%s not found in %s", id, filename)
+	}
+
+	// The trace numbers aren't uploaded, so returns can't be sent for them
+	query = `delete from transfer_trace_numbers where transfer_id = ? and merged_filename = ?`
+	traceStmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("UnmergeTransfer: transfer=%s trace numbers: %v", id, err)
+	}
+	defer traceStmt.Close()
+
+	if _, err := traceStmt.Exec(id, filename); err != nil {
+		return fmt.Errorf("UnmergeTransfer: transfer=%s trace numbers: %v", id, err)
+	}
+	return nil
+}
+
+// RequeueMergedFile moves everything merged into filename (Transfers, returns of IncomingTransfers and dishonored
+// returns) back to pending so it's merged into another file. This is used when a merged file is abandoned before
+// upload, such as after another paygate instance took over the file's merge and upload lease.
+func (r *SQLRepo) RequeueMergedFile(filename string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("RequeueMergedFile: filename=%s: %v", filename, err)
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{
+			query: `update transfers set merged_filename = null, trace_number = null, effective_entry_date = null, claimed_by = null, claimed_at = null, status = ?, requeued_at = ?
+where merged_filename = ? and status = ? and deleted_at is null`,
+			args: []interface{}{model.TransferPending, time.Now(), filename, model.TransferProcessed},
+		},
+		{
+			query: `delete from transfer_trace_numbers where merged_filename = ?`,
+			args:  []interface{}{filename},
+		},
+		{
+			query: `update incoming_transfer_returns set merged_filename = null, merged_at = null where merged_filename = ?`,
+			args:  []interface{}{filename},
+		},
+		{
+			query: `update transfer_returns set merged_filename = null, merged_at = null where merged_filename = ?`,
+			args:  []interface{}{filename},
+		},
+	}
+	for i := range statements {
+		stmt, err := tx.Prepare(statements[i].query)
+		if err != nil {
+			return fmt.Errorf("RequeueMergedFile: filename=%s: prepare: %v rollback=%v", filename, err, tx.Rollback())
+		}
+		_, err = stmt.Exec(statements[i].args...)
+		stmt.Close()
+		if err != nil {
+			return fmt.Errorf("RequeueMergedFile: filename=%s: %v rollback=%v", filename, err, tx.Rollback())
+		}
+	}
+	return tx.Commit()
 }
@@ -191,10 +191,19 @@ func TestTransfers_MarkTransferAsMerged(t *testing.T) {
 	}
 
 	// mark our transfer as merged, so we don't see it (in a new transferCursor we create)
-	if err := transferRepo.MarkTransferAsMerged(firstBatch[0].ID, "merged-file.ach", "traceNumber"); err != nil {
+	if err := transferRepo.MarkTransferAsMerged(firstBatch[0].ID, "merged-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
 		t.Fatal(err)
 	}
 
+	// move the EffectiveEntryDate forward (i.e. the merged file was requeued)
+	effectiveEntryDate := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	if err := transferRepo.UpdateEffectiveEntryDate("merged-file.ach", "traceNumber", effectiveEntryDate); err != nil {
+		t.Fatal(err)
+	}
+	if xfer, err := transferRepo.GetTransfer(firstBatch[0].ID); err != nil || !xfer.EffectiveEntryDate.Equal(effectiveEntryDate) {
+		t.Errorf("transfer=%#v error=%v", xfer, err)
+	}
+
 	// re-create our transferCursor and see the transfer ignored
 	// plus add a second transfer and ensure we get that
 	requests = []*transferRequest{
@@ -228,3 +237,255 @@ func TestTransfers_MarkTransferAsMerged(t *testing.T) {
 		t.Errorf("got %v", firstBatch[0].Amount.String())
 	}
 }
+
+func TestTransfers_ClaimTransfer(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	transferRepo := &SQLRepo{db.DB, log.NewNopLogger()}
+	amt, _ := model.NewAmount("USD", "12.12")
+
+	userID := id.User(base.ID())
+	xfers, err := transferRepo.createUserTransfers(userID, []*transferRequest{
+		{
+			Type:                   model.PushTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator1"),
+			OriginatorDepository:   id.Depository("originator1"),
+			Receiver:               model.ReceiverID("receiver1"),
+			ReceiverDepository:     id.Depository("receiver1"),
+			Description:            "money1",
+			StandardEntryClassCode: "PPD",
+			fileID:                 "test-file1",
+		},
+	})
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("transfers=%#v error=%v", xfers, err)
+	}
+	xferID := xfers[0].ID
+
+	if claimed, err := transferRepo.ClaimTransfer(xferID, "instance-a", time.Minute); !claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+	if claimed, err := transferRepo.ClaimTransfer(xferID, "instance-b", time.Minute); claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+	// an expired claim is taken over
+	if claimed, err := transferRepo.ClaimTransfer(xferID, "instance-b", -1*time.Second); !claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+
+	// released claims can be taken right away, but only by the owner releasing it
+	if err := transferRepo.ReleaseTransferClaim(xferID, "instance-a"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := transferRepo.ClaimTransfer(xferID, "instance-a", time.Minute); claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+	if err := transferRepo.ReleaseTransferClaim(xferID, "instance-b"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := transferRepo.ClaimTransfer(xferID, "instance-a", time.Minute); !claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+
+	// merged transfers can't be claimed
+	if err := transferRepo.MarkTransferAsMerged(xferID, "merged-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := transferRepo.ClaimTransfer(xferID, "instance-b", time.Minute); claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+}
+
+func TestTransfers_MergedTransfers(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	transferRepo := &SQLRepo{db.DB, log.NewNopLogger()}
+	amt, _ := model.NewAmount("USD", "12.12")
+
+	userID := id.User(base.ID())
+	xfers, err := transferRepo.createUserTransfers(userID, []*transferRequest{
+		{
+			Type:                   model.PushTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator1"),
+			OriginatorDepository:   id.Depository("originator1"),
+			Receiver:               model.ReceiverID("receiver1"),
+			ReceiverDepository:     id.Depository("receiver1"),
+			Description:            "money1",
+			StandardEntryClassCode: "PPD",
+			fileID:                 "test-file1",
+		},
+	})
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("transfers=%#v error=%v", xfers, err)
+	}
+	if err := transferRepo.MarkTransferAsMerged(xfers[0].ID, "merged-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := transferRepo.GetMergedTransfers("merged-file.ach")
+	if err != nil || len(merged) != 1 {
+		t.Fatalf("merged=%#v error=%v", merged, err)
+	}
+	if merged[0].TransferID != xfers[0].ID || merged[0].UserID != userID || merged[0].TraceNumber != "traceNumber" || len(merged[0].TraceNumbers) != 1 || merged[0].Amount.String() != "USD 12.12" {
+		t.Errorf("merged[0]=%#v", merged[0])
+	}
+
+	if err := transferRepo.UnmergeTransfer(xfers[0].ID, "other-file.ach"); err == nil {
+		t.Error("expected error")
+	}
+	if err := transferRepo.UnmergeTransfer(xfers[0].ID, "merged-file.ach"); err != nil {
+		t.Fatal(err)
+	}
+	xfer, err := transferRepo.getUserTransfer(xfers[0].ID, userID)
+	if err != nil || xfer.Status != model.TransferCanceled {
+		t.Errorf("transfer=%#v error=%v", xfer, err)
+	}
+	if merged, err := transferRepo.GetMergedTransfers("merged-file.ach"); len(merged) != 0 || err != nil {
+		t.Errorf("merged=%#v error=%v", merged, err)
+	}
+}
+
+func TestTransfers_RequeueMergedFile(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	transferRepo := &SQLRepo{db.DB, log.NewNopLogger()}
+	amt, _ := model.NewAmount("USD", "12.12")
+
+	userID := id.User(base.ID())
+	xfers, err := transferRepo.createUserTransfers(userID, []*transferRequest{
+		{
+			Type:                   model.PushTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator1"),
+			OriginatorDepository:   id.Depository("originator1"),
+			Receiver:               model.ReceiverID("receiver1"),
+			ReceiverDepository:     id.Depository("receiver1"),
+			Description:            "money1",
+			StandardEntryClassCode: "PPD",
+			fileID:                 "test-file1",
+		},
+	})
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("transfers=%#v error=%v", xfers, err)
+	}
+	if err := transferRepo.MarkTransferAsMerged(xfers[0].ID, "merged-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := transferRepo.RequeueMergedFile("merged-file.ach"); err != nil {
+		t.Fatal(err)
+	}
+	xfer, err := transferRepo.getUserTransfer(xfers[0].ID, userID)
+	if err != nil || xfer.Status != model.TransferPending {
+		t.Errorf("transfer=%#v error=%v", xfer, err)
+	}
+	if merged, err := transferRepo.GetMergedTransfers("merged-file.ach"); len(merged) != 0 || err != nil {
+		t.Errorf("merged=%#v error=%v", merged, err)
+	}
+	if found, err := transferRepo.LookupTransferFromTrace("traceNumber", amt); found != nil || err != nil {
+		t.Errorf("transfer=%#v error=%v", found, err)
+	}
+
+	// the Transfer is merged again
+	if err := transferRepo.MarkTransferAsMerged(xfers[0].ID, "other-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
+		t.Fatal(err)
+	}
+	if merged, err := transferRepo.GetMergedTransfers("other-file.ach"); len(merged) != 1 || err != nil {
+		t.Errorf("merged=%#v error=%v", merged, err)
+	}
+}
+
+func TestTransfers_cursorRequeued(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	keeper := secrets.TestStringKeeper(t)
+	depRepo := depository.NewDepositoryRepo(log.NewNopLogger(), db.DB, keeper)
+	transferRepo := &SQLRepo{db.DB, log.NewNopLogger()}
+
+	userID := id.User(base.ID())
+	dep := &model.Depository{
+		ID:                     id.Depository(base.ID()),
+		BankName:               "bank name",
+		Holder:                 "holder",
+		HolderType:             model.Individual,
+		Type:                   model.Checking,
+		RoutingNumber:          "076401251",
+		EncryptedAccountNumber: "151",
+		Status:                 model.DepositoryVerified,
+	}
+	if err := depRepo.UpsertUserDepository(userID, dep); err != nil {
+		t.Fatal(err)
+	}
+	amt, _ := model.NewAmount("USD", "12.12")
+	xfers, err := transferRepo.createUserTransfers(userID, []*transferRequest{
+		{
+			Type:                   model.PushTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator"),
+			OriginatorDepository:   id.Depository("originator"),
+			Receiver:               model.ReceiverID("receiver"),
+			ReceiverDepository:     dep.ID,
+			Description:            "money",
+			StandardEntryClassCode: "PPD",
+			fileID:                 "test-file",
+		},
+	})
+	if err != nil || len(xfers) != 1 {
+		t.Fatalf("transfers=%#v error=%v", xfers, err)
+	}
+
+	// our cursor reads the transfer, but another instance claims and merges it
+	cur := transferRepo.GetCursor(10, depRepo)
+	if groupable, err := cur.Next(); len(groupable) != 1 || err != nil {
+		t.Fatalf("groupable=%#v error=%v", groupable, err)
+	}
+	if claimed, err := transferRepo.ClaimTransfer(xfers[0].ID, "first", time.Minute); !claimed || err != nil {
+		t.Fatalf("claimed=%v error=%v", claimed, err)
+	}
+	if err := transferRepo.MarkTransferAsMerged(xfers[0].ID, "merged-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
+		t.Fatal(err)
+	}
+	if groupable, err := cur.Next(); len(groupable) != 0 || err != nil {
+		t.Fatalf("groupable=%#v error=%v", groupable, err)
+	}
+
+	// the other instance's file wasn't uploaded
+	if filenames, err := transferRepo.GetAbandonedMergedFiles("first", "076401251"); len(filenames) != 1 || filenames[0] != "merged-file.ach" || err != nil {
+		t.Fatalf("filenames=%v error=%v", filenames, err)
+	}
+	if filenames, err := transferRepo.GetAbandonedMergedFiles("second", "076401251"); len(filenames) != 0 || err != nil {
+		t.Fatalf("filenames=%v error=%v", filenames, err)
+	}
+
+	// after the file is requeued our cursor returns the transfer again
+	if err := transferRepo.RequeueMergedFile("merged-file.ach"); err != nil {
+		t.Fatal(err)
+	}
+	groupable, err := cur.Next()
+	if len(groupable) != 1 || err != nil {
+		t.Fatalf("groupable=%#v error=%v", groupable, err)
+	}
+	if groupable[0].ID != xfers[0].ID || groupable[0].Destination != "076401251" {
+		t.Errorf("unexpected transfer: %#v", groupable[0])
+	}
+	if groupable, err := cur.Next(); len(groupable) != 0 || err != nil {
+		t.Fatalf("groupable=%#v error=%v", groupable, err)
+	}
+
+	// uploaded files aren't abandoned
+	if err := transferRepo.MarkTransferAsMerged(xfers[0].ID, "other-file.ach", time.Now(), []string{"traceNumber"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DB.Exec(`insert into ach_file_uploads (filename, uploaded_at) values ('other-file.ach', ?);`, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if filenames, err := transferRepo.GetAbandonedMergedFiles("first", "076401251"); len(filenames) != 0 || err != nil {
+		t.Fatalf("filenames=%v error=%v", filenames, err)
+	}
+}
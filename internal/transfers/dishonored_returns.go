@@ -0,0 +1,513 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/events"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/route"
+	"github.com/moov-io/paygate/pkg/id"
+)
+
+var (
+	errTransferReturnNotFound = errors.New("transfer has not been returned")
+	errDishonorDeadlinePassed = errors.New("dishonor deadline has passed")
+)
+
+// TransferReturn is a return we've received (as the ODFI) for one of our Transfers. An incorrect or untimely
+// return can be dishonored within five banking days of receiving it and the RDFI can then contest our dishonored return.
+type TransferReturn struct {
+	TransferID         id.Transfer   `json:"transferID"`
+	UserID             id.User       `json:"-"`
+	ReceiverDepository id.Depository `json:"-"`
+
+	ReturnCode string `json:"returnCode"`
+	// TraceNumber is from the return entry and OriginalTrace is from our forward entry
+	TraceNumber    string `json:"traceNumber"`
+	OriginalTrace  string `json:"originalTrace"`
+	SettlementDate string `json:"settlementDate,omitempty"`
+
+	// Origin is the RDFI which sent the return and Destination is our routing number
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+
+	// Fields from the returned entry which are copied into a dishonored return
+	StandardEntryClassCode  string       `json:"-"`
+	ServiceClassCode        int          `json:"-"`
+	CompanyName             string       `json:"-"`
+	CompanyIdentification   string       `json:"-"`
+	CompanyEntryDescription string       `json:"-"`
+	TransactionCode         int          `json:"-"`
+	Amount                  model.Amount `json:"amount"`
+	IndividualName          string       `json:"-"`
+	IdentificationNumber    string       `json:"-"`
+
+	DishonoredReturnCode         string     `json:"dishonoredReturnCode,omitempty"`
+	DishonoredAddendaInformation string     `json:"dishonoredAddendaInformation,omitempty"`
+	DishonoredTransactionID      string     `json:"-"`
+	DishonoredAt                 *time.Time `json:"dishonoredAt,omitempty"`
+	DishonorDeadline             time.Time  `json:"dishonorDeadline"`
+
+	// MergedFilename is set once our dishonored return is merged into an outbound file
+	MergedFilename string `json:"mergedFilename,omitempty"`
+
+	ContestedReturnCode string     `json:"contestedReturnCode,omitempty"`
+	ContestedAt         *time.Time `json:"contestedAt,omitempty"`
+
+	Created time.Time `json:"created"`
+}
+
+// DishonorDeadline returns the latest time a return received at received can be dishonored.
+func DishonorDeadline(received time.Time) time.Time {
+	start := time.Date(received.Year(), received.Month(), received.Day(), 0, 0, 0, 0, time.UTC)
+	return addBankingDays(start, 5).Add(24 * time.Hour)
+}
+
+// untimedReturnCodes are returns which aren't held to a deadline. R06 is sent when we (as the ODFI) ask for
+// an entry back and R31 is sent once the ODFI agrees to accept a late CCD or CTX return.
+var untimedReturnCodes = map[string]bool{
+	"R06": true, // Returned per ODFI's Request
+	"R31": true, // Permissible Return Entry (CCD and CTX Only)
+}
+
+// IsLateReturn returns true if a return with code for an entry settled on effectiveEntryDate was received after its deadline.
+func IsLateReturn(code string, effectiveEntryDate time.Time, received time.Time) bool {
+	code = strings.ToUpper(code)
+	if untimedReturnCodes[code] || IsDishonoredReturnCode(code) || IsContestedDishonoredReturnCode(code) {
+		return false
+	}
+	return received.After(ReturnDeadline(code, effectiveEntryDate))
+}
+
+// IsDishonoredReturnCode returns true for codes an ODFI uses to dishonor a return (R61-R69).
+func IsDishonoredReturnCode(code string) bool {
+	return code >= "R61" && code <= "R69"
+}
+
+// IsContestedDishonoredReturnCode returns true for codes an RDFI uses to contest a dishonored return (R71-R77).
+func IsContestedDishonoredReturnCode(code string) bool {
+	return code >= "R71" && code <= "R77"
+}
+
+type dishonorRequest struct {
+	ReturnCode         string `json:"returnCode"`
+	AddendaInformation string `json:"addendaInformation,omitempty"`
+}
+
+func validateDishonorRequest(req dishonorRequest) error {
+	code := ach.LookupReturnCode(strings.ToUpper(req.ReturnCode))
+	if code == nil || !IsDishonoredReturnCode(code.Code) {
+		return fmt.Errorf("returnCode %q is not a dishonored return code", req.ReturnCode)
+	}
+	if code.Code == "R69" && req.AddendaInformation == "" {
+		return errors.New("returnCode R69 requires addendaInformation listing the field errors")
+	}
+	// The dishonored return addenda holds the return's trace number, settlement date and code before our information
+	if len(req.AddendaInformation) > 21 {
+		return errors.New("addendaInformation is longer than 21 characters")
+	}
+	return nil
+}
+
+// dishonorTransferReturn queues a dishonored return for ret. The Transfer is marked as processed again and
+// posted against Accounts since its return is being refused. Only reclaimed and late returned Transfers can be dishonored.
+func (c *TransferRouter) dishonorTransferReturn(transfer *model.Transfer, ret *TransferReturn, req dishonorRequest, requestID string) error {
+	if err := validateDishonorRequest(req); err != nil {
+		return err
+	}
+	if ret.DishonoredReturnCode != "" {
+		return fmt.Errorf("return of transfer=%s has already been dishonored with %s", ret.TransferID, ret.DishonoredReturnCode)
+	}
+	// Other statuses mean the transfer isn't returned or its return was already dishonored
+	if transfer.Status != model.TransferReclaimed && transfer.Status != model.TransferLateReturn {
+		return fmt.Errorf("transfer=%s has status %s, only %s and %s transfers can have their return dishonored", ret.TransferID, transfer.Status, model.TransferReclaimed, model.TransferLateReturn)
+	}
+	if time.Now().After(ret.DishonorDeadline) {
+		return fmt.Errorf("transfer=%s: %v (%s)", ret.TransferID, errDishonorDeadlinePassed, ret.DishonorDeadline.Format(time.RFC3339))
+	}
+
+	// Post the transfer against Accounts again since it was reversed when the return was processed
+	var transactionID string
+	if c.accountsClient != nil {
+		origDep, err := c.depRepo.GetUserDepository(transfer.OriginatorDepository, ret.UserID)
+		if err != nil || origDep == nil {
+			return fmt.Errorf("problem reading originator depository=%s: %v", transfer.OriginatorDepository, err)
+		}
+		recDep, err := c.depRepo.GetUserDepository(transfer.ReceiverDepository, ret.UserID)
+		if err != nil || recDep == nil {
+			return fmt.Errorf("problem reading receiver depository=%s: %v", transfer.ReceiverDepository, err)
+		}
+		tx, err := c.postAccountTransaction(ret.UserID, origDep, recDep, transfer.Amount, transfer.Type, requestID)
+		if err != nil {
+			return err
+		}
+		transactionID = tx.ID
+	}
+
+	code := strings.ToUpper(req.ReturnCode)
+	if err := c.transferRepo.DishonorTransferReturn(ret.TransferID, code, req.AddendaInformation, transactionID); err != nil {
+		return err
+	}
+	if err := c.transferRepo.UpdateTransferStatus(ret.TransferID, model.TransferProcessed); err != nil {
+		return fmt.Errorf("problem updating transfer=%s: %v", ret.TransferID, err)
+	}
+
+	if c.eventRepo != nil {
+		err := c.eventRepo.WriteEvent(ret.UserID, &events.Event{
+			ID:      events.EventID(base.ID()),
+			Topic:   fmt.Sprintf("dishonored %s return of transfer", ret.ReturnCode),
+			Message: fmt.Sprintf("%s return dishonored with %s", ret.Amount.String(), code),
+			Type:    events.TransferEvent,
+			Metadata: map[string]string{
+				"transferID": string(ret.TransferID),
+				"returnCode": code,
+			},
+		})
+		if err != nil {
+			c.logger.Log("transfers", fmt.Sprintf("problem writing dishonored return event for transfer=%s", ret.TransferID), "error", err, "requestID", requestID)
+		}
+	}
+	c.logger.Log("transfers", fmt.Sprintf("queued dishonored return of transfer=%s with returnCode=%s", ret.TransferID, code), "requestID", requestID, "userID", ret.UserID)
+	return nil
+}
+
+// acceptTransferReturn accepts the late return ret, which marks the Transfer as reclaimed. Its Accounts transaction
+// was already reversed when the return was processed.
+func (c *TransferRouter) acceptTransferReturn(transfer *model.Transfer, ret *TransferReturn, requestID string) error {
+	if transfer.Status != model.TransferLateReturn {
+		return fmt.Errorf("transfer=%s has status %s, only %s transfers can have their return accepted", ret.TransferID, transfer.Status, model.TransferLateReturn)
+	}
+	if err := c.transferRepo.UpdateTransferStatus(ret.TransferID, model.TransferReclaimed); err != nil {
+		return fmt.Errorf("problem updating transfer=%s: %v", ret.TransferID, err)
+	}
+
+	if c.eventRepo != nil {
+		err := c.eventRepo.WriteEvent(ret.UserID, &events.Event{
+			ID:      events.EventID(base.ID()),
+			Topic:   fmt.Sprintf("accepted late %s return of transfer", ret.ReturnCode),
+			Message: fmt.Sprintf("%s late return accepted", ret.Amount.String()),
+			Type:    events.TransferEvent,
+			Metadata: map[string]string{
+				"transferID": string(ret.TransferID),
+				"returnCode": ret.ReturnCode,
+			},
+		})
+		if err != nil {
+			c.logger.Log("transfers", fmt.Sprintf("problem writing accepted return event for transfer=%s", ret.TransferID), "error", err, "requestID", requestID)
+		}
+	}
+	c.logger.Log("transfers", fmt.Sprintf("accepted late return of transfer=%s with returnCode=%s", ret.TransferID, ret.ReturnCode), "requestID", requestID, "userID", ret.UserID)
+	return nil
+}
+
+// getUserTransferReturn reads the Transfer and TransferReturn from the request's path if they belong to userID
+func (c *TransferRouter) getUserTransferReturn(r *http.Request, userID id.User) (*model.Transfer, *TransferReturn, error) {
+	transferID := getTransferID(r)
+	transfer, err := c.transferRepo.getUserTransfer(transferID, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, errTransferReturnNotFound
+		}
+		return nil, nil, err
+	}
+	if transfer == nil {
+		return nil, nil, errTransferReturnNotFound
+	}
+	ret, err := c.transferRepo.GetTransferReturn(transferID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ret == nil || ret.UserID != userID {
+		return nil, nil, errTransferReturnNotFound
+	}
+	return transfer, ret, nil
+}
+
+func (c *TransferRouter) getTransferReturn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+
+		_, ret, err := c.getUserTransferReturn(r, responder.XUserID)
+		if err != nil {
+			if err == errTransferReturnNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(ret)
+		})
+	}
+}
+
+func (c *TransferRouter) dishonorTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+
+		var req dishonorRequest
+		if err := json.NewDecoder(route.Read(r.Body)).Decode(&req); err != nil {
+			responder.Problem(err)
+			return
+		}
+		transfer, ret, err := c.getUserTransferReturn(r, responder.XUserID)
+		if err != nil {
+			if err == errTransferReturnNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			responder.Problem(err)
+			return
+		}
+		if err := c.dishonorTransferReturn(transfer, ret, req, responder.XRequestID); err != nil {
+			responder.Log("transfers", fmt.Sprintf("problem dishonoring return of transfer=%s: %v", ret.TransferID, err))
+			responder.Problem(err)
+			return
+		}
+		ret, err = c.transferRepo.GetTransferReturn(ret.TransferID)
+		if err != nil {
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(ret)
+		})
+	}
+}
+
+func (c *TransferRouter) acceptTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+
+		transfer, ret, err := c.getUserTransferReturn(r, responder.XUserID)
+		if err != nil {
+			if err == errTransferReturnNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			responder.Problem(err)
+			return
+		}
+		if err := c.acceptTransferReturn(transfer, ret, responder.XRequestID); err != nil {
+			responder.Log("transfers", fmt.Sprintf("problem accepting return of transfer=%s: %v", ret.TransferID, err))
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(ret)
+		})
+	}
+}
+
+// CreateTransferReturn records a return received for one of our Transfers.
+func (r *SQLRepo) CreateTransferReturn(ret *TransferReturn) error {
+	query := `insert into transfer_returns (transfer_id, user_id, receiver_depository, return_code, trace_number, original_trace, settlement_date, origin, destination,
+standard_entry_class_code, service_class_code, company_name, company_identification, company_entry_description, transaction_code, amount, individual_name,
+identification_number, created_at) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("CreateTransferReturn: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		ret.TransferID, ret.UserID, ret.ReceiverDepository, ret.ReturnCode, ret.TraceNumber, ret.OriginalTrace, ret.SettlementDate, ret.Origin, ret.Destination,
+		ret.StandardEntryClassCode, ret.ServiceClassCode, ret.CompanyName, ret.CompanyIdentification, ret.CompanyEntryDescription, ret.TransactionCode, ret.Amount.String(), ret.IndividualName,
+		ret.IdentificationNumber, ret.Created,
+	)
+	if err != nil {
+		if database.UniqueViolation(err) {
+			return fmt.Errorf("transfer=%s has already been returned", ret.TransferID)
+		}
+		return fmt.Errorf("CreateTransferReturn: transfer=%s: %v", ret.TransferID, err)
+	}
+	return nil
+}
+
+const transferReturnColumns = `transfer_id, user_id, receiver_depository, return_code, trace_number, original_trace, settlement_date, origin, destination,
+standard_entry_class_code, service_class_code, company_name, company_identification, company_entry_description, transaction_code, amount, individual_name,
+identification_number, dishonored_return_code, dishonored_addenda_information, dishonored_transaction_id, dishonored_at, merged_filename,
+contested_return_code, contested_at, created_at`
+
+func scanTransferReturn(row scanner) (*TransferReturn, error) {
+	var ret TransferReturn
+	var (
+		amount                                                  string
+		dishonoredCode, dishonoredInfo, dishonoredTransactionID *string
+		mergedFilename, contestedCode                           *string
+	)
+	err := row.Scan(
+		&ret.TransferID, &ret.UserID, &ret.ReceiverDepository, &ret.ReturnCode, &ret.TraceNumber, &ret.OriginalTrace, &ret.SettlementDate, &ret.Origin, &ret.Destination,
+		&ret.StandardEntryClassCode, &ret.ServiceClassCode, &ret.CompanyName, &ret.CompanyIdentification, &ret.CompanyEntryDescription, &ret.TransactionCode, &amount, &ret.IndividualName,
+		&ret.IdentificationNumber, &dishonoredCode, &dishonoredInfo, &dishonoredTransactionID, &ret.DishonoredAt, &mergedFilename,
+		&contestedCode, &ret.ContestedAt, &ret.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := ret.Amount.FromString(amount); err != nil {
+		return nil, fmt.Errorf("transfer=%s amount: %v", ret.TransferID, err)
+	}
+	if dishonoredCode != nil {
+		ret.DishonoredReturnCode = *dishonoredCode
+	}
+	if dishonoredInfo != nil {
+		ret.DishonoredAddendaInformation = *dishonoredInfo
+	}
+	if dishonoredTransactionID != nil {
+		ret.DishonoredTransactionID = *dishonoredTransactionID
+	}
+	if mergedFilename != nil {
+		ret.MergedFilename = *mergedFilename
+	}
+	if contestedCode != nil {
+		ret.ContestedReturnCode = *contestedCode
+	}
+	ret.DishonorDeadline = DishonorDeadline(ret.Created)
+	return &ret, nil
+}
+
+func (r *SQLRepo) getTransferReturn(query string, args ...interface{}) (*TransferReturn, error) {
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	ret, err := scanTransferReturn(stmt.QueryRow(args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return ret, nil
+}
+
+// GetTransferReturn returns the TransferReturn for transferID or nil if the Transfer hasn't been returned.
+func (r *SQLRepo) GetTransferReturn(transferID id.Transfer) (*TransferReturn, error) {
+	ret, err := r.getTransferReturn(`select `+transferReturnColumns+` from transfer_returns where transfer_id = ? limit 1;`, transferID)
+	if err != nil {
+		return nil, fmt.Errorf("GetTransferReturn: transfer=%s: %v", transferID, err)
+	}
+	return ret, nil
+}
+
+// LookupDishonoredTransferReturn returns the dishonored TransferReturn whose forward entry had originalTrace, or nil if none is found.
+func (r *SQLRepo) LookupDishonoredTransferReturn(originalTrace string) (*TransferReturn, error) {
+	query := `select ` + transferReturnColumns + ` from transfer_returns where original_trace = ? and dishonored_return_code is not null order by created_at desc limit 1;`
+	ret, err := r.getTransferReturn(query, originalTrace)
+	if err != nil {
+		return nil, fmt.Errorf("LookupDishonoredTransferReturn: originalTrace=%s: %v", originalTrace, err)
+	}
+	return ret, nil
+}
+
+// DishonorTransferReturn records our dishonored return of a TransferReturn, which is merged into our next outbound file.
+func (r *SQLRepo) DishonorTransferReturn(transferID id.Transfer, returnCode string, addendaInformation string, transactionID string) error {
+	query := `update transfer_returns set dishonored_return_code = ?, dishonored_addenda_information = ?, dishonored_transaction_id = ?, dishonored_at = ?
+where transfer_id = ? and dishonored_return_code is null;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("DishonorTransferReturn: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(returnCode, addendaInformation, transactionID, time.Now(), transferID)
+	if err != nil {
+		return fmt.Errorf("DishonorTransferReturn: transfer=%s: %v", transferID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("return of transfer=%s has already been dishonored", transferID)
+	}
+	return nil
+}
+
+// GetPendingDishonoredReturns returns dishonored TransferReturn objects which haven't been merged into an outbound file.
+func (r *SQLRepo) GetPendingDishonoredReturns() ([]*TransferReturn, error) {
+	query := `select ` + transferReturnColumns + ` from transfer_returns
+where dishonored_return_code is not null and merged_filename is null order by dishonored_at asc;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetPendingDishonoredReturns: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("GetPendingDishonoredReturns: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*TransferReturn
+	for rows.Next() {
+		ret, err := scanTransferReturn(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetPendingDishonoredReturns: scan: %v", err)
+		}
+		out = append(out, ret)
+	}
+	return out, rows.Err()
+}
+
+// MarkDishonoredReturnMerged records which outbound file our dishonored return was merged into.
+func (r *SQLRepo) MarkDishonoredReturnMerged(transferID id.Transfer, filename string) error {
+	query := `update transfer_returns set merged_filename = ?, merged_at = ? where transfer_id = ? and merged_filename is null;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("MarkDishonoredReturnMerged: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(filename, time.Now(), transferID); err != nil {
+		return fmt.Errorf("MarkDishonoredReturnMerged: transfer=%s: %v", transferID, err)
+	}
+	return nil
+}
+
+// ContestTransferReturn records the RDFI contesting our dishonored return.
+func (r *SQLRepo) ContestTransferReturn(transferID id.Transfer, returnCode string) error {
+	query := `update transfer_returns set contested_return_code = ?, contested_at = ? where transfer_id = ? and contested_return_code is null;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("ContestTransferReturn: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(returnCode, time.Now(), transferID); err != nil {
+		return fmt.Errorf("ContestTransferReturn: transfer=%s: %v", transferID, err)
+	}
+	return nil
+}
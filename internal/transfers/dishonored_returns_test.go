@@ -0,0 +1,334 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/accounts"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/depository"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func testTransferReturn(userID id.User, received time.Time) *TransferReturn {
+	amt, _ := model.NewAmount("USD", "12.42")
+	return &TransferReturn{
+		TransferID:              id.Transfer(base.ID()),
+		UserID:                  userID,
+		ReceiverDepository:      id.Depository(base.ID()),
+		ReturnCode:              "R01",
+		TraceNumber:             "091400600000001",
+		OriginalTrace:           "121042880000001",
+		SettlementDate:          "032",
+		Origin:                  "091400606",
+		Destination:             "121042882",
+		StandardEntryClassCode:  "PPD",
+		ServiceClassCode:        225,
+		CompanyName:             "Acme Corp",
+		CompanyIdentification:   "121042882",
+		CompanyEntryDescription: "payroll",
+		TransactionCode:         26,
+		Amount:                  *amt,
+		IndividualName:          "Jane Doe",
+		IdentificationNumber:    "12345",
+		Created:                 received,
+	}
+}
+
+func TestDishonoredReturns__DishonorDeadline(t *testing.T) {
+	// Friday, five banking days later is the following Friday
+	received := time.Date(2020, time.January, 10, 14, 0, 0, 0, time.UTC)
+	if deadline := DishonorDeadline(received); !deadline.Equal(time.Date(2020, time.January, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("deadline=%v", deadline)
+	}
+}
+
+func TestDishonoredReturns__IsLateReturn(t *testing.T) {
+	// Friday, two banking days later is Wednesday since Monday is a holiday
+	effective := time.Date(2020, time.January, 17, 0, 0, 0, 0, time.UTC)
+
+	if IsLateReturn("R01", effective, time.Date(2020, time.January, 22, 18, 0, 0, 0, time.UTC)) {
+		t.Error("R01 isn't late on Wednesday")
+	}
+	if !IsLateReturn("r01", effective, time.Date(2020, time.January, 23, 9, 0, 0, 0, time.UTC)) {
+		t.Error("R01 is late on Thursday")
+	}
+	if IsLateReturn("R10", effective, time.Date(2020, time.February, 20, 9, 0, 0, 0, time.UTC)) {
+		t.Error("R10 isn't late after a month")
+	}
+	// Unauthorized consumer returns are late after the 60th calendar day
+	if !IsLateReturn("R10", effective, time.Date(2020, time.March, 18, 9, 0, 0, 0, time.UTC)) {
+		t.Error("R10 is late after 60 days")
+	}
+	if IsLateReturn("R06", effective, time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)) || IsLateReturn("R68", effective, time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("R06 and dishonored returns are never late")
+	}
+}
+
+func TestDishonoredReturns__codes(t *testing.T) {
+	if !IsDishonoredReturnCode("R61") || !IsDishonoredReturnCode("R69") || IsDishonoredReturnCode("R01") || IsDishonoredReturnCode("R71") {
+		t.Error("unexpected dishonored return codes")
+	}
+	if !IsContestedDishonoredReturnCode("R71") || !IsContestedDishonoredReturnCode("R77") || IsContestedDishonoredReturnCode("R69") {
+		t.Error("unexpected contested dishonored return codes")
+	}
+}
+
+func TestDishonoredReturns__validate(t *testing.T) {
+	if err := validateDishonorRequest(dishonorRequest{ReturnCode: "r68"}); err != nil {
+		t.Error(err)
+	}
+	if err := validateDishonorRequest(dishonorRequest{ReturnCode: "R01"}); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateDishonorRequest(dishonorRequest{ReturnCode: "R69"}); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateDishonorRequest(dishonorRequest{ReturnCode: "R67", AddendaInformation: strings.Repeat("a", 22)}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDishonoredReturns__SQLRepo(t *testing.T) {
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	repo := NewTransferRepo(log.NewNopLogger(), sqliteDB.DB)
+
+	ret := testTransferReturn(id.User(base.ID()), time.Now())
+	if err := repo.CreateTransferReturn(ret); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateTransferReturn(ret); err == nil {
+		t.Error("expected error")
+	}
+
+	found, err := repo.GetTransferReturn(ret.TransferID)
+	if err != nil || found == nil {
+		t.Fatalf("return=%v error=%v", found, err)
+	}
+	if found.TraceNumber != ret.TraceNumber || found.Amount.String() != "USD 12.42" || found.ServiceClassCode != 225 || found.DishonoredReturnCode != "" {
+		t.Errorf("unexpected return: %#v", found)
+	}
+	if found.DishonorDeadline.Before(time.Now()) {
+		t.Errorf("unexpected DishonorDeadline: %v", found.DishonorDeadline)
+	}
+
+	// not dishonored yet
+	if found, err := repo.LookupDishonoredTransferReturn(ret.OriginalTrace); found != nil || err != nil {
+		t.Errorf("return=%v error=%v", found, err)
+	}
+	if returns, err := repo.GetPendingDishonoredReturns(); len(returns) != 0 || err != nil {
+		t.Errorf("got %d returns: %v", len(returns), err)
+	}
+
+	if err := repo.DishonorTransferReturn(ret.TransferID, "R68", "late", "transaction"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DishonorTransferReturn(ret.TransferID, "R68", "late", "transaction"); err == nil {
+		t.Error("expected error")
+	}
+	returns, err := repo.GetPendingDishonoredReturns()
+	if err != nil || len(returns) != 1 {
+		t.Fatalf("got %d returns: %v", len(returns), err)
+	}
+	if returns[0].DishonoredReturnCode != "R68" || returns[0].DishonoredAddendaInformation != "late" || returns[0].DishonoredTransactionID != "transaction" || returns[0].DishonoredAt == nil {
+		t.Errorf("unexpected return: %#v", returns[0])
+	}
+
+	if err := repo.MarkDishonoredReturnMerged(ret.TransferID, "merged.ach"); err != nil {
+		t.Fatal(err)
+	}
+	if returns, err := repo.GetPendingDishonoredReturns(); len(returns) != 0 || err != nil {
+		t.Errorf("got %d returns: %v", len(returns), err)
+	}
+
+	if err := repo.ContestTransferReturn(ret.TransferID, "R73"); err != nil {
+		t.Fatal(err)
+	}
+	found, err = repo.LookupDishonoredTransferReturn(ret.OriginalTrace)
+	if err != nil || found == nil {
+		t.Fatalf("return=%v error=%v", found, err)
+	}
+	if found.MergedFilename != "merged.ach" || found.ContestedReturnCode != "R73" || found.ContestedAt == nil {
+		t.Errorf("unexpected return: %#v", found)
+	}
+}
+
+func TestDishonoredReturns__dishonorTransfer(t *testing.T) {
+	userID := id.User(base.ID())
+	amt, _ := model.NewAmount("USD", "12.42")
+	transfer := &model.Transfer{
+		ID:                   id.Transfer(base.ID()),
+		Type:                 model.PushTransfer,
+		Amount:               *amt,
+		OriginatorDepository: id.Depository(base.ID()),
+		ReceiverDepository:   id.Depository(base.ID()),
+		Status:               model.TransferReclaimed,
+	}
+	ret := testTransferReturn(userID, time.Now())
+	ret.TransferID = transfer.ID
+	ret.DishonorDeadline = DishonorDeadline(ret.Created)
+
+	repo := &MockRepository{Xfer: transfer, TransferReturns: []*TransferReturn{ret}}
+	depRepo := &depository.MockRepository{Depositories: []*model.Depository{{ID: id.Depository(base.ID())}}}
+
+	xferRouter := CreateTestTransferRouter(depRepo, nil, nil, nil, repo)
+	defer xferRouter.close()
+
+	accountsClient := &accounts.MockClient{
+		Accounts:    []accounts.Account{{ID: base.ID()}},
+		Transaction: &accounts.Transaction{ID: base.ID()},
+	}
+	xferRouter.TransferRouter.accountsClient = accountsClient
+
+	router := mux.NewRouter()
+	xferRouter.RegisterRoutes(router)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", fmt.Sprintf("/transfers/%s/dishonor", transfer.ID), strings.NewReader(`{"returnCode": "R68"}`))
+	r.Header.Set("x-user-id", userID.String())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var resp TransferReturn
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.DishonoredReturnCode != "R68" {
+		t.Errorf("unexpected return: %#v", resp)
+	}
+	if repo.Status != model.TransferProcessed {
+		t.Errorf("transfer status=%s", repo.Status)
+	}
+	if len(accountsClient.PostedTransactions) != 1 || ret.DishonoredTransactionID != accountsClient.Transaction.ID {
+		t.Errorf("got %d posted transactions", len(accountsClient.PostedTransactions))
+	}
+
+	// a second dishonor is rejected
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", fmt.Sprintf("/transfers/%s/dishonor", transfer.ID), strings.NewReader(`{"returnCode": "R68"}`))
+	r.Header.Set("x-user-id", userID.String())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// another user's transfer isn't found
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", fmt.Sprintf("/transfers/%s/return", transfer.ID), nil)
+	r.Header.Set("x-user-id", base.ID())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+}
+
+func TestDishonoredReturns__deadlinePassed(t *testing.T) {
+	ret := testTransferReturn(id.User(base.ID()), time.Now().Add(-14*24*time.Hour))
+	ret.DishonorDeadline = DishonorDeadline(ret.Created)
+
+	xferRouter := CreateTestTransferRouter(nil, nil, nil, nil, &MockRepository{})
+	defer xferRouter.close()
+	xferRouter.TransferRouter.accountsClient = nil
+
+	err := xferRouter.dishonorTransferReturn(&model.Transfer{Status: model.TransferReclaimed}, ret, dishonorRequest{ReturnCode: "R68"}, base.ID())
+	if err == nil || !strings.Contains(err.Error(), errDishonorDeadlinePassed.Error()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDishonoredReturns__notReclaimed(t *testing.T) {
+	ret := testTransferReturn(id.User(base.ID()), time.Now())
+	ret.DishonorDeadline = DishonorDeadline(ret.Created)
+
+	repo := &MockRepository{}
+	xferRouter := CreateTestTransferRouter(nil, nil, nil, nil, repo)
+	defer xferRouter.close()
+	xferRouter.TransferRouter.accountsClient = nil
+
+	// processed transfers aren't returned (or their return was already dishonored)
+	for _, status := range []model.TransferStatus{model.TransferPending, model.TransferProcessed} {
+		err := xferRouter.dishonorTransferReturn(&model.Transfer{Status: status}, ret, dishonorRequest{ReturnCode: "R68"}, base.ID())
+		if err == nil || !strings.Contains(err.Error(), string(status)) {
+			t.Errorf("%s: unexpected error: %v", status, err)
+		}
+	}
+	if repo.Status != "" {
+		t.Errorf("transfer status=%s", repo.Status)
+	}
+}
+
+func TestDishonoredReturns__lateReturn(t *testing.T) {
+	userID := id.User(base.ID())
+	transfer := &model.Transfer{ID: id.Transfer(base.ID()), Status: model.TransferLateReturn}
+	ret := testTransferReturn(userID, time.Now())
+	ret.TransferID = transfer.ID
+	ret.DishonorDeadline = DishonorDeadline(ret.Created)
+
+	repo := &MockRepository{Xfer: transfer, TransferReturns: []*TransferReturn{ret}}
+	xferRouter := CreateTestTransferRouter(nil, nil, nil, nil, repo)
+	defer xferRouter.close()
+	xferRouter.TransferRouter.accountsClient = nil
+
+	router := mux.NewRouter()
+	xferRouter.RegisterRoutes(router)
+
+	// late returns can be dishonored
+	if err := xferRouter.dishonorTransferReturn(transfer, ret, dishonorRequest{ReturnCode: "R68"}, base.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Status != model.TransferProcessed || ret.DishonoredReturnCode != "R68" {
+		t.Errorf("transfer status=%s dishonoredReturnCode=%s", repo.Status, ret.DishonoredReturnCode)
+	}
+
+	// or accepted
+	ret.DishonoredReturnCode, ret.DishonoredAt = "", nil
+	repo.Status = ""
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", fmt.Sprintf("/transfers/%s/accept", transfer.ID), nil)
+	r.Header.Set("x-user-id", userID.String())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if repo.Status != model.TransferReclaimed {
+		t.Errorf("transfer status=%s", repo.Status)
+	}
+
+	// only late returns are accepted
+	transfer.Status = model.TransferReclaimed
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", fmt.Sprintf("/transfers/%s/accept", transfer.ID), nil)
+	r.Header.Set("x-user-id", userID.String())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+}
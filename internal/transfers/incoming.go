@@ -0,0 +1,233 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/pkg/id"
+)
+
+// IncomingTransfer is an ACH entry another financial institution originated against one of our Depositories.
+// paygate acts as the RDFI for these entries.
+type IncomingTransfer struct {
+	ID           id.Transfer   `json:"id"`
+	UserID       id.User       `json:"-"`
+	DepositoryID id.Depository `json:"depository"`
+
+	// Type is push for credits into the Depository and pull for debits out of it
+	Type   model.TransferType `json:"type"`
+	Amount model.Amount       `json:"amount"`
+
+	StandardEntryClassCode  string    `json:"standardEntryClassCode"`
+	ServiceClassCode        int       `json:"serviceClassCode"`
+	TransactionCode         int       `json:"transactionCode"`
+	TraceNumber             string    `json:"traceNumber"`
+	CompanyName             string    `json:"companyName"`
+	CompanyIdentification   string    `json:"companyIdentification"`
+	CompanyEntryDescription string    `json:"companyEntryDescription"`
+	IndividualName          string    `json:"individualName"`
+	IdentificationNumber    string    `json:"identificationNumber"`
+	DiscretionaryData       string    `json:"discretionaryData,omitempty"`
+	EffectiveEntryDate      time.Time `json:"effectiveEntryDate"`
+
+	// Origin and Destination are the ImmediateOrigin and ImmediateDestination of the file this entry was received in.
+	Origin      string `json:"origin"`
+	Destination string `json:"destination"`
+	Filename    string `json:"filename"`
+
+	Status        model.TransferStatus `json:"status"`
+	ReturnCode    string               `json:"returnCode,omitempty"`
+	TransactionID string               `json:"transactionID,omitempty"`
+
+	Created time.Time `json:"created"`
+}
+
+// CreateIncomingTransfer saves an IncomingTransfer. The ID and Created fields are expected to be set.
+func (r *SQLRepo) CreateIncomingTransfer(xfer *IncomingTransfer) error {
+	query := `insert into incoming_transfers (transfer_id, user_id, depository_id, type, amount, standard_entry_class_code, transaction_code, trace_number,
+company_name, company_identification, company_entry_description, individual_name, effective_entry_date, origin, destination, filename,
+status, return_code, transaction_id, service_class_code, identification_number, discretionary_data, created_at, last_updated_at)
+values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("CreateIncomingTransfer: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(
+		xfer.ID, xfer.UserID, xfer.DepositoryID, xfer.Type, xfer.Amount.String(), xfer.StandardEntryClassCode, xfer.TransactionCode, xfer.TraceNumber,
+		xfer.CompanyName, xfer.CompanyIdentification, xfer.CompanyEntryDescription, xfer.IndividualName, xfer.EffectiveEntryDate, xfer.Origin, xfer.Destination, xfer.Filename,
+		xfer.Status, xfer.ReturnCode, xfer.TransactionID, xfer.ServiceClassCode, xfer.IdentificationNumber, xfer.DiscretionaryData, xfer.Created, xfer.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("CreateIncomingTransfer: transfer=%s: %v", xfer.ID, err)
+	}
+	return nil
+}
+
+// incomingTransferColumns are selected by every IncomingTransfer query and read with scanIncomingTransfer
+const incomingTransferColumns = `transfer_id, user_id, depository_id, type, amount, standard_entry_class_code, transaction_code, trace_number,
+company_name, company_identification, company_entry_description, individual_name, effective_entry_date, origin, destination, filename,
+status, return_code, transaction_id, service_class_code, identification_number, discretionary_data, created_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanIncomingTransfer(row scanner) (*IncomingTransfer, error) {
+	var xfer IncomingTransfer
+	var amount string
+	err := row.Scan(
+		&xfer.ID, &xfer.UserID, &xfer.DepositoryID, &xfer.Type, &amount, &xfer.StandardEntryClassCode, &xfer.TransactionCode, &xfer.TraceNumber,
+		&xfer.CompanyName, &xfer.CompanyIdentification, &xfer.CompanyEntryDescription, &xfer.IndividualName, &xfer.EffectiveEntryDate, &xfer.Origin, &xfer.Destination, &xfer.Filename,
+		&xfer.Status, &xfer.ReturnCode, &xfer.TransactionID, &xfer.ServiceClassCode, &xfer.IdentificationNumber, &xfer.DiscretionaryData, &xfer.Created,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := xfer.Amount.FromString(amount); err != nil {
+		return nil, fmt.Errorf("transfer=%s amount: %v", xfer.ID, err)
+	}
+	return &xfer, nil
+}
+
+// GetIncomingTransfer returns the IncomingTransfer for transferID or nil if it's not found.
+func (r *SQLRepo) GetIncomingTransfer(transferID id.Transfer) (*IncomingTransfer, error) {
+	query := `select ` + incomingTransferColumns + ` from incoming_transfers where transfer_id = ? limit 1;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetIncomingTransfer: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	xfer, err := scanIncomingTransfer(stmt.QueryRow(transferID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetIncomingTransfer: transfer=%s: %v", transferID, err)
+	}
+	return xfer, nil
+}
+
+// GetIncomingTransferByTraceNumber returns the newest IncomingTransfer received with traceNumber or nil if it's not found.
+func (r *SQLRepo) GetIncomingTransferByTraceNumber(traceNumber string) (*IncomingTransfer, error) {
+	query := `select ` + incomingTransferColumns + ` from incoming_transfers where trace_number = ? order by created_at desc limit 1;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetIncomingTransferByTraceNumber: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	xfer, err := scanIncomingTransfer(stmt.QueryRow(traceNumber))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetIncomingTransferByTraceNumber: traceNumber=%s: %v", traceNumber, err)
+	}
+	return xfer, nil
+}
+
+// GetIncomingTransferForEntry returns the IncomingTransfer recorded for the entry with traceNumber and effectiveEntryDate
+// in filename or nil if it's not found. Entries are retried from a file with the same name.
+func (r *SQLRepo) GetIncomingTransferForEntry(filename string, traceNumber string, effectiveEntryDate time.Time) (*IncomingTransfer, error) {
+	query := `select ` + incomingTransferColumns + ` from incoming_transfers where filename = ? and trace_number = ? and effective_entry_date = ?
+order by created_at desc limit 1;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetIncomingTransferForEntry: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	xfer, err := scanIncomingTransfer(stmt.QueryRow(filename, traceNumber, effectiveEntryDate))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GetIncomingTransferForEntry: filename=%s traceNumber=%s: %v", filename, traceNumber, err)
+	}
+	return xfer, nil
+}
+
+// GetUserIncomingTransfers returns every IncomingTransfer received for a user's Depositories, newest first.
+func (r *SQLRepo) GetUserIncomingTransfers(userID id.User) ([]*IncomingTransfer, error) {
+	query := `select ` + incomingTransferColumns + ` from incoming_transfers where user_id = ? order by created_at desc;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetUserIncomingTransfers: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userID)
+	if err != nil {
+		return nil, fmt.Errorf("GetUserIncomingTransfers: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*IncomingTransfer
+	for rows.Next() {
+		xfer, err := scanIncomingTransfer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetUserIncomingTransfers: scan: %v", err)
+		}
+		out = append(out, xfer)
+	}
+	return out, rows.Err()
+}
+
+// MarkIncomingTransferPosted records the outcome of posting a pending IncomingTransfer against Accounts.
+func (r *SQLRepo) MarkIncomingTransferPosted(transferID id.Transfer, status model.TransferStatus, returnCode string, transactionID string) error {
+	query := `update incoming_transfers set status = ?, return_code = ?, transaction_id = ?, last_updated_at = ? where transfer_id = ? and status = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("MarkIncomingTransferPosted: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(status, returnCode, transactionID, time.Now(), transferID, model.TransferPending)
+	if err != nil {
+		return fmt.Errorf("MarkIncomingTransferPosted: transfer=%s: %v", transferID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("MarkIncomingTransferPosted: transfer=%s is not pending", transferID)
+	}
+	return nil
+}
+
+// DeleteIncomingTransfer removes a pending IncomingTransfer which failed to post so its entry is recorded again
+// when it's retried.
+func (r *SQLRepo) DeleteIncomingTransfer(transferID id.Transfer) error {
+	query := `delete from incoming_transfers where transfer_id = ? and status = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("DeleteIncomingTransfer: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(transferID, model.TransferPending); err != nil {
+		return fmt.Errorf("DeleteIncomingTransfer: transfer=%s: %v", transferID, err)
+	}
+	return nil
+}
+
+// UpdateIncomingTransferStatus sets the status and return code of an IncomingTransfer.
+func (r *SQLRepo) UpdateIncomingTransferStatus(transferID id.Transfer, status model.TransferStatus, returnCode string) error {
+	query := `update incoming_transfers set status = ?, return_code = ?, last_updated_at = ? where transfer_id = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("UpdateIncomingTransferStatus: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(status, returnCode, time.Now(), transferID); err != nil {
+		return fmt.Errorf("UpdateIncomingTransferStatus: transfer=%s: %v", transferID, err)
+	}
+	return nil
+}
@@ -0,0 +1,471 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/moov-io/ach"
+	"github.com/moov-io/base"
+	"github.com/moov-io/base/admin"
+	moovhttp "github.com/moov-io/base/http"
+	"github.com/moov-io/paygate/internal/accounts"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/events"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/route"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// ReturnDeadlineWarning is how long before a return's deadline we warn about it still needing to be sent.
+	ReturnDeadlineWarning = func() time.Duration {
+		if v := os.Getenv("ACH_RETURN_DEADLINE_WARNING"); v != "" {
+			if dur, _ := time.ParseDuration(v); dur > 0 {
+				return dur
+			}
+		}
+		return 24 * time.Hour
+	}()
+
+	incomingReturnsNearDeadline = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "incoming_returns_near_deadline",
+		Help: "Counter of returns created for incoming transfers close to their NACHA deadline",
+	}, []string{"return_code"})
+
+	errIncomingTransferNotFound = errors.New("incoming transfer not found")
+	errReturnDeadlinePassed     = errors.New("return deadline has passed")
+)
+
+// IncomingReturn is a return we're sending (as the RDFI) back to the ODFI of an IncomingTransfer.
+type IncomingReturn struct {
+	TransferID id.Transfer `json:"transferID"`
+	UserID     id.User     `json:"-"`
+
+	ReturnCode         string     `json:"returnCode"`
+	DateOfDeath        *time.Time `json:"dateOfDeath,omitempty"`
+	AddendaInformation string     `json:"addendaInformation,omitempty"`
+
+	// Deadline is the latest the return can be sent to the ODFI
+	Deadline time.Time `json:"deadline"`
+	Warning  string    `json:"warning,omitempty"`
+
+	// MergedFilename is set once the return is merged into an outbound file
+	MergedFilename string    `json:"mergedFilename,omitempty"`
+	Created        time.Time `json:"created"`
+}
+
+type incomingReturnRequest struct {
+	ReturnCode         string     `json:"returnCode"`
+	DateOfDeath        *time.Time `json:"dateOfDeath,omitempty"`
+	AddendaInformation string     `json:"addendaInformation,omitempty"`
+}
+
+// sixtyDayReturnCodes are returns for unauthorized entries to consumer accounts which the RDFI
+// has 60 calendar days to send. All other returns need to be sent within two banking days.
+var sixtyDayReturnCodes = map[string]bool{
+	"R05": true, // Unauthorized Debit to Consumer Account
+	"R07": true, // Authorization Revoked by Customer
+	"R10": true, // Customer Advises Not Authorized
+	"R11": true, // Customer Advises Entry Not in Accordance with the Terms of the Authorization
+	"R37": true, // Source Document Presented for Payment
+	"R38": true, // Stop Payment on Source Document
+	"R51": true, // Item is Ineligible, Notice Not Provided, etc
+	"R52": true, // Stop Payment on Item
+	"R53": true, // Item and ACH Entry Presented for Payment
+}
+
+// ReturnDeadline returns the latest time a return with code can be sent for an entry settled on effectiveEntryDate.
+func ReturnDeadline(code string, effectiveEntryDate time.Time) time.Time {
+	start := time.Date(effectiveEntryDate.Year(), effectiveEntryDate.Month(), effectiveEntryDate.Day(), 0, 0, 0, 0, time.UTC)
+	if sixtyDayReturnCodes[strings.ToUpper(code)] {
+		return start.AddDate(0, 0, 60).Add(24 * time.Hour)
+	}
+	return addBankingDays(start, 2).Add(24 * time.Hour)
+}
+
+// addBankingDays returns t moved forward n banking days. base.Time's AddBankingDay adds n calendar days
+// before moving to the next banking day, so we step forward one banking day at a time.
+func addBankingDays(t time.Time, n int) time.Time {
+	bt := base.NewTime(t)
+	for i := 0; i < n; i++ {
+		bt = bt.AddBankingDay(1)
+	}
+	return bt.Time
+}
+
+// returnDeadlineWarning returns a non-empty warning when deadline is within ReturnDeadlineWarning of now.
+func returnDeadlineWarning(deadline time.Time, now time.Time) string {
+	if left := deadline.Sub(now); left < ReturnDeadlineWarning {
+		return fmt.Sprintf("return deadline of %s is in %v", deadline.Format(time.RFC3339), left.Truncate(time.Minute))
+	}
+	return ""
+}
+
+func validateIncomingReturnRequest(req incomingReturnRequest) error {
+	code := ach.LookupReturnCode(req.ReturnCode)
+	if code == nil {
+		return fmt.Errorf("unknown returnCode %q", req.ReturnCode)
+	}
+	// R61 and above are dishonored, contested dishonored and ACH Operator returns which an RDFI doesn't send
+	if code.Code >= "R61" {
+		return fmt.Errorf("returnCode %s can't be used to return an incoming transfer", code.Code)
+	}
+	if (code.Code == "R14" || code.Code == "R15") && req.DateOfDeath == nil {
+		return fmt.Errorf("returnCode %s requires dateOfDeath", code.Code)
+	}
+	if len(req.AddendaInformation) > 44 {
+		return errors.New("addendaInformation is longer than 44 characters")
+	}
+	return nil
+}
+
+// createIncomingReturn queues a return of xfer for merging into an outbound file. The transfer's Accounts transaction
+// is reversed and an event is written.
+func createIncomingReturn(logger log.Logger, repo Repository, accountsClient accounts.Client, eventRepo events.Repository, xfer *IncomingTransfer, req incomingReturnRequest, requestID string) (*IncomingReturn, error) {
+	if err := validateIncomingReturnRequest(req); err != nil {
+		return nil, err
+	}
+	if xfer.Status != model.TransferProcessed && xfer.Status != model.TransferFailed {
+		return nil, fmt.Errorf("incoming transfer=%s can't be returned with status %s", xfer.ID, xfer.Status)
+	}
+
+	now := time.Now()
+	ret := &IncomingReturn{
+		TransferID:         xfer.ID,
+		UserID:             xfer.UserID,
+		ReturnCode:         strings.ToUpper(req.ReturnCode),
+		DateOfDeath:        req.DateOfDeath,
+		AddendaInformation: req.AddendaInformation,
+		Deadline:           ReturnDeadline(req.ReturnCode, xfer.EffectiveEntryDate),
+		Created:            now,
+	}
+	if now.After(ret.Deadline) {
+		return nil, fmt.Errorf("incoming transfer=%s: %v (%s)", xfer.ID, errReturnDeadlinePassed, ret.Deadline.Format(time.RFC3339))
+	}
+	if ret.Warning = returnDeadlineWarning(ret.Deadline, now); ret.Warning != "" {
+		incomingReturnsNearDeadline.With("return_code", ret.ReturnCode).Add(1)
+		logger.Log("incoming-returns", fmt.Sprintf("WARNING: incoming transfer=%s %s", xfer.ID, ret.Warning), "requestID", requestID, "userID", xfer.UserID)
+	}
+
+	// Reverse the posted transaction against Accounts. The return is only saved if the reversal succeeds.
+	reverse := func() error {
+		if accountsClient != nil && xfer.TransactionID != "" && xfer.Status == model.TransferProcessed {
+			if err := accountsClient.ReverseTransaction(requestID, xfer.UserID, xfer.TransactionID); err != nil {
+				return fmt.Errorf("problem with accounts ReverseTransaction: %v", err)
+			}
+		}
+		return nil
+	}
+	if err := repo.CreateIncomingReturn(ret, reverse); err != nil {
+		return nil, err
+	}
+
+	if eventRepo != nil {
+		err := eventRepo.WriteEvent(xfer.UserID, &events.Event{
+			ID:      events.EventID(base.ID()),
+			Topic:   fmt.Sprintf("returning incoming %s transfer from %s", xfer.Type, xfer.CompanyName),
+			Message: fmt.Sprintf("%s returned with %s", xfer.Amount.String(), ret.ReturnCode),
+			Type:    events.IncomingTransferEvent,
+			Metadata: map[string]string{
+				"transferID": string(xfer.ID),
+				"returnCode": ret.ReturnCode,
+			},
+		})
+		if err != nil {
+			logger.Log("incoming-returns", fmt.Sprintf("problem writing incoming transfer=%s return event", xfer.ID), "error", err, "requestID", requestID)
+		}
+	}
+	logger.Log("incoming-returns", fmt.Sprintf("queued return of incoming transfer=%s with returnCode=%s", xfer.ID, ret.ReturnCode), "requestID", requestID, "userID", xfer.UserID)
+	return ret, nil
+}
+
+// CreateIncomingReturn saves an IncomingReturn which hasn't been merged yet and marks its IncomingTransfer as reclaimed.
+// Only one return can exist for an IncomingTransfer.
+//
+// reverse (if non-nil) is called before the changes are committed, which are rolled back if it returns an error.
+func (r *SQLRepo) CreateIncomingReturn(ret *IncomingReturn, reverse func() error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("CreateIncomingReturn: begin: %v", err)
+	}
+
+	query := `insert into incoming_transfer_returns (transfer_id, user_id, return_code, date_of_death, addenda_information, deadline, created_at) values (?, ?, ?, ?, ?, ?, ?);`
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("CreateIncomingReturn: prepare: %v rollback=%v", err, tx.Rollback())
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(ret.TransferID, ret.UserID, ret.ReturnCode, ret.DateOfDeath, ret.AddendaInformation, ret.Deadline, ret.Created); err != nil {
+		if database.UniqueViolation(err) {
+			tx.Rollback()
+			return fmt.Errorf("incoming transfer=%s has already been returned", ret.TransferID)
+		}
+		return fmt.Errorf("CreateIncomingReturn: transfer=%s: %v rollback=%v", ret.TransferID, err, tx.Rollback())
+	}
+
+	query = `update incoming_transfers set status = ?, return_code = ?, last_updated_at = ? where transfer_id = ?;`
+	statusStmt, err := tx.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("CreateIncomingReturn: prepare status: %v rollback=%v", err, tx.Rollback())
+	}
+	defer statusStmt.Close()
+
+	if _, err := statusStmt.Exec(model.TransferReclaimed, ret.ReturnCode, time.Now(), ret.TransferID); err != nil {
+		return fmt.Errorf("CreateIncomingReturn: transfer=%s status: %v rollback=%v", ret.TransferID, err, tx.Rollback())
+	}
+
+	if reverse != nil {
+		if err := reverse(); err != nil {
+			return fmt.Errorf("%v rollback=%v", err, tx.Rollback())
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPendingIncomingReturns returns IncomingReturn objects which haven't been merged into an outbound file.
+func (r *SQLRepo) GetPendingIncomingReturns() ([]*IncomingReturn, error) {
+	query := `select transfer_id, user_id, return_code, date_of_death, addenda_information, deadline, created_at from incoming_transfer_returns
+where merged_filename is null order by created_at asc;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("GetPendingIncomingReturns: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("GetPendingIncomingReturns: query: %v", err)
+	}
+	defer rows.Close()
+
+	var out []*IncomingReturn
+	for rows.Next() {
+		var ret IncomingReturn
+		var addendaInformation *string
+		if err := rows.Scan(&ret.TransferID, &ret.UserID, &ret.ReturnCode, &ret.DateOfDeath, &addendaInformation, &ret.Deadline, &ret.Created); err != nil {
+			return nil, fmt.Errorf("GetPendingIncomingReturns: scan: %v", err)
+		}
+		if addendaInformation != nil {
+			ret.AddendaInformation = *addendaInformation
+		}
+		out = append(out, &ret)
+	}
+	return out, rows.Err()
+}
+
+// MarkIncomingReturnMerged records which outbound file an IncomingReturn was merged into.
+func (r *SQLRepo) MarkIncomingReturnMerged(transferID id.Transfer, filename string) error {
+	query := `update incoming_transfer_returns set merged_filename = ?, merged_at = ? where transfer_id = ? and merged_filename is null;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("MarkIncomingReturnMerged: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(filename, time.Now(), transferID); err != nil {
+		return fmt.Errorf("MarkIncomingReturnMerged: transfer=%s: %v", transferID, err)
+	}
+	return nil
+}
+
+// DishonorIncomingReturn records the ODFI dishonoring our return of an IncomingTransfer. The IncomingTransfer is
+// updated with status and the Accounts transaction it was posted again with.
+func (r *SQLRepo) DishonorIncomingReturn(transferID id.Transfer, returnCode string, status model.TransferStatus, transactionID string) error {
+	query := `update incoming_transfers set status = ?, transaction_id = ?, last_updated_at = ? where transfer_id = ?;`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("DishonorIncomingReturn: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	if _, err := stmt.Exec(status, transactionID, now, transferID); err != nil {
+		return fmt.Errorf("DishonorIncomingReturn: transfer=%s: %v", transferID, err)
+	}
+
+	// Returns created automatically when the entry was received aren't saved, so there might not be a row to update.
+	query = `update incoming_transfer_returns set dishonored_return_code = ?, dishonored_at = ? where transfer_id = ?;`
+	stmt, err = r.db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("DishonorIncomingReturn: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(returnCode, now, transferID); err != nil {
+		return fmt.Errorf("DishonorIncomingReturn: transfer=%s: %v", transferID, err)
+	}
+	return nil
+}
+
+func (c *TransferRouter) getUserIncomingTransfers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+
+		xfers, err := c.transferRepo.GetUserIncomingTransfers(responder.XUserID)
+		if err != nil {
+			responder.Log("incoming-transfers", fmt.Sprintf("error getting incoming transfers: %v", err))
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(xfers)
+		})
+	}
+}
+
+// getUserIncomingTransfer reads the IncomingTransfer from the request's path if it belongs to userID
+func (c *TransferRouter) getUserIncomingTransfer(r *http.Request, userID id.User) (*IncomingTransfer, error) {
+	xfer, err := c.transferRepo.GetIncomingTransfer(getTransferID(r))
+	if err != nil {
+		return nil, err
+	}
+	if xfer == nil || xfer.UserID != userID {
+		return nil, errIncomingTransferNotFound
+	}
+	return xfer, nil
+}
+
+func (c *TransferRouter) getIncomingTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+
+		xfer, err := c.getUserIncomingTransfer(r, responder.XUserID)
+		if err != nil {
+			if err == errIncomingTransferNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(xfer)
+		})
+	}
+}
+
+func (c *TransferRouter) returnIncomingTransfer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+
+		var req incomingReturnRequest
+		if err := json.NewDecoder(route.Read(r.Body)).Decode(&req); err != nil {
+			responder.Problem(err)
+			return
+		}
+		xfer, err := c.getUserIncomingTransfer(r, responder.XUserID)
+		if err != nil {
+			if err == errIncomingTransferNotFound {
+				http.NotFound(w, r)
+				return
+			}
+			responder.Problem(err)
+			return
+		}
+		ret, err := createIncomingReturn(c.logger, c.transferRepo, c.accountsClient, c.eventRepo, xfer, req, responder.XRequestID)
+		if err != nil {
+			responder.Log("incoming-transfers", fmt.Sprintf("problem returning incoming transfer=%s: %v", xfer.ID, err))
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(ret)
+		})
+	}
+}
+
+// RegisterAdminRoutes adds admin routes for returning incoming transfers on behalf of users
+// and listing returns which haven't been merged for upload yet.
+func RegisterAdminRoutes(logger log.Logger, svc *admin.Server, repo Repository, accountsClient accounts.Client, eventRepo events.Repository) {
+	svc.AddHandler("/incoming-transfers/returns", getPendingIncomingReturns(logger, repo))
+	svc.AddHandler("/incoming-transfers/{transferId}/return", adminReturnIncomingTransfer(logger, repo, accountsClient, eventRepo))
+}
+
+func getPendingIncomingReturns(logger log.Logger, repo Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		returns, err := repo.GetPendingIncomingReturns()
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		now := time.Now()
+		for i := range returns {
+			returns[i].Warning = returnDeadlineWarning(returns[i].Deadline, now)
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(returns)
+	}
+}
+
+func adminReturnIncomingTransfer(logger log.Logger, repo Repository, accountsClient accounts.Client, eventRepo events.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			moovhttp.Problem(w, fmt.Errorf("unsupported HTTP verb %s", r.Method))
+			return
+		}
+
+		var req incomingReturnRequest
+		if err := json.NewDecoder(route.Read(r.Body)).Decode(&req); err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		xfer, err := repo.GetIncomingTransfer(getTransferID(r))
+		if err != nil {
+			moovhttp.Problem(w, err)
+			return
+		}
+		if xfer == nil {
+			http.NotFound(w, r)
+			return
+		}
+		ret, err := createIncomingReturn(logger, repo, accountsClient, eventRepo, xfer, req, moovhttp.GetRequestID(r))
+		if err != nil {
+			logger.Log("incoming-transfers", fmt.Sprintf("problem returning incoming transfer=%s", xfer.ID), "error", err, "requestID", moovhttp.GetRequestID(r))
+			moovhttp.Problem(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(ret)
+	}
+}
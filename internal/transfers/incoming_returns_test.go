@@ -0,0 +1,304 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	moovadmin "github.com/moov-io/base/admin"
+	"github.com/moov-io/paygate/internal/accounts"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func testIncomingTransfer(effective time.Time) *IncomingTransfer {
+	amt, _ := model.NewAmount("USD", "12.42")
+	return &IncomingTransfer{
+		ID:                     id.Transfer(base.ID()),
+		UserID:                 id.User(base.ID()),
+		DepositoryID:           id.Depository(base.ID()),
+		Type:                   model.PullTransfer,
+		Amount:                 *amt,
+		StandardEntryClassCode: "PPD",
+		ServiceClassCode:       225,
+		TransactionCode:        27,
+		TraceNumber:            "076401255655291",
+		CompanyName:            "Acme Corp",
+		EffectiveEntryDate:     effective,
+		Origin:                 "076401251",
+		Destination:            "053200019",
+		Filename:               "inbound.ach",
+		Status:                 model.TransferProcessed,
+		TransactionID:          base.ID(),
+		Created:                time.Now(),
+	}
+}
+
+func TestIncomingReturns__ReturnDeadline(t *testing.T) {
+	// Friday, two banking days later is Wednesday since Monday is a holiday
+	effective := time.Date(2020, time.January, 17, 0, 0, 0, 0, time.UTC)
+	if deadline := ReturnDeadline("R01", effective); !deadline.Equal(time.Date(2020, time.January, 23, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("R01 deadline=%v", deadline)
+	}
+	// Unauthorized consumer returns have 60 calendar days
+	if deadline := ReturnDeadline("R10", effective); !deadline.Equal(time.Date(2020, time.March, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("R10 deadline=%v", deadline)
+	}
+}
+
+func TestIncomingReturns__returnDeadlineWarning(t *testing.T) {
+	now := time.Now()
+	if msg := returnDeadlineWarning(now.Add(2*time.Hour), now); msg == "" {
+		t.Error("expected warning")
+	}
+	if msg := returnDeadlineWarning(now.Add(ReturnDeadlineWarning+time.Hour), now); msg != "" {
+		t.Errorf("unexpected warning: %s", msg)
+	}
+}
+
+func TestIncomingReturns__validate(t *testing.T) {
+	if err := validateIncomingReturnRequest(incomingReturnRequest{ReturnCode: "R01"}); err != nil {
+		t.Error(err)
+	}
+	if err := validateIncomingReturnRequest(incomingReturnRequest{ReturnCode: "R99"}); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateIncomingReturnRequest(incomingReturnRequest{ReturnCode: "R61"}); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateIncomingReturnRequest(incomingReturnRequest{ReturnCode: "R14"}); err == nil {
+		t.Error("expected error")
+	}
+	if err := validateIncomingReturnRequest(incomingReturnRequest{ReturnCode: "R01", AddendaInformation: strings.Repeat("a", 45)}); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestIncomingReturns__createIncomingReturn(t *testing.T) {
+	repo := &MockRepository{}
+	accountsClient := &accounts.MockClient{}
+
+	xfer := testIncomingTransfer(time.Now())
+	repo.IncomingTransfers = append(repo.IncomingTransfers, xfer)
+
+	ret, err := createIncomingReturn(log.NewNopLogger(), repo, accountsClient, nil, xfer, incomingReturnRequest{ReturnCode: "r01"}, base.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.ReturnCode != "R01" || ret.Deadline.Before(time.Now()) {
+		t.Errorf("unexpected return: %#v", ret)
+	}
+	if len(repo.IncomingReturns) != 1 {
+		t.Errorf("got %d returns", len(repo.IncomingReturns))
+	}
+
+	// expired deadline
+	xfer = testIncomingTransfer(time.Now().Add(-10 * 24 * time.Hour))
+	if _, err := createIncomingReturn(log.NewNopLogger(), repo, accountsClient, nil, xfer, incomingReturnRequest{ReturnCode: "R01"}, base.ID()); err == nil {
+		t.Error("expected error")
+	} else if !strings.Contains(err.Error(), errReturnDeadlinePassed.Error()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// already returned
+	xfer.EffectiveEntryDate = time.Now()
+	xfer.Status = model.TransferReclaimed
+	if _, err := createIncomingReturn(log.NewNopLogger(), repo, accountsClient, nil, xfer, incomingReturnRequest{ReturnCode: "R01"}, base.ID()); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestIncomingReturns__SQLRepo(t *testing.T) {
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	repo := NewTransferRepo(log.NewNopLogger(), sqliteDB.DB)
+
+	xfer := testIncomingTransfer(time.Now().Truncate(24 * time.Hour))
+	if err := repo.CreateIncomingTransfer(xfer); err != nil {
+		t.Fatal(err)
+	}
+
+	dateOfDeath := time.Date(2020, time.January, 2, 0, 0, 0, 0, time.UTC)
+	ret, err := createIncomingReturn(log.NewNopLogger(), repo, &accounts.MockClient{}, nil, xfer, incomingReturnRequest{
+		ReturnCode:         "R15",
+		DateOfDeath:        &dateOfDeath,
+		AddendaInformation: "deceased",
+	}, base.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := repo.GetIncomingTransfer(xfer.ID)
+	if err != nil || found == nil {
+		t.Fatalf("transfer=%v error=%v", found, err)
+	}
+	if found.Status != model.TransferReclaimed || found.ReturnCode != "R15" {
+		t.Errorf("unexpected incoming transfer: %#v", found)
+	}
+
+	// a second return is rejected
+	if err := repo.CreateIncomingReturn(ret, nil); err == nil {
+		t.Error("expected error")
+	}
+
+	returns, err := repo.GetPendingIncomingReturns()
+	if err != nil || len(returns) != 1 {
+		t.Fatalf("got %d returns: %v", len(returns), err)
+	}
+	if returns[0].TransferID != xfer.ID || returns[0].DateOfDeath == nil || returns[0].AddendaInformation != "deceased" {
+		t.Errorf("unexpected return: %#v", returns[0])
+	}
+
+	if err := repo.MarkIncomingReturnMerged(xfer.ID, "merged.ach"); err != nil {
+		t.Fatal(err)
+	}
+	if returns, err := repo.GetPendingIncomingReturns(); err != nil || len(returns) != 0 {
+		t.Errorf("got %d returns: %v", len(returns), err)
+	}
+
+	xfers, err := repo.GetUserIncomingTransfers(xfer.UserID)
+	if err != nil || len(xfers) != 1 {
+		t.Errorf("got %d incoming transfers: %v", len(xfers), err)
+	}
+}
+
+func TestIncomingReturns__reversalFailed(t *testing.T) {
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	repo := NewTransferRepo(log.NewNopLogger(), sqliteDB.DB)
+
+	xfer := testIncomingTransfer(time.Now().Truncate(24 * time.Hour))
+	if err := repo.CreateIncomingTransfer(xfer); err != nil {
+		t.Fatal(err)
+	}
+
+	accountsClient := &accounts.MockClient{Err: errors.New("bad error")}
+	if _, err := createIncomingReturn(log.NewNopLogger(), repo, accountsClient, nil, xfer, incomingReturnRequest{ReturnCode: "R10"}, base.ID()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// nothing was saved, so the transfer can be returned once Accounts recovers
+	found, err := repo.GetIncomingTransfer(xfer.ID)
+	if err != nil || found == nil {
+		t.Fatalf("transfer=%v error=%v", found, err)
+	}
+	if found.Status != model.TransferProcessed || found.ReturnCode != "" {
+		t.Errorf("unexpected incoming transfer: %#v", found)
+	}
+	if returns, err := repo.GetPendingIncomingReturns(); err != nil || len(returns) != 0 {
+		t.Fatalf("got %d returns: %v", len(returns), err)
+	}
+
+	accountsClient.Err = nil
+	if _, err := createIncomingReturn(log.NewNopLogger(), repo, accountsClient, nil, xfer, incomingReturnRequest{ReturnCode: "R10"}, base.ID()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncomingReturns__routes(t *testing.T) {
+	repo := &MockRepository{}
+	xfer := testIncomingTransfer(time.Now())
+	repo.IncomingTransfers = append(repo.IncomingTransfers, xfer)
+
+	xferRouter := CreateTestTransferRouter(nil, nil, nil, nil, repo)
+	defer xferRouter.close()
+
+	router := mux.NewRouter()
+	xferRouter.RegisterRoutes(router)
+
+	// list
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/incoming-transfers", nil)
+	r.Header.Set("x-user-id", xfer.UserID.String())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	var xfers []*IncomingTransfer
+	if err := json.NewDecoder(w.Body).Decode(&xfers); err != nil || len(xfers) != 1 {
+		t.Fatalf("got %d incoming transfers: %v", len(xfers), err)
+	}
+
+	// another user can't read the transfer
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", fmt.Sprintf("/incoming-transfers/%s", xfer.ID), nil)
+	r.Header.Set("x-user-id", base.ID())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d", w.Code)
+	}
+
+	// return
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", fmt.Sprintf("/incoming-transfers/%s/return", xfer.ID), strings.NewReader(`{"returnCode": "R10"}`))
+	r.Header.Set("x-user-id", xfer.UserID.String())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d: %s", w.Code, w.Body.String())
+	}
+	var ret IncomingReturn
+	if err := json.NewDecoder(w.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.TransferID != xfer.ID || ret.ReturnCode != "R10" {
+		t.Errorf("unexpected return: %#v", ret)
+	}
+}
+
+func TestIncomingReturns__adminRoutes(t *testing.T) {
+	svc := moovadmin.NewServer(":0")
+	go svc.Listen()
+	defer svc.Shutdown()
+
+	// the last day an unauthorized return can be sent
+	repo := &MockRepository{}
+	xfer := testIncomingTransfer(time.Now().UTC().AddDate(0, 0, -60))
+	repo.IncomingTransfers = append(repo.IncomingTransfers, xfer)
+
+	RegisterAdminRoutes(log.NewNopLogger(), svc, repo, &accounts.MockClient{}, nil)
+
+	addr := fmt.Sprintf("http://%s/incoming-transfers/%s/return", svc.BindAddr(), xfer.ID)
+	resp, err := http.DefaultClient.Post(addr, "application/json", strings.NewReader(`{"returnCode": "R10"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(resp.Body)
+		t.Errorf("bogus HTTP status: %s: %v", resp.Status, string(bs))
+	}
+
+	resp, err = http.DefaultClient.Get(fmt.Sprintf("http://%s/incoming-transfers/returns", svc.BindAddr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var returns []*IncomingReturn
+	if err := json.NewDecoder(resp.Body).Decode(&returns); err != nil || len(returns) != 1 {
+		t.Fatalf("got %d returns: %v", len(returns), err)
+	}
+	if returns[0].TransferID != xfer.ID || returns[0].Warning == "" {
+		t.Errorf("unexpected return: %#v", returns[0])
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestTransfers__IncomingTransfers(t *testing.T) {
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+
+	repo := NewTransferRepo(log.NewNopLogger(), sqliteDB.DB)
+
+	amt, _ := model.NewAmount("USD", "12.42")
+	xfer := &IncomingTransfer{
+		ID:                     id.Transfer(base.ID()),
+		UserID:                 id.User(base.ID()),
+		DepositoryID:           id.Depository(base.ID()),
+		Type:                   model.PushTransfer,
+		Amount:                 *amt,
+		StandardEntryClassCode: "PPD",
+		TransactionCode:        22,
+		TraceNumber:            "076401255655291",
+		CompanyName:            "Acme Corp",
+		EffectiveEntryDate:     time.Now().Truncate(24 * time.Hour),
+		Origin:                 "076401251",
+		Destination:            "053200019",
+		Filename:               "inbound.ach",
+		Status:                 model.TransferProcessed,
+		Created:                time.Now(),
+	}
+	if err := repo.CreateIncomingTransfer(xfer); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := repo.GetIncomingTransfer(xfer.ID)
+	if err != nil || found == nil {
+		t.Fatalf("transfer=%v error=%v", found, err)
+	}
+	if found.UserID != xfer.UserID || found.Amount.String() != "USD 12.42" || found.TransactionCode != 22 || found.Status != model.TransferProcessed {
+		t.Errorf("unexpected incoming transfer: %#v", found)
+	}
+
+	// missing
+	if found, err := repo.GetIncomingTransfer(id.Transfer(base.ID())); found != nil || err != nil {
+		t.Errorf("transfer=%v error=%v", found, err)
+	}
+}
@@ -17,6 +17,14 @@ type MockRepository struct {
 	Xfer   *model.Transfer
 	FileID string
 
+	MergedTransfers []*MergedTransfer
+	AbandonedFiles  []string
+
+	IncomingTransfers []*IncomingTransfer
+	IncomingReturns   []*IncomingReturn
+
+	TransferReturns []*TransferReturn
+
 	Cur *Cursor
 
 	Err error
@@ -43,6 +51,13 @@ func (r *MockRepository) getUserTransfer(id id.Transfer, userID id.User) (*model
 	return r.Xfer, nil
 }
 
+func (r *MockRepository) GetTransfer(id id.Transfer) (*model.Transfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.Xfer, nil
+}
+
 func (r *MockRepository) UpdateTransferStatus(id id.Transfer, status model.TransferStatus) error {
 	r.Status = status
 	return r.Err
@@ -62,6 +77,20 @@ func (r *MockRepository) LookupTransferFromReturn(sec string, amount *model.Amou
 	return r.Xfer, nil
 }
 
+func (r *MockRepository) LookupTransferFromTrace(traceNumber string, amount *model.Amount) (*model.Transfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.Xfer, nil
+}
+
+func (r *MockRepository) LookupTransferFromNOC(traceNumber string) (*model.Transfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.Xfer, nil
+}
+
 func (r *MockRepository) SetReturnCode(id id.Transfer, returnCode string) error {
 	r.ReturnCode = returnCode
 	return r.Err
@@ -71,10 +100,272 @@ func (r *MockRepository) GetCursor(batchSize int, depRepo depository.Repository)
 	return r.Cur
 }
 
-func (r *MockRepository) MarkTransferAsMerged(id id.Transfer, filename string, traceNumber string) error {
+func (r *MockRepository) MarkTransferAsMerged(id id.Transfer, filename string, effectiveEntryDate time.Time, traceNumbers []string) error {
+	return r.Err
+}
+
+func (r *MockRepository) ClaimTransfer(id id.Transfer, owner string, ttl time.Duration) (bool, error) {
+	if r.Err != nil {
+		return false, r.Err
+	}
+	return true, nil
+}
+
+func (r *MockRepository) UpdateEffectiveEntryDate(filename string, traceNumber string, effectiveEntryDate time.Time) error {
+	return r.Err
+}
+
+func (r *MockRepository) ReleaseTransferClaim(id id.Transfer, owner string) error {
+	return r.Err
+}
+
+func (r *MockRepository) GetMergedTransfers(filename string) ([]*MergedTransfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.MergedTransfers, nil
+}
+
+func (r *MockRepository) UnmergeTransfer(id id.Transfer, filename string) error {
+	if r.Err == nil {
+		r.Status = model.TransferCanceled
+	}
+	return r.Err
+}
+
+func (r *MockRepository) RequeueMergedFile(filename string) error {
+	if r.Err == nil {
+		r.Status = model.TransferPending
+	}
+	return r.Err
+}
+
+func (r *MockRepository) GetAbandonedMergedFiles(owner string, routingNumber string) ([]string, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.AbandonedFiles, nil
+}
+
+func (r *MockRepository) CreateIncomingTransfer(xfer *IncomingTransfer) error {
+	if r.Err == nil {
+		r.IncomingTransfers = append(r.IncomingTransfers, xfer)
+	}
+	return r.Err
+}
+
+func (r *MockRepository) GetIncomingTransfer(id id.Transfer) (*IncomingTransfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	for i := range r.IncomingTransfers {
+		if r.IncomingTransfers[i].ID == id {
+			return r.IncomingTransfers[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MockRepository) GetUserIncomingTransfers(userID id.User) ([]*IncomingTransfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	var out []*IncomingTransfer
+	for i := range r.IncomingTransfers {
+		if r.IncomingTransfers[i].UserID == userID {
+			out = append(out, r.IncomingTransfers[i])
+		}
+	}
+	return out, nil
+}
+
+func (r *MockRepository) GetIncomingTransferForEntry(filename string, traceNumber string, effectiveEntryDate time.Time) (*IncomingTransfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	for i := range r.IncomingTransfers {
+		xfer := r.IncomingTransfers[i]
+		if xfer.Filename == filename && xfer.TraceNumber == traceNumber && xfer.EffectiveEntryDate.Equal(effectiveEntryDate) {
+			return xfer, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MockRepository) MarkIncomingTransferPosted(id id.Transfer, status model.TransferStatus, returnCode string, transactionID string) error {
+	if r.Err == nil {
+		r.Status = status
+		r.ReturnCode = returnCode
+	}
+	return r.Err
+}
+
+func (r *MockRepository) DeleteIncomingTransfer(id id.Transfer) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	for i := range r.IncomingTransfers {
+		if r.IncomingTransfers[i].ID == id {
+			r.IncomingTransfers = append(r.IncomingTransfers[:i], r.IncomingTransfers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *MockRepository) UpdateIncomingTransferStatus(id id.Transfer, status model.TransferStatus, returnCode string) error {
+	if r.Err == nil {
+		r.Status = status
+		r.ReturnCode = returnCode
+	}
+	return r.Err
+}
+
+func (r *MockRepository) CreateIncomingReturn(ret *IncomingReturn, reverse func() error) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	if reverse != nil {
+		if err := reverse(); err != nil {
+			return err
+		}
+	}
+	r.IncomingReturns = append(r.IncomingReturns, ret)
+	r.Status = model.TransferReclaimed
+	return nil
+}
+
+func (r *MockRepository) GetPendingIncomingReturns() ([]*IncomingReturn, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	var out []*IncomingReturn
+	for i := range r.IncomingReturns {
+		if r.IncomingReturns[i].MergedFilename == "" {
+			out = append(out, r.IncomingReturns[i])
+		}
+	}
+	return out, nil
+}
+
+func (r *MockRepository) MarkIncomingReturnMerged(id id.Transfer, filename string) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	for i := range r.IncomingReturns {
+		if r.IncomingReturns[i].TransferID == id {
+			r.IncomingReturns[i].MergedFilename = filename
+		}
+	}
+	return nil
+}
+
+func (r *MockRepository) GetIncomingTransferByTraceNumber(traceNumber string) (*IncomingTransfer, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	for i := range r.IncomingTransfers {
+		if r.IncomingTransfers[i].TraceNumber == traceNumber {
+			return r.IncomingTransfers[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MockRepository) DishonorIncomingReturn(id id.Transfer, returnCode string, status model.TransferStatus, transactionID string) error {
+	if r.Err == nil {
+		r.Status = status
+		r.ReturnCode = returnCode
+	}
+	return r.Err
+}
+
+func (r *MockRepository) CreateTransferReturn(ret *TransferReturn) error {
+	if r.Err == nil {
+		r.TransferReturns = append(r.TransferReturns, ret)
+	}
 	return r.Err
 }
 
+func (r *MockRepository) GetTransferReturn(id id.Transfer) (*TransferReturn, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	for i := range r.TransferReturns {
+		if r.TransferReturns[i].TransferID == id {
+			return r.TransferReturns[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MockRepository) LookupDishonoredTransferReturn(originalTrace string) (*TransferReturn, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	for i := range r.TransferReturns {
+		if r.TransferReturns[i].OriginalTrace == originalTrace && r.TransferReturns[i].DishonoredReturnCode != "" {
+			return r.TransferReturns[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *MockRepository) DishonorTransferReturn(id id.Transfer, returnCode string, addendaInformation string, transactionID string) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	for i := range r.TransferReturns {
+		if r.TransferReturns[i].TransferID == id {
+			now := time.Now()
+			r.TransferReturns[i].DishonoredReturnCode = returnCode
+			r.TransferReturns[i].DishonoredAddendaInformation = addendaInformation
+			r.TransferReturns[i].DishonoredTransactionID = transactionID
+			r.TransferReturns[i].DishonoredAt = &now
+		}
+	}
+	return nil
+}
+
+func (r *MockRepository) GetPendingDishonoredReturns() ([]*TransferReturn, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	var out []*TransferReturn
+	for i := range r.TransferReturns {
+		if r.TransferReturns[i].DishonoredReturnCode != "" && r.TransferReturns[i].MergedFilename == "" {
+			out = append(out, r.TransferReturns[i])
+		}
+	}
+	return out, nil
+}
+
+func (r *MockRepository) MarkDishonoredReturnMerged(id id.Transfer, filename string) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	for i := range r.TransferReturns {
+		if r.TransferReturns[i].TransferID == id {
+			r.TransferReturns[i].MergedFilename = filename
+		}
+	}
+	return nil
+}
+
+func (r *MockRepository) ContestTransferReturn(id id.Transfer, returnCode string) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	for i := range r.TransferReturns {
+		if r.TransferReturns[i].TransferID == id {
+			now := time.Now()
+			r.TransferReturns[i].ContestedReturnCode = returnCode
+			r.TransferReturns[i].ContestedAt = &now
+		}
+	}
+	return nil
+}
+
 func (r *MockRepository) createUserTransfers(userID id.User, requests []*transferRequest) ([]*model.Transfer, error) {
 	if r.Err != nil {
 		return nil, r.Err
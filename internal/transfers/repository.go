@@ -22,11 +22,16 @@ import (
 type Repository interface {
 	getUserTransfers(userID id.User) ([]*model.Transfer, error)
 	getUserTransfer(id id.Transfer, userID id.User) (*model.Transfer, error)
+	GetTransfer(id id.Transfer) (*model.Transfer, error) // admin endpoint
 	UpdateTransferStatus(id id.Transfer, status model.TransferStatus) error
 
 	GetFileIDForTransfer(id id.Transfer, userID id.User) (string, error)
 
 	LookupTransferFromReturn(sec string, amount *model.Amount, traceNumber string, effectiveEntryDate time.Time) (*model.Transfer, error)
+	// LookupTransferFromTrace finds the processed Transfer whose entry was merged with traceNumber and amount.
+	LookupTransferFromTrace(traceNumber string, amount *model.Amount) (*model.Transfer, error)
+	// LookupTransferFromNOC finds the Transfer whose entry was merged with traceNumber, which NOCs copy from the original entry.
+	LookupTransferFromNOC(traceNumber string) (*model.Transfer, error)
 	SetReturnCode(id id.Transfer, returnCode string) error
 
 	// GetCursor returns a database cursor for Transfer objects that need to be
@@ -35,7 +40,55 @@ type Repository interface {
 	// We currently default EffectiveEntryDate to tomorrow for any transfer and thus a
 	// transfer created today needs to be posted.
 	GetCursor(batchSize int, depRepo depository.Repository) *Cursor
-	MarkTransferAsMerged(id id.Transfer, filename string, traceNumber string) error
+	MarkTransferAsMerged(id id.Transfer, filename string, effectiveEntryDate time.Time, traceNumbers []string) error
+	// UpdateEffectiveEntryDate moves the EffectiveEntryDate of the Transfer merged into filename with traceNumber.
+	UpdateEffectiveEntryDate(filename string, traceNumber string, effectiveEntryDate time.Time) error
+
+	// ClaimTransfer atomically marks a pending Transfer as being merged by owner. Claims expire after ttl
+	// so Transfers claimed by a crashed paygate instance can be claimed again.
+	ClaimTransfer(id id.Transfer, owner string, ttl time.Duration) (bool, error)
+	// ReleaseTransferClaim gives up owner's claim on a Transfer which failed to merge.
+	ReleaseTransferClaim(id id.Transfer, owner string) error
+
+	// GetMergedTransfers returns the Transfers merged into a file which is pending upload.
+	GetMergedTransfers(filename string) ([]*MergedTransfer, error)
+	// UnmergeTransfer cancels a Transfer which was pulled out of its merged file before upload.
+	UnmergeTransfer(id id.Transfer, filename string) error
+	// RequeueMergedFile moves everything merged into filename back to pending when the file is abandoned before upload.
+	RequeueMergedFile(filename string) error
+	// GetAbandonedMergedFiles returns the merged files of Transfers claimed by owner for routingNumber which weren't uploaded.
+	GetAbandonedMergedFiles(owner string, routingNumber string) ([]string, error)
+
+	// CreateIncomingTransfer records an entry we received (as the RDFI) for one of our Depositories.
+	CreateIncomingTransfer(xfer *IncomingTransfer) error
+	GetIncomingTransfer(id id.Transfer) (*IncomingTransfer, error)
+	GetUserIncomingTransfers(userID id.User) ([]*IncomingTransfer, error)
+	// GetIncomingTransferForEntry finds the IncomingTransfer already recorded for an entry of filename.
+	GetIncomingTransferForEntry(filename string, traceNumber string, effectiveEntryDate time.Time) (*IncomingTransfer, error)
+	// MarkIncomingTransferPosted saves the outcome of posting a pending IncomingTransfer against Accounts.
+	MarkIncomingTransferPosted(id id.Transfer, status model.TransferStatus, returnCode string, transactionID string) error
+	// DeleteIncomingTransfer removes a pending IncomingTransfer whose entry failed to post.
+	DeleteIncomingTransfer(id id.Transfer) error
+	UpdateIncomingTransferStatus(id id.Transfer, status model.TransferStatus, returnCode string) error
+
+	// CreateIncomingReturn queues an IncomingTransfer to be returned to its ODFI in our next outbound file
+	// and marks it as reclaimed. reverse is called before committing and the return isn't saved if it fails.
+	CreateIncomingReturn(ret *IncomingReturn, reverse func() error) error
+	GetPendingIncomingReturns() ([]*IncomingReturn, error)
+	MarkIncomingReturnMerged(id id.Transfer, filename string) error
+	GetIncomingTransferByTraceNumber(traceNumber string) (*IncomingTransfer, error)
+	// DishonorIncomingReturn records the ODFI dishonoring our return of an IncomingTransfer.
+	DishonorIncomingReturn(id id.Transfer, returnCode string, status model.TransferStatus, transactionID string) error
+
+	// CreateTransferReturn records a return received (as the ODFI) for one of our Transfers.
+	CreateTransferReturn(ret *TransferReturn) error
+	GetTransferReturn(id id.Transfer) (*TransferReturn, error)
+	LookupDishonoredTransferReturn(originalTrace string) (*TransferReturn, error)
+	// DishonorTransferReturn queues our dishonored return of a TransferReturn for the next outbound file.
+	DishonorTransferReturn(id id.Transfer, returnCode string, addendaInformation string, transactionID string) error
+	GetPendingDishonoredReturns() ([]*TransferReturn, error)
+	MarkDishonoredReturnMerged(id id.Transfer, filename string) error
+	ContestTransferReturn(id id.Transfer, returnCode string) error
 
 	createUserTransfers(userID id.User, requests []*transferRequest) ([]*model.Transfer, error)
 	deleteUserTransfer(id id.Transfer, userID id.User) error
@@ -93,7 +146,7 @@ func (r *SQLRepo) getUserTransfers(userID id.User) ([]*model.Transfer, error) {
 }
 
 func (r *SQLRepo) getUserTransfer(id id.Transfer, userID id.User) (*model.Transfer, error) {
-	query := `select transfer_id, type, amount, originator_id, originator_depository, receiver, receiver_depository, description, standard_entry_class_code, status, same_day, return_code, created_at
+	query := `select transfer_id, type, amount, originator_id, originator_depository, receiver, receiver_depository, description, standard_entry_class_code, status, same_day, return_code, effective_entry_date, created_at
 from transfers
 where transfer_id = ? and user_id = ? and deleted_at is null
 limit 1`
@@ -107,17 +160,21 @@ limit 1`
 
 	transfer := &model.Transfer{}
 	var (
-		amt        string
-		returnCode *string
-		created    time.Time
+		amt                string
+		returnCode         *string
+		effectiveEntryDate *time.Time
+		created            time.Time
 	)
-	err = row.Scan(&transfer.ID, &transfer.Type, &amt, &transfer.Originator, &transfer.OriginatorDepository, &transfer.Receiver, &transfer.ReceiverDepository, &transfer.Description, &transfer.StandardEntryClassCode, &transfer.Status, &transfer.SameDay, &returnCode, &created)
+	err = row.Scan(&transfer.ID, &transfer.Type, &amt, &transfer.Originator, &transfer.OriginatorDepository, &transfer.Receiver, &transfer.ReceiverDepository, &transfer.Description, &transfer.StandardEntryClassCode, &transfer.Status, &transfer.SameDay, &returnCode, &effectiveEntryDate, &created)
 	if err != nil {
 		return nil, err
 	}
 	if returnCode != nil {
 		transfer.ReturnCode = ach.LookupReturnCode(*returnCode)
 	}
+	if effectiveEntryDate != nil {
+		transfer.EffectiveEntryDate = *effectiveEntryDate
+	}
 	transfer.Created = base.NewTime(created)
 	// parse Amount struct
 	if err := transfer.Amount.FromString(amt); err != nil {
@@ -158,6 +215,36 @@ func (r *SQLRepo) GetFileIDForTransfer(id id.Transfer, userID id.User) (string,
 	return fileID, nil
 }
 
+// GetTransfer returns the Transfer with its UserID and TransactionID. A nil Transfer is returned if it's not found.
+func (r *SQLRepo) GetTransfer(transferID id.Transfer) (*model.Transfer, error) {
+	query := `select user_id, transaction_id from transfers where transfer_id = ? and deleted_at is null limit 1`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var userID, transactionID *string
+	if err := stmt.QueryRow(transferID).Scan(&userID, &transactionID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if userID == nil || *userID == "" {
+		return nil, nil // not found
+	}
+	xfer, err := r.getUserTransfer(transferID, id.User(*userID))
+	if err != nil {
+		return nil, err
+	}
+	xfer.UserID = *userID
+	if transactionID != nil {
+		xfer.TransactionID = *transactionID
+	}
+	return xfer, nil
+}
+
 func (r *SQLRepo) LookupTransferFromReturn(sec string, amount *model.Amount, traceNumber string, effectiveEntryDate time.Time) (*model.Transfer, error) {
 	// To match returned files we take a few values which are assumed to uniquely identify a Transfer.
 	// traceNumber, per NACHA guidelines, should be globally unique (routing number + random value),
@@ -188,6 +275,53 @@ where standard_entry_class_code = ? and amount = ? and trace_number = ? and stat
 	return xfer, err
 }
 
+// LookupTransferFromTrace returns the most recently merged Transfer with an entry of traceNumber and amount.
+// Trace numbers are only unique within a merged file, so the amount is also compared. A nil Transfer is returned
+// if none is found.
+func (r *SQLRepo) LookupTransferFromTrace(traceNumber string, amount *model.Amount) (*model.Transfer, error) {
+	query := `select t.transfer_id from transfer_trace_numbers tn
+inner join transfers t on tn.transfer_id = t.transfer_id
+where tn.trace_number = ? and t.amount = ? and t.status = ? and t.deleted_at is null
+order by tn.created_at desc limit 1`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var transferID string
+	if err := stmt.QueryRow(traceNumber, amount.String(), model.TransferProcessed).Scan(&transferID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return r.GetTransfer(id.Transfer(transferID))
+}
+
+// LookupTransferFromNOC returns the most recently merged Transfer with an entry of traceNumber. NOCs copy the trace
+// number of the original entry but not its amount. A nil Transfer is returned if none is found.
+func (r *SQLRepo) LookupTransferFromNOC(traceNumber string) (*model.Transfer, error) {
+	query := `select t.transfer_id from transfer_trace_numbers tn
+inner join transfers t on tn.transfer_id = t.transfer_id
+where tn.trace_number = ? and t.status in (?, ?) and t.deleted_at is null
+order by tn.created_at desc limit 1`
+	stmt, err := r.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var transferID string
+	if err := stmt.QueryRow(traceNumber, model.TransferProcessed, model.TransferReclaimed).Scan(&transferID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return r.GetTransfer(id.Transfer(transferID))
+}
+
 func (r *SQLRepo) SetReturnCode(id id.Transfer, returnCode string) error {
 	query := `update transfers set return_code = ? where transfer_id = ? and return_code is null and deleted_at is null`
 	stmt, err := r.db.Prepare(query)
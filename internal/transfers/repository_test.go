@@ -145,7 +145,7 @@ func TestTransfers__LookupTransferFromReturn(t *testing.T) {
 		}
 
 		// set metadata after transfer is merged into an ACH file for the FED
-		if err := repo.MarkTransferAsMerged(transfers[0].ID, "merged.ach", "traceNumber"); err != nil {
+		if err := repo.MarkTransferAsMerged(transfers[0].ID, "merged.ach", time.Now(), []string{"traceNumber"}); err != nil {
 			t.Fatal(err)
 		}
 
@@ -170,6 +170,138 @@ func TestTransfers__LookupTransferFromReturn(t *testing.T) {
 	check(t, &SQLRepo{mysqlDB.DB, log.NewNopLogger()})
 }
 
+func TestTransfers__LookupTransferFromTrace(t *testing.T) {
+	t.Parallel()
+
+	check := func(t *testing.T, repo *SQLRepo) {
+		amt, _ := model.NewAmount("USD", "18.21")
+		userID := id.User(base.ID())
+		req := &transferRequest{
+			Type:                   model.PushTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator"),
+			OriginatorDepository:   id.Depository("originator"),
+			Receiver:               model.ReceiverID("receiver"),
+			ReceiverDepository:     id.Depository("receiver"),
+			Description:            "money",
+			StandardEntryClassCode: "PPD",
+			fileID:                 "test-file",
+		}
+		transfers, err := repo.createUserTransfers(userID, []*transferRequest{req})
+		if err != nil {
+			t.Fatal(err)
+		}
+		effectiveEntryDate := time.Date(2020, time.March, 2, 0, 0, 0, 0, time.UTC)
+		if err := repo.MarkTransferAsMerged(transfers[0].ID, "merged.ach", effectiveEntryDate, []string{"076401250000001", "076401250000002"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// every entry's trace number matches
+		for _, trace := range []string{"076401250000001", "076401250000002"} {
+			xfer, err := repo.LookupTransferFromTrace(trace, amt)
+			if err != nil || xfer == nil {
+				t.Fatalf("transfer=%#v error=%v", xfer, err)
+			}
+			if xfer.ID != transfers[0].ID || xfer.UserID != userID.String() {
+				t.Errorf("found other transfer=%q user=%q", xfer.ID, xfer.UserID)
+			}
+			if !xfer.EffectiveEntryDate.Equal(effectiveEntryDate) {
+				t.Errorf("unexpected EffectiveEntryDate: %v", xfer.EffectiveEntryDate)
+			}
+
+			// NOCs match the trace number without an amount
+			if xfer, err := repo.LookupTransferFromNOC(trace); err != nil || xfer == nil || xfer.ID != transfers[0].ID {
+				t.Errorf("transfer=%#v error=%v", xfer, err)
+			}
+		}
+
+		// merging the transfer again doesn't record its trace numbers
+		if err := repo.MarkTransferAsMerged(transfers[0].ID, "other.ach", effectiveEntryDate, []string{"076401250000003"}); err == nil {
+			t.Error("expected error")
+		}
+		if xfer, err := repo.LookupTransferFromTrace("076401250000003", amt); xfer != nil || err != nil {
+			t.Errorf("transfer=%#v error=%v", xfer, err)
+		}
+
+		// other amounts and trace numbers don't match
+		other, _ := model.NewAmount("USD", "18.22")
+		if xfer, err := repo.LookupTransferFromTrace("076401250000001", other); xfer != nil || err != nil {
+			t.Errorf("transfer=%#v error=%v", xfer, err)
+		}
+		if xfer, err := repo.LookupTransferFromTrace("076401250000003", amt); xfer != nil || err != nil {
+			t.Errorf("transfer=%#v error=%v", xfer, err)
+		}
+
+		// unmerged transfers are forgotten
+		if err := repo.UnmergeTransfer(transfers[0].ID, "merged.ach"); err != nil {
+			t.Fatal(err)
+		}
+		if xfer, err := repo.LookupTransferFromTrace("076401250000001", amt); xfer != nil || err != nil {
+			t.Errorf("transfer=%#v error=%v", xfer, err)
+		}
+		if xfer, err := repo.LookupTransferFromNOC("076401250000001"); xfer != nil || err != nil {
+			t.Errorf("transfer=%#v error=%v", xfer, err)
+		}
+	}
+
+	// SQLite tests
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+	check(t, &SQLRepo{sqliteDB.DB, log.NewNopLogger()})
+
+	// MySQL tests
+	mysqlDB := database.CreateTestMySQLDB(t)
+	defer mysqlDB.Close()
+	check(t, &SQLRepo{mysqlDB.DB, log.NewNopLogger()})
+}
+
+func TestTransfers__GetTransfer(t *testing.T) {
+	t.Parallel()
+
+	check := func(t *testing.T, repo Repository) {
+		amt, _ := model.NewAmount("USD", "12.42")
+		userID := id.User(base.ID())
+		req := &transferRequest{
+			Type:                   model.PushTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator"),
+			OriginatorDepository:   id.Depository("originator"),
+			Receiver:               model.ReceiverID("receiver"),
+			ReceiverDepository:     id.Depository("receiver"),
+			Description:            "money",
+			StandardEntryClassCode: "PPD",
+			transactionID:          "transaction",
+		}
+		transfers, err := repo.createUserTransfers(userID, []*transferRequest{req})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		xfer, err := repo.GetTransfer(transfers[0].ID)
+		if err != nil || xfer == nil {
+			t.Fatalf("transfer=%#v error=%v", xfer, err)
+		}
+		if xfer.ID != transfers[0].ID || xfer.UserID != userID.String() || xfer.TransactionID != "transaction" {
+			t.Errorf("unexpected transfer: %#v", xfer)
+		}
+
+		// unknown Transfer
+		if xfer, err := repo.GetTransfer(id.Transfer(base.ID())); xfer != nil || err != nil {
+			t.Errorf("transfer=%#v error=%v", xfer, err)
+		}
+	}
+
+	// SQLite tests
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+	check(t, &SQLRepo{sqliteDB.DB, log.NewNopLogger()})
+
+	// MySQL tests
+	mysqlDB := database.CreateTestMySQLDB(t)
+	defer mysqlDB.Close()
+	check(t, &SQLRepo{mysqlDB.DB, log.NewNopLogger()})
+}
+
 func TestTransfers__SetReturnCode(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,355 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/internal/route"
+	"github.com/moov-io/paygate/internal/util"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// returnRateWindow is how far back NACHA measures an originator's return rates.
+const returnRateWindow = 60 * 24 * time.Hour
+
+var (
+	originatorReturnRate = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "ach_originator_debit_return_rate",
+		Help: "Percent of an originator's debits over the previous 60 days which were returned",
+	}, []string{"originator", "type"})
+
+	userReturnRate = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Name: "ach_user_debit_return_rate",
+		Help: "Percent of a user's debits over the previous 60 days which were returned",
+	}, []string{"user", "type"})
+
+	debitsBlockedByReturnRate = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Name: "ach_debits_blocked_by_return_rate",
+		Help: "Counter of debits rejected because their originator is over a return rate threshold",
+	}, []string{"type"})
+
+	errReturnRatesUnavailable = errors.New("return rates are unavailable")
+)
+
+// unauthorizedReturnCodes are returns NACHA counts towards an originator's unauthorized return rate.
+var unauthorizedReturnCodes = map[string]bool{
+	"R05": true, // Unauthorized Debit to Consumer Account
+	"R07": true, // Authorization Revoked by Customer
+	"R10": true, // Customer Advises Not Authorized
+	"R11": true, // Customer Advises Entry Not in Accordance with the Terms of the Authorization
+	"R29": true, // Corporate Customer Advises Not Authorized
+	"R51": true, // Item is Ineligible, Notice Not Provided, etc
+}
+
+// administrativeReturnCodes are returns NACHA counts towards an originator's administrative return rate.
+var administrativeReturnCodes = map[string]bool{
+	"R02": true, // Account Closed
+	"R03": true, // No Account/Unable to Locate Account
+	"R04": true, // Invalid Account Number
+}
+
+// UnauthorizedReturnRateLimit returns the highest percent of debits which can be returned as unauthorized.
+func UnauthorizedReturnRateLimit() string {
+	return util.Or(os.Getenv("TRANSFERS_UNAUTHORIZED_RETURN_RATE_LIMIT"), "0.5")
+}
+
+// AdministrativeReturnRateLimit returns the highest percent of debits which can be returned for administrative reasons.
+func AdministrativeReturnRateLimit() string {
+	return util.Or(os.Getenv("TRANSFERS_ADMINISTRATIVE_RETURN_RATE_LIMIT"), "3.0")
+}
+
+// OverallReturnRateLimit returns the highest percent of debits which can be returned for any reason.
+func OverallReturnRateLimit() string {
+	return util.Or(os.Getenv("TRANSFERS_OVERALL_RETURN_RATE_LIMIT"), "15.0")
+}
+
+// ReturnRateMinimumDebits returns how many debits an originator needs over the previous 60 days before its
+// return rates are compared against any threshold.
+func ReturnRateMinimumDebits() string {
+	return util.Or(os.Getenv("TRANSFERS_RETURN_RATE_MINIMUM_DEBITS"), "100")
+}
+
+// EnforceReturnRates returns true when debits from originators over a return rate threshold should be rejected.
+func EnforceReturnRates() bool {
+	return util.Yes(os.Getenv("TRANSFERS_ENFORCE_RETURN_RATES"))
+}
+
+// ReturnRateThresholds are the highest percents of debits an originator can have returned.
+type ReturnRateThresholds struct {
+	Unauthorized   float64 `json:"unauthorized"`
+	Administrative float64 `json:"administrative"`
+	Overall        float64 `json:"overall"`
+
+	// MinimumDebits is how many debits are needed before any threshold can be exceeded
+	MinimumDebits int `json:"minimumDebits"`
+}
+
+// ParseReturnRateThresholds attempts to convert multiple strings into percents (e.g. 0.5) and the minimum
+// count of debits.
+func ParseReturnRateThresholds(unauthorized, administrative, overall, minimumDebits string) (*ReturnRateThresholds, error) {
+	parse := func(v string) (float64, error) {
+		n, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(v, "%")), 64)
+		if err != nil {
+			return 0, err
+		}
+		if n <= 0 || n > 100 {
+			return 0, fmt.Errorf("%v isn't a percent", n)
+		}
+		return n, nil
+	}
+	u, err := parse(unauthorized)
+	if err != nil {
+		return nil, fmt.Errorf("unauthorized: %v", err)
+	}
+	a, err := parse(administrative)
+	if err != nil {
+		return nil, fmt.Errorf("administrative: %v", err)
+	}
+	o, err := parse(overall)
+	if err != nil {
+		return nil, fmt.Errorf("overall: %v", err)
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(minimumDebits))
+	if err != nil {
+		return nil, fmt.Errorf("minimum debits: %v", err)
+	}
+	if min < 0 {
+		return nil, fmt.Errorf("minimum debits: %d is negative", min)
+	}
+	return &ReturnRateThresholds{
+		Unauthorized:   u,
+		Administrative: a,
+		Overall:        o,
+		MinimumDebits:  min,
+	}, nil
+}
+
+// ReturnRates are the counts and percents of debits which were returned over the previous 60 days.
+type ReturnRates struct {
+	OriginatorID model.OriginatorID `json:"originatorID,omitempty"`
+
+	Debits                int `json:"debits"`
+	UnauthorizedReturns   int `json:"unauthorizedReturns"`
+	AdministrativeReturns int `json:"administrativeReturns"`
+	Returns               int `json:"returns"`
+
+	UnauthorizedRate   float64 `json:"unauthorizedRate"`
+	AdministrativeRate float64 `json:"administrativeRate"`
+	OverallRate        float64 `json:"overallRate"`
+
+	// Exceeded lists which thresholds (unauthorized, administrative or overall) the rates are over
+	Exceeded []string `json:"exceeded,omitempty"`
+}
+
+func (rr *ReturnRates) add(returnCode string, count int) {
+	rr.Debits += count
+	if returnCode == "" {
+		return
+	}
+	rr.Returns += count
+	if unauthorizedReturnCodes[returnCode] {
+		rr.UnauthorizedReturns += count
+	}
+	if administrativeReturnCodes[returnCode] {
+		rr.AdministrativeReturns += count
+	}
+}
+
+// calculate fills in the rates from the counts and lists which thresholds are exceeded.
+func (rr *ReturnRates) calculate(thresholds *ReturnRateThresholds) {
+	if rr.Debits == 0 {
+		return
+	}
+	percent := func(n int) float64 {
+		return float64(n) / float64(rr.Debits) * 100.0
+	}
+	rr.UnauthorizedRate = percent(rr.UnauthorizedReturns)
+	rr.AdministrativeRate = percent(rr.AdministrativeReturns)
+	rr.OverallRate = percent(rr.Returns)
+
+	rr.Exceeded = nil
+	if thresholds == nil || rr.Debits < thresholds.MinimumDebits {
+		return
+	}
+	if rr.UnauthorizedRate > thresholds.Unauthorized {
+		rr.Exceeded = append(rr.Exceeded, "unauthorized")
+	}
+	if rr.AdministrativeRate > thresholds.Administrative {
+		rr.Exceeded = append(rr.Exceeded, "administrative")
+	}
+	if rr.OverallRate > thresholds.Overall {
+		rr.Exceeded = append(rr.Exceeded, "overall")
+	}
+}
+
+// ReturnRateReport is a user's debit return rates along with the rates of each of their originators.
+type ReturnRateReport struct {
+	Since       time.Time             `json:"since"`
+	Thresholds  *ReturnRateThresholds `json:"thresholds"`
+	User        *ReturnRates          `json:"user"`
+	Originators []*ReturnRates        `json:"originators"`
+}
+
+// NewReturnRateChecker returns a ReturnRateChecker which calculates return rates from the transfers table.
+func NewReturnRateChecker(logger log.Logger, db *sql.DB, thresholds *ReturnRateThresholds, enforce bool) *ReturnRateChecker {
+	return &ReturnRateChecker{
+		logger:     logger,
+		db:         db,
+		thresholds: thresholds,
+		enforce:    enforce,
+	}
+}
+
+// ReturnRateChecker calculates the rolling 60 day return rates of debits (pull transfers) for each user and originator
+// and optionally rejects new debits from originators over NACHA's thresholds.
+//
+// Debits are counted by when the Transfer was created and returns by the return_code later recorded on it. Only debits
+// sent to the Fed (processed, reclaimed or returned late) are counted, so canceled, failed and pending debits don't
+// lower the rates.
+//
+// Rates are calculated when they're requested or a debit is checked against them, which is also when our gauges
+// are updated.
+type ReturnRateChecker struct {
+	db     *sql.DB
+	logger log.Logger
+
+	thresholds *ReturnRateThresholds
+	enforce    bool
+}
+
+// report calculates the return rates for userID and each of their originators and updates our metrics.
+func (rc *ReturnRateChecker) report(userID id.User) (*ReturnRateReport, error) {
+	since := time.Now().Add(-returnRateWindow)
+
+	query := `select originator_id, return_code, count(*) from transfers
+where user_id = ? and type = ? and status in (?, ?, ?) and created_at > ? and deleted_at is null group by originator_id, return_code;`
+	stmt, err := rc.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("return rates: prepare: %v", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(userID, model.PullTransfer, model.TransferProcessed, model.TransferReclaimed, model.TransferLateReturn, since)
+	if err != nil {
+		return nil, fmt.Errorf("return rates: query: %v", err)
+	}
+	defer rows.Close()
+
+	report := &ReturnRateReport{
+		Since:      since,
+		Thresholds: rc.thresholds,
+		User:       &ReturnRates{},
+	}
+	originators := make(map[model.OriginatorID]*ReturnRates)
+	for rows.Next() {
+		var originatorID string
+		var returnCode *string
+		var count int
+		if err := rows.Scan(&originatorID, &returnCode, &count); err != nil {
+			return nil, fmt.Errorf("return rates: scan: %v", err)
+		}
+		code := ""
+		if returnCode != nil {
+			code = strings.ToUpper(strings.TrimSpace(*returnCode))
+		}
+		rates, exists := originators[model.OriginatorID(originatorID)]
+		if !exists {
+			rates = &ReturnRates{OriginatorID: model.OriginatorID(originatorID)}
+			originators[rates.OriginatorID] = rates
+			report.Originators = append(report.Originators, rates)
+		}
+		rates.add(code, count)
+		report.User.add(code, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("return rates: rows: %v", err)
+	}
+
+	report.User.calculate(rc.thresholds)
+	recordReturnRates(userReturnRate.With("user", userID.String()), report.User)
+
+	sort.Slice(report.Originators, func(i, j int) bool {
+		return report.Originators[i].OriginatorID < report.Originators[j].OriginatorID
+	})
+	for i := range report.Originators {
+		report.Originators[i].calculate(rc.thresholds)
+		recordReturnRates(originatorReturnRate.With("originator", string(report.Originators[i].OriginatorID)), report.Originators[i])
+	}
+	return report, nil
+}
+
+func recordReturnRates(gauge metrics.Gauge, rates *ReturnRates) {
+	gauge.With("type", "unauthorized").Set(rates.UnauthorizedRate)
+	gauge.With("type", "administrative").Set(rates.AdministrativeRate)
+	gauge.With("type", "overall").Set(rates.OverallRate)
+}
+
+// enforcedReport returns the return rates for userID when enforcement is enabled and nil otherwise.
+func (rc *ReturnRateChecker) enforcedReport(userID id.User) (*ReturnRateReport, error) {
+	if rc == nil || !rc.enforce {
+		return nil, nil
+	}
+	return rc.report(userID)
+}
+
+// allowDebit returns an error when originatorID is over any return rate threshold in report.
+// A nil report (i.e. enforcement is disabled) allows every debit.
+func allowDebit(report *ReturnRateReport, originatorID model.OriginatorID) error {
+	if report == nil {
+		return nil
+	}
+	for _, rates := range report.Originators {
+		if rates.OriginatorID != originatorID || len(rates.Exceeded) == 0 {
+			continue
+		}
+		for i := range rates.Exceeded {
+			debitsBlockedByReturnRate.With("type", rates.Exceeded[i]).Add(1)
+		}
+		return fmt.Errorf("return rates: originator=%s is over the %s return rate threshold", originatorID, strings.Join(rates.Exceeded, " and "))
+	}
+	return nil
+}
+
+func (c *TransferRouter) getReturnRates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		responder := route.NewResponder(c.logger, w, r)
+		if responder == nil {
+			return
+		}
+		if c.returnRateChecker == nil {
+			responder.Problem(errReturnRatesUnavailable)
+			return
+		}
+
+		report, err := c.returnRateChecker.report(responder.XUserID)
+		if err != nil {
+			responder.Log("transfers", fmt.Sprintf("error calculating return rates: %v", err))
+			responder.Problem(err)
+			return
+		}
+
+		responder.Respond(func(w http.ResponseWriter) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(report)
+		})
+	}
+}
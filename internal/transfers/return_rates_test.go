@@ -0,0 +1,233 @@
+// Copyright 2020 The Moov Authors
+// Use of this source code is governed by an Apache License
+// license that can be found in the LICENSE file.
+
+package transfers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/moov-io/base"
+	"github.com/moov-io/paygate/internal/database"
+	"github.com/moov-io/paygate/internal/model"
+	"github.com/moov-io/paygate/pkg/id"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+func TestReturnRates__ParseReturnRateThresholds(t *testing.T) {
+	thresholds, err := ParseReturnRateThresholds(UnauthorizedReturnRateLimit(), AdministrativeReturnRateLimit(), OverallReturnRateLimit(), ReturnRateMinimumDebits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thresholds.Unauthorized != 0.5 || thresholds.Administrative != 3.0 || thresholds.Overall != 15.0 || thresholds.MinimumDebits != 100 {
+		t.Errorf("unexpected thresholds: %#v", thresholds)
+	}
+
+	if thresholds, err := ParseReturnRateThresholds("1%", "2", " 10.5 ", " 20 "); err != nil {
+		t.Fatal(err)
+	} else if thresholds.Unauthorized != 1.0 || thresholds.Administrative != 2.0 || thresholds.Overall != 10.5 || thresholds.MinimumDebits != 20 {
+		t.Errorf("unexpected thresholds: %#v", thresholds)
+	}
+
+	if _, err := ParseReturnRateThresholds("invalid", "3.0", "15.0", "100"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := ParseReturnRateThresholds("0.5", "0", "15.0", "100"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := ParseReturnRateThresholds("0.5", "3.0", "101", "100"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := ParseReturnRateThresholds("0.5", "3.0", "15.0", "invalid"); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := ParseReturnRateThresholds("0.5", "3.0", "15.0", "-1"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestReturnRates__calculate(t *testing.T) {
+	thresholds, _ := ParseReturnRateThresholds("0.5", "3.0", "15.0", "100")
+
+	rates := &ReturnRates{}
+	rates.calculate(thresholds)
+	if rates.OverallRate != 0.0 || len(rates.Exceeded) != 0 {
+		t.Errorf("unexpected rates: %#v", rates)
+	}
+
+	rates.add("", 95)
+	rates.add("R10", 1)
+	rates.add("R03", 3)
+	rates.add("R01", 1)
+	rates.calculate(thresholds)
+
+	if rates.Debits != 100 || rates.Returns != 5 || rates.UnauthorizedReturns != 1 || rates.AdministrativeReturns != 3 {
+		t.Errorf("unexpected counts: %#v", rates)
+	}
+	if rates.UnauthorizedRate != 1.0 || rates.AdministrativeRate != 3.0 || rates.OverallRate != 5.0 {
+		t.Errorf("unexpected rates: %#v", rates)
+	}
+	// the administrative rate is at, but not over, its threshold
+	if len(rates.Exceeded) != 1 || rates.Exceeded[0] != "unauthorized" {
+		t.Errorf("exceeded=%v", rates.Exceeded)
+	}
+
+	// too few debits to exceed any threshold
+	thresholds.MinimumDebits = 101
+	rates.calculate(thresholds)
+	if rates.UnauthorizedRate != 1.0 || len(rates.Exceeded) != 0 {
+		t.Errorf("unexpected rates: %#v", rates)
+	}
+}
+
+func TestReturnRates__report(t *testing.T) {
+	t.Parallel()
+
+	thresholds, _ := ParseReturnRateThresholds("0.5", "3.0", "15.0", "4")
+
+	check := func(t *testing.T, rc *ReturnRateChecker) {
+		userID := id.User(base.ID())
+		repo := NewTransferRepo(log.NewNopLogger(), rc.db)
+
+		amt, _ := model.NewAmount("USD", "25.12")
+		req := &transferRequest{
+			Type:                   model.PullTransfer,
+			Amount:                 *amt,
+			Originator:             model.OriginatorID("originator"),
+			OriginatorDepository:   id.Depository("originator"),
+			Receiver:               model.ReceiverID("receiver"),
+			ReceiverDepository:     id.Depository("receiver"),
+			Description:            "money",
+			StandardEntryClassCode: "PPD",
+			fileID:                 "test-file",
+		}
+		var requests []*transferRequest
+		for i := 0; i < 4; i++ {
+			requests = append(requests, req)
+		}
+		other := *req
+		other.Originator = model.OriginatorID("other")
+		push := *req
+		push.Type = model.PushTransfer
+		requests = append(requests, &other, &push, req, req)
+
+		xfers, err := repo.createUserTransfers(userID, requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every debit is sent except one pending and one canceled debit, which aren't counted
+		for i := 0; i < 6; i++ {
+			if err := repo.UpdateTransferStatus(xfers[i].ID, model.TransferProcessed); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := repo.UpdateTransferStatus(xfers[7].ID, model.TransferCanceled); err != nil {
+			t.Fatal(err)
+		}
+		// one unauthorized return for our originator and a return of the push transfer, which isn't counted
+		if err := repo.SetReturnCode(xfers[0].ID, "R10"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.UpdateTransferStatus(xfers[0].ID, model.TransferReclaimed); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetReturnCode(xfers[5].ID, "R01"); err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := rc.report(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.User.Debits != 5 || report.User.Returns != 1 || report.User.UnauthorizedRate != 20.0 {
+			t.Errorf("unexpected user rates: %#v", report.User)
+		}
+		if len(report.Originators) != 2 {
+			t.Fatalf("got %d originators", len(report.Originators))
+		}
+		// our originator has the minimum count of debits and is over the unauthorized and overall thresholds
+		if rates := report.Originators[0]; rates.OriginatorID != "originator" || rates.Debits != 4 || rates.OverallRate != 25.0 {
+			t.Errorf("unexpected originator rates: %#v", rates)
+		} else if len(rates.Exceeded) != 2 || rates.Exceeded[0] != "unauthorized" || rates.Exceeded[1] != "overall" {
+			t.Errorf("exceeded=%v", rates.Exceeded)
+		}
+		if rates := report.Originators[1]; rates.OriginatorID != "other" || rates.Debits != 1 || rates.Returns != 0 || len(rates.Exceeded) != 0 {
+			t.Errorf("unexpected originator rates: %#v", rates)
+		}
+
+		// enforcement is disabled
+		if report, err := rc.enforcedReport(userID); report != nil || err != nil {
+			t.Fatalf("report=%#v error=%v", report, err)
+		}
+		rc.enforce = true
+		report, err = rc.enforcedReport(userID)
+		if report == nil || err != nil {
+			t.Fatalf("report=%#v error=%v", report, err)
+		}
+		if err := allowDebit(report, "originator"); err == nil {
+			t.Error("expected error")
+		}
+		if err := allowDebit(report, "other"); err != nil {
+			t.Fatal(err)
+		}
+		if err := allowDebit(nil, "originator"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sqliteDB := database.CreateTestSqliteDB(t)
+	defer sqliteDB.Close()
+	check(t, NewReturnRateChecker(log.NewNopLogger(), sqliteDB.DB, thresholds, false))
+
+	mysqlDB := database.CreateTestMySQLDB(t)
+	defer mysqlDB.Close()
+	check(t, NewReturnRateChecker(log.NewNopLogger(), mysqlDB.DB, thresholds, false))
+}
+
+func TestReturnRates__route(t *testing.T) {
+	db := database.CreateTestSqliteDB(t)
+	defer db.Close()
+
+	repo := NewTransferRepo(log.NewNopLogger(), db.DB)
+	xferRouter := CreateTestTransferRouter(nil, nil, nil, nil, repo)
+	defer xferRouter.close()
+
+	router := mux.NewRouter()
+	xferRouter.RegisterRoutes(router)
+
+	// no checker
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/transfers/return-rates", nil)
+	r.Header.Set("x-user-id", base.ID())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d", w.Code)
+	}
+
+	thresholds, _ := ParseReturnRateThresholds("0.5", "3.0", "15.0", "100")
+	xferRouter.returnRateChecker = NewReturnRateChecker(log.NewNopLogger(), db.DB, thresholds, true)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/transfers/return-rates", nil)
+	r.Header.Set("x-user-id", base.ID())
+	router.ServeHTTP(w, r)
+	w.Flush()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var report ReturnRateReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.User == nil || report.User.Debits != 0 || len(report.Originators) != 0 || report.Thresholds.Overall != 15.0 {
+		t.Errorf("unexpected report: %#v", report)
+	}
+}
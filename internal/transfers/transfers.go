@@ -117,6 +117,7 @@ type TransferRouter struct {
 	transferRepo       Repository
 
 	transferLimitChecker *LimitChecker
+	returnRateChecker    *ReturnRateChecker
 
 	achClientFactory func(userID id.User) *achclient.ACH
 
@@ -132,6 +133,7 @@ func NewTransferRouter(
 	originatorsRepo originators.Repository,
 	transferRepo Repository,
 	transferLimitChecker *LimitChecker,
+	returnRateChecker *ReturnRateChecker,
 	achClientFactory func(userID id.User) *achclient.ACH,
 	accountsClient accounts.Client,
 	customersClient customers.Client,
@@ -144,6 +146,7 @@ func NewTransferRouter(
 		origRepo:             originatorsRepo,
 		transferRepo:         transferRepo,
 		transferLimitChecker: transferLimitChecker,
+		returnRateChecker:    returnRateChecker,
 		achClientFactory:     achClientFactory,
 		accountsClient:       accountsClient,
 		customersClient:      customersClient,
@@ -152,6 +155,7 @@ func NewTransferRouter(
 
 func (c *TransferRouter) RegisterRoutes(router *mux.Router) {
 	router.Methods("GET").Path("/transfers").HandlerFunc(c.getUserTransfers())
+	router.Methods("GET").Path("/transfers/return-rates").HandlerFunc(c.getReturnRates())
 	router.Methods("GET").Path("/transfers/{transferId}").HandlerFunc(c.getUserTransfer())
 
 	router.Methods("POST").Path("/transfers").HandlerFunc(c.createUserTransfers())
@@ -162,6 +166,13 @@ func (c *TransferRouter) RegisterRoutes(router *mux.Router) {
 	router.Methods("GET").Path("/transfers/{transferId}/events").HandlerFunc(c.getUserTransferEvents())
 	router.Methods("POST").Path("/transfers/{transferId}/failed").HandlerFunc(c.validateUserTransfer())
 	router.Methods("POST").Path("/transfers/{transferId}/files").HandlerFunc(c.getUserTransferFiles())
+	router.Methods("GET").Path("/transfers/{transferId}/return").HandlerFunc(c.getTransferReturn())
+	router.Methods("POST").Path("/transfers/{transferId}/dishonor").HandlerFunc(c.dishonorTransfer())
+	router.Methods("POST").Path("/transfers/{transferId}/accept").HandlerFunc(c.acceptTransfer())
+
+	router.Methods("GET").Path("/incoming-transfers").HandlerFunc(c.getUserIncomingTransfers())
+	router.Methods("GET").Path("/incoming-transfers/{transferId}").HandlerFunc(c.getIncomingTransfer())
+	router.Methods("POST").Path("/incoming-transfers/{transferId}/return").HandlerFunc(c.returnIncomingTransfer())
 }
 
 func getTransferID(r *http.Request) id.Transfer {
@@ -267,6 +278,9 @@ func (c *TransferRouter) createUserTransfers() http.HandlerFunc {
 		}
 		remoteIP := route.RemoteAddr(r.Header)
 
+		// Return rates are only calculated once for all debits in this request
+		var returnRates *ReturnRateReport
+
 		for i := range requests {
 			transferID, req := base.ID(), requests[i]
 			if err := req.missingFields(); err != nil {
@@ -294,6 +308,21 @@ func (c *TransferRouter) createUserTransfers() http.HandlerFunc {
 				responder.Problem(err)
 				return
 			}
+			// Reject debits from originators with too many returns
+			if req.Type == model.PullTransfer {
+				if returnRates == nil {
+					if returnRates, err = c.returnRateChecker.enforcedReport(responder.XUserID); err != nil {
+						responder.Log("transfers", fmt.Sprintf("error calculating return rates: %v", err))
+						responder.Problem(err)
+						return
+					}
+				}
+				if err := allowDebit(returnRates, req.Originator); err != nil {
+					responder.Log("transfers", fmt.Sprintf("rejecting transfers: %v", err))
+					responder.Problem(err)
+					return
+				}
+			}
 
 			// Post the Transfer's transaction against the Accounts
 			var transactionID string